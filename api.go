@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BranchStatus is the "# branch.*" header of `git status --porcelain=v2`.
+type BranchStatus struct {
+	Head     string `json:"head"`
+	Commit   string `json:"commit"`
+	Upstream string `json:"upstream,omitempty"`
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+	Detached bool   `json:"detached"`
+}
+
+// FileChange is a path with its change in the index or the working tree.
+type FileChange struct {
+	Path     string `json:"path"`
+	OrigPath string `json:"orig_path,omitempty"`
+	Status   string `json:"status"`
+}
+
+// RepoStatus is the parsed output of `git status --porcelain=v2`.
+type RepoStatus struct {
+	Branch     BranchStatus `json:"branch"`
+	Staged     []FileChange `json:"staged"`
+	Unstaged   []FileChange `json:"unstaged"`
+	Untracked  []string     `json:"untracked"`
+	Conflicted []FileChange `json:"conflicted"`
+}
+
+// Commit is a single record of `git log`.
+type Commit struct {
+	Hash           string    `json:"hash"`
+	ShortHash      string    `json:"short_hash"`
+	AuthorName     string    `json:"author_name"`
+	AuthorEmail    string    `json:"author_email"`
+	AuthorDate     time.Time `json:"author_date"`
+	CommitterName  string    `json:"committer_name"`
+	CommitterEmail string    `json:"committer_email"`
+	CommitterDate  time.Time `json:"committer_date"`
+	Parents        []string  `json:"parents"`
+	Subject        string    `json:"subject"`
+	Body           string    `json:"body,omitempty"`
+}
+
+// Branch is a local or remote-tracking branch with its tracking info.
+type Branch struct {
+	Name          string    `json:"name"`
+	Remote        bool      `json:"remote"`
+	Current       bool      `json:"current"`
+	Commit        string    `json:"commit"`
+	Subject       string    `json:"subject"`
+	CommitterDate time.Time `json:"committer_date"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Ahead         int       `json:"ahead"`
+	Behind        int       `json:"behind"`
+	UpstreamGone  bool      `json:"upstream_gone,omitempty"`
+}
+
+const (
+	defaultLogLimit = 50
+	maxLogLimit     = 1000
+)
+
+// statusNames maps porcelain status letters to readable names.
+var statusNames = map[byte]string{
+	'M': "modified",
+	'T': "type-changed",
+	'A': "added",
+	'D': "deleted",
+	'R': "renamed",
+	'C': "copied",
+	'U': "unmerged",
+}
+
+// parseStatusV2 parses the output of `git status --porcelain=v2 --branch -z`.
+func parseStatusV2(out string) (*RepoStatus, error) {
+	status := &RepoStatus{
+		Staged:     []FileChange{},
+		Unstaged:   []FileChange{},
+		Untracked:  []string{},
+		Conflicted: []FileChange{},
+	}
+	records := strings.Split(out, "\x00")
+	for i := 0; i < len(records); i++ {
+		rec := records[i]
+		if rec == "" {
+			continue
+		}
+		switch rec[0] {
+		case '#':
+			parseBranchHeader(&status.Branch, rec)
+		case '1', '2':
+			// 1 XY sub mH mI mW hH hI path
+			// 2 XY sub mH mI mW hH hI Xscore path, followed by origPath
+			n := 9
+			if rec[0] == '2' {
+				n = 10
+			}
+			fields := strings.SplitN(rec, " ", n)
+			if len(fields) != n {
+				return nil, fmt.Errorf("malformed status record %q", rec)
+			}
+			change := FileChange{Path: fields[n-1]}
+			if rec[0] == '2' {
+				if i+1 >= len(records) {
+					return nil, fmt.Errorf("missing original path for %q", change.Path)
+				}
+				i++
+				change.OrigPath = records[i]
+			}
+			xy := fields[1]
+			if xy[0] != '.' {
+				staged := change
+				staged.Status = statusNames[xy[0]]
+				status.Staged = append(status.Staged, staged)
+			}
+			if xy[1] != '.' {
+				unstaged := change
+				unstaged.Status = statusNames[xy[1]]
+				status.Unstaged = append(status.Unstaged, unstaged)
+			}
+		case 'u':
+			// u XY sub m1 m2 m3 mW h1 h2 h3 path
+			fields := strings.SplitN(rec, " ", 11)
+			if len(fields) != 11 {
+				return nil, fmt.Errorf("malformed status record %q", rec)
+			}
+			status.Conflicted = append(status.Conflicted, FileChange{Path: fields[10], Status: fields[1]})
+		case '?':
+			status.Untracked = append(status.Untracked, strings.TrimPrefix(rec, "? "))
+		case '!':
+			// Ignored files are only listed with --ignored.
+		default:
+			return nil, fmt.Errorf("unknown status record %q", rec)
+		}
+	}
+	return status, nil
+}
+
+func parseBranchHeader(b *BranchStatus, rec string) {
+	key, value, _ := strings.Cut(strings.TrimPrefix(rec, "# "), " ")
+	switch key {
+	case "branch.oid":
+		if value != "(initial)" {
+			b.Commit = value
+		}
+	case "branch.head":
+		if value == "(detached)" {
+			b.Detached = true
+		} else {
+			b.Head = value
+		}
+	case "branch.upstream":
+		b.Upstream = value
+	case "branch.ab":
+		ahead, behind, _ := strings.Cut(value, " ")
+		b.Ahead, _ = strconv.Atoi(strings.TrimPrefix(ahead, "+"))
+		b.Behind, _ = strconv.Atoi(strings.TrimPrefix(behind, "-"))
+	}
+}
+
+// logFormat separates fields with the unit separator and records with the
+// record separator, neither of which appear in commit metadata.
+const logFormat = "%H%x1f%h%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%P%x1f%s%x1f%b%x1e"
+
+// parseLog parses `git log` output produced with logFormat.
+func parseLog(out string) ([]Commit, error) {
+	commits := []Commit{}
+	for _, rec := range strings.Split(out, "\x1e") {
+		rec = strings.TrimLeft(rec, "\n")
+		if rec == "" {
+			continue
+		}
+		f := strings.Split(rec, "\x1f")
+		if len(f) != 11 {
+			return nil, fmt.Errorf("malformed log record %q", rec)
+		}
+		authorDate, err := time.Parse(time.RFC3339, f[4])
+		if err != nil {
+			return nil, err
+		}
+		committerDate, err := time.Parse(time.RFC3339, f[7])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, Commit{
+			Hash:           f[0],
+			ShortHash:      f[1],
+			AuthorName:     f[2],
+			AuthorEmail:    f[3],
+			AuthorDate:     authorDate,
+			CommitterName:  f[5],
+			CommitterEmail: f[6],
+			CommitterDate:  committerDate,
+			Parents:        strings.Fields(f[8]),
+			Subject:        f[9],
+			Body:           strings.TrimSpace(f[10]),
+		})
+	}
+	return commits, nil
+}
+
+// branchFormat lists the for-each-ref fields parsed by parseBranches,
+// separated by NUL bytes.
+const branchFormat = "%(refname)%00%(refname:short)%00%(HEAD)%00%(objectname)%00%(committerdate:iso-strict)%00%(upstream:short)%00%(upstream:track,nobracket)%00%(subject)"
+
+// parseBranches parses `git for-each-ref` output produced with branchFormat.
+func parseBranches(out string) ([]Branch, error) {
+	branches := []Branch{}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Split(line, "\x00")
+		if len(f) != 8 {
+			return nil, fmt.Errorf("malformed branch record %q", line)
+		}
+		// Skip symbolic refs such as origin/HEAD.
+		if strings.HasSuffix(f[0], "/HEAD") {
+			continue
+		}
+		b := Branch{
+			Name:     f[1],
+			Remote:   strings.HasPrefix(f[0], "refs/remotes/"),
+			Current:  f[2] == "*",
+			Commit:   f[3],
+			Upstream: f[5],
+			Subject:  f[7],
+		}
+		if f[4] != "" {
+			date, err := time.Parse(time.RFC3339, f[4])
+			if err != nil {
+				return nil, err
+			}
+			b.CommitterDate = date
+		}
+		// The track field looks like "ahead 1, behind 2" or "gone".
+		for _, part := range strings.Split(f[6], ", ") {
+			kind, count, _ := strings.Cut(part, " ")
+			switch kind {
+			case "ahead":
+				b.Ahead, _ = strconv.Atoi(count)
+			case "behind":
+				b.Behind, _ = strconv.Atoi(count)
+			case "gone":
+				b.UpstreamGone = true
+			}
+		}
+		branches = append(branches, b)
+	}
+	return branches, nil
+}
+
+// writeJSON sends v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// apiStatusHandler: GET /api/status
+func apiStatusHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	out, err := repo.runGit(r.Context(), "status", "--porcelain=v2", "--branch", "-z")
+	if err != nil {
+		http.Error(w, "Failed to get git status: "+out, errorStatus(err))
+		return
+	}
+	status, err := parseStatusV2(out)
+	if err != nil {
+		http.Error(w, "Failed to parse git status: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// apiLogHandler: GET /api/log?limit=&path=
+func apiLogHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	limit := defaultLogLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxLogLimit)
+	}
+
+	args := []string{"log", "-n", strconv.Itoa(limit), "--format=" + logFormat}
+	if path := r.URL.Query().Get("path"); path != "" {
+		args = append(args, "--", path)
+	}
+	out, err := repo.runGit(r.Context(), args...)
+	if err != nil {
+		http.Error(w, "Failed to get git log: "+out, errorStatus(err))
+		return
+	}
+	commits, err := parseLog(out)
+	if err != nil {
+		http.Error(w, "Failed to parse git log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, commits)
+}
+
+// apiBranchesHandler: GET /api/branches
+func apiBranchesHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	out, err := repo.runGit(r.Context(), "for-each-ref", "--format="+branchFormat, "refs/heads", "refs/remotes")
+	if err != nil {
+		http.Error(w, "Failed to list branches: "+out, errorStatus(err))
+		return
+	}
+	branches, err := parseBranches(out)
+	if err != nil {
+		http.Error(w, "Failed to parse branches: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, branches)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatusV2(t *testing.T) {
+	records := []string{
+		"# branch.oid 1234abcd",
+		"# branch.head main",
+		"# branch.upstream origin/main",
+		"# branch.ab +2 -1",
+		"1 M. N... 100644 100644 100644 aaaa bbbb main.bean",
+		"1 .M N... 100644 100644 100644 aaaa aaaa accounts.bean",
+		"1 AM N... 000000 100644 100644 0000 cccc new file.bean",
+		"2 R. N... 100644 100644 100644 aaaa aaaa R100 2025/renamed.bean",
+		"2025/old.bean",
+		"u UU N... 100644 100644 100644 100644 aaaa bbbb cccc conflict.bean",
+		"? notes.txt",
+		"! ignored.log",
+	}
+	status, err := parseStatusV2(strings.Join(records, "\x00") + "\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RepoStatus{
+		Branch: BranchStatus{Head: "main", Commit: "1234abcd", Upstream: "origin/main", Ahead: 2, Behind: 1},
+		Staged: []FileChange{
+			{Path: "main.bean", Status: "modified"},
+			{Path: "new file.bean", Status: "added"},
+			{Path: "2025/renamed.bean", OrigPath: "2025/old.bean", Status: "renamed"},
+		},
+		Unstaged: []FileChange{
+			{Path: "accounts.bean", Status: "modified"},
+			{Path: "new file.bean", Status: "modified"},
+		},
+		Untracked:  []string{"notes.txt"},
+		Conflicted: []FileChange{{Path: "conflict.bean", Status: "UU"}},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %+v\nwant %+v", status, want)
+	}
+}
+
+func TestParseStatusV2Branch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   BranchStatus
+	}{
+		{"# branch.oid (initial)\x00# branch.head main", BranchStatus{Head: "main"}},
+		{"# branch.oid abcd\x00# branch.head (detached)", BranchStatus{Commit: "abcd", Detached: true}},
+	}
+	for _, tt := range tests {
+		status, err := parseStatusV2(tt.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Branch != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.header, status.Branch, tt.want)
+		}
+	}
+}
+
+func TestParseStatusV2Errors(t *testing.T) {
+	for _, out := range []string{
+		"1 M. short",
+		"2 R. N... 100644 100644 100644 aaaa aaaa R100 renamed.bean",
+		"u UU N... too short",
+		"x unknown",
+	} {
+		if _, err := parseStatusV2(out); err == nil {
+			t.Errorf("%q: expected an error", out)
+		}
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	record := func(fields ...string) string { return strings.Join(fields, "\x1f") + "\x1e" }
+	out := record("aaaa1111", "aaaa", "Alice", "a@x", "2025-01-02T03:04:05+05:45", "Bob", "b@x", "2025-01-03T00:00:00Z", "p1 p2", "Merge topic", "Body line\n\n") +
+		"\n" + record("bbbb2222", "bbbb", "Alice", "a@x", "2025-01-01T00:00:00Z", "Alice", "a@x", "2025-01-01T00:00:00Z", "", "Initial", "")
+	commits, err := parseLog(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("got %d commits, want 2", len(commits))
+	}
+	c := commits[0]
+	if c.Hash != "aaaa1111" || c.ShortHash != "aaaa" || c.AuthorName != "Alice" || c.CommitterEmail != "b@x" ||
+		c.Subject != "Merge topic" || c.Body != "Body line" || !reflect.DeepEqual(c.Parents, []string{"p1", "p2"}) {
+		t.Errorf("unexpected commit %+v", c)
+	}
+	if want := time.Date(2025, 1, 1, 21, 19, 5, 0, time.UTC); !c.AuthorDate.Equal(want) {
+		t.Errorf("author date %v, want %v", c.AuthorDate, want)
+	}
+	if len(commits[1].Parents) != 0 || commits[1].Body != "" {
+		t.Errorf("unexpected root commit %+v", commits[1])
+	}
+
+	for _, bad := range []string{record("too", "few"), record("h", "h", "a", "e", "yesterday", "c", "e", "2025-01-01T00:00:00Z", "", "s", "")} {
+		if _, err := parseLog(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestParseBranches(t *testing.T) {
+	line := func(fields ...string) string { return strings.Join(fields, "\x00") }
+	out := strings.Join([]string{
+		line("refs/heads/main", "main", "*", "aaaa", "2025-01-02T00:00:00Z", "origin/main", "ahead 1, behind 2", "Latest"),
+		line("refs/heads/old", "old", " ", "bbbb", "2024-12-01T00:00:00Z", "origin/old", "gone", "Old work"),
+		line("refs/remotes/origin/HEAD", "origin", " ", "aaaa", "2025-01-02T00:00:00Z", "", "", ""),
+		line("refs/remotes/origin/main", "origin/main", " ", "cccc", "", "", "", "Remote"),
+	}, "\n") + "\n"
+	branches, err := parseBranches(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Branch{
+		{Name: "main", Current: true, Commit: "aaaa", Subject: "Latest", CommitterDate: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), Upstream: "origin/main", Ahead: 1, Behind: 2},
+		{Name: "old", Commit: "bbbb", Subject: "Old work", CommitterDate: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), Upstream: "origin/old", UpstreamGone: true},
+		{Name: "origin/main", Remote: true, Commit: "cccc", Subject: "Remote"},
+	}
+	if len(branches) != len(want) {
+		t.Fatalf("got %+v, want %+v", branches, want)
+	}
+	for i := range want {
+		if !branches[i].CommitterDate.Equal(want[i].CommitterDate) {
+			t.Errorf("branch %d: date %v, want %v", i, branches[i].CommitterDate, want[i].CommitterDate)
+		}
+		branches[i].CommitterDate, want[i].CommitterDate = time.Time{}, time.Time{}
+		if branches[i] != want[i] {
+			t.Errorf("branch %d: got %+v, want %+v", i, branches[i], want[i])
+		}
+	}
+
+	if _, err := parseBranches("refs/heads/main\x00main\n"); err == nil {
+		t.Error("expected an error for a malformed record")
+	}
+}
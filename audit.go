@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig is the "audit" section of the config file.
+type AuditConfig struct {
+	// Path of the JSON lines audit log. Defaults to audit.jsonl in the data
+	// directory.
+	Path string `json:"path"`
+}
+
+// AuditEntry records one external command run by the server.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	User         string    `json:"user"`
+	AuthProvider string    `json:"auth_provider,omitempty"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	Repo         string    `json:"repo,omitempty"`
+	Dir          string    `json:"dir"`
+	Argv         []string  `json:"argv"`
+	ExitCode     int       `json:"exit_code"`
+	DurationMs   int64     `json:"duration_ms"`
+	Output       string    `json:"output"`
+	Truncated    bool      `json:"truncated,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// maxAuditOutput is how much of a command's output is kept in the log.
+const maxAuditOutput = 4096
+
+// AuditLog is an append-only JSON lines file.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// auditLog is opened in main.
+var auditLog *AuditLog
+
+func openAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: f}, nil
+}
+
+// Append writes e as one line of the log.
+func (a *AuditLog) Append(e *AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// requestInfo describes the HTTP request that triggered a command.
+type requestInfo struct {
+	RemoteAddr   string
+	ForwardedFor string
+	Endpoint     string
+	Repo         string
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey, info)
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	if info == nil {
+		return &requestInfo{}
+	}
+	return info
+}
+
+// auditCommand is what runCommand knows about a finished command.
+type auditCommand struct {
+	dir      string
+	argv     []string
+	start    time.Time
+	exitCode int
+	output   string
+	err      error
+}
+
+// recordAudit appends the command and the request context to the audit log.
+// Failures to write are logged but do not fail the command.
+func recordAudit(ctx context.Context, c auditCommand) {
+	if auditLog == nil {
+		return
+	}
+	info := requestInfoFrom(ctx)
+	entry := &AuditEntry{
+		Time:         c.start.UTC(),
+		RemoteAddr:   info.RemoteAddr,
+		ForwardedFor: info.ForwardedFor,
+		Endpoint:     info.Endpoint,
+		Repo:         info.Repo,
+		Dir:          c.dir,
+		Argv:         c.argv,
+		ExitCode:     c.exitCode,
+		DurationMs:   time.Since(c.start).Milliseconds(),
+		Output:       c.output,
+	}
+	if user := currentUser(ctx); user != nil {
+		entry.User = user.Name
+		entry.AuthProvider = user.Provider
+	}
+	if len(entry.Output) > maxAuditOutput {
+		entry.Output = strings.ToValidUTF8(entry.Output[:maxAuditOutput], "")
+		entry.Truncated = true
+	}
+	if c.err != nil {
+		entry.Error = c.err.Error()
+	}
+	if err := auditLog.Append(entry); err != nil {
+		log.Println("Failed to write audit log:", err)
+	}
+}
+
+// auditFilter selects audit entries; zero fields match everything.
+type auditFilter struct {
+	User     string
+	Endpoint string
+	Repo     string
+	Command  string
+	Since    time.Time
+	Until    time.Time
+	Failed   bool
+}
+
+func parseAuditFilter(r *http.Request) (*auditFilter, error) {
+	q := r.URL.Query()
+	f := &auditFilter{
+		User:     q.Get("user"),
+		Endpoint: q.Get("endpoint"),
+		Repo:     q.Get("repo"),
+		Command:  q.Get("command"),
+		Failed:   q.Get("failed") == "1",
+	}
+	for key, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		s := q.Get(key)
+		if s == "" {
+			continue
+		}
+		parsed, err := parseTimeParam(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*t = parsed
+	}
+	// A bare date as "until" includes the whole day.
+	if len(q.Get("until")) == len("2006-01-02") {
+		f.Until = f.Until.Add(24 * time.Hour)
+	}
+	return f, nil
+}
+
+// parseTimeParam accepts RFC 3339 timestamps and YYYY-MM-DD dates.
+func parseTimeParam(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func (f *auditFilter) match(e *AuditEntry) bool {
+	switch {
+	case f.User != "" && !strings.EqualFold(e.User, f.User):
+		return false
+	case f.Endpoint != "" && !strings.Contains(e.Endpoint, f.Endpoint):
+		return false
+	case f.Repo != "" && e.Repo != f.Repo:
+		return false
+	case f.Command != "" && !strings.Contains(strings.Join(e.Argv, " "), f.Command):
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Failed && e.ExitCode == 0:
+		return false
+	}
+	return true
+}
+
+// Query returns the entries matching f, oldest first. A limit above zero
+// keeps only the newest entries.
+func (a *AuditLog) Query(f *auditFilter, limit int) ([]*AuditEntry, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []*AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a partially written last line.
+			continue
+		}
+		if f.match(&e) {
+			entries = append(entries, &e)
+			if limit > 0 && len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditEntriesHandler: GET /audit/entries returns matching entries, newest
+// first, as JSON.
+func auditEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 200
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := auditLog.Query(filter, limit)
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	writeJSON(w, entries)
+}
+
+// auditExportHandler: GET /audit/export?format=jsonl|csv downloads every
+// matching entry.
+func auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := auditLog.Query(filter, 0)
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := "audit-" + time.Now().Format("2006-01-02")
+	switch r.URL.Query().Get("format") {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "user", "auth_provider", "remote_addr", "forwarded_for", "endpoint", "repo", "dir", "argv", "exit_code", "duration_ms", "output", "error"})
+		for _, e := range entries {
+			cw.Write([]string{
+				e.Time.Format(time.RFC3339), e.User, e.AuthProvider, e.RemoteAddr, e.ForwardedFor,
+				e.Endpoint, e.Repo, e.Dir, strings.Join(e.Argv, " "), strconv.Itoa(e.ExitCode),
+				strconv.FormatInt(e.DurationMs, 10), e.Output, e.Error,
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "Unknown format, use jsonl or csv", http.StatusBadRequest)
+	}
+}
+
+// auditPageHandler: GET /audit shows the audit log with filters.
+func auditPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Audit Log - Git Server</title>
+    <style>
+      body { font-family: Arial, sans-serif; margin: 20px; }
+      table { border-collapse: collapse; width: 100%; font-size: 0.9rem; }
+      th, td { border: 1px solid #ccc; padding: 4px 6px; text-align: left; vertical-align: top; }
+      th { background: #f4f4f4; }
+      td.argv { font-family: monospace; }
+      tr.failed { background: #ffeef0; }
+      pre { margin: 0; white-space: pre-wrap; max-height: 10rem; overflow-y: auto; }
+      form input { margin-right: 0.5rem; }
+    </style>
+</head>
+<body>
+  <a href="/">&larr; Back</a>
+  <h2>Audit Log</h2>
+  <form id="filters">
+    <input name="user" placeholder="User">
+    <input name="endpoint" placeholder="Endpoint">
+    <input name="repo" placeholder="Repo">
+    <input name="command" placeholder="Command contains">
+    <label>Since <input name="since" type="date"></label>
+    <label>Until <input name="until" type="date"></label>
+    <label><input name="failed" type="checkbox" value="1"> Failed only</label>
+    <button type="submit">Filter</button>
+    <button type="button" onclick="exportLog('jsonl')">Export JSONL</button>
+    <button type="button" onclick="exportLog('csv')">Export CSV</button>
+  </form>
+  <p id="summary"></p>
+  <table>
+    <thead><tr><th>Time</th><th>User</th><th>Remote</th><th>Endpoint</th><th>Command</th><th>Exit</th><th>Duration</th><th>Output</th></tr></thead>
+    <tbody id="entries"></tbody>
+  </table>
+  <script>
+    function filterParams() {
+      const params = new URLSearchParams();
+      for (const [key, value] of new FormData(document.getElementById("filters"))) {
+        if (value) params.set(key, value);
+      }
+      return params;
+    }
+
+    function exportLog(format) {
+      const params = filterParams();
+      params.set("format", format);
+      location.href = "/audit/export?" + params.toString();
+    }
+
+    function cell(row, text, className) {
+      const td = document.createElement("td");
+      if (className) td.className = className;
+      td.innerText = text;
+      row.appendChild(td);
+      return td;
+    }
+
+    async function load() {
+      const resp = await fetch("/audit/entries?" + filterParams().toString());
+      const summary = document.getElementById("summary");
+      if (!resp.ok) {
+        summary.innerText = await resp.text();
+        return;
+      }
+      const entries = await resp.json();
+      summary.innerText = entries.length + " entries (newest first)";
+      const tbody = document.getElementById("entries");
+      tbody.innerHTML = "";
+      for (const e of entries) {
+        const row = document.createElement("tr");
+        if (e.exit_code !== 0) row.className = "failed";
+        cell(row, new Date(e.time).toLocaleString());
+        cell(row, e.user + (e.auth_provider ? " (" + e.auth_provider + ")" : ""));
+        cell(row, e.remote_addr + (e.forwarded_for ? " via " + e.forwarded_for : ""));
+        cell(row, e.endpoint + (e.repo ? " [" + e.repo + "]" : ""));
+        cell(row, e.argv.join(" "), "argv");
+        cell(row, e.exit_code);
+        cell(row, e.duration_ms + " ms");
+        const out = cell(row, "");
+        const pre = document.createElement("pre");
+        pre.innerText = e.output + (e.truncated ? "\n[truncated]" : "") + (e.error ? "\n" + e.error : "");
+        out.appendChild(pre);
+        tbody.appendChild(row);
+      }
+    }
+
+    document.getElementById("filters").onsubmit = function(event) {
+      event.preventDefault();
+      load();
+    };
+    load();
+  </script>
+</body>
+</html>`))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestAuditRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev *AuditLog) { auditLog = prev }(auditLog)
+	auditLog = a
+
+	ctx := context.WithValue(context.Background(), userContextKey, &User{Name: "alice", Provider: "token"})
+	ctx = withRequestInfo(ctx, &requestInfo{
+		RemoteAddr: "192.0.2.1:1234", ForwardedFor: "198.51.100.7", Endpoint: "POST /git/run", Repo: "ledger",
+	})
+	dir := t.TempDir()
+	if _, _, err := runCommand(ctx, dir, "sh", "-c", "printf out; printf err >&2; exit 3"); err == nil {
+		t.Fatal("expected the command to fail")
+	}
+	if _, _, err := runCommand(context.Background(), dir, "true"); err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(ctx, auditCommand{
+		argv:     []string{"cat", "big"},
+		start:    time.Now(),
+		exitCode: -1,
+		output:   strings.Repeat("é", maxAuditOutput),
+		err:      errors.New("failed to start"),
+	})
+
+	entries, err := a.Query(&auditFilter{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	first := entries[0]
+	if first.Time.IsZero() || first.Time.Location() != time.UTC {
+		t.Errorf("time %v", first.Time)
+	}
+	first.Time, first.DurationMs = time.Time{}, 0
+	want := &AuditEntry{
+		User: "alice", AuthProvider: "token", RemoteAddr: "192.0.2.1:1234", ForwardedFor: "198.51.100.7",
+		Endpoint: "POST /git/run", Repo: "ledger", Dir: dir,
+		Argv:     []string{"sh", "-c", "printf out; printf err >&2; exit 3"},
+		ExitCode: 3, Output: "outerr", Error: "exit status 3",
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("got %+v\nwant %+v", first, want)
+	}
+	if e := entries[1]; e.User != "" || e.ExitCode != 0 || e.Error != "" || !reflect.DeepEqual(e.Argv, []string{"true"}) {
+		t.Errorf("got %+v", e)
+	}
+	if e := entries[2]; !e.Truncated || len(e.Output) > maxAuditOutput || !utf8.ValidString(e.Output) || e.Error != "failed to start" {
+		t.Errorf("truncated entry: %d bytes, truncated=%v, error %q", len(e.Output), e.Truncated, e.Error)
+	}
+
+	// A line cut short by a crash is skipped, and later entries still read.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2025-`)
+	f.Close()
+	if entries, err := a.Query(&auditFilter{}, 0); err != nil || len(entries) != 3 {
+		t.Errorf("got %d entries, %v", len(entries), err)
+	}
+
+	tests := []struct {
+		filter auditFilter
+		limit  int
+		want   [][]string
+	}{
+		{auditFilter{User: "ALICE"}, 0, [][]string{{"sh", "-c", "printf out; printf err >&2; exit 3"}, {"cat", "big"}}},
+		{auditFilter{Failed: true}, 1, [][]string{{"cat", "big"}}},
+		{auditFilter{Command: "true"}, 0, [][]string{{"true"}}},
+		{auditFilter{Endpoint: "/git/run", Repo: "ledger"}, 0, [][]string{{"sh", "-c", "printf out; printf err >&2; exit 3"}, {"cat", "big"}}},
+		{auditFilter{Since: time.Now().Add(time.Hour)}, 0, nil},
+		{auditFilter{Until: time.Now().Add(-time.Hour)}, 0, nil},
+	}
+	for _, tt := range tests {
+		entries, err := a.Query(&tt.filter, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]string
+		for _, e := range entries {
+			got = append(got, e.Argv)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/audit/entries?user=bob&since=2025-01-02T03:04:05Z&until=2025-01-31&failed=1", nil)
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &auditFilter{
+		User:   "bob",
+		Since:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Until:  time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+		Failed: true,
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("got %+v\nwant %+v", f, want)
+	}
+	if _, err := parseAuditFilter(httptest.NewRequest("GET", "/audit/entries?since=yesterday", nil)); err == nil {
+		t.Error("expected an error for an invalid since")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is a permission level. Each role includes the permissions of the
+// roles below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleViewer can read diffs, status, logs and run bean queries.
+	RoleViewer
+	// RoleEditor can additionally create PRs and fetch HBL statements.
+	RoleEditor
+	// RoleMaintainer can additionally approve, merge and close PRs.
+	RoleMaintainer
+	// RoleAdmin can additionally run raw git commands.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:       "none",
+	RoleViewer:     "viewer",
+	RoleEditor:     "editor",
+	RoleMaintainer: "maintainer",
+	RoleAdmin:      "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (Role, error) {
+	for role, name := range roleNames {
+		if name == s {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// User is an authenticated identity.
+type User struct {
+	Name  string
+	Email string
+	Role  Role
+	// Provider is the name of the AuthProvider that authenticated the user.
+	Provider string
+}
+
+// AuthConfig is the "auth" section of the config file.
+type AuthConfig struct {
+	Users []UserConfig `json:"users"`
+	// SessionTTL is how long a login session lasts, e.g. "12h".
+	SessionTTL string `json:"session_ttl"`
+	// AnonymousRole is granted to requests without credentials. Empty
+	// means such requests must log in.
+	AnonymousRole string `json:"anonymous_role"`
+	// SecureCookies marks the session cookie as HTTPS only.
+	SecureCookies bool `json:"secure_cookies"`
+	// CloudflareAccess verifies the JWT added by Cloudflare Access.
+	CloudflareAccess *CloudflareAccessConfig `json:"cloudflare_access"`
+}
+
+// UserConfig is a local user. PasswordHash is produced by -hash-password and
+// each entry of Tokens by -new-token.
+type UserConfig struct {
+	Name         string   `json:"name"`
+	Email        string   `json:"email"`
+	Role         string   `json:"role"`
+	PasswordHash string   `json:"password_hash"`
+	Tokens       []string `json:"tokens"`
+}
+
+// AuthProvider identifies the user making a request.
+type AuthProvider interface {
+	Name() string
+	// Authenticate returns nil, nil if the request carries no credentials for
+	// this provider, and an error if it carries invalid ones.
+	Authenticate(r *http.Request) (*User, error)
+}
+
+// Authenticator tries each provider in turn.
+type Authenticator struct {
+	providers []AuthProvider
+	sessions  *sessionStore
+	local     *localUsers
+	anonymous *User
+	secure    bool
+}
+
+// authenticator is set in main.
+var authenticator *Authenticator
+
+const (
+	sessionCookie     = "git_commands_session"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// newAuthenticator builds the configured providers. Cloudflare Access, if
+// enabled, is consulted first so that its token is required. A nil
+// cfg keeps the server usable out of the box by giving anonymous requests
+// read-only access.
+func newAuthenticator(cfg *AuthConfig) (*Authenticator, error) {
+	if cfg == nil {
+		cfg = &AuthConfig{AnonymousRole: RoleViewer.String()}
+	}
+	ttl := defaultSessionTTL
+	if cfg.SessionTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(cfg.SessionTTL); err != nil {
+			return nil, fmt.Errorf("auth.session_ttl: %w", err)
+		}
+	}
+	local, err := newLocalUsers(cfg.Users)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		sessions: newSessionStore(ttl),
+		local:    local,
+		secure:   cfg.SecureCookies,
+	}
+	if cfg.CloudflareAccess != nil {
+		cf, err := newCFAccessProvider(cfg.CloudflareAccess, local)
+		if err != nil {
+			return nil, err
+		}
+		a.providers = append(a.providers, cf)
+	}
+	a.providers = append(a.providers,
+		&sessionProvider{sessions: a.sessions},
+		&tokenProvider{users: local},
+	)
+	if cfg.AnonymousRole != "" {
+		role, err := parseRole(cfg.AnonymousRole)
+		if err != nil {
+			return nil, fmt.Errorf("auth.anonymous_role: %w", err)
+		}
+		a.anonymous = &User{Name: "anonymous", Role: role, Provider: "anonymous"}
+	}
+	return a, nil
+}
+
+// Authenticate returns the user making the request, or nil if there is none.
+func (a *Authenticator) Authenticate(r *http.Request) (*User, error) {
+	for _, p := range a.providers {
+		user, err := p.Authenticate(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+		if user != nil {
+			user.Provider = p.Name()
+			return user, nil
+		}
+	}
+	return a.anonymous, nil
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	requestInfoContextKey
+)
+
+// currentUser returns the user stored in ctx by requireRole.
+func currentUser(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey).(*User)
+	return user
+}
+
+// authorArgs returns the `git commit` arguments attributing the commit to
+// user, if the user has a verified email.
+func authorArgs(user *User) []string {
+	if user == nil || user.Email == "" {
+		return nil
+	}
+	return []string{"--author", fmt.Sprintf("%s <%s>", user.Name, user.Email)}
+}
+
+// requireRole rejects requests from users below role.
+func requireRole(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticator.Authenticate(r)
+		if err != nil {
+			log.Println("Authentication failed:", err)
+			http.Error(w, "Authentication failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if user == nil {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		if user.Role < role {
+			http.Error(w, fmt.Sprintf("Forbidden: %s role required", role), http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = withRequestInfo(ctx, &requestInfo{
+			RemoteAddr:   r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Endpoint:     r.Method + " " + r.URL.Path,
+		})
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// localUsers are the users defined in the config file.
+type localUsers struct {
+	byName  map[string]*UserConfig
+	byToken map[string]*UserConfig
+	roles   map[string]Role
+}
+
+func newLocalUsers(configs []UserConfig) (*localUsers, error) {
+	lu := &localUsers{
+		byName:  make(map[string]*UserConfig),
+		byToken: make(map[string]*UserConfig),
+		roles:   make(map[string]Role),
+	}
+	for i := range configs {
+		uc := &configs[i]
+		if uc.Name == "" {
+			return nil, fmt.Errorf("auth.users[%d]: name is required", i)
+		}
+		if _, dup := lu.byName[uc.Name]; dup {
+			return nil, fmt.Errorf("auth.users: duplicate user %q", uc.Name)
+		}
+		role, err := parseRole(uc.Role)
+		if err != nil {
+			return nil, fmt.Errorf("auth.users %s: %w", uc.Name, err)
+		}
+		if uc.PasswordHash != "" {
+			if _, _, _, err := parsePasswordHash(uc.PasswordHash); err != nil {
+				return nil, fmt.Errorf("auth.users %s: %w", uc.Name, err)
+			}
+		}
+		for _, t := range uc.Tokens {
+			digest, ok := strings.CutPrefix(t, "sha256$")
+			if !ok {
+				return nil, fmt.Errorf("auth.users %s: tokens must be sha256$<hex> hashes", uc.Name)
+			}
+			lu.byToken[digest] = uc
+		}
+		lu.byName[uc.Name] = uc
+		lu.roles[uc.Name] = role
+	}
+	return lu, nil
+}
+
+func (lu *localUsers) user(uc *UserConfig) *User {
+	return &User{Name: uc.Name, Email: uc.Email, Role: lu.roles[uc.Name]}
+}
+
+// login checks a username and password.
+func (lu *localUsers) login(name, password string) *User {
+	uc, ok := lu.byName[name]
+	if !ok || uc.PasswordHash == "" {
+		// Hash anyway so unknown users take as long as wrong passwords.
+		checkPassword(dummyPasswordHash(), password)
+		return nil
+	}
+	if !checkPassword(uc.PasswordHash, password) {
+		return nil
+	}
+	return lu.user(uc)
+}
+
+// tokenProvider authenticates "Authorization: Bearer <token>" headers.
+type tokenProvider struct {
+	users *localUsers
+}
+
+func (p *tokenProvider) Name() string { return "token" }
+
+func (p *tokenProvider) Authenticate(r *http.Request) (*User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	uc, ok := p.users.byToken[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return p.users.user(uc), nil
+}
+
+// sessionProvider authenticates the session cookie set by /login.
+type sessionProvider struct {
+	sessions *sessionStore
+}
+
+func (p *sessionProvider) Name() string { return "session" }
+
+func (p *sessionProvider) Authenticate(r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	// An expired session is treated like no session so the user is sent
+	// back to the login page.
+	return p.sessions.get(cookie.Value), nil
+}
+
+type session struct {
+	user    *User
+	expires time.Time
+}
+
+// sessionStore keeps login sessions in memory; they are lost on restart.
+type sessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*session
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{ttl: ttl, sessions: make(map[string]*session)}
+}
+
+func (s *sessionStore) create(user *User) string {
+	id := randomToken()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = &session{user: user, expires: now.Add(s.ttl)}
+	return id
+}
+
+func (s *sessionStore) get(id string) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		return nil
+	}
+	u := *sess.user
+	return &u
+}
+
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Passwords are stored as pbkdf2-sha256$<iterations>$<salt>$<key> with the
+// salt and key base64 encoded.
+const (
+	passwordIterations = 600000
+	passwordKeyLen     = 32
+)
+
+var dummyPasswordHash = sync.OnceValue(func() string { return hashPassword("dummy password") })
+
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key := pbkdf2(sha256.New, []byte(password), salt, passwordIterations, passwordKeyLen)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func parsePasswordHash(encoded string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, fmt.Errorf("unsupported password hash format")
+	}
+	if iterations, err = strconv.Atoi(parts[1]); err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash iterations")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash salt")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash key")
+	}
+	return iterations, salt, key, nil
+}
+
+func checkPassword(encoded, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+	got := pbkdf2(sha256.New, []byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// pbkdf2 implements PBKDF2 from RFC 8018.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		u = prf.Sum(u[:0])
+		t := make([]byte, hashLen)
+		copy(t, u)
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+// newToken returns a random API token and the hash to put in the config.
+func newToken() (token, hashed string) {
+	token = randomToken()
+	sum := sha256.Sum256([]byte(token))
+	return token, "sha256$" + hex.EncodeToString(sum[:])
+}
+
+// loginHandler: GET shows the login form, POST checks the credentials and
+// starts a session.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	// Only redirect within this server.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+
+	errMsg := ""
+	w.Header().Set("Content-Type", "text/html")
+	if r.Method == http.MethodPost {
+		user := authenticator.local.login(r.PostFormValue("username"), r.PostFormValue("password"))
+		if user != nil {
+			user.Provider = "session"
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    authenticator.sessions.create(user),
+				Path:     "/",
+				MaxAge:   int(authenticator.sessions.ttl.Seconds()),
+				HttpOnly: true,
+				Secure:   authenticator.secure,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("Failed login for %q from %s", r.PostFormValue("username"), r.RemoteAddr)
+		errMsg = "Invalid username or password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+    <title>Login - Git Server</title>
+    <style>body { font-family: Arial, sans-serif; margin: 20px; }</style>
+</head>
+<body>
+  <h2>Login</h2>
+  <p style="color: #b31d28;">%s</p>
+  <form method="POST" action="/login">
+    <input type="hidden" name="next" value="%s">
+    <p><input type="text" name="username" placeholder="Username" autofocus required></p>
+    <p><input type="password" name="password" placeholder="Password" required></p>
+    <button type="submit">Login</button>
+  </form>
+</body>
+</html>`, errMsg, html.EscapeString(next))
+}
+
+// logoutHandler: POST ends the session.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		authenticator.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Vectors from RFC 7914 section 11 and the PBKDF2-HMAC-SHA256 vectors
+	// commonly used alongside RFC 6070.
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	}
+	for _, tt := range tests {
+		got := pbkdf2(sha256.New, []byte(tt.password), []byte(tt.salt), tt.iterations, len(tt.want)/2)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s/%s/%d: got %x, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	// PBKDF2-HMAC-SHA256("password", "salt", 1).
+	const known = "pbkdf2-sha256$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs"
+	tests := []struct {
+		encoded, password string
+		want              bool
+	}{
+		{known, "password", true},
+		{known, "Password", false},
+		{known, "", false},
+		{"pbkdf2-sha1$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"pbkdf2-sha256$0$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"pbkdf2-sha256$1$c2FsdA$", "password", false},
+		{"pbkdf2-sha256$1$!$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{"password", "password", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.encoded, tt.password); got != tt.want {
+			t.Errorf("%s with %q: got %v, want %v", tt.encoded, tt.password, got, tt.want)
+		}
+	}
+
+	encoded := hashPassword("correct horse")
+	if _, _, _, err := parsePasswordHash(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(encoded, "correct horse") || checkPassword(encoded, "correct horse ") {
+		t.Errorf("hashPassword's output %s does not check", encoded)
+	}
+	if hashPassword("correct horse") == encoded {
+		t.Error("two hashes of the same password share a salt")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	viewerToken, viewerHash := newToken()
+	editorToken, editorHash := newToken()
+	newAuth := func(anonymousRole string) *Authenticator {
+		a, err := newAuthenticator(&AuthConfig{
+			AnonymousRole: anonymousRole,
+			Users: []UserConfig{
+				{Name: "viewer", Role: "viewer", Tokens: []string{viewerHash}},
+				{Name: "editor", Email: "editor@example.com", Role: "editor", Tokens: []string{editorHash}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	defer func(a *Authenticator) { authenticator = a }(authenticator)
+
+	var seen *User
+	h := requireRole(RoleEditor, func(w http.ResponseWriter, r *http.Request) {
+		seen = currentUser(r.Context())
+	})
+	tests := []struct {
+		name          string
+		anonymousRole string
+		token         string
+		accept        string
+		wantStatus    int
+		wantUser      string
+	}{
+		{"editor", "", editorToken, "", http.StatusOK, "editor"},
+		{"viewer is below editor", "", viewerToken, "", http.StatusForbidden, ""},
+		{"invalid token", "", "nope", "", http.StatusUnauthorized, ""},
+		{"no credentials", "", "", "", http.StatusUnauthorized, ""},
+		{"browser is sent to login", "", "", "text/html", http.StatusSeeOther, ""},
+		{"anonymous viewer", "viewer", "", "", http.StatusForbidden, ""},
+		{"anonymous editor", "editor", "", "", http.StatusOK, "anonymous"},
+		{"token beats anonymous", "viewer", editorToken, "", http.StatusOK, "editor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator = newAuth(tt.anonymousRole)
+			seen = nil
+			r := httptest.NewRequest("GET", "/api/pr?repo=x", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			got := ""
+			if seen != nil {
+				got = seen.Name
+			}
+			if got != tt.wantUser {
+				t.Errorf("handler saw user %q, want %q", got, tt.wantUser)
+			}
+			if tt.wantStatus == http.StatusSeeOther {
+				if loc := w.Header().Get("Location"); loc != "/login?next=%2Fapi%2Fpr%3Frepo%3Dx" {
+					t.Errorf("redirected to %s", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newSessionStore(time.Hour)
+	user := &User{Name: "alice", Role: RoleEditor}
+	id := s.create(user)
+	got := s.get(id)
+	if got == nil || got.Name != "alice" {
+		t.Fatalf("got %+v", got)
+	}
+	// get hands out copies, so callers can't change the session's user.
+	got.Role = RoleAdmin
+	if s.get(id).Role != RoleEditor {
+		t.Error("session user was modified through get")
+	}
+	if s.get("other") != nil {
+		t.Error("unknown session was found")
+	}
+
+	s.sessions[id].expires = time.Now().Add(-time.Second)
+	if s.get(id) != nil {
+		t.Error("expired session was found")
+	}
+	// Creating a session drops expired ones.
+	other := s.create(user)
+	if _, ok := s.sessions[id]; ok || len(s.sessions) != 1 {
+		t.Errorf("expired session was kept: %d sessions", len(s.sessions))
+	}
+
+	s.delete(other)
+	if s.get(other) != nil {
+		t.Error("deleted session was found")
+	}
+
+	// The cookie of an expired session counts as no credentials.
+	s.sessions[id] = &session{user: user, expires: time.Now().Add(-time.Second)}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+	if u, err := (&sessionProvider{sessions: s}).Authenticate(r); u != nil || err != nil {
+		t.Errorf("got %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transaction is a beancount transaction as far as the semantic diff needs
+// it. Other directives, such as open, balance or pad, are skipped.
+type Transaction struct {
+	File      string    `json:"file"`
+	Line      int       `json:"line"`
+	Date      string    `json:"date"`
+	Flag      string    `json:"flag"`
+	Payee     string    `json:"payee,omitempty"`
+	Narration string    `json:"narration"`
+	Tags      []string  `json:"tags,omitempty"`
+	Links     []string  `json:"links,omitempty"`
+	Meta      []string  `json:"meta,omitempty"`
+	Postings  []Posting `json:"postings"`
+}
+
+// Posting is one leg of a transaction. Units is empty for a posting whose
+// amount beancount infers; Cost and Price keep the text of "{...}" and
+// "@ ..." annotations.
+type Posting struct {
+	Flag     string `json:"flag,omitempty"`
+	Account  string `json:"account"`
+	Units    string `json:"units,omitempty"`
+	Cost     string `json:"cost,omitempty"`
+	Price    string `json:"price,omitempty"`
+	number   *big.Rat
+	currency string
+}
+
+// LedgerAmount is a number of a currency.
+type LedgerAmount struct {
+	Number   *big.Rat
+	Currency string
+}
+
+var (
+	txnHeader   = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\s+(txn|[*!&#?%A-Z])(?:\s+(.*))?$`)
+	postingLine = regexp.MustCompile(`^\s+(?:([*!])\s+)?((?:Assets|Liabilities|Equity|Income|Expenses|[A-Z][A-Za-z0-9-]*)(?::[A-Za-z0-9][A-Za-z0-9-]*)+)(.*)$`)
+	metaLine    = regexp.MustCompile(`^\s+([a-z][A-Za-z0-9_-]*):\s*(.*)$`)
+	includeLine = regexp.MustCompile(`^include\s+"((?:[^"\\]|\\.)*)"`)
+)
+
+// parseLedger parses the transactions of one beancount file and returns the
+// files it includes, resolved against its directory.
+func parseLedger(file, content string) (txns []*Transaction, includes []string, errs []string) {
+	var txn *Transaction
+	for i, line := range strings.Split(content, "\n") {
+		lineno := i + 1
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || line[0] != ' ' && line[0] != '\t' {
+			txn = nil
+		}
+		if m := includeLine.FindStringSubmatch(line); m != nil {
+			name, err := strconv.Unquote(`"` + m[1] + `"`)
+			if err != nil {
+				name = m[1]
+			}
+			if !path.IsAbs(name) {
+				name = path.Join(path.Dir(file), name)
+			}
+			includes = append(includes, name)
+			continue
+		}
+		if m := txnHeader.FindStringSubmatch(line); m != nil {
+			txn = &Transaction{File: file, Line: lineno, Date: m[1], Flag: m[2], Postings: []Posting{}}
+			if err := parseTxnHeader(txn, m[3]); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %v", file, lineno, err))
+			}
+			txns = append(txns, txn)
+			continue
+		}
+		if txn == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ";") {
+			continue
+		}
+		if m := metaLine.FindStringSubmatch(line); m != nil {
+			txn.Meta = append(txn.Meta, m[1]+": "+strings.TrimSpace(m[2]))
+			continue
+		}
+		if m := postingLine.FindStringSubmatch(line); m != nil {
+			p, err := parsePosting(m[1], m[2], m[3])
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %v", file, lineno, err))
+			}
+			txn.Postings = append(txn.Postings, p)
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s:%d: unexpected line in transaction: %s", file, lineno, trimmed))
+	}
+	return txns, includes, errs
+}
+
+// parseTxnHeader parses the payee, narration, tags and links after the flag.
+func parseTxnHeader(txn *Transaction, rest string) error {
+	var strs []string
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		switch rest[0] {
+		case '"':
+			q, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return fmt.Errorf("unterminated string")
+			}
+			s, _ := strconv.Unquote(q)
+			strs = append(strs, s)
+			rest = rest[len(q):]
+		case ';':
+			rest = ""
+		default:
+			word, after, _ := strings.Cut(rest, " ")
+			switch word[0] {
+			case '#':
+				txn.Tags = append(txn.Tags, word[1:])
+			case '^':
+				txn.Links = append(txn.Links, word[1:])
+			default:
+				return fmt.Errorf("unexpected %q", word)
+			}
+			rest = after
+		}
+	}
+	switch len(strs) {
+	case 0:
+	case 1:
+		txn.Narration = strs[0]
+	case 2:
+		txn.Payee, txn.Narration = strs[0], strs[1]
+	default:
+		return fmt.Errorf("too many strings")
+	}
+	return nil
+}
+
+// parsePosting parses the amount, cost and price that follow the account.
+func parsePosting(flag, account, rest string) (Posting, error) {
+	p := Posting{Flag: flag, Account: account}
+	if i := strings.Index(rest, ";"); i >= 0 {
+		rest = rest[:i]
+	}
+	rest = strings.TrimSpace(rest)
+	if i := strings.Index(rest, "@"); i >= 0 {
+		p.Price = strings.TrimSpace(rest[i:])
+		rest = strings.TrimSpace(rest[:i])
+	}
+	if i := strings.Index(rest, "{"); i >= 0 {
+		p.Cost = strings.TrimSpace(rest[i:])
+		rest = strings.TrimSpace(rest[:i])
+	}
+	if rest == "" {
+		return p, nil
+	}
+	amount, err := parseLedgerAmount(rest)
+	if err != nil {
+		return p, err
+	}
+	p.number, p.currency = amount.Number, amount.Currency
+	p.Units = strings.Join(strings.Fields(rest), " ")
+	return p, nil
+}
+
+// parseLedgerAmount parses "<number expression> <currency>".
+func parseLedgerAmount(s string) (LedgerAmount, error) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndexAny(s, " \t")
+	if i < 0 {
+		return LedgerAmount{}, fmt.Errorf("amount %q has no currency", s)
+	}
+	n, err := parseLedgerNumber(s[:i])
+	if err != nil {
+		return LedgerAmount{}, err
+	}
+	return LedgerAmount{Number: n, Currency: s[i+1:]}, nil
+}
+
+// parseLedgerNumber evaluates a beancount number, which may be an arithmetic
+// expression such as "(10 + 2.5) / 3" and may group digits with commas.
+func parseLedgerNumber(s string) (*big.Rat, error) {
+	e := &exprParser{s: strings.ReplaceAll(s, ",", "")}
+	n, err := e.sum()
+	if err == nil && strings.TrimSpace(e.s[e.pos:]) != "" {
+		err = fmt.Errorf("unexpected %q", e.s[e.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q: %v", s, err)
+	}
+	return n, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (e *exprParser) peek() byte {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+	if e.pos == len(e.s) {
+		return 0
+	}
+	return e.s[e.pos]
+}
+
+func (e *exprParser) sum() (*big.Rat, error) {
+	n, err := e.product()
+	for err == nil {
+		op := e.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		e.pos++
+		var m *big.Rat
+		if m, err = e.product(); err == nil {
+			if op == '+' {
+				n.Add(n, m)
+			} else {
+				n.Sub(n, m)
+			}
+		}
+	}
+	return n, err
+}
+
+func (e *exprParser) product() (*big.Rat, error) {
+	n, err := e.unary()
+	for err == nil {
+		op := e.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		e.pos++
+		var m *big.Rat
+		if m, err = e.unary(); err == nil {
+			if op == '*' {
+				n.Mul(n, m)
+			} else if m.Sign() == 0 {
+				err = fmt.Errorf("division by zero")
+			} else {
+				n.Quo(n, m)
+			}
+		}
+	}
+	return n, err
+}
+
+func (e *exprParser) unary() (*big.Rat, error) {
+	switch e.peek() {
+	case '-':
+		e.pos++
+		n, err := e.unary()
+		if err != nil {
+			return nil, err
+		}
+		return n.Neg(n), nil
+	case '+':
+		e.pos++
+		return e.unary()
+	case '(':
+		e.pos++
+		n, err := e.sum()
+		if err != nil {
+			return nil, err
+		}
+		if e.peek() != ')' {
+			return nil, fmt.Errorf("missing )")
+		}
+		e.pos++
+		return n, nil
+	}
+	start := e.pos
+	for e.pos < len(e.s) && (e.s[e.pos] >= '0' && e.s[e.pos] <= '9' || e.s[e.pos] == '.') {
+		e.pos++
+	}
+	n, ok := new(big.Rat).SetString(e.s[start:e.pos])
+	if !ok {
+		return nil, fmt.Errorf("expected a number")
+	}
+	return n, nil
+}
+
+// ratString formats r as a decimal, with as many places as it needs up to
+// 10.
+func ratString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	places := 1
+	scaled := new(big.Rat)
+	for ten := big.NewRat(10, 1); places < 10; places++ {
+		scaled.Mul(r, ten)
+		if scaled.IsInt() {
+			break
+		}
+		ten.Mul(ten, big.NewRat(10, 1))
+	}
+	return r.FloatString(places)
+}
+
+// weight is the amount a posting contributes to its transaction's balance:
+// its units, or their cost or price if annotated.
+func (p *Posting) weight() (LedgerAmount, bool) {
+	if p.number == nil {
+		return LedgerAmount{}, false
+	}
+	units := LedgerAmount{Number: p.number, Currency: p.currency}
+	annotated := func(spec string, total bool) (LedgerAmount, bool) {
+		a, err := parseLedgerAmount(spec)
+		if err != nil {
+			return units, true
+		}
+		if total {
+			if p.number.Sign() < 0 {
+				a.Number.Neg(a.Number)
+			}
+			return a, true
+		}
+		return LedgerAmount{Number: a.Number.Mul(a.Number, p.number), Currency: a.Currency}, true
+	}
+	if strings.HasPrefix(p.Cost, "{{") {
+		return annotated(strings.Trim(p.Cost, "{} "), true)
+	}
+	if p.Cost != "" {
+		// Only "{<number> <currency>, ...}" carries a usable per-unit cost.
+		spec, _, _ := strings.Cut(strings.Trim(p.Cost, "{} "), ",")
+		if strings.TrimSpace(spec) != "" && !strings.HasPrefix(strings.TrimSpace(spec), "\"") {
+			if _, err := parseLedgerAmount(spec); err == nil {
+				return annotated(spec, false)
+			}
+		}
+		return units, true
+	}
+	if rest, ok := strings.CutPrefix(p.Price, "@@"); ok {
+		return annotated(rest, true)
+	}
+	if rest, ok := strings.CutPrefix(p.Price, "@"); ok {
+		return annotated(rest, false)
+	}
+	return units, true
+}
+
+// balances returns the change the transaction makes to each account, by
+// currency. A posting without an amount gets what balances the others.
+func (t *Transaction) balances() map[string]map[string]*big.Rat {
+	deltas := make(map[string]map[string]*big.Rat)
+	add := func(account, currency string, n *big.Rat) {
+		if deltas[account] == nil {
+			deltas[account] = make(map[string]*big.Rat)
+		}
+		if deltas[account][currency] == nil {
+			deltas[account][currency] = new(big.Rat)
+		}
+		deltas[account][currency].Add(deltas[account][currency], n)
+	}
+	residual := make(map[string]*big.Rat)
+	elided := ""
+	for i := range t.Postings {
+		p := &t.Postings[i]
+		w, ok := p.weight()
+		if !ok {
+			elided = p.Account
+			continue
+		}
+		add(p.Account, p.currency, p.number)
+		if residual[w.Currency] == nil {
+			residual[w.Currency] = new(big.Rat)
+		}
+		residual[w.Currency].Add(residual[w.Currency], w.Number)
+	}
+	if elided != "" {
+		currencies := make([]string, 0, len(residual))
+		for c := range residual {
+			currencies = append(currencies, c)
+		}
+		sort.Strings(currencies)
+		for _, c := range currencies {
+			if residual[c].Sign() != 0 {
+				add(elided, c, new(big.Rat).Neg(residual[c]))
+			}
+		}
+	}
+	return deltas
+}
+
+// key identifies the content of a transaction, ignoring where it is.
+func (t *Transaction) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %q %q %q %q %q\n", t.Date, t.Flag, t.Payee, t.Narration, t.Tags, t.Links, t.Meta)
+	for _, p := range t.Postings {
+		// Amounts are compared by value, so 10.0 and 10.00 are the same.
+		units := ""
+		if p.number != nil {
+			units = p.number.RatString() + " " + p.currency
+		}
+		fmt.Fprintf(&b, "%s %s %s %s %s\n", p.Flag, p.Account, units, p.Cost, p.Price)
+	}
+	return b.String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLedger(t *testing.T) {
+	content := strings.Join([]string{
+		`option "title" "Books"`,
+		`include "accounts.bean"`,
+		`include "/abs/prices.bean"`,
+		``,
+		`2025-01-01 open Assets:Cash`,
+		``,
+		`2025-01-02 * "Cafe" "Coffee" #food ^receipt-1 ; comment`,
+		`  receipt: "r1.pdf"`,
+		`  ; a comment inside the transaction`,
+		`  Expenses:Food:Coffee   3.50 USD ; note`,
+		`  ! Assets:Cash`,
+		``,
+		`2025-01-03 txn "Buy shares"`,
+		"\tAssets:Broker:VTI   2 VTI {100.00 USD} @ 101 USD",
+		"\tAssets:Broker:Cash  -(2 * 100) USD",
+		`2025-01-04 balance Assets:Cash 10 USD`,
+		`2025-01-05 ! "Bad" "too" "many"`,
+		`  Expenses:Misc  1,000.5 EUR`,
+		`  nonsense here`,
+		`  Assets:Cash  abc EUR`,
+	}, "\r\n")
+	txns, includes, errs := parseLedger("2025/main.bean", content)
+
+	if want := []string{"2025/accounts.bean", "/abs/prices.bean"}; !reflect.DeepEqual(includes, want) {
+		t.Errorf("includes %q, want %q", includes, want)
+	}
+	wantErrs := []string{
+		"2025/main.bean:17: too many strings",
+		"2025/main.bean:19: unexpected line in transaction: nonsense here",
+		`2025/main.bean:20: invalid number "abc": expected a number`,
+	}
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("errors %q, want %q", errs, wantErrs)
+	}
+	if len(txns) != 3 {
+		t.Fatalf("got %d transactions, want 3", len(txns))
+	}
+
+	coffee := txns[0]
+	if coffee.Line != 7 || coffee.Date != "2025-01-02" || coffee.Flag != "*" || coffee.Payee != "Cafe" || coffee.Narration != "Coffee" ||
+		!reflect.DeepEqual(coffee.Tags, []string{"food"}) || !reflect.DeepEqual(coffee.Links, []string{"receipt-1"}) ||
+		!reflect.DeepEqual(coffee.Meta, []string{`receipt: "r1.pdf"`}) {
+		t.Errorf("unexpected transaction %+v", coffee)
+	}
+	if len(coffee.Postings) != 2 || coffee.Postings[0].Units != "3.50 USD" || coffee.Postings[1].Flag != "!" || coffee.Postings[1].Units != "" {
+		t.Errorf("unexpected postings %+v", coffee.Postings)
+	}
+
+	shares := txns[1]
+	if shares.Flag != "txn" || shares.Narration != "Buy shares" || shares.Payee != "" {
+		t.Errorf("unexpected transaction %+v", shares)
+	}
+	if p := shares.Postings[0]; p.Units != "2 VTI" || p.Cost != "{100.00 USD}" || p.Price != "@ 101 USD" {
+		t.Errorf("unexpected posting %+v", p)
+	}
+	if p := shares.Postings[1]; p.Units != "-(2 * 100) USD" || p.number.Cmp(big.NewRat(-200, 1)) != 0 {
+		t.Errorf("unexpected posting %+v", p)
+	}
+}
+
+func TestParseLedgerNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"10", "10", false},
+		{"-3.50", "-3.5", false},
+		{"1,234.5", "1234.5", false},
+		{"(10 + 2.5) / 5", "2.5", false},
+		{"2 * -3 + 1", "-5", false},
+		{"1 / 3", "0.3333333333", false},
+		{"1 / 0", "", true},
+		{"(1 + 2", "", true},
+		{"1 2", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		n, err := parseLedgerNumber(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.in, n)
+			}
+			continue
+		}
+		if err != nil || ratString(n) != tt.want {
+			t.Errorf("%q: got %v, %v, want %s", tt.in, n, err, tt.want)
+		}
+	}
+}
+
+// balanceStrings formats the balances of a transaction for comparison.
+func balanceStrings(t *Transaction) map[string]string {
+	got := make(map[string]string)
+	for account, amounts := range t.balances() {
+		for currency, n := range amounts {
+			got[account+" "+currency] = ratString(n)
+		}
+	}
+	return got
+}
+
+func TestTransactionBalances(t *testing.T) {
+	tests := []struct {
+		name     string
+		postings []string
+		want     map[string]string
+	}{
+		{
+			"elided posting",
+			[]string{"Expenses:Food  3.50 USD", "Assets:Cash"},
+			map[string]string{"Expenses:Food USD": "3.5", "Assets:Cash USD": "-3.5"},
+		},
+		{
+			"per-unit cost",
+			[]string{"Assets:VTI  2 VTI {100 USD}", "Assets:Cash"},
+			map[string]string{"Assets:VTI VTI": "2", "Assets:Cash USD": "-200"},
+		},
+		{
+			"total cost of a sale",
+			[]string{"Assets:VTI  -2 VTI {{210 USD}}", "Assets:Cash"},
+			map[string]string{"Assets:VTI VTI": "-2", "Assets:Cash USD": "210"},
+		},
+		{
+			"price",
+			[]string{"Assets:EUR  10 EUR @ 1.1 USD", "Assets:Cash"},
+			map[string]string{"Assets:EUR EUR": "10", "Assets:Cash USD": "-11"},
+		},
+		{
+			"total price",
+			[]string{"Assets:EUR  10 EUR @@ 12 USD", "Assets:Cash"},
+			map[string]string{"Assets:EUR EUR": "10", "Assets:Cash USD": "-12"},
+		},
+		{
+			"cost with a date only",
+			[]string{"Assets:VTI  -1 VTI {2025-01-01}", "Assets:Cash  100 USD", "Income:Gains"},
+			map[string]string{"Assets:VTI VTI": "-1", "Assets:Cash USD": "100", "Income:Gains VTI": "1", "Income:Gains USD": "-100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "2025-01-01 * \"x\"\n  " + strings.Join(tt.postings, "\n  ") + "\n"
+			txns, _, errs := parseLedger("main.bean", content)
+			if len(errs) > 0 || len(txns) != 1 {
+				t.Fatalf("parse: %q, %d transactions", errs, len(txns))
+			}
+			if got := balanceStrings(txns[0]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRatString(t *testing.T) {
+	tests := []struct {
+		r    *big.Rat
+		want string
+	}{
+		{big.NewRat(5, 1), "5"},
+		{big.NewRat(-7, 2), "-3.5"},
+		{big.NewRat(1, 8), "0.125"},
+		{big.NewRat(2, 3), "0.6666666667"},
+	}
+	for _, tt := range tests {
+		if got := ratString(tt.r); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.r, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultBranchPrefix is prepended to the user name to form the branch
+	// the create PR workflow commits to, e.g. edits/alice.
+	defaultBranchPrefix = "edits/"
+	// legacyEditBranch is the single shared branch used before edit branches
+	// were per user. PRs from it can still be managed.
+	legacyEditBranch = "edit"
+	// topicSeparator joins the user and topic of a topic branch, e.g.
+	// edits/alice--march-receipts. Slugs never contain it.
+	topicSeparator = "--"
+	maxTopicLength = 50
+)
+
+// validBranchPrefix accepts slash separated components, the last one possibly
+// empty or partial, e.g. "edits/" or "wip/edit-".
+var validBranchPrefix = regexp.MustCompile(`^(?:[A-Za-z0-9_-]+/)*[A-Za-z0-9_-]*$`)
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify lowercases s and replaces every run of other characters than
+// letters and digits with a single dash, so the result is safe in a branch
+// name.
+func slugify(s string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// userSlug is the branch name component identifying user. It also names
+// the user's worktree and history file, so different users must never
+// share one: when slugify loses information, as it does for "Alice",
+// "a.b" or an email address, a short hash of the user's identity is
+// appended. Names that look like such a slug, or like the "anonymous" and
+// "user" slugs of users without a name, are hashed too.
+func userSlug(user *User) string {
+	if user == nil || user.Provider == "anonymous" {
+		return "anonymous"
+	}
+	identity := cmp.Or(user.Name, user.Email)
+	if identity == "" {
+		return "user"
+	}
+	slug := slugify(identity)
+	if slug == identity && slug != "anonymous" && slug != "user" && !hashedSlug.MatchString(slug) {
+		return slug
+	}
+	sum := sha256.Sum256([]byte(identity))
+	return cmp.Or(slug, "user") + "-" + hex.EncodeToString(sum[:3])
+}
+
+// hashedSlug matches the slugs userSlug appends a hash to.
+var hashedSlug = regexp.MustCompile(`-[0-9a-f]{6}$`)
+
+// editBranch returns the branch the create PR workflow uses for user, or for
+// the user's topic if one is given.
+func (repo *Repo) editBranch(user *User, topic string) (string, error) {
+	branch := repo.BranchPrefix + userSlug(user)
+	if topic == "" {
+		return branch, nil
+	}
+	slug := slugify(topic)
+	if slug == "" {
+		return "", fmt.Errorf("topic %q has no letters or digits", topic)
+	}
+	if len(slug) > maxTopicLength {
+		return "", fmt.Errorf("topic is longer than %d characters", maxTopicLength)
+	}
+	return branch + topicSeparator + slug, nil
+}
+
+// parseEditBranch splits an edit branch into its user and topic.
+func (repo *Repo) parseEditBranch(branch string) (user, topic string, ok bool) {
+	rest, found := strings.CutPrefix(branch, repo.BranchPrefix)
+	if !found || rest == "" || branch == legacyEditBranch {
+		return "", "", false
+	}
+	user, topic, _ = strings.Cut(rest, topicSeparator)
+	return user, topic, true
+}
+
+// EditBranch is a branch of the create PR workflow with its PR, if any.
+type EditBranch struct {
+	Name string `json:"name"`
+	// User is the user slug from the branch name, empty for the legacy
+	// shared branch.
+	User  string `json:"user"`
+	Topic string `json:"topic,omitempty"`
+	// Mine is set for branches of the requesting user.
+	Mine bool `json:"mine"`
+	// Local and Remote tell where the branch exists; Commit and the fields
+	// after it describe the remote branch if there is one.
+	Local   bool   `json:"local"`
+	Remote  bool   `json:"remote"`
+	Commit  string `json:"commit"`
+	Subject string `json:"subject"`
+	Date    string `json:"date,omitempty"`
+	// Ahead and Behind count the commits relative to the base branch.
+	Ahead  int          `json:"ahead"`
+	Behind int          `json:"behind"`
+	PR     *PullRequest `json:"pr"`
+}
+
+// listEditBranches returns the local and remote edit branches, those of user
+// first.
+func listEditBranches(ctx context.Context, repo *Repo, user *User) ([]*EditBranch, error) {
+	out, err := repo.runGit(ctx, "for-each-ref", "--format="+branchFormat, "refs/heads", "refs/remotes/origin")
+	if err != nil {
+		return nil, gitStepError("Failed to list branches", out, err)
+	}
+	refs, err := parseBranches(out)
+	if err != nil {
+		return nil, err
+	}
+	mine := userSlug(user)
+	byName := make(map[string]*EditBranch)
+	branches := []*EditBranch{}
+	for _, ref := range refs {
+		name := ref.Name
+		if ref.Remote {
+			var found bool
+			if name, found = strings.CutPrefix(name, "origin/"); !found {
+				continue
+			}
+		}
+		owner, topic, ok := repo.parseEditBranch(name)
+		if !ok && name != legacyEditBranch {
+			continue
+		}
+		b := byName[name]
+		if b == nil {
+			b = &EditBranch{Name: name, User: owner, Topic: topic, Mine: ok && owner == mine}
+			byName[name] = b
+			branches = append(branches, b)
+		}
+		// Prefer the remote branch, which is what the PR shows.
+		if ref.Remote || !b.Remote {
+			b.Commit, b.Subject = ref.Commit, ref.Subject
+			if !ref.CommitterDate.IsZero() {
+				b.Date = ref.CommitterDate.Format("2006-01-02 15:04")
+			}
+		}
+		if ref.Remote {
+			b.Remote = true
+		} else {
+			b.Local = true
+		}
+	}
+
+	// Without a fetched base branch there is nothing to compare against.
+	base := "origin/" + repo.BaseBranch
+	if _, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", base); err == nil {
+		for _, b := range branches {
+			out, err := repo.runGit(ctx, "rev-list", "--left-right", "--count", base+"..."+b.Commit)
+			if err != nil {
+				return nil, gitStepError("Failed to compare "+b.Name, out, err)
+			}
+			if f := strings.Fields(out); len(f) == 2 {
+				b.Behind, _ = strconv.Atoi(f[0])
+				b.Ahead, _ = strconv.Atoi(f[1])
+			}
+		}
+	}
+	sort.SliceStable(branches, func(i, j int) bool {
+		if branches[i].Mine != branches[j].Mine {
+			return branches[i].Mine
+		}
+		return branches[i].Name < branches[j].Name
+	})
+	return branches, nil
+}
+
+// apiEditBranchesHandler: GET /api/edit-branches lists every user's pending
+// edit branches with their open PRs.
+func apiEditBranchesHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	user := currentUser(r.Context())
+	branches, err := listEditBranches(r.Context(), repo, user)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	resp := map[string]any{
+		"prefix":   repo.BranchPrefix,
+		"base":     repo.BaseBranch,
+		"mine":     repo.BranchPrefix + userSlug(user),
+		"branches": branches,
+	}
+	// Branches are still worth listing if the provider is unreachable.
+	prs, err := repo.provider.List(r.Context())
+	if err != nil {
+		resp["pr_error"] = err.Error()
+	}
+	for i := range prs {
+		if prs[i].Base != repo.BaseBranch {
+			continue
+		}
+		for _, b := range branches {
+			if b.Name == prs[i].Head {
+				b.PR = &prs[i]
+			}
+		}
+	}
+	writeJSON(w, resp)
+}
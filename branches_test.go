@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestUserSlug(t *testing.T) {
+	tests := []struct {
+		user *User
+		want string
+	}{
+		{nil, "anonymous"},
+		{&User{Name: "alice"}, "alice"},
+		{&User{Name: "a-b"}, "a-b"},
+		{&User{Name: "Alice"}, "alice-3bc510"},
+		{&User{Name: "a.b"}, "a-b-2e7336"},
+		{&User{Name: "alice@example.com", Email: "alice@example.com"}, "alice-example-com-ff8d98"},
+		{&User{Email: "alice@example.com"}, "alice-example-com-ff8d98"},
+		{&User{}, "user"},
+		{&User{Name: "anonymous", Role: RoleViewer, Provider: "anonymous"}, "anonymous"},
+		{&User{Name: "anonymous", Provider: "session"}, "anonymous-2f183a"},
+		{&User{Name: "user"}, "user-04f899"},
+		{&User{Name: "alice-3bc510"}, "alice-3bc510-e5546e"},
+		{&User{Name: "alice-3bc51"}, "alice-3bc51"},
+	}
+	for _, tt := range tests {
+		if got := userSlug(tt.user); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.user, got, tt.want)
+		}
+	}
+
+	// Names that slugify alike still get different slugs.
+	seen := map[string]string{userSlug(nil): "nil"}
+	// Including names that are another user's slug, reserved or hashed.
+	names := []string{"alice", "Alice", "ALICE", "a.b", "a-b", "a_b", "A B", "日本", "中文",
+		"", "anonymous", "user", "alice-3bc510", userSlug(&User{Name: "日本"})}
+	for _, name := range names {
+		slug := userSlug(&User{Name: name})
+		if other, ok := seen[slug]; ok {
+			t.Errorf("%q and %q share the slug %q", name, other, slug)
+		}
+		seen[slug] = name
+	}
+}
+
+func TestEditBranch(t *testing.T) {
+	repo := &Repo{BranchPrefix: defaultBranchPrefix}
+	tests := []struct {
+		topic, want, err string
+	}{
+		{"", "edits/alice", ""},
+		{"March receipts!", "edits/alice--march-receipts", ""},
+		{"???", "", `topic "???" has no letters or digits`},
+	}
+	for _, tt := range tests {
+		got, err := repo.editBranch(&User{Name: "alice"}, tt.topic)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.topic, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.topic, got, err, tt.want)
+		}
+		user, topic, ok := repo.parseEditBranch(got)
+		if !ok || user != "alice" || topic != slugify(tt.topic) {
+			t.Errorf("parseEditBranch(%q) = %q, %q, %v", got, user, topic, ok)
+		}
+	}
+	for _, branch := range []string{"main", "edit", "edits/"} {
+		if _, _, ok := repo.parseEditBranch(branch); ok {
+			t.Errorf("%q parsed as an edit branch", branch)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudflareAccessConfig enables verification of Cloudflare Access JWTs.
+type CloudflareAccessConfig struct {
+	// TeamDomain is e.g. "https://myteam.cloudflareaccess.com". It must match
+	// the token issuer and is used to locate the signing keys.
+	TeamDomain string `json:"team_domain"`
+	// Audience lists the accepted application AUD tags.
+	Audience []string `json:"audience"`
+	// JWKSURL overrides the key set location, by default
+	// <team_domain>/cdn-cgi/access/certs.
+	JWKSURL string `json:"jwks_url"`
+	// JWKSFile loads the key set from a local file instead, for offline
+	// testing.
+	JWKSFile string `json:"jwks_file"`
+	// Roles maps emails to roles. Users not listed get the role of the local
+	// user with the same email, or DefaultRole.
+	Roles       map[string]string `json:"roles"`
+	DefaultRole string            `json:"default_role"`
+	// Optional lets requests without a token fall through to the other
+	// providers. By default they are rejected.
+	Optional bool `json:"optional"`
+}
+
+const (
+	cfAccessHeader = "Cf-Access-Jwt-Assertion"
+	cfAccessCookie = "CF_Authorization"
+	// jwtLeeway allows for clock skew when checking exp and nbf.
+	jwtLeeway = time.Minute
+	// jwksRefreshInterval limits key set refetches triggered by unknown
+	// key ids.
+	jwksRefreshInterval = time.Minute
+	jwksMaxAge          = time.Hour
+)
+
+// cfAccessProvider authenticates requests by the JWT Cloudflare Access adds
+// to every request it lets through.
+type cfAccessProvider struct {
+	cfg         *CloudflareAccessConfig
+	roles       map[string]Role
+	defaultRole Role
+	local       *localUsers
+	keys        *jwks
+}
+
+func newCFAccessProvider(cfg *CloudflareAccessConfig, local *localUsers) (*cfAccessProvider, error) {
+	if cfg.TeamDomain == "" {
+		return nil, fmt.Errorf("auth.cloudflare_access.team_domain is required")
+	}
+	if len(cfg.Audience) == 0 {
+		return nil, fmt.Errorf("auth.cloudflare_access.audience is required")
+	}
+	cfg.TeamDomain = strings.TrimSuffix(cfg.TeamDomain, "/")
+	p := &cfAccessProvider{cfg: cfg, roles: make(map[string]Role), local: local}
+	for email, name := range cfg.Roles {
+		role, err := parseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("auth.cloudflare_access.roles %s: %w", email, err)
+		}
+		p.roles[strings.ToLower(email)] = role
+	}
+	if cfg.DefaultRole != "" {
+		role, err := parseRole(cfg.DefaultRole)
+		if err != nil {
+			return nil, fmt.Errorf("auth.cloudflare_access.default_role: %w", err)
+		}
+		p.defaultRole = role
+	}
+
+	switch {
+	case cfg.JWKSFile != "":
+		p.keys = &jwks{load: func() ([]byte, error) { return os.ReadFile(cfg.JWKSFile) }}
+	default:
+		url := cfg.JWKSURL
+		if url == "" {
+			url = cfg.TeamDomain + "/cdn-cgi/access/certs"
+		}
+		p.keys = &jwks{load: func() ([]byte, error) { return fetchJWKS(url) }}
+	}
+	// Fail at startup rather than on the first request if the keys are
+	// unreachable or malformed.
+	if err := p.keys.refresh(); err != nil {
+		return nil, fmt.Errorf("auth.cloudflare_access: loading keys: %w", err)
+	}
+	return p, nil
+}
+
+func (p *cfAccessProvider) Name() string { return "cloudflare-access" }
+
+func (p *cfAccessProvider) Authenticate(r *http.Request) (*User, error) {
+	token := r.Header.Get(cfAccessHeader)
+	if token == "" {
+		if cookie, err := r.Cookie(cfAccessCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		if p.cfg.Optional {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("missing %s", cfAccessHeader)
+	}
+
+	claims, err := p.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	email := strings.ToLower(claims.Email)
+	if email == "" {
+		// Service tokens carry a common name instead of an email.
+		if claims.CommonName == "" {
+			return nil, fmt.Errorf("token has no identity")
+		}
+		return &User{Name: claims.CommonName, Role: p.roleFor(claims.CommonName)}, nil
+	}
+	return &User{Name: email, Email: email, Role: p.roleFor(email)}, nil
+}
+
+func (p *cfAccessProvider) roleFor(identity string) Role {
+	if role, ok := p.roles[identity]; ok {
+		return role
+	}
+	for name, uc := range p.local.byName {
+		if uc.Email != "" && strings.EqualFold(uc.Email, identity) {
+			return p.local.roles[name]
+		}
+	}
+	return p.defaultRole
+}
+
+// jwtClaims are the Cloudflare Access claims checked by the server.
+type jwtClaims struct {
+	Issuer     string   `json:"iss"`
+	Audience   audience `json:"aud"`
+	Expiry     int64    `json:"exp"`
+	NotBefore  int64    `json:"nbf"`
+	Email      string   `json:"email"`
+	CommonName string   `json:"common_name"`
+}
+
+// audience accepts both forms of the aud claim: a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// verify checks the token signature and its iss, aud, exp and nbf claims.
+func (p *cfAccessProvider) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	key, err := p.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(header.Alg, key, digest[:], sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	if claims.Issuer != p.cfg.TeamDomain {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !audienceMatches(claims.Audience, p.cfg.Audience) {
+		return nil, fmt.Errorf("token audience not accepted")
+	}
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceMatches(got audience, accepted []string) bool {
+	for _, a := range got {
+		for _, b := range accepted {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature supports the algorithms Cloudflare Access may use.
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest, sig []byte) error {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return fmt.Errorf("key type does not match %s", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+// jwks caches a JSON Web Key Set and reloads it when it is stale or a token
+// names an unknown key.
+type jwks struct {
+	load func() ([]byte, error)
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	loaded      time.Time
+	lastAttempt time.Time
+}
+
+func (k *jwks) key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.loaded) > jwksMaxAge
+	if (!ok || stale) && time.Since(k.lastAttempt) > jwksRefreshInterval {
+		if err := k.refreshLocked(); err != nil && !ok {
+			return nil, fmt.Errorf("loading keys: %w", err)
+		}
+		key, ok = k.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (k *jwks) refresh() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.refreshLocked()
+}
+
+func (k *jwks) refreshLocked() error {
+	k.lastAttempt = time.Now()
+	data, err := k.load()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	k.loaded = time.Now()
+	return nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseJWKS decodes the RSA and P-256 keys of a key set, indexed by key id.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		switch jwk.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid EC key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in key set")
+	}
+	return keys, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTeamDomain = "https://team.cloudflareaccess.com"
+
+var b64 = base64.RawURLEncoding
+
+// testKeys are the signing keys of the fake Cloudflare Access.
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func (k *testKeys) jwks() []byte {
+	pad := func(b []byte) []byte { return append(make([]byte, 32-len(b)), b...) }
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kid": "rsa1", "kty": "RSA", "n": b64.EncodeToString(k.rsa.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kid": "ec1", "kty": "EC", "crv": "P-256", "x": b64.EncodeToString(pad(k.ec.X.Bytes())), "y": b64.EncodeToString(pad(k.ec.Y.Bytes()))},
+		{"kid": "ec384", "kty": "EC", "crv": "P-384", "x": "AA", "y": "AA"},
+	}})
+	return data
+}
+
+// sign returns a JWT with the claims, signed with the key named by kid.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64.EncodeToString(sig)
+}
+
+func TestCFAccessVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(keys.jwks())
+	}))
+	defer srv.Close()
+
+	local, err := newLocalUsers([]UserConfig{{Name: "alice", Email: "Alice@example.com", Role: "maintainer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newCFAccessProvider(&CloudflareAccessConfig{
+		TeamDomain:  testTeamDomain + "/",
+		Audience:    []string{"aud1"},
+		JWKSURL:     srv.URL,
+		Roles:       map[string]string{"bob@example.com": "editor"},
+		DefaultRole: "viewer",
+	}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Errorf("keys fetched %d times at startup, want 1", fetches)
+	}
+
+	now := time.Now()
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": testTeamDomain, "aud": []string{"aud1"}, "exp": now.Add(time.Hour).Unix(), "email": "bob@example.com"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"rsa", keys.sign(t, "RS256", "rsa1", claims(nil)), ""},
+		{"ec", keys.sign(t, "ES256", "ec1", claims(nil)), ""},
+		{"audience string", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["aud"] = "aud1" })), ""},
+		{"expired within leeway", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() })), ""},
+		{"expired", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() })), "token expired"},
+		{"no expiry", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { delete(c, "exp") })), "token expired"},
+		{"not yet valid", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() })), "not yet valid"},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), "unexpected issuer"},
+		{"wrong audience", keys.sign(t, "RS256", "rsa1", claims(func(c map[string]any) { c["aud"] = []string{"other"} })), "audience"},
+		{"unknown key", keys.sign(t, "RS256", "nope", claims(nil)), "unknown signing key"},
+		{"algorithm mismatch", keys.sign(t, "RS256", "ec1", claims(nil)), "does not match"},
+		{"unsupported algorithm", keys.sign(t, "HS256", "rsa1", claims(nil)), "unsupported"},
+		{"malformed", "abc.def", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.verify(tt.token, now)
+			if tt.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	// A tampered payload fails the signature check.
+	token := keys.sign(t, "RS256", "rsa1", claims(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims(func(c map[string]any) { c["email"] = "admin@example.com" }))
+	parts[1] = b64.EncodeToString(forged)
+	if _, err := p.verify(strings.Join(parts, "."), now); err == nil || !strings.Contains(err.Error(), "invalid token signature") {
+		t.Errorf("forged token: got %v", err)
+	}
+
+	users := []struct {
+		email string
+		role  Role
+	}{
+		{"bob@example.com", RoleEditor},
+		{"alice@example.com", RoleMaintainer},
+		{"carol@example.com", RoleViewer},
+	}
+	for _, u := range users {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(cfAccessHeader, keys.sign(t, "ES256", "ec1", claims(func(c map[string]any) { c["email"] = u.email })))
+		user, err := p.Authenticate(r)
+		if err != nil {
+			t.Fatalf("%s: %v", u.email, err)
+		}
+		if user.Email != u.email || user.Role != u.role {
+			t.Errorf("%s: got %+v, want role %v", u.email, user, u.role)
+		}
+	}
+
+	if _, err := p.Authenticate(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Error("a request without a token was accepted")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys := newTestKeys(t)
+	parsed, err := parseJWKS(keys.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 {
+		t.Errorf("got %d keys, want 2 (the P-384 key is skipped)", len(parsed))
+	}
+	if pub, ok := parsed["rsa1"].(*rsa.PublicKey); !ok || !pub.Equal(&keys.rsa.PublicKey) {
+		t.Errorf("rsa1 is %v", parsed["rsa1"])
+	}
+	if pub, ok := parsed["ec1"].(*ecdsa.PublicKey); !ok || !pub.Equal(&keys.ec.PublicKey) {
+		t.Errorf("ec1 is %v", parsed["ec1"])
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kid": "k", "kty": "RSA", "n": "!!", "e": "AQAB"}]}`,
+		`{"keys": [{"kid": "k", "kty": "RSA", "n": "AQAB", "e": "AQABAQAB"}]}`,
+	} {
+		if _, err := parseJWKS([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
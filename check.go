@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mainFilePlaceholder in a check command is replaced with the repository's
+// main beancount file.
+const mainFilePlaceholder = "{main_file}"
+
+// defaultChecks run before every commit unless a repository configures its
+// own.
+var defaultChecks = [][]string{{"bean-check", mainFilePlaceholder}}
+
+// CheckProblem is one error reported by a check command. File is relative to
+// the repository and empty, with Line zero, if the output didn't name one.
+type CheckProblem struct {
+	Check   string `json:"check"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+	// Detail holds the indented lines following the message, such as the
+	// offending transaction.
+	Detail string `json:"detail,omitempty"`
+}
+
+func (p CheckProblem) String() string {
+	if p.File == "" {
+		return p.Check + ": " + p.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// CheckError blocks a commit whose ledger fails the checks.
+type CheckError struct {
+	Problems []CheckProblem
+}
+
+func (e *CheckError) Error() string {
+	lines := []string{"The ledger failed its checks:"}
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *CheckError) HTTPStatus() int { return http.StatusUnprocessableEntity }
+
+// problemLine matches "file:line: message" and "file:line:column: message".
+var problemLine = regexp.MustCompile(`^(.+?):(\d+):(?:\d+:)?\s*(.*)$`)
+
+// parseCheckOutput turns the output of a failed check into problems. Paths
+// are made relative to dir, where the check ran.
+func parseCheckOutput(check, dir, out string) []CheckProblem {
+	var problems []CheckProblem
+	for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			if n := len(problems); n > 0 && (line != "" || problems[n-1].Detail != "") {
+				problems[n-1].Detail += strings.TrimRight(line, " \t") + "\n"
+			}
+			continue
+		}
+		p := CheckProblem{Check: check, Message: line}
+		if m := problemLine.FindStringSubmatch(line); m != nil {
+			file := m[1]
+			if rel, err := filepath.Rel(dir, file); err == nil && filepath.IsAbs(file) && filepath.IsLocal(rel) {
+				file = rel
+			}
+			p.File = filepath.ToSlash(file)
+			p.Line, _ = strconv.Atoi(m[2])
+			p.Message = m[3]
+		}
+		problems = append(problems, p)
+	}
+	for i := range problems {
+		problems[i].Detail = strings.Trim(problems[i].Detail, "\n")
+	}
+	return problems
+}
+
+// runChecks runs the checks of repo in dir, a checkout of the repository, and
+// returns the problems of those that fail. An error means a check couldn't
+// be judged, e.g. because it timed out or the request was canceled.
+func runChecks(ctx context.Context, repo *Repo, dir string) ([]CheckProblem, error) {
+	problems := []CheckProblem{}
+	for _, argv := range repo.Checks {
+		args := make([]string, len(argv))
+		for i, arg := range argv {
+			args[i] = strings.ReplaceAll(arg, mainFilePlaceholder, repo.MainFile)
+		}
+		name := argv[0]
+		reportStep(ctx, "Running "+strings.Join(args, " "))
+		out, stderr, err := runCommand(ctx, dir, args[0], args[1:]...)
+		if err == nil {
+			continue
+		}
+		var timeout *TimeoutError
+		if ctx.Err() != nil || errors.As(err, &timeout) {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		found := parseCheckOutput(name, dir, out+stderr)
+		if len(found) == 0 {
+			found = []CheckProblem{{Check: name, Message: err.Error()}}
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+// checkIndex runs the checks on the staged content, which is what a commit
+// would contain, by exporting the index to a temporary directory.
+func checkIndex(ctx context.Context, repo *Repo) ([]CheckProblem, error) {
+	tmp, err := os.MkdirTemp("", "git-commands-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if out, err := repo.runGit(ctx, "checkout-index", "--all", "--prefix="+tmp+string(filepath.Separator)); err != nil {
+		return nil, gitStepError("Failed to export the staged files", out, err)
+	}
+	return runChecks(ctx, repo, tmp)
+}
+
+// apiCheckHandler: GET /api/check runs the ledger checks on the working tree,
+// or on the staged files with cached=1, and lists the problems found.
+func apiCheckHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	// Exporting the index takes the lock exclusively.
+	cached := r.URL.Query().Get("cached") == "1"
+	ctx, release, err := repo.lock.acquire(r.Context(), cached, "check ledger")
+	if err != nil {
+		http.Error(w, "Failed to check the ledger: "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+	var problems []CheckProblem
+	if cached {
+		problems, err = checkIndex(ctx, repo)
+	} else {
+		problems, err = runChecks(ctx, repo, repo.Path)
+	}
+	if err != nil {
+		http.Error(w, "Failed to check the ledger: "+err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, map[string]any{"ok": len(problems) == 0, "problems": problems})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseCheckOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []CheckProblem
+	}{
+		{
+			"bean-check",
+			"/srv/ledger/2025/main.bean:12:      Transaction does not balance: (1.00 USD)\n\n" +
+				"   2025-01-02 * \"Coffee\"\n     Expenses:Food  4.00 USD  \n     Assets:Cash  -3.00 USD\n\n" +
+				"/srv/ledger/accounts.bean:3: Invalid account name\n",
+			[]CheckProblem{
+				{Check: "bean-check", File: "2025/main.bean", Line: 12, Message: "Transaction does not balance: (1.00 USD)",
+					Detail: "   2025-01-02 * \"Coffee\"\n     Expenses:Food  4.00 USD\n     Assets:Cash  -3.00 USD"},
+				{Check: "bean-check", File: "accounts.bean", Line: 3, Message: "Invalid account name"},
+			},
+		},
+		{
+			"column and relative path",
+			"main.bean:4:7: syntax error\n",
+			[]CheckProblem{{Check: "bean-check", File: "main.bean", Line: 4, Message: "syntax error"}},
+		},
+		{
+			"outside the checkout",
+			"/etc/other.bean:1: error\n",
+			[]CheckProblem{{Check: "bean-check", File: "/etc/other.bean", Line: 1, Message: "error"}},
+		},
+		{
+			"no location",
+			"Error: file not found\n  main.bean\n",
+			[]CheckProblem{{Check: "bean-check", Message: "Error: file not found", Detail: "  main.bean"}},
+		},
+		{"empty", "", nil},
+		{"leading detail is dropped", "   stray\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCheckOutput("bean-check", "/srv/ledger", tt.out)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckErrorMessage(t *testing.T) {
+	err := &CheckError{Problems: []CheckProblem{
+		{Check: "bean-check", File: "main.bean", Line: 3, Message: "bad"},
+		{Check: "lint", Message: "failed"},
+	}}
+	if got, want := err.Error(), "The ledger failed its checks:\nmain.bean:3: bad\nlint: failed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunChecks(t *testing.T) {
+	dir := t.TempDir()
+	repo := &Repo{MainFile: "main.bean", Checks: [][]string{
+		{"true", mainFilePlaceholder},
+		{"sh", "-c", "echo \"$0:2: unbalanced\"; exit 1", mainFilePlaceholder},
+		{"sh", "-c", "echo oops >&2; exit 3"},
+		{"sh", "-c", "exit 1"},
+	}}
+	problems, err := runChecks(context.Background(), repo, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CheckProblem{
+		{Check: "sh", File: "main.bean", Line: 2, Message: "unbalanced"},
+		{Check: "sh", Message: "oops"},
+		{Check: "sh", Message: "exit status 1"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got %+v\nwant %+v", problems, want)
+	}
+}
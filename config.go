@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is the server configuration loaded from the JSON file given by the
+// -config flag (or the GIT_COMMANDS_CONFIG env variable). Every section is
+// optional; missing sections fall back to built-in defaults.
+type Config struct {
+	Policy *PolicyConfig `json:"policy"`
+	Repos  []RepoConfig  `json:"repos"`
+	Auth   *AuthConfig   `json:"auth"`
+	Audit  *AuditConfig  `json:"audit"`
+	Jobs   *JobsConfig   `json:"jobs"`
+	// Worktrees gives every editor a worktree of their own. Disabled unless
+	// the section is present.
+	Worktrees *WorktreesConfig `json:"worktrees"`
+	// Health runs ledger health checks on a schedule and after pulls.
+	// Disabled unless the section is present.
+	Health *HealthConfig `json:"health"`
+	// LockTimeout is how long a request waits for a repository that is busy
+	// with another operation, e.g. "30s".
+	LockTimeout string `json:"lock_timeout"`
+	// CommandTimeouts limits how long external commands may run, keyed by
+	// command and optional subcommand, e.g. {"git push": "1m"}.
+	CommandTimeouts map[string]string `json:"command_timeouts"`
+	// DataDir holds the files the server writes, such as the audit log.
+	// Defaults to ~/.git-commands.
+	DataDir string `json:"data_dir"`
+}
+
+func getConfigPath() string {
+	if path, exists := os.LookupEnv("GIT_COMMANDS_CONFIG"); exists {
+		return path
+	}
+	return ""
+}
+
+// dataDir returns the configured data directory or the default one.
+func (c *Config) dataDir() string {
+	if c.DataDir != "" {
+		return c.DataDir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".git-commands"
+	}
+	return filepath.Join(home, ".git-commands")
+}
+
+func (c *Config) lockTimeout() (time.Duration, error) {
+	if c.LockTimeout == "" {
+		return defaultLockTimeout, nil
+	}
+	d, err := time.ParseDuration(c.LockTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("lock_timeout: %w", err)
+	}
+	return d, nil
+}
+
+func (c *Config) jobsDir() string {
+	return filepath.Join(c.dataDir(), "jobs")
+}
+
+func (c *Config) worktreesDir() string {
+	return filepath.Join(c.dataDir(), "worktrees")
+}
+
+func (c *Config) healthDir() string {
+	return filepath.Join(c.dataDir(), "health")
+}
+
+func (c *Config) historyDir() string {
+	return filepath.Join(c.dataDir(), "history")
+}
+
+func (c *Config) auditPath() string {
+	if c.Audit != nil && c.Audit.Path != "" {
+		return c.Audit.Path
+	}
+	return filepath.Join(c.dataDir(), "audit.jsonl")
+}
+
+// loadConfig reads the config file at path. An empty path yields the default
+// configuration.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictError is returned by createPR when a merge stops on conflicts and
+// the caller asked to keep them for resolution.
+type ConflictError struct {
+	Ref   string
+	Files []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Merging %s stopped on conflicts in: %s\nResolve them, complete the merge, then create the PR again.",
+		e.Ref, strings.Join(e.Files, ", "))
+}
+
+func (e *ConflictError) HTTPStatus() int { return http.StatusConflict }
+
+// conflictMarkerSize makes the markers merge-file writes long enough that
+// ledger content is never mistaken for them.
+const conflictMarkerSize = 20
+
+var (
+	markerOurs   = strings.Repeat("<", conflictMarkerSize) + " ours"
+	markerBase   = strings.Repeat("|", conflictMarkerSize) + " base"
+	markerSep    = strings.Repeat("=", conflictMarkerSize)
+	markerTheirs = strings.Repeat(">", conflictMarkerSize) + " theirs"
+)
+
+// ConflictHunk is one conflicting region with the three versions of it.
+type ConflictHunk struct {
+	Ours   string `json:"ours"`
+	Base   string `json:"base"`
+	Theirs string `json:"theirs"`
+}
+
+// MergeSegment is either text both sides agree on or a conflict hunk.
+type MergeSegment struct {
+	Text     string        `json:"text,omitempty"`
+	Conflict *ConflictHunk `json:"conflict,omitempty"`
+}
+
+// ConflictedFile is an unmerged path. Text conflicts are split into
+// segments; for binary files and modify/delete conflicts only a whole side
+// can be chosen. A path deleted on both sides has neither side and can
+// only be deleted.
+type ConflictedFile struct {
+	Path string `json:"path"`
+	// Kind is "text", "binary" or "delete".
+	Kind      string         `json:"kind"`
+	HasOurs   bool           `json:"has_ours"`
+	HasTheirs bool           `json:"has_theirs"`
+	Segments  []MergeSegment `json:"segments,omitempty"`
+	// Hunks is the number of conflict segments.
+	Hunks int `json:"hunks"`
+}
+
+// MergeState describes an in-progress merge.
+type MergeState struct {
+	Merging   bool             `json:"merging"`
+	MergeHead string           `json:"merge_head,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	Files     []ConflictedFile `json:"files"`
+}
+
+// conflictedPaths lists the unmerged paths of the index.
+func conflictedPaths(ctx context.Context, repo *Repo) ([]string, error) {
+	out, err := repo.runGit(ctx, "diff", "--name-only", "--diff-filter=U", "-z")
+	if err != nil {
+		return nil, gitStepError("Failed to list conflicts", out, err)
+	}
+	var paths []string
+	for _, p := range strings.Split(out, "\x00") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// mergeState reads the merge in progress and its conflicted files.
+func mergeState(ctx context.Context, repo *Repo) (*MergeState, error) {
+	st := &MergeState{Files: []ConflictedFile{}}
+	out, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "MERGE_HEAD")
+	if err != nil {
+		return st, nil
+	}
+	st.Merging = true
+	st.MergeHead = strings.TrimSpace(out)
+	if msgPath, err := repo.runGit(ctx, "rev-parse", "--git-path", "MERGE_MSG"); err == nil {
+		msgPath = strings.TrimSpace(msgPath)
+		if !filepath.IsAbs(msgPath) {
+			msgPath = filepath.Join(repo.Path, msgPath)
+		}
+		if msg, err := os.ReadFile(msgPath); err == nil {
+			st.Message = strings.TrimSpace(string(msg))
+		}
+	}
+
+	paths, err := conflictedPaths(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		f, err := readConflict(ctx, repo, path)
+		if err != nil {
+			return nil, err
+		}
+		st.Files = append(st.Files, *f)
+	}
+	return st, nil
+}
+
+// conflictStages returns the base (1), ours (2) and theirs (3) blobs of an
+// unmerged path. Missing stages have empty ids.
+func conflictStages(ctx context.Context, repo *Repo, path string) ([4]string, error) {
+	var stages [4]string
+	out, err := repo.runGit(ctx, "ls-files", "--unmerged", "-z", "--", path)
+	if err != nil {
+		return stages, gitStepError("Failed to read conflict stages", out, err)
+	}
+	for _, rec := range strings.Split(out, "\x00") {
+		// <mode> <object> <stage>\t<path>
+		info, _, ok := strings.Cut(rec, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 || len(fields[2]) != 1 {
+			continue
+		}
+		stage := fields[2][0] - '0'
+		if stage >= 1 && stage <= 3 {
+			stages[stage] = fields[1]
+		}
+	}
+	return stages, nil
+}
+
+func readBlob(ctx context.Context, repo *Repo, id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	out, err := repo.runGit(ctx, "cat-file", "blob", id)
+	if err != nil {
+		return "", gitStepError("Failed to read "+id, out, err)
+	}
+	return out, nil
+}
+
+func readConflict(ctx context.Context, repo *Repo, path string) (*ConflictedFile, error) {
+	stages, err := conflictStages(ctx, repo, path)
+	if err != nil {
+		return nil, err
+	}
+	if stages == [4]string{} {
+		return nil, fmt.Errorf("%s is not conflicted", path)
+	}
+	f := &ConflictedFile{Path: path, HasOurs: stages[2] != "", HasTheirs: stages[3] != ""}
+	if !f.HasOurs || !f.HasTheirs {
+		f.Kind = "delete"
+		return f, nil
+	}
+	var versions [4]string
+	for i := 1; i <= 3; i++ {
+		if versions[i], err = readBlob(ctx, repo, stages[i]); err != nil {
+			return nil, err
+		}
+		if strings.ContainsRune(versions[i], 0) {
+			f.Kind = "binary"
+			return f, nil
+		}
+	}
+	f.Kind = "text"
+	merged, err := mergeFile(ctx, versions[2], versions[1], versions[3])
+	if err != nil {
+		return nil, err
+	}
+	f.Segments = parseMergeSegments(merged)
+	for _, s := range f.Segments {
+		if s.Conflict != nil {
+			f.Hunks++
+		}
+	}
+	return f, nil
+}
+
+// mergeFile runs a diff3 style three-way merge and returns the result with
+// conflict markers.
+func mergeFile(ctx context.Context, ours, base, theirs string) (string, error) {
+	tmp, err := os.MkdirTemp("", "git-commands-merge")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	files := []string{filepath.Join(tmp, "ours"), filepath.Join(tmp, "base"), filepath.Join(tmp, "theirs")}
+	for i, content := range []string{ours, base, theirs} {
+		if err := os.WriteFile(files[i], []byte(content), 0o600); err != nil {
+			return "", err
+		}
+	}
+	out, stderr, err := runCommand(ctx, tmp, "git", "merge-file", "-p", "--diff3",
+		fmt.Sprintf("--marker-size=%d", conflictMarkerSize),
+		"-L", "ours", "-L", "base", "-L", "theirs", files[0], files[1], files[2])
+	// merge-file exits with the number of conflicts; only negative
+	// statuses (shown as 255 and above 127) are errors.
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || exitErr.ExitCode() > 127) {
+		return "", gitStepError("Failed to merge file", stderr, err)
+	}
+	return out, nil
+}
+
+// parseMergeSegments splits merge-file output at its conflict markers.
+func parseMergeSegments(merged string) []MergeSegment {
+	var segments []MergeSegment
+	var text strings.Builder
+	var hunk *ConflictHunk
+	// section is where lines of the current hunk go.
+	var section *string
+	for _, line := range strings.SplitAfter(merged, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case hunk == nil && trimmed == markerOurs:
+			if text.Len() > 0 {
+				segments = append(segments, MergeSegment{Text: text.String()})
+				text.Reset()
+			}
+			hunk = &ConflictHunk{}
+			section = &hunk.Ours
+		case hunk != nil && trimmed == markerBase:
+			section = &hunk.Base
+		case hunk != nil && trimmed == markerSep:
+			section = &hunk.Theirs
+		case hunk != nil && trimmed == markerTheirs:
+			segments = append(segments, MergeSegment{Conflict: hunk})
+			hunk, section = nil, nil
+		case hunk != nil:
+			*section += line
+		default:
+			text.WriteString(line)
+		}
+	}
+	if text.Len() > 0 {
+		segments = append(segments, MergeSegment{Text: text.String()})
+	}
+	return segments
+}
+
+// resolveSegments joins the segments, taking the chosen side of each
+// conflict: "ours", "theirs", "base", "both" (ours then theirs) or
+// "both-theirs-first".
+func resolveSegments(segments []MergeSegment, choices []string) (string, error) {
+	var b strings.Builder
+	i := 0
+	for _, s := range segments {
+		if s.Conflict == nil {
+			b.WriteString(s.Text)
+			continue
+		}
+		if i >= len(choices) {
+			return "", fmt.Errorf("no choice given for conflict %d", i+1)
+		}
+		h := s.Conflict
+		switch choices[i] {
+		case "ours":
+			b.WriteString(h.Ours)
+		case "theirs":
+			b.WriteString(h.Theirs)
+		case "base":
+			b.WriteString(h.Base)
+		case "both":
+			b.WriteString(joinLines(h.Ours, h.Theirs))
+		case "both-theirs-first":
+			b.WriteString(joinLines(h.Theirs, h.Ours))
+		default:
+			return "", fmt.Errorf("unknown choice %q for conflict %d", choices[i], i+1)
+		}
+		i++
+	}
+	if i != len(choices) {
+		return "", fmt.Errorf("got %d choices for %d conflicts", len(choices), i)
+	}
+	return b.String(), nil
+}
+
+// joinLines concatenates two blocks of lines, making sure the first ends
+// with a newline.
+func joinLines(a, b string) string {
+	if a != "" && !strings.HasSuffix(a, "\n") {
+		a += "\n"
+	}
+	return a + b
+}
+
+// conflictsHandler: GET /git/conflicts lists the conflicted files of the
+// merge in progress.
+func conflictsHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	st, err := mergeState(r.Context(), repo)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, st)
+}
+
+// ConflictResolution is the body of POST /git/conflicts/resolve. Either
+// Choices (one per conflict hunk, for text files) or Side ("ours" or
+// "theirs", for the whole file) must be set.
+type ConflictResolution struct {
+	Path    string   `json:"path"`
+	Choices []string `json:"choices"`
+	Side    string   `json:"side"`
+}
+
+// resolveConflictHandler: POST /git/conflicts/resolve writes the chosen
+// version of a conflicted file and stages it.
+func resolveConflictHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	var res ConflictResolution
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Path == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	ctx, release, err := repo.lock.acquire(r.Context(), true, "resolve conflict")
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	if err := resolveConflict(ctx, repo, &res); err != nil {
+		status := http.StatusBadRequest
+		if s := errorStatus(err); s != http.StatusInternalServerError {
+			status = s
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	st, err := mergeState(ctx, repo)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, st)
+}
+
+func resolveConflict(ctx context.Context, repo *Repo, res *ConflictResolution) error {
+	full, err := repoFilePath(repo.Path, res.Path)
+	if err != nil {
+		return err
+	}
+	f, err := readConflict(ctx, repo, res.Path)
+	if err != nil {
+		return err
+	}
+	if !f.HasOurs && !f.HasTheirs {
+		// Deleted on both sides, e.g. after both renamed it differently.
+		out, err := repo.runGit(ctx, "rm", "--quiet", "--cached", "--", res.Path)
+		return gitErrorOrNil("Failed to remove "+res.Path, out, err)
+	}
+
+	if res.Side != "" {
+		var keep bool
+		switch res.Side {
+		case "ours":
+			keep = f.HasOurs
+		case "theirs":
+			keep = f.HasTheirs
+		default:
+			return fmt.Errorf("unknown side %q", res.Side)
+		}
+		if !keep {
+			out, err := repo.runGit(ctx, "rm", "--quiet", "--", res.Path)
+			return gitErrorOrNil("Failed to remove "+res.Path, out, err)
+		}
+		out, err := repo.runGit(ctx, "checkout", "--"+res.Side, "--", res.Path)
+		if err != nil {
+			return gitStepError("Failed to check out "+res.Side, out, err)
+		}
+		out, err = repo.runGit(ctx, "add", "--", res.Path)
+		return gitErrorOrNil("Failed to stage "+res.Path, out, err)
+	}
+
+	if f.Kind != "text" {
+		return fmt.Errorf("%s is a %s conflict; choose a side for the whole file", res.Path, f.Kind)
+	}
+	content, err := resolveSegments(f.Segments, res.Choices)
+	if err != nil {
+		return fmt.Errorf("%s: %w (reload the conflicts and try again)", res.Path, err)
+	}
+	// Keep the mode of the file, such as its executable bit.
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(full); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(full, []byte(content), mode); err != nil {
+		return err
+	}
+	out, err := repo.runGit(ctx, "add", "--", res.Path)
+	return gitErrorOrNil("Failed to stage "+res.Path, out, err)
+}
+
+func gitErrorOrNil(step, out string, err error) error {
+	if err != nil {
+		return gitStepError(step, out, err)
+	}
+	return nil
+}
+
+// repoFilePath joins a repository-relative path to root, refusing paths
+// that escape it.
+func repoFilePath(root, rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+// completeMergeHandler: POST /git/conflicts/commit creates the merge commit
+// once every conflict is resolved.
+func completeMergeHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	ctx, release, err := repo.lock.acquire(r.Context(), true, "complete merge")
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	if _, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "MERGE_HEAD"); err != nil {
+		http.Error(w, "No merge in progress", http.StatusBadRequest)
+		return
+	}
+	paths, err := conflictedPaths(ctx, repo)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if len(paths) > 0 {
+		http.Error(w, "Unresolved conflicts in: "+strings.Join(paths, ", "), http.StatusConflict)
+		return
+	}
+	args := append([]string{"commit", "--no-edit"}, authorArgs(currentUser(ctx))...)
+	out, err := repo.runGit(ctx, args...)
+	if err != nil {
+		http.Error(w, gitStepError("Failed to commit merge", out, err).Error(), errorStatus(err))
+		return
+	}
+	w.Write([]byte(out))
+}
+
+// abortMergeHandler: POST /git/conflicts/abort abandons the merge.
+func abortMergeHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	out, err := repo.runGit(r.Context(), "merge", "--abort")
+	if err != nil {
+		http.Error(w, gitStepError("Failed to abort merge", out, err).Error(), errorStatus(err))
+		return
+	}
+	w.Write([]byte("Merge aborted"))
+}
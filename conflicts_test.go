@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// conflict builds merge-file output for one hunk.
+func conflict(ours, base, theirs string) string {
+	return markerOurs + "\n" + ours + markerBase + "\n" + base + markerSep + "\n" + theirs + markerTheirs + "\n"
+}
+
+func TestParseMergeSegments(t *testing.T) {
+	tests := []struct {
+		name   string
+		merged string
+		want   []MergeSegment
+	}{
+		{"no conflicts", "a\nb\n", []MergeSegment{{Text: "a\nb\n"}}},
+		{"empty", "", nil},
+		{
+			"one conflict",
+			"head\n" + conflict("ours\n", "base\n", "theirs\n") + "tail\n",
+			[]MergeSegment{
+				{Text: "head\n"},
+				{Conflict: &ConflictHunk{Ours: "ours\n", Base: "base\n", Theirs: "theirs\n"}},
+				{Text: "tail\n"},
+			},
+		},
+		{
+			"adjacent conflicts and an empty side",
+			conflict("o1\no2\n", "", "t1\n") + conflict("", "b\n", "t2\n"),
+			[]MergeSegment{
+				{Conflict: &ConflictHunk{Ours: "o1\no2\n", Theirs: "t1\n"}},
+				{Conflict: &ConflictHunk{Base: "b\n", Theirs: "t2\n"}},
+			},
+		},
+		{
+			"short markers are content",
+			"<<<<<<< ours\n=======\n>>>>>>> theirs\n",
+			[]MergeSegment{{Text: "<<<<<<< ours\n=======\n>>>>>>> theirs\n"}},
+		},
+		{
+			"CRLF",
+			strings.ReplaceAll("x\n"+conflict("o\n", "b\n", "t\n"), "\n", "\r\n"),
+			[]MergeSegment{
+				{Text: "x\r\n"},
+				{Conflict: &ConflictHunk{Ours: "o\r\n", Base: "b\r\n", Theirs: "t\r\n"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMergeSegments(tt.merged)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSegments(t *testing.T) {
+	segments := []MergeSegment{
+		{Text: "head\n"},
+		{Conflict: &ConflictHunk{Ours: "ours", Base: "base\n", Theirs: "theirs\n"}},
+		{Text: "middle\n"},
+		{Conflict: &ConflictHunk{Ours: "o2\n", Base: "", Theirs: "t2\n"}},
+	}
+	tests := []struct {
+		choices []string
+		want    string
+		err     string
+	}{
+		{[]string{"ours", "theirs"}, "head\noursmiddle\nt2\n", ""},
+		{[]string{"base", "base"}, "head\nbase\nmiddle\n", ""},
+		{[]string{"both", "both"}, "head\nours\ntheirs\nmiddle\no2\nt2\n", ""},
+		{[]string{"both-theirs-first", "theirs"}, "head\ntheirs\noursmiddle\nt2\n", ""},
+		{[]string{"ours"}, "", "no choice given for conflict 2"},
+		{[]string{"ours", "theirs", "ours"}, "", "got 3 choices for 2 conflicts"},
+		{[]string{"mine", "ours"}, "", `unknown choice "mine" for conflict 1`},
+	}
+	for _, tt := range tests {
+		got, err := resolveSegments(segments, tt.choices)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v: got error %v, want %q", tt.choices, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.choices, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"* * * * *", ""},
+		{"30 6 * * 1-5", ""},
+		{"*/15 0-6,18-23 1,15 */2 7", ""},
+		{"5-50/5 * * * *", ""},
+		{"@daily", ""},
+		{"@every 30m", ""},
+		{"@every 30s", "at least 1m"},
+		{"@every soon", "at least 1m"},
+		{"@fortnightly", "expected 5 fields"},
+		{"* * * *", "expected 5 fields"},
+		{"60 * * * *", "out of range"},
+		{"* 24 * * *", "out of range"},
+		{"* * 0 * *", "out of range"},
+		{"* * * 13 *", "out of range"},
+		{"* * * * 8", "out of range"},
+		{"* * * * 5-1", "out of range"},
+		{"*/0 * * * *", "invalid step"},
+		{"*/x * * * *", "invalid step"},
+		{"a * * * *", "invalid value"},
+		{"1-b * * * *", "invalid value"},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.spec)
+		if tt.err == "" && err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q: got %v, want an error containing %q", tt.spec, err, tt.err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	kathmandu := time.FixedZone("NPT", 5*3600+45*60)
+	// 2025-01-15 is a Wednesday.
+	from := time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2025, 1, 15, 10, 21, 0, 0, time.UTC)},
+		{"30 6 * * *", from, time.Date(2025, 1, 16, 6, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 1, 17, 12, 0, 0, 0, time.UTC), time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2025, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		{"0 0 1 * 5", from, time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", from, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * *", time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC), time.Date(2025, 1, 16, 12, 0, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2025, 1, 15, 10, 20, 0, 0, kathmandu), time.Date(2025, 1, 16, 6, 0, 0, 0, kathmandu)},
+		{"@every 90m", from, from.Add(90 * time.Minute)},
+		{"0 0 30 2 *", from, time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q from %v: got %v, want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DiffLine is one line of a hunk with its line numbers in the old and new
+// file, zero where the line doesn't exist on that side.
+type DiffLine struct {
+	// Type is "context", "add", "delete" or "note" for git's
+	// "\ No newline at end of file".
+	Type string `json:"type"`
+	Old  int    `json:"old,omitempty"`
+	New  int    `json:"new,omitempty"`
+	Text string `json:"text"`
+}
+
+// Hunk is a hunk of a file diff.
+type Hunk struct {
+	// Header is the "@@ -a,b +c,d @@" line.
+	Header   string `json:"header"`
+	OldStart int    `json:"old_start"`
+	OldLines int    `json:"old_lines"`
+	NewStart int    `json:"new_start"`
+	NewLines int    `json:"new_lines"`
+	// Section is the function context git shows after the line numbers.
+	Section string     `json:"section,omitempty"`
+	Lines   []DiffLine `json:"lines"`
+}
+
+// rawLines returns the hunk's lines as they appear in a patch.
+func (h *Hunk) rawLines() []string {
+	prefix := map[string]string{"context": " ", "add": "+", "delete": "-", "note": "\\"}
+	lines := make([]string, len(h.Lines))
+	for i, l := range h.Lines {
+		lines[i] = prefix[l.Type] + l.Text
+	}
+	return lines
+}
+
+// FileDiff is the diff of one file.
+type FileDiff struct {
+	OldPath string `json:"old_path"`
+	NewPath string `json:"new_path"`
+	// Status is "modified", "added", "deleted", "renamed", "copied",
+	// "mode changed" or "conflicted". Conflicted files have no hunks; they
+	// are resolved through /git/conflicts.
+	Status    string  `json:"status"`
+	Binary    bool    `json:"binary"`
+	Additions int     `json:"additions"`
+	Deletions int     `json:"deletions"`
+	Hunks     []*Hunk `json:"hunks"`
+
+	// header holds the lines before the first hunk, needed to turn hunks
+	// back into a patch.
+	header []string
+}
+
+// Path is the file's current path, or its old one if it was deleted.
+func (f *FileDiff) Path() string {
+	if f.Status == "deleted" {
+		return f.OldPath
+	}
+	return f.NewPath
+}
+
+// diffPatchArgs are the options every parsed diff is produced with. The
+// prefixes are fixed so user config can't change the headers.
+var diffPatchArgs = []string{"--no-color", "--no-ext-diff", "--src-prefix=a/", "--dst-prefix=b/"}
+
+// parseDiff parses the output of `git diff` run with diffPatchArgs.
+func parseDiff(out string) ([]*FileDiff, error) {
+	files := []*FileDiff{}
+	var file *FileDiff
+	var hunk *Hunk
+	var oldLine, newLine int
+	lines := strings.Split(out, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "diff --git "); ok {
+			oldPath, newPath, err := parseDiffGitPaths(rest)
+			if err != nil {
+				return nil, err
+			}
+			file = &FileDiff{OldPath: oldPath, NewPath: newPath, Status: "modified", Hunks: []*Hunk{}, header: []string{line}}
+			files = append(files, file)
+			hunk = nil
+			continue
+		}
+		// During a merge, conflicted files are shown as combined diffs,
+		// with a column per side, or only named if there is no content to
+		// combine, as when one side deleted the file.
+		if rest, ok := strings.CutPrefix(line, "diff --cc "); ok {
+			file = conflictedFile(rest)
+			files = append(files, file)
+			hunk = nil
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "* Unmerged path "); ok {
+			files = append(files, conflictedFile(rest))
+			file, hunk = nil, nil
+			continue
+		}
+		if file == nil || file.Status == "conflicted" {
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			h, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			hunk = h
+			oldLine, newLine = h.OldStart, h.NewStart
+			file.Hunks = append(file.Hunks, hunk)
+			continue
+		}
+		if hunk == nil {
+			parseDiffHeaderLine(file, line)
+			file.header = append(file.header, line)
+			continue
+		}
+		if line == "" {
+			// Some tools strip the space of empty context lines.
+			line = " "
+		}
+		text := line[1:]
+		switch line[0] {
+		case ' ':
+			hunk.Lines = append(hunk.Lines, DiffLine{Type: "context", Old: oldLine, New: newLine, Text: text})
+			oldLine++
+			newLine++
+		case '-':
+			hunk.Lines = append(hunk.Lines, DiffLine{Type: "delete", Old: oldLine, Text: text})
+			oldLine++
+			file.Deletions++
+		case '+':
+			hunk.Lines = append(hunk.Lines, DiffLine{Type: "add", New: newLine, Text: text})
+			newLine++
+			file.Additions++
+		case '\\':
+			hunk.Lines = append(hunk.Lines, DiffLine{Type: "note", Text: text})
+		default:
+			return nil, fmt.Errorf("unexpected diff line %q", line)
+		}
+	}
+	return files, nil
+}
+
+// conflictedFile is the entry of an unmerged path.
+func conflictedFile(path string) *FileDiff {
+	path = unquoteDiffPath(path)
+	return &FileDiff{OldPath: path, NewPath: path, Status: "conflicted", Hunks: []*Hunk{}}
+}
+
+// parseDiffHeaderLine updates file from an extended header line such as
+// "new file mode 100644" or "rename from x".
+func parseDiffHeaderLine(file *FileDiff, line string) {
+	switch {
+	case strings.HasPrefix(line, "new file mode "):
+		file.Status = "added"
+	case strings.HasPrefix(line, "deleted file mode "):
+		file.Status = "deleted"
+	case strings.HasPrefix(line, "rename from "):
+		file.Status = "renamed"
+		file.OldPath = unquoteDiffPath(strings.TrimPrefix(line, "rename from "))
+	case strings.HasPrefix(line, "rename to "):
+		file.NewPath = unquoteDiffPath(strings.TrimPrefix(line, "rename to "))
+	case strings.HasPrefix(line, "copy from "):
+		file.Status = "copied"
+		file.OldPath = unquoteDiffPath(strings.TrimPrefix(line, "copy from "))
+	case strings.HasPrefix(line, "copy to "):
+		file.NewPath = unquoteDiffPath(strings.TrimPrefix(line, "copy to "))
+	case strings.HasPrefix(line, "new mode "):
+		if file.Status == "modified" {
+			file.Status = "mode changed"
+		}
+	case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+		file.Binary = true
+	}
+}
+
+// parseDiffGitPaths splits the "a/old b/new" part of a "diff --git" line.
+// Unquoted paths may contain spaces, so the line is split in half if both
+// paths are the same, and at " b/" otherwise. The "rename from/to" lines
+// that follow a rename settle any ambiguity.
+func parseDiffGitPaths(s string) (oldPath, newPath string, err error) {
+	if strings.HasPrefix(s, `"`) || strings.HasSuffix(s, `"`) {
+		var parts []string
+		for rest := s; rest != ""; rest = strings.TrimPrefix(rest, " ") {
+			var part string
+			if strings.HasPrefix(rest, `"`) {
+				q, err := strconv.QuotedPrefix(rest)
+				if err != nil {
+					return "", "", fmt.Errorf("malformed diff header %q", s)
+				}
+				part, rest = q, rest[len(q):]
+			} else {
+				part, rest, _ = strings.Cut(rest, " ")
+			}
+			parts = append(parts, unquoteDiffPath(part))
+		}
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("malformed diff header %q", s)
+		}
+		oldPath, newPath = parts[0], parts[1]
+	} else if half := (len(s) - 1) / 2; len(s)%2 == 1 && half >= 2 && s[half] == ' ' && s[2:half] == s[half+3:] {
+		oldPath, newPath = s[:half], s[half+1:]
+	} else if strings.Count(s, " b/") == 1 {
+		oldPath, newPath, _ = strings.Cut(s, " b/")
+		newPath = "b/" + newPath
+	} else {
+		return "", "", fmt.Errorf("malformed diff header %q", s)
+	}
+	oldPath, ok1 := strings.CutPrefix(oldPath, "a/")
+	newPath, ok2 := strings.CutPrefix(newPath, "b/")
+	if !ok1 || !ok2 {
+		return "", "", fmt.Errorf("malformed diff header %q", s)
+	}
+	return oldPath, newPath, nil
+}
+
+// unquoteDiffPath decodes a path git quoted because of special characters.
+// Git's octal escapes are valid Go escapes.
+func unquoteDiffPath(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	return s
+}
+
+// parseHunkHeader parses "@@ -a,b +c,d @@ section".
+func parseHunkHeader(line string) (*Hunk, error) {
+	h := &Hunk{Header: line, Lines: []DiffLine{}}
+	rest, ok := strings.CutPrefix(line, "@@ -")
+	ranges, section, found := strings.Cut(rest, " @@")
+	if !ok || !found {
+		return nil, fmt.Errorf("malformed hunk header %q", line)
+	}
+	h.Section = strings.TrimSpace(section)
+	oldRange, newRange, found := strings.Cut(ranges, " +")
+	if !found {
+		return nil, fmt.Errorf("malformed hunk header %q", line)
+	}
+	var err1, err2 error
+	h.OldStart, h.OldLines, err1 = parseHunkRange(oldRange)
+	h.NewStart, h.NewLines, err2 = parseHunkRange(newRange)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("malformed hunk header %q", line)
+	}
+	return h, nil
+}
+
+// parseHunkRange parses "start,count" or "start", where count defaults to 1.
+func parseHunkRange(s string) (start, count int, err error) {
+	startStr, countStr, found := strings.Cut(s, ",")
+	if start, err = strconv.Atoi(startStr); err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return start, 1, nil
+	}
+	count, err = strconv.Atoi(countStr)
+	return start, count, err
+}
+
+// apiDiffHandler: GET /api/diff?cached=1&range=&path= returns the diff parsed
+// into files, hunks and numbered lines. Without options it shows the
+// unstaged changes like /git/diff; cached=1 shows the staged ones and range
+// (e.g. main..HEAD or HEAD~3) compares commits. path, which may be repeated,
+// limits the diff to files or directories.
+func apiDiffHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	query := r.URL.Query()
+	args := append([]string{"diff", "--find-renames"}, diffPatchArgs...)
+	cached := query.Get("cached") == "1"
+	rev := strings.TrimSpace(query.Get("range"))
+	if cached && rev != "" {
+		http.Error(w, "cached and range can't be combined", http.StatusBadRequest)
+		return
+	}
+	if cached {
+		args = append(args, "--cached")
+	}
+	if rev != "" {
+		if strings.HasPrefix(rev, "-") || strings.ContainsAny(rev, " \t\n") {
+			http.Error(w, "Invalid range", http.StatusBadRequest)
+			return
+		}
+		args = append(args, "--end-of-options", rev)
+	}
+	args = append(args, "--")
+	args = append(args, query["path"]...)
+
+	out, err := repo.runGitEnv(r.Context(), []string{"GIT_LITERAL_PATHSPECS=1"}, args...)
+	if err != nil {
+		http.Error(w, gitStepError("Failed to get git diff", out, err).Error(), errorStatus(err))
+		return
+	}
+	files, err := parseDiff(out)
+	if err != nil {
+		http.Error(w, "Failed to parse git diff: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, files)
+}
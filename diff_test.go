@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	out := strings.Join([]string{
+		"diff --git a/main.bean b/main.bean",
+		"index 1111111..2222222 100644",
+		"--- a/main.bean",
+		"+++ b/main.bean",
+		"@@ -1,3 +1,3 @@ option \"title\"",
+		" 2025-01-01 open Assets:Cash",
+		"-2025-01-02 * \"Coffee\"",
+		"+2025-01-02 * \"Tea\"",
+		"",
+		"@@ -10 +10,2 @@",
+		"-end",
+		"\\ No newline at end of file",
+		"+end",
+		"+more",
+		"diff --git a/new file.bean b/new file.bean",
+		"new file mode 100644",
+		"index 0000000..3333333",
+		"--- /dev/null",
+		"+++ b/new file.bean",
+		"@@ -0,0 +1 @@",
+		"+hello",
+		"diff --git a/old.bean b/old.bean",
+		"deleted file mode 100644",
+		"index 4444444..0000000",
+		"diff --git a/2024/a b.bean b/2025/c.bean",
+		"similarity index 90%",
+		"rename from 2024/a b.bean",
+		"rename to 2025/c.bean",
+		"diff --git \"a/caf\\303\\251.bean\" \"b/caf\\303\\251.bean\"",
+		"old mode 100644",
+		"new mode 100755",
+		"diff --git a/receipt.pdf b/receipt.pdf",
+		"index 5555555..6666666 100644",
+		"Binary files a/receipt.pdf and b/receipt.pdf differ",
+	}, "\n") + "\n"
+	files, err := parseDiff(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		OldPath, NewPath, Status string
+		Binary                   bool
+		Additions, Deletions     int
+		Hunks                    int
+	}
+	want := []summary{
+		{"main.bean", "main.bean", "modified", false, 3, 2, 2},
+		{"new file.bean", "new file.bean", "added", false, 1, 0, 1},
+		{"old.bean", "old.bean", "deleted", false, 0, 0, 0},
+		{"2024/a b.bean", "2025/c.bean", "renamed", false, 0, 0, 0},
+		{"café.bean", "café.bean", "mode changed", false, 0, 0, 0},
+		{"receipt.pdf", "receipt.pdf", "modified", true, 0, 0, 0},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for i, f := range files {
+		got := summary{f.OldPath, f.NewPath, f.Status, f.Binary, f.Additions, f.Deletions, len(f.Hunks)}
+		if got != want[i] {
+			t.Errorf("file %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+	if files[2].Path() != "old.bean" || files[3].Path() != "2025/c.bean" {
+		t.Errorf("paths %q, %q", files[2].Path(), files[3].Path())
+	}
+
+	hunks := files[0].Hunks
+	if h := hunks[0]; h.OldStart != 1 || h.OldLines != 3 || h.NewStart != 1 || h.NewLines != 3 || h.Section != `option "title"` {
+		t.Errorf("hunk header %+v", h)
+	}
+	wantLines := []DiffLine{
+		{Type: "context", Old: 1, New: 1, Text: "2025-01-01 open Assets:Cash"},
+		{Type: "delete", Old: 2, Text: `2025-01-02 * "Coffee"`},
+		{Type: "add", New: 2, Text: `2025-01-02 * "Tea"`},
+		{Type: "context", Old: 3, New: 3, Text: ""},
+	}
+	if !reflect.DeepEqual(hunks[0].Lines, wantLines) {
+		t.Errorf("lines %+v", hunks[0].Lines)
+	}
+	wantLines = []DiffLine{
+		{Type: "delete", Old: 10, Text: "end"},
+		{Type: "note", Text: " No newline at end of file"},
+		{Type: "add", New: 10, Text: "end"},
+		{Type: "add", New: 11, Text: "more"},
+	}
+	if !reflect.DeepEqual(hunks[1].Lines, wantLines) {
+		t.Errorf("lines %+v", hunks[1].Lines)
+	}
+	if got := hunks[1].rawLines(); !reflect.DeepEqual(got, []string{"-end", "\\ No newline at end of file", "+end", "+more"}) {
+		t.Errorf("raw lines %q", got)
+	}
+	if want := []string{"diff --git a/main.bean b/main.bean", "index 1111111..2222222 100644", "--- a/main.bean", "+++ b/main.bean"}; !reflect.DeepEqual(files[0].header, want) {
+		t.Errorf("header %q", files[0].header)
+	}
+
+	if files, err := parseDiff(""); err != nil || len(files) != 0 {
+		t.Errorf("empty diff: got %v, %v", files, err)
+	}
+	for _, bad := range []string{
+		"diff --git a/x b/x\n@@ -1 +1 @@\n?what\n",
+		"diff --git a/x b/x\n@@ -a +1 @@\n",
+		"diff --git x y\n",
+	} {
+		if _, err := parseDiff(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestParseDiffConflicted(t *testing.T) {
+	// `git diff` in the middle of a merge with a content conflict in
+	// main.bean and a delete/modify conflict in gone.bean.
+	out := strings.Join([]string{
+		"diff --cc main.bean",
+		"index f4ea702,3b6f40a..0000000",
+		"--- a/main.bean",
+		"+++ b/main.bean",
+		"@@@ -1,3 -1,3 +1,7 @@@",
+		"  a",
+		"++<<<<<<< HEAD",
+		" +B1",
+		"++=======",
+		"+ B2",
+		"++>>>>>>> topic",
+		"  c",
+		"diff --git a/clean.bean b/clean.bean",
+		"index 9766475..866e03d 100644",
+		"--- a/clean.bean",
+		"+++ b/clean.bean",
+		"@@ -1 +1,2 @@",
+		" ok",
+		"+more",
+		"* Unmerged path gone.bean",
+		"diff --cc \"caf\\303\\251.bean\"",
+		"index 1111111,2222222..0000000",
+		"@@@ -1 -1 +1,5 @@@",
+		"++<<<<<<< HEAD",
+	}, "\n") + "\n"
+	files, err := parseDiff(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, fmt.Sprintf("%s %s %d hunks +%d -%d", f.Status, f.Path(), len(f.Hunks), f.Additions, f.Deletions))
+	}
+	want := []string{
+		"conflicted main.bean 0 hunks +0 -0",
+		"modified clean.bean 1 hunks +1 -0",
+		"conflicted gone.bean 0 hunks +0 -0",
+		"conflicted café.bean 0 hunks +0 -0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestAPIDiffDuringMerge(t *testing.T) {
+	repo := newTestRepo(t)
+	git(t, repo, "checkout", "-q", "-b", "topic")
+	writeFile(t, repo, "main.bean", "; topic\n")
+	git(t, repo, "commit", "-q", "-am", "topic")
+	git(t, repo, "checkout", "-q", "main")
+	writeFile(t, repo, "main.bean", "; main\n")
+	git(t, repo, "commit", "-q", "-am", "main")
+	if _, err := repo.runGit(context.Background(), "merge", "topic"); err == nil {
+		t.Fatal("expected a merge conflict")
+	}
+
+	for _, query := range []string{"", "?cached=1"} {
+		w := httptest.NewRecorder()
+		apiDiffHandler(w, httptest.NewRequest("GET", "/api/diff"+query, nil), repo)
+		var files []*FileDiff
+		if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+			t.Fatalf("%q: %v: %s", query, err, w.Body)
+		}
+		if len(files) != 1 || files[0].NewPath != "main.bean" || files[0].Status != "conflicted" {
+			t.Errorf("%q: got %s", query, w.Body)
+		}
+	}
+}
+
+func TestParseDiffGitPaths(t *testing.T) {
+	tests := []struct {
+		in, old, new string
+		err          bool
+	}{
+		{"a/x.bean b/x.bean", "x.bean", "x.bean", false},
+		{"a/with space b/with space", "with space", "with space", false},
+		{"a/b/ b/c b/b/ b/c", "b/ b/c", "b/ b/c", false},
+		{"a/old name b/new name", "old name", "new name", false},
+		{`"a/tab\there" "b/tab\there"`, "tab\there", "tab\there", false},
+		{`a/plain "b/quo\"ted"`, "plain", `quo"ted`, false},
+		{"a/x b/y b/z", "", "", true},
+		{"x.bean x.bean", "", "", true},
+		{`"a/unterminated b/x`, "", "", true},
+	}
+	for _, tt := range tests {
+		oldPath, newPath, err := parseDiffGitPaths(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q, %q", tt.in, oldPath, newPath)
+			}
+			continue
+		}
+		if err != nil || oldPath != tt.old || newPath != tt.new {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q", tt.in, oldPath, newPath, err, tt.old, tt.new)
+		}
+	}
+}
+
+func TestParseHunkHeader(t *testing.T) {
+	tests := []struct {
+		line                                   string
+		oldStart, oldLines, newStart, newLines int
+		section                                string
+	}{
+		{"@@ -1,5 +1,6 @@", 1, 5, 1, 6, ""},
+		{"@@ -3 +3 @@ 2025-01-01 open", 3, 1, 3, 1, "2025-01-01 open"},
+		{"@@ -0,0 +1,2 @@", 0, 0, 1, 2, ""},
+	}
+	for _, tt := range tests {
+		h, err := parseHunkHeader(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if h.OldStart != tt.oldStart || h.OldLines != tt.oldLines || h.NewStart != tt.newStart || h.NewLines != tt.newLines || h.Section != tt.section {
+			t.Errorf("%q: got %+v", tt.line, h)
+		}
+	}
+	for _, bad := range []string{"@@ -1 @@", "@@ +1 -1 @@", "@@ -1,x +1 @@", "@@ -1 +1"} {
+		if _, err := parseHunkHeader(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
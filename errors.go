@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// httpStatusError is implemented by errors that know the HTTP status they
+// are reported with, such as *BusyError (409) or *TimeoutError (504).
+type httpStatusError interface {
+	error
+	HTTPStatus() int
+}
+
+// errorStatus is the HTTP status to report err with: that of the first error
+// in its chain with an HTTPStatus method, or 500.
+func errorStatus(err error) int {
+	var se httpStatusError
+	if errors.As(err, &se) {
+		return se.HTTPStatus()
+	}
+	if errors.Is(err, errNotSupported) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// runCommand runs name with args inside dir and records the invocation in the
+// audit log. Every external command started by the server goes through here.
+func runCommand(ctx context.Context, dir, name string, args ...string) (stdout, stderr string, err error) {
+	return runCommandEnv(ctx, dir, nil, name, args...)
+}
+
+// runCommandEnv is runCommand with extra "KEY=value" environment variables.
+// The command is killed, with its children, when ctx is canceled (the client
+// disconnected or the job was canceled) or when its timeout expires, in
+// which case a *TimeoutError is returned.
+func runCommandEnv(ctx context.Context, dir string, env []string, name string, args ...string) (stdout, stderr string, err error) {
+	argv := append([]string{name}, args...)
+	timeout := commandTimeout(argv)
+	cmdCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(cmdCtx, name, args...)
+	killProcessGroup(cmd)
+	// Don't wait forever for output from children that escaped the kill.
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Dir = dir
+	// Never wait for a credential prompt nobody can answer.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never")
+	cmd.Env = append(cmd.Env, env...)
+
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	if p := progressFrom(ctx); p != nil {
+		// Stream the output as it arrives as well as collecting it.
+		outLines := &progressLineWriter{p: p, stream: "stdout"}
+		errLines := &progressLineWriter{p: p, stream: "stderr"}
+		defer outLines.Flush()
+		defer errLines.Flush()
+		cmd.Stdout = io.MultiWriter(&out, outLines)
+		cmd.Stderr = io.MultiWriter(&errOut, errLines)
+		reportCommand(ctx, argv)
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	if err != nil && ctx.Err() == nil && errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+		err = &TimeoutError{Argv: argv, Timeout: timeout, Err: err}
+	}
+	recordAudit(ctx, auditCommand{
+		dir:      dir,
+		argv:     argv,
+		start:    start,
+		exitCode: exitCode(err),
+		output:   out.String() + errOut.String(),
+		err:      err,
+	})
+	return out.String(), errOut.String(), err
+}
+
+// exitCode returns the exit status of a finished command, 0 on success and
+// -1 if it could not be started.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// runGit executes a git command inside the repository directory and returns
+// its stdout, or all of its output if it fails. Read-only subcommands share
+// the repository lock, all others hold it exclusively.
+func (repo *Repo) runGit(ctx context.Context, command ...string) (string, error) {
+	return repo.runGitEnv(ctx, nil, command...)
+}
+
+// runGitEnv is runGit with extra environment variables.
+func (repo *Repo) runGitEnv(ctx context.Context, env []string, command ...string) (string, error) {
+	op := "git"
+	if len(command) > 0 {
+		op += " " + command[0]
+	}
+	write := len(command) == 0 || !readOnlyGitCommands[command[0]]
+	ctx, release, err := repo.lock.acquire(ctx, write, op)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer release()
+
+	out, stderr, err := runCommandEnv(ctx, repo.Path, env, "git", command...)
+	if err != nil {
+		// Some failures, such as merge conflicts, are reported on stdout.
+		return out + stderr, err
+	}
+	return out, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup is a no-op where process groups aren't available;
+// canceling cmd kills only the command itself.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,100 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processAlive reports whether pid is a running process. Zombies, which a
+// container's init may never reap, count as dead.
+func processAlive(t *testing.T, pid int) bool {
+	t.Helper()
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return false
+	}
+	return !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
+
+// startSleeper runs a shell that starts `sleep 30` in the background and
+// waits for it, and returns the sleep's pid and the shell's result.
+func startSleeper(t *testing.T, ctx context.Context) (pid int, result <-chan error) {
+	t.Helper()
+	p := &collectProgress{lines: make(chan string, 1)}
+	ctx = withProgress(ctx, p)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := runCommand(ctx, t.TempDir(), "sh", "-c", "sleep 30 & echo $!; wait")
+		done <- err
+	}()
+	select {
+	case line := <-p.lines:
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pid, done
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shell did not start sleep")
+		return 0, nil
+	}
+}
+
+// collectProgress passes on the output lines of a command as they arrive.
+type collectProgress struct {
+	lines chan string
+}
+
+func (p *collectProgress) send(event string, data any) {
+	if m, ok := data.(map[string]string); ok && event == "output" {
+		p.lines <- m["line"]
+	}
+}
+
+func TestCommandTimeoutKillsChildren(t *testing.T) {
+	defer func(prev map[string]time.Duration) { commandTimeouts = prev }(commandTimeouts)
+	commandTimeouts = map[string]time.Duration{"sh": 200 * time.Millisecond}
+
+	start := time.Now()
+	pid, result := startSleeper(t, context.Background())
+	err := <-result
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("got %v, want a TimeoutError", err)
+	}
+	if got := err.Error(); got != "sh timed out after 200ms" {
+		t.Errorf("message %q", got)
+	}
+	// The shell waits for sleep, so it only returned this early if the
+	// whole group was killed rather than after WaitDelay.
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+	if processAlive(t, pid) {
+		t.Errorf("sleep (pid %d) outlived the timeout", pid)
+	}
+}
+
+func TestCommandCancelKillsChildren(t *testing.T) {
+	defer func(prev map[string]time.Duration) { commandTimeouts = prev }(commandTimeouts)
+	commandTimeouts = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pid, result := startSleeper(t, ctx)
+	cancel()
+	err := <-result
+	var timeoutErr *TimeoutError
+	if err == nil || errors.As(err, &timeoutErr) {
+		t.Fatalf("got %v, want the error of the killed shell", err)
+	}
+	if processAlive(t, pid) {
+		t.Errorf("sleep (pid %d) outlived the cancellation", pid)
+	}
+}
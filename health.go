@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthConfig is the "health" section of the config file. When it is
+// present, the ledgers are checked on a schedule and after every pull, and
+// alerts are sent when a check starts failing.
+type HealthConfig struct {
+	// Schedule is a cron expression such as "0 6 * * *", an alias such as
+	// "@hourly", or "@every 30m". Without one the checks only run after
+	// pulls and when started from the UI.
+	Schedule string `json:"schedule"`
+	// Queries lists the ids of the saved queries to run. A query fails when
+	// it returns rows. Defaults to all saved queries of the repository.
+	Queries []string `json:"queries"`
+	// SkipLedgerChecks leaves out the repository's ledger checks, which run
+	// bean-check by default.
+	SkipLedgerChecks bool `json:"skip_ledger_checks"`
+	// Notifiers receive an alert when checks start failing.
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// Keep is how many runs are kept per repository. Defaults to 500.
+	Keep int `json:"keep"`
+}
+
+const (
+	defaultHealthRunsKept = 500
+	// maxHealthRows caps the rows of a failing query kept with a run.
+	maxHealthRows = 100
+	// notifyTimeout limits how long sending one alert may take.
+	notifyTimeout = time.Minute
+)
+
+// Health check statuses. A check that couldn't run, e.g. because a query is
+// invalid, has the error status and neither passes nor fails.
+const (
+	HealthOK      = "ok"
+	HealthFailing = "failing"
+	HealthError   = "error"
+)
+
+// HealthCheckResult is the outcome of one check of a run.
+type HealthCheckResult struct {
+	// Name is the saved query id, or "ledger" for the ledger checks.
+	Name string `json:"name"`
+	// Kind is "query" or "ledger".
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	// Rows is how many rows a query returned, or how many problems the
+	// ledger checks found.
+	Rows     int            `json:"rows"`
+	Error    string         `json:"error,omitempty"`
+	Result   *QueryResult   `json:"result,omitempty"`
+	Problems []CheckProblem `json:"problems,omitempty"`
+}
+
+// Summary describes the outcome in a few words.
+func (c *HealthCheckResult) Summary() string {
+	switch {
+	case c.Status == HealthError:
+		return "error: " + c.Error
+	case c.Kind == "ledger":
+		return fmt.Sprintf("%d problems", c.Rows)
+	default:
+		return fmt.Sprintf("%d rows", c.Rows)
+	}
+}
+
+// HealthRun is one run of the health checks of a repository.
+type HealthRun struct {
+	Repo string `json:"repo"`
+	// Trigger is "schedule", "pull" or "manual".
+	Trigger  string              `json:"trigger"`
+	User     string              `json:"user,omitempty"`
+	Started  time.Time           `json:"started"`
+	Finished time.Time           `json:"finished"`
+	Commit   string              `json:"commit,omitempty"`
+	Checks   []HealthCheckResult `json:"checks"`
+	// Alerted lists the checks that started failing in this run.
+	Alerted []string `json:"alerted,omitempty"`
+}
+
+// health runs the scheduled checks. It is nil when they are disabled.
+var health *HealthMonitor
+
+// HealthMonitor runs the health checks of every repository, keeps their
+// results on disk and sends alerts.
+type HealthMonitor struct {
+	dir       string
+	cfg       *HealthConfig
+	schedule  *cronSchedule
+	keep      int
+	notifiers []Notifier
+
+	mu   sync.Mutex
+	runs map[string][]*HealthRun
+	// state is the last status other than an error of every check, by
+	// repository and check name.
+	state map[string]map[string]string
+	// running holds, for repositories with a run in progress, a channel
+	// closed once it and the runs pending after it are done. pending is the
+	// run to start when the current one finishes.
+	running map[string]chan struct{}
+	pending map[string]healthRequest
+}
+
+// healthRequest asks for a run of the health checks.
+type healthRequest struct {
+	trigger string
+	// commit is the commit to check, or empty for the shared clone as it is.
+	commit string
+}
+
+func newHealthMonitor(dir string, cfg *HealthConfig) (*HealthMonitor, error) {
+	m := &HealthMonitor{
+		dir: dir, cfg: cfg, keep: defaultHealthRunsKept,
+		runs: make(map[string][]*HealthRun), state: make(map[string]map[string]string),
+		running: make(map[string]chan struct{}), pending: make(map[string]healthRequest),
+	}
+	if cfg.Keep > 0 {
+		m.keep = cfg.Keep
+	}
+	if cfg.Schedule != "" {
+		schedule, err := parseCron(cfg.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		m.schedule = schedule
+	}
+	for _, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc, filepath.Join(dir, "alerts.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		m.notifiers = append(m.notifiers, n)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	for _, repo := range repos.List() {
+		if err := m.load(repo.ID); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *HealthMonitor) path(repoID string) string {
+	return filepath.Join(m.dir, repoID+".jsonl")
+}
+
+// load reads the saved runs of a repository and restores the state of its
+// checks from them.
+func (m *HealthMonitor) load(repoID string) error {
+	f, err := os.Open(m.path(repoID))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		run := &HealthRun{}
+		if err := json.Unmarshal(scanner.Bytes(), run); err != nil {
+			log.Printf("Skipping unreadable health check run of %s: %v", repoID, err)
+			continue
+		}
+		m.runs[repoID] = append(m.runs[repoID], run)
+		m.updateState(run)
+	}
+	return scanner.Err()
+}
+
+// updateState records the statuses of run and returns the checks that
+// started failing with it.
+func (m *HealthMonitor) updateState(run *HealthRun) []HealthCheckResult {
+	state := m.state[run.Repo]
+	if state == nil {
+		state = make(map[string]string)
+		m.state[run.Repo] = state
+	}
+	var started []HealthCheckResult
+	for _, c := range run.Checks {
+		if c.Status == HealthError {
+			continue
+		}
+		if c.Status == HealthFailing && state[c.Name] != HealthFailing {
+			started = append(started, c)
+		}
+		state[c.Name] = c.Status
+	}
+	return started
+}
+
+// save writes the kept runs of a repository, replacing the file atomically.
+func (m *HealthMonitor) save(repoID string) error {
+	var buf strings.Builder
+	for _, run := range m.runs[repoID] {
+		line, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	path := m.path(repoID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// scheduleLoop starts a run of every repository whenever the schedule
+// fires.
+func (m *HealthMonitor) scheduleLoop() {
+	for {
+		next := m.schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Health check schedule %q never fires", m.cfg.Schedule)
+			return
+		}
+		time.Sleep(time.Until(next))
+		for _, repo := range repos.List() {
+			m.trigger(repo.ID, healthRequest{trigger: "schedule"})
+		}
+	}
+}
+
+// trigger starts a run of the repository in the background. A run
+// triggered while another one is in progress starts when that one finishes;
+// further triggers in the meantime are folded into it.
+func (m *HealthMonitor) trigger(repoID string, req healthRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.running[repoID]; ok {
+		m.pending[repoID] = req
+		return
+	}
+	done := make(chan struct{})
+	m.running[repoID] = done
+	go m.background(repoID, req, done)
+}
+
+// background runs req, then the run pending after it, if any.
+func (m *HealthMonitor) background(repoID string, req healthRequest, done chan struct{}) {
+	ctx := withRequestInfo(context.Background(), &requestInfo{Endpoint: "health check (" + req.trigger + ")", Repo: repoID})
+	if _, err := m.run(ctx, repoID, req); err != nil {
+		log.Printf("Health check of %s failed: %v", repoID, err)
+	}
+	m.finish(repoID, done)
+}
+
+// finish ends the run in progress, starting the pending one in its place.
+func (m *HealthMonitor) finish(repoID string, done chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, ok := m.pending[repoID]
+	if !ok {
+		delete(m.running, repoID)
+		close(done)
+		return
+	}
+	delete(m.pending, repoID)
+	go m.background(repoID, next, done)
+}
+
+// runNow runs the checks of the repository and returns the run, after
+// waiting for any run in progress. Triggers that come in meanwhile start
+// after it as usual.
+func (m *HealthMonitor) runNow(ctx context.Context, repoID string) (*HealthRun, error) {
+	var mine chan struct{}
+	for mine == nil {
+		m.mu.Lock()
+		done, busy := m.running[repoID]
+		if !busy {
+			mine = make(chan struct{})
+			m.running[repoID] = mine
+		}
+		m.mu.Unlock()
+		if busy {
+			reportStep(ctx, "Waiting for the health check in progress")
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	defer m.finish(repoID, mine)
+	return m.run(ctx, repoID, healthRequest{trigger: "manual"})
+}
+
+// run checks the repository, records the run and sends an alert if checks
+// started failing. An error means the checks couldn't run at all. Callers
+// go through trigger or runNow so runs of a repository don't overlap.
+func (m *HealthMonitor) run(ctx context.Context, repoID string, req healthRequest) (*HealthRun, error) {
+	repo := repos.Get(repoID)
+	run := &HealthRun{Repo: repo.ID, Trigger: req.trigger, Started: time.Now().UTC(), Checks: []HealthCheckResult{}}
+	if user := currentUser(ctx); user != nil {
+		run.User = user.Name
+	}
+	if err := m.check(ctx, repo, req.commit, run); err != nil {
+		return nil, err
+	}
+	run.Finished = time.Now().UTC()
+
+	m.mu.Lock()
+	started := m.updateState(run)
+	for _, c := range started {
+		run.Alerted = append(run.Alerted, c.Name)
+	}
+	runs := append(m.runs[repo.ID], run)
+	if len(runs) > m.keep {
+		runs = runs[len(runs)-m.keep:]
+	}
+	m.runs[repo.ID] = runs
+	err := m.save(repo.ID)
+	m.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save health check run of %s: %v", repo.ID, err)
+	}
+
+	if len(started) > 0 {
+		m.notify(&HealthAlert{Repo: repo.ID, Time: run.Finished, Trigger: req.trigger, Commit: run.Commit, Checks: started})
+	}
+	return run, nil
+}
+
+// check runs the configured checks on the shared clone of repo, or on
+// commit, exported to a temporary directory, if not empty.
+func (m *HealthMonitor) check(ctx context.Context, repo *Repo, commit string, run *HealthRun) error {
+	ctx, release, err := repo.lock.acquire(ctx, false, "health check")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if commit == "" {
+		if out, err := repo.runGit(ctx, "rev-parse", "HEAD"); err == nil {
+			run.Commit = strings.TrimSpace(out)
+		}
+	} else {
+		tmp, err := os.MkdirTemp("", "git-commands-health")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir := filepath.Join(tmp, "tree")
+		// With an index of its own the export leaves the repository
+		// untouched, so the shared lock held is enough.
+		env := []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+		for _, args := range [][]string{{"read-tree", commit}, {"checkout-index", "--all", "--prefix=" + dir + string(filepath.Separator)}} {
+			if out, stderr, err := runCommandEnv(ctx, repo.Path, env, "git", args...); err != nil {
+				return gitStepError("exporting "+shortHash(commit), out+stderr, err)
+			}
+		}
+		exported := *repo
+		exported.Path = dir
+		repo = &exported
+		run.Commit = commit
+	}
+
+	queries, err := loadSavedQueries(repo)
+	if err != nil {
+		return fmt.Errorf("loading saved queries: %w", err)
+	}
+	ids := m.cfg.Queries
+	if ids == nil {
+		for _, q := range queries {
+			ids = append(ids, q.ID)
+		}
+	}
+	for _, id := range ids {
+		c := HealthCheckResult{Name: id, Kind: "query"}
+		if i := findSavedQuery(queries, id); i < 0 {
+			c.Status, c.Error = HealthError, "no saved query with this id"
+		} else if query, err := queries[i].render(nil); err != nil {
+			c.Status, c.Error = HealthError, err.Error()
+		} else {
+			reportStep(ctx, "Running query "+id)
+			c.Result, err = runHealthQuery(ctx, repo, query)
+			switch {
+			case err != nil:
+				c.Status, c.Error = HealthError, err.Error()
+			case len(c.Result.Rows) > 0:
+				c.Status, c.Rows = HealthFailing, len(c.Result.Rows)
+				if c.Rows > maxHealthRows {
+					c.Result.Rows = c.Result.Rows[:maxHealthRows]
+				}
+			default:
+				c.Status, c.Result = HealthOK, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		run.Checks = append(run.Checks, c)
+	}
+
+	if !m.cfg.SkipLedgerChecks {
+		c := HealthCheckResult{Name: "ledger", Kind: "ledger", Status: HealthOK}
+		problems, err := runChecks(ctx, repo, repo.Path)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			c.Status, c.Error = HealthError, err.Error()
+		case len(problems) > 0:
+			c.Status, c.Rows, c.Problems = HealthFailing, len(problems), problems
+		}
+		run.Checks = append(run.Checks, c)
+	}
+	return nil
+}
+
+// runHealthQuery runs query on the main file of repo. The caller holds the
+// repository lock.
+func runHealthQuery(ctx context.Context, repo *Repo, query string) (*QueryResult, error) {
+	out, stderr, err := runCommand(ctx, repo.Path, "bean-query", "-f", "csv", repo.MainFile, query)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return parseQueryCSV(out)
+}
+
+// notify sends alert to every notifier, logging failures.
+func (m *HealthMonitor) notify(alert *HealthAlert) {
+	for _, n := range m.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := n.Notify(ctx, alert); err != nil {
+			log.Printf("Failed to send health alert for %s: %v", alert.Repo, err)
+		}
+		cancel()
+	}
+}
+
+// latest returns up to limit runs of a repository, newest first.
+func (m *HealthMonitor) latest(repoID string, limit int) []*HealthRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := m.runs[repoID]
+	list := []*HealthRun{}
+	for i := len(runs) - 1; i >= 0 && len(list) < limit; i-- {
+		list = append(list, runs[i])
+	}
+	return list
+}
+
+// apiHealthHandler: GET /api/health?limit= lists the latest health check
+// runs of the repository, newest first, and when the next scheduled run is.
+func apiHealthHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if health == nil {
+		writeJSON(w, map[string]any{"enabled": false, "runs": []*HealthRun{}})
+		return
+	}
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	status := map[string]any{
+		"enabled":  true,
+		"schedule": health.cfg.Schedule,
+		"runs":     health.latest(repo.ID, limit),
+	}
+	if health.schedule != nil {
+		if next := health.schedule.next(time.Now()); !next.IsZero() {
+			status["next"] = next
+		}
+	}
+	writeJSON(w, status)
+}
+
+// runHealthHandler: POST /api/health/run runs the health checks of the
+// repository now and returns the run.
+func runHealthHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if health == nil {
+		http.Error(w, "Health checks are not configured", http.StatusNotFound)
+		return
+	}
+	run, err := health.runNow(r.Context(), repo.ID)
+	if err != nil {
+		http.Error(w, "Failed to run the health checks: "+err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, run)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHistoryEntries is how many entries are kept per user.
+	maxHistoryEntries   = 1000
+	defaultHistoryLimit = 50
+)
+
+// HistoryEntry is a bean query or git command a user ran.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	Repo string    `json:"repo"`
+	// Kind is "query" or "command".
+	Kind string `json:"kind"`
+	// Query is the BQL that ran, with the parameters of a saved query
+	// filled in.
+	Query      string            `json:"query,omitempty"`
+	SavedQuery string            `json:"saved_query,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	// Command is the git command without the leading "git".
+	Command []string `json:"command,omitempty"`
+	// Rows is how many rows a query returned, unknown for the text format,
+	// or how many lines of output a command printed.
+	Rows       *int   `json:"rows,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// text is what the history is searched by.
+func (e *HistoryEntry) text() string {
+	if e.Kind == "command" {
+		return strings.Join(e.Command, " ")
+	}
+	return e.SavedQuery + " " + e.Query
+}
+
+// HistoryLog keeps the history of every user in a JSON lines file of their
+// own.
+type HistoryLog struct {
+	dir string
+
+	mu sync.Mutex
+	// entries holds the loaded histories by user slug, oldest first.
+	entries map[string][]*HistoryEntry
+}
+
+// history is opened in main.
+var history *HistoryLog
+
+func openHistory(dir string) (*HistoryLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &HistoryLog{dir: dir, entries: make(map[string][]*HistoryEntry)}, nil
+}
+
+func (h *HistoryLog) path(slug string) string {
+	return filepath.Join(h.dir, slug+".jsonl")
+}
+
+// userEntries returns the history of a user, reading it on first use. The
+// caller holds h.mu.
+func (h *HistoryLog) userEntries(slug string) []*HistoryEntry {
+	if entries, ok := h.entries[slug]; ok {
+		return entries
+	}
+	var entries []*HistoryEntry
+	f, err := os.Open(h.path(slug))
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			e := &HistoryEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Failed to read the history of %s: %v", slug, err)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		log.Printf("Failed to read the history of %s: %v", slug, err)
+	}
+	h.entries[slug] = entries
+	return entries
+}
+
+// Record adds e to the history of the request's user. The file is appended
+// to, and rewritten with the latest entries once it holds twice as many as
+// are kept. Failures are logged but don't fail the request.
+func (h *HistoryLog) Record(ctx context.Context, e *HistoryEntry) {
+	if h == nil {
+		return
+	}
+	slug := userSlug(currentUser(ctx))
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Failed to encode history entry:", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := append(h.userEntries(slug), e)
+	h.entries[slug] = entries
+	if len(entries) > 2*maxHistoryEntries {
+		h.entries[slug] = entries[len(entries)-maxHistoryEntries:]
+		if err := h.rewrite(slug); err != nil {
+			log.Println("Failed to write history:", err)
+		}
+		return
+	}
+	f, err := os.OpenFile(h.path(slug), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Println("Failed to write history:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write history:", err)
+	}
+}
+
+// rewrite replaces the history file of a user with the loaded entries. The
+// caller holds h.mu.
+func (h *HistoryLog) rewrite(slug string) error {
+	var buf strings.Builder
+	for _, e := range h.entries[slug] {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	path := h.path(slug)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns up to limit entries of a user's history in repo, newest
+// first. kind and search, matched case-insensitively against the query or
+// command, narrow it down if not empty.
+func (h *HistoryLog) List(user *User, repo, kind, search string, limit int) []*HistoryEntry {
+	search = strings.ToLower(search)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.userEntries(userSlug(user))
+	list := []*HistoryEntry{}
+	for i := len(entries) - 1; i >= 0 && len(list) < limit; i-- {
+		e := entries[i]
+		if e.Repo != repo || (kind != "" && e.Kind != kind) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(e.text()), search) {
+			continue
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// recordCommand adds a git command and its result to the user's history.
+func recordCommand(ctx context.Context, repo *Repo, command []string, start time.Time, output string, err error) {
+	lines := strings.Count(strings.TrimRight(output, "\n"), "\n")
+	if strings.TrimSpace(output) != "" {
+		lines++
+	}
+	e := &HistoryEntry{
+		Time: start.UTC(), Repo: repo.ID, Kind: "command", Command: command,
+		Rows: &lines, DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		e.Rows, e.Error = nil, err.Error()
+	}
+	history.Record(ctx, e)
+}
+
+// apiHistoryHandler: GET /api/history?kind=&q=&limit= lists the requesting
+// user's queries and commands in the repository, newest first. kind is
+// "query" or "command", and q searches their text.
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if kind != "" && kind != "query" && kind != "command" {
+		http.Error(w, "Unknown kind "+kind, http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryEntries {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if history == nil {
+		writeJSON(w, []*HistoryEntry{})
+		return
+	}
+	writeJSON(w, history.List(currentUser(r.Context()), repo.ID, kind, q.Get("q"), limit))
+}
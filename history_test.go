@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countLines returns the number of lines in a file.
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestHistoryRecordRewrite(t *testing.T) {
+	dir := t.TempDir()
+	h, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Name: "alice"}
+	ctx := context.WithValue(context.Background(), userContextKey, user)
+	record := func(i int) {
+		h.Record(ctx, &HistoryEntry{Time: time.Now(), Repo: "ledger", Kind: "command", Command: []string{"log", "-" + strconv.Itoa(i)}})
+	}
+	for i := 1; i <= 2*maxHistoryEntries; i++ {
+		record(i)
+	}
+	path := h.path(userSlug(user))
+	if n := countLines(t, path); n != 2*maxHistoryEntries {
+		t.Fatalf("%d lines before the rewrite, want %d", n, 2*maxHistoryEntries)
+	}
+
+	// One more entry and the file is cut down to the newest ones.
+	record(2*maxHistoryEntries + 1)
+	if n := countLines(t, path); n != maxHistoryEntries {
+		t.Errorf("%d lines after the rewrite, want %d", n, maxHistoryEntries)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	record(2*maxHistoryEntries + 2)
+
+	// A new log reads what was written.
+	reopened, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reopened.List(user, "ledger", "", "", maxHistoryEntries+10)
+	if len(list) != maxHistoryEntries+1 {
+		t.Fatalf("%d entries after reopening, want %d", len(list), maxHistoryEntries+1)
+	}
+	if got, want := list[0].Command[1], "-"+strconv.Itoa(2*maxHistoryEntries+2); got != want {
+		t.Errorf("newest entry %s, want %s", got, want)
+	}
+	if got, want := list[len(list)-1].Command[1], "-"+strconv.Itoa(maxHistoryEntries+2); got != want {
+		t.Errorf("oldest entry %s, want %s", got, want)
+	}
+}
+
+func TestHistoryList(t *testing.T) {
+	h, err := openHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := &User{Name: "alice"}, &User{Name: "bob"}
+	record := func(user *User, e *HistoryEntry) {
+		h.Record(context.WithValue(context.Background(), userContextKey, user), e)
+	}
+	rows := 3
+	record(alice, &HistoryEntry{Repo: "ledger", Kind: "query", Query: "SELECT account WHERE account ~ 'Expenses'", Rows: &rows})
+	record(alice, &HistoryEntry{Repo: "ledger", Kind: "command", Command: []string{"log", "--oneline"}})
+	record(alice, &HistoryEntry{Repo: "ledger", Kind: "query", SavedQuery: "monthly-expenses", Query: "SELECT sum(position)"})
+	record(alice, &HistoryEntry{Repo: "other", Kind: "command", Command: []string{"status"}})
+	record(bob, &HistoryEntry{Repo: "ledger", Kind: "command", Command: []string{"pull"}})
+
+	text := func(list []*HistoryEntry) []string {
+		var s []string
+		for _, e := range list {
+			s = append(s, e.text())
+		}
+		return s
+	}
+	tests := []struct {
+		user               *User
+		repo, kind, search string
+		limit              int
+		want               []string
+	}{
+		{alice, "ledger", "", "", 10, []string{"monthly-expenses SELECT sum(position)", "log --oneline", " SELECT account WHERE account ~ 'Expenses'"}},
+		{alice, "ledger", "", "", 2, []string{"monthly-expenses SELECT sum(position)", "log --oneline"}},
+		{alice, "ledger", "query", "", 10, []string{"monthly-expenses SELECT sum(position)", " SELECT account WHERE account ~ 'Expenses'"}},
+		{alice, "ledger", "command", "", 10, []string{"log --oneline"}},
+		{alice, "ledger", "", "EXPENSES", 10, []string{"monthly-expenses SELECT sum(position)", " SELECT account WHERE account ~ 'Expenses'"}},
+		{alice, "ledger", "command", "oneline", 10, []string{"log --oneline"}},
+		{alice, "ledger", "", "nothing", 10, nil},
+		{alice, "other", "", "", 10, []string{"status"}},
+		{bob, "ledger", "", "", 10, []string{"pull"}},
+		{&User{Name: "carol"}, "ledger", "", "", 10, nil},
+	}
+	for _, tt := range tests {
+		if got := text(h.List(tt.user, tt.repo, tt.kind, tt.search, tt.limit)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s kind=%q search=%q limit=%d: got %q, want %q", tt.user.Name, tt.repo, tt.kind, tt.search, tt.limit, got, tt.want)
+		}
+	}
+	if got := h.List(alice, "ledger", "query", "", 10)[1].Rows; got == nil || *got != 3 {
+		t.Errorf("rows %v", got)
+	}
+}
+
+func TestAPIHistoryHandler(t *testing.T) {
+	defer func(prev *HistoryLog) { history = prev }(history)
+	repo := &Repo{ID: "ledger"}
+	ctx := context.WithValue(context.Background(), userContextKey, &User{Name: "alice"})
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		apiHistoryHandler(w, httptest.NewRequest("GET", "/api/history"+query, nil).WithContext(ctx), repo)
+		return w
+	}
+
+	history = nil
+	if w := get(""); w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("without a history: %d %q", w.Code, w.Body)
+	}
+
+	var err error
+	if history, err = openHistory(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for i := range defaultHistoryLimit + 5 {
+		history.Record(ctx, &HistoryEntry{Repo: "ledger", Kind: "command", Command: []string{"log", "-" + strconv.Itoa(i)}})
+	}
+	tests := []struct {
+		query  string
+		status int
+		count  int
+	}{
+		{"", http.StatusOK, defaultHistoryLimit},
+		{"?limit=3", http.StatusOK, 3},
+		{"?limit=1", http.StatusOK, 1},
+		{"?limit=" + strconv.Itoa(maxHistoryEntries), http.StatusOK, defaultHistoryLimit + 5},
+		{"?limit=" + strconv.Itoa(maxHistoryEntries+1), http.StatusBadRequest, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?limit=-1", http.StatusBadRequest, 0},
+		{"?limit=ten", http.StatusBadRequest, 0},
+		{"?kind=command&q=-1", http.StatusOK, 11}, // -1 and -10 to -19
+		{"?kind=query", http.StatusOK, 0},
+		{"?kind=shell", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := get(tt.query)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var entries []*HistoryEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tt.count {
+			t.Errorf("%s: %d entries, want %d", tt.query, len(entries), tt.count)
+		}
+	}
+}
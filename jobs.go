@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJobWorkers = 2
+	defaultJobsKept   = 500
+	// jobQueueSize is how many jobs may wait for a worker.
+	jobQueueSize = 100
+	// maxJobEvents caps the log of a single job.
+	maxJobEvents = 10000
+	// maxJobRequestBody caps the request body saved for a job.
+	maxJobRequestBody = 1 << 20
+)
+
+// JobsConfig configures the background job workers.
+type JobsConfig struct {
+	// Workers is how many jobs run at the same time. Defaults to 2.
+	Workers int `json:"workers"`
+	// Keep is how many finished jobs are kept on disk. Defaults to 500.
+	Keep int `json:"keep"`
+}
+
+// JobStatus is the state of a background job.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+	// JobInterrupted marks jobs that were unfinished when the server stopped.
+	JobInterrupted JobStatus = "interrupted"
+)
+
+// JobEvent is one progress event of a job, as it would have been streamed.
+type JobEvent struct {
+	Time  time.Time       `json:"time"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// JobResult is the response the request would have returned if it had run
+// synchronously.
+type JobResult struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// Job is a request running in the background.
+type Job struct {
+	ID       string     `json:"id"`
+	Repo     string     `json:"repo"`
+	User     string     `json:"user"`
+	Endpoint string     `json:"endpoint"`
+	Status   JobStatus  `json:"status"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Events   []JobEvent `json:"events,omitempty"`
+	// EventsDropped counts events past maxJobEvents that were not kept.
+	EventsDropped int        `json:"events_dropped,omitempty"`
+	Result        *JobResult `json:"result,omitempty"`
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the job changes.
+	changed chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	run     func(ctx context.Context) JobResult
+}
+
+// send records a progress event; it makes a Job a progressSink.
+func (j *Job) send(event string, data any) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Events) >= maxJobEvents {
+		j.EventsDropped++
+		return
+	}
+	j.Events = append(j.Events, JobEvent{Time: time.Now(), Event: event, Data: b})
+	j.notifyLocked()
+}
+
+func (j *Job) notifyLocked() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// view returns a copy of the job that is safe to encode, with its events
+// only if withEvents is set.
+func (j *Job) view(withEvents bool) *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v := &Job{
+		ID: j.ID, Repo: j.Repo, User: j.User, Endpoint: j.Endpoint, Status: j.Status,
+		Created: j.Created, Started: j.Started, Finished: j.Finished,
+		EventsDropped: j.EventsDropped, Result: j.Result,
+	}
+	if withEvents {
+		v.Events = append([]JobEvent(nil), j.Events...)
+	}
+	return v
+}
+
+// done reports whether the job has finished. Callers holding j.mu check
+// j.Finished directly.
+func (j *Job) done() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Finished != nil
+}
+
+// JobManager queues jobs, runs them on a pool of workers and keeps finished
+// jobs on disk so they survive restarts.
+type JobManager struct {
+	dir   string
+	keep  int
+	queue chan *Job
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// order lists the jobs oldest first.
+	order []*Job
+}
+
+// jobs is the job manager, set in main.
+var jobs *JobManager
+
+// newJobManager loads the jobs saved in dir and starts the workers.
+func newJobManager(dir string, cfg *JobsConfig) (*JobManager, error) {
+	workers, keep := defaultJobWorkers, defaultJobsKept
+	if cfg != nil {
+		if cfg.Workers > 0 {
+			workers = cfg.Workers
+		}
+		if cfg.Keep > 0 {
+			keep = cfg.Keep
+		}
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &JobManager{dir: dir, keep: keep, queue: make(chan *Job, jobQueueSize), jobs: make(map[string]*Job)}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	for range workers {
+		go m.worker()
+	}
+	return m, nil
+}
+
+func (m *JobManager) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		job := &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			log.Printf("Skipping unreadable job file %s: %v", e.Name(), err)
+			continue
+		}
+		job.changed = make(chan struct{})
+		if job.Finished == nil {
+			// The server stopped while it was queued or running.
+			now := time.Now()
+			job.Status = JobInterrupted
+			job.Finished = &now
+			m.save(job)
+		}
+		m.jobs[job.ID] = job
+		m.order = append(m.order, job)
+	}
+	sort.Slice(m.order, func(a, b int) bool { return m.order[a].Created.Before(m.order[b].Created) })
+	m.prune()
+	return nil
+}
+
+// save writes the job to its file, replacing it atomically.
+func (m *JobManager) save(job *Job) {
+	data, err := json.Marshal(job.view(true))
+	if err != nil {
+		log.Println("Failed to encode job:", err)
+		return
+	}
+	path := filepath.Join(m.dir, job.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Println("Failed to save job:", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Println("Failed to save job:", err)
+	}
+}
+
+// prune forgets the oldest finished jobs beyond the configured number.
+func (m *JobManager) prune() {
+	finished := 0
+	for _, job := range m.order {
+		if job.done() {
+			finished++
+		}
+	}
+	kept := m.order[:0]
+	for _, job := range m.order {
+		if finished > m.keep && job.done() {
+			finished--
+			delete(m.jobs, job.ID)
+			os.Remove(filepath.Join(m.dir, job.ID+".json"))
+			continue
+		}
+		kept = append(kept, job)
+	}
+	m.order = kept
+}
+
+// errQueueFull is returned when too many jobs are waiting.
+var errQueueFull = errors.New("too many queued jobs, try again later")
+
+// Submit queues run as a new job. It runs with ctx's values, such as the
+// user and request info, but not its cancellation: the job outlives the
+// request that created it.
+func (m *JobManager) Submit(ctx context.Context, repo *Repo, endpoint string, run func(ctx context.Context) JobResult) (*Job, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:       hex.EncodeToString(id),
+		Repo:     repo.ID,
+		Endpoint: endpoint,
+		Status:   JobQueued,
+		Created:  time.Now(),
+		changed:  make(chan struct{}),
+		run:      run,
+	}
+	if user := currentUser(ctx); user != nil {
+		job.User = user.Name
+	}
+	job.ctx, job.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	job.ctx = withProgress(job.ctx, job)
+
+	m.mu.Lock()
+	select {
+	case m.queue <- job:
+	default:
+		m.mu.Unlock()
+		job.cancel()
+		return nil, errQueueFull
+	}
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job)
+	m.mu.Unlock()
+	m.save(job)
+	return job, nil
+}
+
+func (m *JobManager) worker() {
+	for job := range m.queue {
+		m.runJob(job)
+	}
+}
+
+func (m *JobManager) runJob(job *Job) {
+	defer job.cancel()
+	job.mu.Lock()
+	if job.Finished != nil {
+		// Canceled while queued.
+		job.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	job.Started = &now
+	job.Status = JobRunning
+	job.notifyLocked()
+	job.mu.Unlock()
+
+	result := job.run(job.ctx)
+
+	job.mu.Lock()
+	finished := time.Now()
+	job.Finished = &finished
+	job.Result = &result
+	switch {
+	case job.ctx.Err() != nil:
+		job.Status = JobCanceled
+	case result.Status >= 400:
+		job.Status = JobFailed
+	default:
+		job.Status = JobSucceeded
+	}
+	job.notifyLocked()
+	job.mu.Unlock()
+	m.finish(job)
+}
+
+// finish saves a finished job and drops old ones.
+func (m *JobManager) finish(job *Job) {
+	m.save(job)
+	m.mu.Lock()
+	m.prune()
+	m.mu.Unlock()
+}
+
+// Cancel stops a queued or running job. It reports false if the job had
+// already finished.
+func (m *JobManager) Cancel(job *Job) bool {
+	job.mu.Lock()
+	if job.Finished != nil {
+		job.mu.Unlock()
+		return false
+	}
+	job.cancel()
+	if job.Status == JobQueued {
+		now := time.Now()
+		job.Status = JobCanceled
+		job.Finished = &now
+		job.notifyLocked()
+		job.mu.Unlock()
+		m.finish(job)
+		return true
+	}
+	// A running job is marked canceled by its worker once it stops.
+	job.mu.Unlock()
+	return true
+}
+
+// Get returns the job with the given id.
+func (m *JobManager) Get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// List returns the jobs matching the filters, newest first.
+func (m *JobManager) List(user *User, repoID string, status JobStatus, limit int) []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []*Job{}
+	for i := len(m.order) - 1; i >= 0 && len(list) < limit; i-- {
+		job := m.order[i]
+		if !canSeeJob(user, job) || (repoID != "" && job.Repo != repoID) {
+			continue
+		}
+		v := job.view(false)
+		if status != "" && v.Status != status {
+			continue
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// canSeeJob reports whether user may look at or cancel job. Admins see every
+// job, everyone else only their own.
+func canSeeJob(user *User, job *Job) bool {
+	return user != nil && (user.Role >= RoleAdmin || user.Name == job.User)
+}
+
+// background lets the client run h as a background job by adding ?async=1.
+// The request is answered with 202 Accepted and the job, whose progress
+// and result are available under /jobs/{id}. Other requests are passed to h
+// unchanged.
+func background(h repoHandlerFunc) repoHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, repo *Repo) {
+		if r.URL.Query().Get("async") != "1" {
+			h(w, r, repo)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJobRequestBody))
+		if err != nil {
+			http.Error(w, "Failed to read request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		query.Del("async")
+		query.Del("stream")
+
+		job, err := jobs.Submit(r.Context(), repo, r.Method+" "+r.URL.Path, func(ctx context.Context) JobResult {
+			jr := r.Clone(ctx)
+			jr.URL.RawQuery = query.Encode()
+			jr.Header.Del("Accept")
+			jr.Body = io.NopCloser(bytes.NewReader(body))
+			res := &bufferedResponse{header: make(http.Header)}
+			h(res, jr, repo)
+			if res.status == 0 {
+				res.status = http.StatusOK
+			}
+			return JobResult{Status: res.status, Body: res.body.String()}
+		})
+		if err != nil {
+			http.Error(w, "Failed to start job: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, job.view(false))
+	}
+}
+
+// longRunning makes h available both as a background job and as an event
+// stream.
+func longRunning(h repoHandlerFunc) repoHandlerFunc {
+	return background(streamable(h))
+}
+
+// jobFromRequest looks up the {id} job and checks the user may see it.
+func jobFromRequest(w http.ResponseWriter, r *http.Request) *Job {
+	job := jobs.Get(r.PathValue("id"))
+	if job == nil || !canSeeJob(currentUser(r.Context()), job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil
+	}
+	return job
+}
+
+// jobsHandler: GET /jobs lists recent jobs, newest first, optionally
+// filtered by repo and status.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, 1000)
+	}
+	query := r.URL.Query()
+	writeJSON(w, jobs.List(currentUser(r.Context()), query.Get("repo"), JobStatus(query.Get("status")), limit))
+}
+
+// jobHandler: GET /jobs/{id} shows a job with its log and result.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if job := jobFromRequest(w, r); job != nil {
+		writeJSON(w, job.view(true))
+	}
+}
+
+// jobEventsHandler: GET /jobs/{id}/events streams the job's log as
+// Server-Sent Events, from the start and then as it happens, ending with a
+// "done" event once the job finishes.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	job := jobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+	stream := newSSEStream(w)
+	defer stream.keepAlive()()
+
+	sent := 0
+	for {
+		job.mu.Lock()
+		events := append([]JobEvent(nil), job.Events[sent:]...)
+		sent = len(job.Events)
+		changed := job.changed
+		finished := job.Finished != nil
+		status, result := job.Status, job.Result
+		job.mu.Unlock()
+
+		for _, e := range events {
+			stream.send(e.Event, e.Data)
+		}
+		if finished {
+			done := map[string]any{"status": 0, "body": fmt.Sprintf("Job %s", status), "job_status": status}
+			if result != nil {
+				done["status"], done["body"] = result.Status, result.Body
+			}
+			stream.send("done", done)
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// cancelJobHandler: POST /jobs/{id}/cancel stops a queued or running job.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := jobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+	if !jobs.Cancel(job) {
+		http.Error(w, "Job already finished", http.StatusConflict)
+		return
+	}
+	w.Write([]byte("Job canceled"))
+}
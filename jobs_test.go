@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitJob waits until job has finished and has been saved as finished.
+func waitJob(t *testing.T, m *JobManager, job *Job) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		var saved Job
+		data, err := os.ReadFile(filepath.Join(m.dir, job.ID+".json"))
+		if err == nil && json.Unmarshal(data, &saved) == nil && saved.Finished != nil {
+			return
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-timeout:
+			t.Fatalf("job %s did not finish", job.ID)
+		}
+	}
+}
+
+// eventData returns the events of job as event names and decoded data.
+func eventData(t *testing.T, job *Job) [][2]any {
+	t.Helper()
+	var got [][2]any
+	for _, e := range job.Events {
+		var data any
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, [2]any{e.Event, data})
+	}
+	return got
+}
+
+func TestJobLogsPersist(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newJobManager(dir, &JobsConfig{Workers: 1, Keep: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repo{ID: "ledger"}
+	ctx := context.WithValue(context.Background(), userContextKey, &User{Name: "alice"})
+
+	ok, err := m.Submit(ctx, repo, "POST /git/run", func(ctx context.Context) JobResult {
+		reportStep(ctx, "Pulling")
+		if _, _, err := runCommand(ctx, t.TempDir(), "sh", "-c", "echo one; echo two"); err != nil {
+			return JobResult{Status: http.StatusInternalServerError, Body: err.Error()}
+		}
+		return JobResult{Status: http.StatusOK, Body: "done"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := m.Submit(ctx, repo, "POST /api/pr", func(ctx context.Context) JobResult {
+		return JobResult{Status: http.StatusConflict, Body: "busy"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	canceled, err := m.Submit(ctx, repo, "POST /hbl/fetch", func(ctx context.Context) JobResult {
+		close(started)
+		<-ctx.Done()
+		return JobResult{Status: http.StatusInternalServerError, Body: ctx.Err().Error()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, m, ok)
+	waitJob(t, m, failed)
+	<-started
+	if !m.Cancel(canceled) {
+		t.Error("Cancel reported the running job as finished")
+	}
+	waitJob(t, m, canceled)
+	if m.Cancel(canceled) {
+		t.Error("Cancel reported the finished job as running")
+	}
+
+	// A job the server was running when it stopped, and a file that isn't
+	// a job.
+	interrupted := &Job{ID: "0000000000000001", Repo: "ledger", User: "bob", Endpoint: "POST /api/pull",
+		Status: JobRunning, Created: time.Now().Add(-time.Hour),
+		Events: []JobEvent{{Time: time.Now(), Event: "step", Data: json.RawMessage(`{"step":"Fetching"}`)}}}
+	data, _ := json.Marshal(interrupted)
+	os.WriteFile(filepath.Join(dir, interrupted.ID+".json"), data, 0o600)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600)
+
+	reloaded, err := newJobManager(dir, &JobsConfig{Workers: 1, Keep: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reloaded.Get(ok.ID)
+	if got == nil {
+		t.Fatal("finished job was not reloaded")
+	}
+	if got.Status != JobSucceeded || got.User != "alice" || got.Endpoint != "POST /git/run" ||
+		!reflect.DeepEqual(got.Result, &JobResult{Status: http.StatusOK, Body: "done"}) {
+		t.Errorf("reloaded job %+v", got.view(false))
+	}
+	wantEvents := [][2]any{
+		{"step", map[string]any{"step": "Pulling"}},
+		{"command", map[string]any{"argv": []any{"sh", "-c", "echo one; echo two"}}},
+		{"output", map[string]any{"stream": "stdout", "line": "one"}},
+		{"output", map[string]any{"stream": "stdout", "line": "two"}},
+	}
+	if events := eventData(t, got); !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("events %v\nwant %v", events, wantEvents)
+	}
+	if got := reloaded.Get(failed.ID); got == nil || got.Status != JobFailed {
+		t.Errorf("failed job reloaded as %+v", got)
+	}
+	if got := reloaded.Get(canceled.ID); got == nil || got.Status != JobCanceled {
+		t.Errorf("canceled job reloaded as %+v", got)
+	}
+
+	// Keep is 3, so the oldest of the four finished jobs, the interrupted
+	// one, was dropped, file and all.
+	if reloaded.Get(interrupted.ID) != nil {
+		t.Error("the oldest job was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, interrupted.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("the oldest job's file: %v", err)
+	}
+	list := reloaded.List(&User{Name: "alice"}, "", "", 10)
+	var ids []string
+	for _, job := range list {
+		ids = append(ids, job.ID)
+	}
+	if want := []string{canceled.ID, failed.ID, ok.ID}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("listed %q, want %q", ids, want)
+	}
+	if list := reloaded.List(&User{Name: "bob"}, "", "", 10); len(list) != 0 {
+		t.Errorf("bob sees %d of alice's jobs", len(list))
+	}
+}
+
+func TestJobInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	job := &Job{ID: "0000000000000002", Repo: "ledger", User: "bob", Endpoint: "POST /api/pull",
+		Status: JobQueued, Created: time.Now()}
+	data, _ := json.Marshal(job)
+	os.WriteFile(filepath.Join(dir, job.ID+".json"), data, 0o600)
+
+	m, err := newJobManager(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.Get(job.ID)
+	if got == nil || got.Status != JobInterrupted || got.Finished == nil {
+		t.Fatalf("got %+v", got)
+	}
+	// The new status is saved, so it survives another restart.
+	data, err = os.ReadFile(filepath.Join(dir, job.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Job
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Status != JobInterrupted {
+		t.Errorf("saved %s, %v", data, err)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ledgerSource reads the ledger files of one version of a repository: a
+// commit, the index or the working tree.
+type ledgerSource struct {
+	repo *Repo
+	// rev is a commit hash, ":" for the index or "" for the working tree.
+	rev string
+	// files lists the files of a commit or the index, for includes with
+	// globs and to tell missing files from errors.
+	files map[string]bool
+}
+
+func newLedgerSource(ctx context.Context, repo *Repo, rev string) (*ledgerSource, error) {
+	src := &ledgerSource{repo: repo, rev: rev}
+	if rev == "" {
+		return src, nil
+	}
+	args := []string{"ls-files", "-z"}
+	if rev != ":" {
+		args = []string{"ls-tree", "-r", "-z", "--name-only", rev}
+	}
+	out, err := repo.runGit(ctx, args...)
+	if err != nil {
+		return nil, gitStepError("Failed to list files", out, err)
+	}
+	src.files = make(map[string]bool)
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			src.files[name] = true
+		}
+	}
+	return src, nil
+}
+
+// read returns the content of the file name, relative to the repository, or
+// ok false if it doesn't exist in this version.
+func (src *ledgerSource) read(ctx context.Context, name string) (content string, ok bool, err error) {
+	if src.rev == "" {
+		data, err := os.ReadFile(filepath.Join(src.repo.Path, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return string(data), err == nil, err
+	}
+	if !src.files[name] {
+		return "", false, nil
+	}
+	out, err := src.repo.runGit(ctx, "cat-file", "blob", strings.TrimSuffix(src.rev, ":")+":"+name)
+	if err != nil {
+		return "", false, gitStepError("Failed to read "+name, out, err)
+	}
+	return out, true, nil
+}
+
+// glob returns the files matching an include pattern, sorted.
+func (src *ledgerSource) glob(pattern string) []string {
+	var matches []string
+	if src.rev == "" {
+		found, _ := filepath.Glob(filepath.Join(src.repo.Path, filepath.FromSlash(pattern)))
+		for _, f := range found {
+			if rel, err := filepath.Rel(src.repo.Path, f); err == nil {
+				matches = append(matches, filepath.ToSlash(rel))
+			}
+		}
+	} else {
+		for name := range src.files {
+			if ok, _ := path.Match(pattern, name); ok {
+				matches = append(matches, name)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// loadLedger parses the transactions of mainFile and the files it includes.
+// Problems with single files are returned as messages rather than failing
+// the whole diff. A missing main file is an empty ledger.
+func loadLedger(ctx context.Context, src *ledgerSource, mainFile string) ([]*Transaction, []string, error) {
+	var txns []*Transaction
+	var errs []string
+	seen := make(map[string]bool)
+	mainFile = path.Clean(filepath.ToSlash(mainFile))
+	queue := []string{mainFile}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		content, ok, err := src.read(ctx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			if name != mainFile {
+				errs = append(errs, fmt.Sprintf("%s: included file not found", name))
+			}
+			continue
+		}
+		fileTxns, includes, fileErrs := parseLedger(name, content)
+		txns = append(txns, fileTxns...)
+		errs = append(errs, fileErrs...)
+		for _, inc := range includes {
+			if path.IsAbs(inc) || !filepath.IsLocal(filepath.FromSlash(inc)) {
+				errs = append(errs, fmt.Sprintf("%s: include %s is outside the repository", name, inc))
+				continue
+			}
+			if strings.ContainsAny(inc, "*?[") {
+				queue = append(queue, src.glob(inc)...)
+			} else {
+				queue = append(queue, inc)
+			}
+		}
+	}
+	return txns, errs, nil
+}
+
+// LedgerChange is a transaction that was modified.
+type LedgerChange struct {
+	Old *Transaction `json:"old"`
+	New *Transaction `json:"new"`
+}
+
+// BalanceDelta is the net change of an account in one currency.
+type BalanceDelta struct {
+	Account  string `json:"account"`
+	Currency string `json:"currency"`
+	Delta    string `json:"delta"`
+}
+
+// LedgerDiff compares the transactions of two versions of a ledger.
+type LedgerDiff struct {
+	From     string         `json:"from"`
+	To       string         `json:"to"`
+	Added    []*Transaction `json:"added"`
+	Removed  []*Transaction `json:"removed"`
+	Modified []LedgerChange `json:"modified"`
+	Balances []BalanceDelta `json:"balances"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// diffLedgers matches the old and new transactions. Identical transactions
+// are unchanged wherever they moved. Of the rest, those sharing the date,
+// payee and narration, or failing that the date and accounts, are paired as
+// modified.
+func diffLedgers(oldTxns, newTxns []*Transaction) *LedgerDiff {
+	d := &LedgerDiff{Added: []*Transaction{}, Removed: []*Transaction{}, Modified: []LedgerChange{}, Balances: []BalanceDelta{}}
+
+	unchanged := make(map[string][]*Transaction)
+	for _, t := range oldTxns {
+		unchanged[t.key()] = append(unchanged[t.key()], t)
+	}
+	var added []*Transaction
+	for _, t := range newTxns {
+		if same := unchanged[t.key()]; len(same) > 0 {
+			unchanged[t.key()] = same[1:]
+			continue
+		}
+		added = append(added, t)
+	}
+	var removed []*Transaction
+	for _, t := range oldTxns {
+		if same := unchanged[t.key()]; len(same) > 0 && same[0] == t {
+			unchanged[t.key()] = same[1:]
+			removed = append(removed, t)
+		}
+	}
+
+	pairKeys := []func(*Transaction) string{
+		func(t *Transaction) string { return t.Date + "\x00" + t.Payee + "\x00" + t.Narration },
+		func(t *Transaction) string {
+			accounts := make([]string, len(t.Postings))
+			for i, p := range t.Postings {
+				accounts[i] = p.Account
+			}
+			sort.Strings(accounts)
+			return t.Date + "\x00" + strings.Join(accounts, "\x00")
+		},
+	}
+	for _, pairKey := range pairKeys {
+		candidates := make(map[string][]*Transaction)
+		for _, t := range removed {
+			candidates[pairKey(t)] = append(candidates[pairKey(t)], t)
+		}
+		paired := make(map[*Transaction]bool)
+		var stillAdded []*Transaction
+		for _, t := range added {
+			if old := candidates[pairKey(t)]; len(old) > 0 {
+				candidates[pairKey(t)] = old[1:]
+				paired[old[0]] = true
+				d.Modified = append(d.Modified, LedgerChange{Old: old[0], New: t})
+				continue
+			}
+			stillAdded = append(stillAdded, t)
+		}
+		added = stillAdded
+		var stillRemoved []*Transaction
+		for _, t := range removed {
+			if !paired[t] {
+				stillRemoved = append(stillRemoved, t)
+			}
+		}
+		removed = stillRemoved
+	}
+	d.Added = append(d.Added, added...)
+	d.Removed = append(d.Removed, removed...)
+
+	byDate := func(a, b *Transaction) bool {
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	}
+	sort.SliceStable(d.Added, func(i, j int) bool { return byDate(d.Added[i], d.Added[j]) })
+	sort.SliceStable(d.Removed, func(i, j int) bool { return byDate(d.Removed[i], d.Removed[j]) })
+	sort.SliceStable(d.Modified, func(i, j int) bool { return byDate(d.Modified[i].New, d.Modified[j].New) })
+
+	// Unchanged transactions cancel out, so only the changes count.
+	totals := make(map[[2]string]*big.Rat)
+	addBalances := func(t *Transaction, sign int) {
+		for account, amounts := range t.balances() {
+			for currency, n := range amounts {
+				k := [2]string{account, currency}
+				if totals[k] == nil {
+					totals[k] = new(big.Rat)
+				}
+				if sign < 0 {
+					totals[k].Sub(totals[k], n)
+				} else {
+					totals[k].Add(totals[k], n)
+				}
+			}
+		}
+	}
+	for _, t := range d.Added {
+		addBalances(t, 1)
+	}
+	for _, t := range d.Removed {
+		addBalances(t, -1)
+	}
+	for _, c := range d.Modified {
+		addBalances(c.New, 1)
+		addBalances(c.Old, -1)
+	}
+	for k, n := range totals {
+		if n.Sign() != 0 {
+			d.Balances = append(d.Balances, BalanceDelta{Account: k[0], Currency: k[1], Delta: ratString(n)})
+		}
+	}
+	sort.Slice(d.Balances, func(i, j int) bool {
+		if d.Balances[i].Account != d.Balances[j].Account {
+			return d.Balances[i].Account < d.Balances[j].Account
+		}
+		return d.Balances[i].Currency < d.Balances[j].Currency
+	})
+	return d
+}
+
+// ledgerDiff compares the ledger at two versions, each a commit hash, ":"
+// for the index or "" for the working tree. The shared lock is held
+// throughout so both sides are read from a consistent repository.
+func ledgerDiff(ctx context.Context, repo *Repo, from, to string) (*LedgerDiff, error) {
+	ctx, release, err := repo.lock.acquire(ctx, false, "ledger diff")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var sides [2][]*Transaction
+	var errs []string
+	for i, rev := range []string{from, to} {
+		src, err := newLedgerSource(ctx, repo, rev)
+		if err != nil {
+			return nil, err
+		}
+		txns, sideErrs, err := loadLedger(ctx, src, repo.MainFile)
+		if err != nil {
+			return nil, err
+		}
+		sides[i] = txns
+		label := ledgerRevLabel(rev)
+		for _, e := range sideErrs {
+			errs = append(errs, label+": "+e)
+		}
+	}
+	d := diffLedgers(sides[0], sides[1])
+	d.From, d.To, d.Errors = ledgerRevLabel(from), ledgerRevLabel(to), errs
+	return d, nil
+}
+
+func ledgerRevLabel(rev string) string {
+	switch rev {
+	case "":
+		return "working tree"
+	case ":":
+		return "index"
+	}
+	return shortHash(rev)
+}
+
+// resolveCommit returns the hash of the commit rev names.
+func resolveCommit(ctx context.Context, repo *Repo, rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") || strings.ContainsAny(rev, " \t\n") {
+		return "", fmt.Errorf("invalid revision %q", rev)
+	}
+	out, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q", rev)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// apiLedgerDiffHandler: GET /api/ledger-diff?cached=1&range= compares the
+// transactions of two versions of the ledger instead of its lines, with the
+// balance change of every affected account. The options are those of
+// /api/diff: by default the working tree is compared with HEAD, cached=1
+// compares the index with HEAD, range A..B compares two commits, A...B
+// compares B with where it forked from A, and a single commit is compared
+// with the working tree.
+func apiLedgerDiffHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	cached := query.Get("cached") == "1"
+	rev := strings.TrimSpace(query.Get("range"))
+	if cached && rev != "" {
+		http.Error(w, "cached and range can't be combined", http.StatusBadRequest)
+		return
+	}
+	from, to := "HEAD", ""
+	if cached {
+		to = ":"
+	}
+	forked := false
+	if a, b, ok := strings.Cut(rev, "..."); ok {
+		from, to, forked = a, b, true
+	} else if a, b, ok := strings.Cut(rev, ".."); ok {
+		from, to = a, b
+	} else if rev != "" {
+		from = rev
+	}
+	if from == "" {
+		from = "HEAD"
+	}
+	if rev != "" && to == "" && strings.Contains(rev, "..") {
+		to = "HEAD"
+	}
+
+	var err error
+	if from, err = resolveCommit(ctx, repo, from); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to != "" && to != ":" {
+		if to, err = resolveCommit(ctx, repo, to); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if forked {
+		out, err := repo.runGit(ctx, "merge-base", from, to)
+		if err != nil {
+			http.Error(w, gitStepError("Failed to find the merge base", out, err).Error(), errorStatus(err))
+			return
+		}
+		from = strings.TrimSpace(out)
+	}
+	d, err := ledgerDiff(ctx, repo, from, to)
+	if err != nil {
+		http.Error(w, "Failed to diff the ledger: "+err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, d)
+}
+
+// apiPRLedgerDiffHandler: GET /api/prs/{number}/ledger-diff returns the
+// transactions the PR would add, remove or modify in its base branch.
+func apiPRLedgerDiffHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	pr := prFromRequest(w, r, repo)
+	if pr == nil {
+		return
+	}
+	ctx := r.Context()
+	if err := fetchPR(ctx, repo, pr); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	out, err := repo.runGit(ctx, "merge-base", "origin/"+pr.Base, pr.HeadSHA)
+	if err != nil {
+		http.Error(w, gitStepError("Failed to find the merge base", out, err).Error(), errorStatus(err))
+		return
+	}
+	d, err := ledgerDiff(ctx, repo, strings.TrimSpace(out), pr.HeadSHA)
+	if err != nil {
+		http.Error(w, "Failed to diff the ledger: "+err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, d)
+}
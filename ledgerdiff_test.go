@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// mustParseLedger parses a test ledger that has no errors.
+func mustParseLedger(t *testing.T, file, content string) []*Transaction {
+	t.Helper()
+	txns, _, errs := parseLedger(file, content)
+	if len(errs) > 0 {
+		t.Fatalf("%s: %q", file, errs)
+	}
+	return txns
+}
+
+func TestDiffLedgers(t *testing.T) {
+	oldTxns := mustParseLedger(t, "main.bean", `
+2025-01-01 * "Rent"
+  Expenses:Rent  1000 USD
+  Assets:Bank
+
+2025-01-02 * "Cafe" "Coffee"
+  Expenses:Food  3.50 USD
+  Assets:Cash
+
+2025-01-03 * "Groceries"
+  Expenses:Food  20 USD
+  Assets:Cash
+
+2025-01-04 * "Gym"
+  Expenses:Health  30 USD
+  Assets:Bank
+`)
+	newTxns := mustParseLedger(t, "main.bean", `
+2025-01-02 * "Cafe" "Coffee"
+  Expenses:Food  4.00 USD
+  Assets:Cash
+
+2025-01-03 * "Supermarket"
+  Expenses:Food  20 USD
+  Assets:Cash
+
+2025-01-05 * "Book"
+  Expenses:Books  15 USD
+  Assets:Cash
+`)
+	// Rent moved to another file and its amount was rewritten, but it is
+	// the same transaction.
+	newTxns = append(newTxns, mustParseLedger(t, "2025/rent.bean", `
+2025-01-01 * "Rent"
+  Expenses:Rent  1000.00 USD
+  Assets:Bank
+`)...)
+
+	d := diffLedgers(oldTxns, newTxns)
+	narrations := func(txns []*Transaction) []string {
+		s := []string{}
+		for _, t := range txns {
+			s = append(s, t.Narration)
+		}
+		return s
+	}
+	if got := narrations(d.Added); !reflect.DeepEqual(got, []string{"Book"}) {
+		t.Errorf("added %q", got)
+	}
+	if got := narrations(d.Removed); !reflect.DeepEqual(got, []string{"Gym"}) {
+		t.Errorf("removed %q", got)
+	}
+	var modified [][2]string
+	for _, c := range d.Modified {
+		modified = append(modified, [2]string{c.Old.Narration, c.New.Narration})
+	}
+	// Coffee is paired by date, payee and narration, Groceries by date and
+	// accounts.
+	if want := [][2]string{{"Coffee", "Coffee"}, {"Groceries", "Supermarket"}}; !reflect.DeepEqual(modified, want) {
+		t.Errorf("modified %q, want %q", modified, want)
+	}
+	wantBalances := []BalanceDelta{
+		{Account: "Assets:Bank", Currency: "USD", Delta: "30"},
+		{Account: "Assets:Cash", Currency: "USD", Delta: "-15.5"},
+		{Account: "Expenses:Books", Currency: "USD", Delta: "15"},
+		{Account: "Expenses:Food", Currency: "USD", Delta: "0.5"},
+		{Account: "Expenses:Health", Currency: "USD", Delta: "-30"},
+	}
+	if !reflect.DeepEqual(d.Balances, wantBalances) {
+		t.Errorf("balances %+v\nwant %+v", d.Balances, wantBalances)
+	}
+}
+
+func TestDiffLedgersDuplicates(t *testing.T) {
+	coffee := `
+2025-01-02 * "Coffee"
+  Expenses:Food  3 USD
+  Assets:Cash
+`
+	oldTxns := mustParseLedger(t, "main.bean", coffee)
+	newTxns := mustParseLedger(t, "main.bean", coffee+coffee)
+	d := diffLedgers(oldTxns, newTxns)
+	if len(d.Added) != 1 || d.Added[0].Line != 6 || len(d.Removed) != 0 || len(d.Modified) != 0 {
+		t.Errorf("got %+v", d)
+	}
+
+	d = diffLedgers(newTxns, oldTxns)
+	if len(d.Removed) != 1 || len(d.Added) != 0 || len(d.Modified) != 0 {
+		t.Errorf("got %+v", d)
+	}
+	if want := []BalanceDelta{{"Assets:Cash", "USD", "3"}, {"Expenses:Food", "USD", "-3"}}; !reflect.DeepEqual(d.Balances, want) {
+		t.Errorf("balances %+v", d.Balances)
+	}
+
+	if d := diffLedgers(oldTxns, oldTxns); len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.Balances) != 0 {
+		t.Errorf("identical ledgers: got %+v", d)
+	}
+}
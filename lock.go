@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultLockTimeout is how long a request waits for a busy repository.
+const defaultLockTimeout = 30 * time.Second
+
+// readOnlyGitCommands can run alongside each other. Every other git
+// subcommand takes the repository lock exclusively.
+var readOnlyGitCommands = map[string]bool{
+	"blame":            true,
+	"cat-file":         true,
+	"check-ref-format": true,
+	"describe":         true,
+	"diff":             true,
+	"for-each-ref":     true,
+	"grep":             true,
+	"log":              true,
+	"ls-files":         true,
+	"ls-remote":        true,
+	"ls-tree":          true,
+	"merge-base":       true,
+	"merge-file":       true,
+	"rev-list":         true,
+	"rev-parse":        true,
+	"shortlog":         true,
+	"show":             true,
+	"status":           true,
+	"verify-commit":    true,
+}
+
+// LockHolder describes an operation holding the repository lock.
+type LockHolder struct {
+	Op    string    `json:"op"`
+	User  string    `json:"user"`
+	Write bool      `json:"write"`
+	Since time.Time `json:"since"`
+}
+
+// BusyError is returned when the repository lock could not be acquired in
+// time.
+type BusyError struct {
+	Holder LockHolder
+	Waited time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("repository busy: running %s for user %s (since %s, waited %s)",
+		e.Holder.Op, e.Holder.User, e.Holder.Since.Format(time.TimeOnly), e.Waited.Round(time.Second))
+}
+
+func (e *BusyError) HTTPStatus() int { return http.StatusConflict }
+
+type lockWaiter struct {
+	holder *LockHolder
+	ready  chan struct{}
+}
+
+// repoLock is a first-come first-served read/write lock. Read-only git
+// commands share it; mutating commands and multi-step workflows hold it
+// exclusively. Unlike sync.RWMutex it knows who holds it, so waiters that
+// time out can say what they were waiting for.
+type repoLock struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	readers map[*LockHolder]bool
+	writer  *LockHolder
+	queue   []*lockWaiter
+}
+
+func newRepoLock(timeout time.Duration) *repoLock {
+	return &repoLock{timeout: timeout, readers: make(map[*LockHolder]bool)}
+}
+
+// lockContextKey marks contexts whose operation already holds a lock, so
+// nested git commands of a workflow don't wait on themselves.
+type lockContextKey struct{ lock *repoLock }
+
+// acquire waits until the lock is available in the requested mode, the
+// timeout expires or ctx is done. The returned context records the held
+// lock and must be passed to the commands run under it.
+func (l *repoLock) acquire(ctx context.Context, write bool, op string) (context.Context, func(), error) {
+	if held, ok := ctx.Value(lockContextKey{l}).(*LockHolder); ok {
+		if write && !held.Write {
+			return nil, nil, fmt.Errorf("%s needs exclusive access but %s holds a shared lock", op, held.Op)
+		}
+		return ctx, func() {}, nil
+	}
+
+	holder := &LockHolder{Op: op, Write: write}
+	if user := currentUser(ctx); user != nil {
+		holder.User = user.Name
+	}
+
+	start := time.Now()
+	l.mu.Lock()
+	if len(l.queue) == 0 && l.available(write) {
+		l.grantLocked(holder)
+		l.mu.Unlock()
+		return context.WithValue(ctx, lockContextKey{l}, holder), func() { l.release(holder) }, nil
+	}
+	waiter := &lockWaiter{holder: holder, ready: make(chan struct{})}
+	l.queue = append(l.queue, waiter)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var cause error
+	select {
+	case <-waiter.ready:
+		return context.WithValue(ctx, lockContextKey{l}, holder), func() { l.release(holder) }, nil
+	case <-timer.C:
+	case <-ctx.Done():
+		cause = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// Granted just as we gave up; hand it on.
+		l.releaseLocked(holder)
+	default:
+		for i, w := range l.queue {
+			if w == waiter {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+		// Readers queued behind this waiter may be able to run now.
+		l.dispatchLocked()
+	}
+	if cause != nil {
+		return nil, nil, cause
+	}
+	return nil, nil, &BusyError{Holder: l.currentHolderLocked(), Waited: time.Since(start)}
+}
+
+func (l *repoLock) available(write bool) bool {
+	if write {
+		return l.writer == nil && len(l.readers) == 0
+	}
+	return l.writer == nil
+}
+
+func (l *repoLock) grantLocked(h *LockHolder) {
+	h.Since = time.Now()
+	if h.Write {
+		l.writer = h
+	} else {
+		l.readers[h] = true
+	}
+}
+
+func (l *repoLock) release(h *LockHolder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(h)
+}
+
+func (l *repoLock) releaseLocked(h *LockHolder) {
+	if l.writer == h {
+		l.writer = nil
+	}
+	delete(l.readers, h)
+	l.dispatchLocked()
+}
+
+// dispatchLocked grants the lock to waiters at the head of the queue.
+func (l *repoLock) dispatchLocked() {
+	for len(l.queue) > 0 {
+		next := l.queue[0]
+		if !l.available(next.holder.Write) {
+			return
+		}
+		l.queue = l.queue[1:]
+		l.grantLocked(next.holder)
+		close(next.ready)
+	}
+}
+
+// currentHolderLocked returns the writer, or the oldest reader.
+func (l *repoLock) currentHolderLocked() LockHolder {
+	if l.writer != nil {
+		return *l.writer
+	}
+	var oldest *LockHolder
+	for r := range l.readers {
+		if oldest == nil || r.Since.Before(oldest.Since) {
+			oldest = r
+		}
+	}
+	if oldest == nil {
+		return LockHolder{Op: "a queued operation"}
+	}
+	return *oldest
+}
+
+// LockStatus is the state of a repository lock reported by /api/lock.
+type LockStatus struct {
+	Holders []LockHolder `json:"holders"`
+	Queued  []LockHolder `json:"queued"`
+}
+
+func (l *repoLock) status() LockStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := LockStatus{Holders: []LockHolder{}, Queued: []LockHolder{}}
+	if l.writer != nil {
+		st.Holders = append(st.Holders, *l.writer)
+	}
+	for r := range l.readers {
+		st.Holders = append(st.Holders, *r)
+	}
+	for _, w := range l.queue {
+		st.Queued = append(st.Queued, *w.holder)
+	}
+	return st
+}
+
+// apiLockHandler: GET /api/lock shows who holds the repository lock.
+func apiLockHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	writeJSON(w, repo.lock.status())
+}
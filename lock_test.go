@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n operations are queued for l.
+func waitQueued(t *testing.T, l *repoLock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(l.status().Queued) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d operations queued, want %d", len(l.status().Queued), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// mustAcquire acquires l, failing the test if that fails.
+func mustAcquire(t *testing.T, l *repoLock, write bool, op string) func() {
+	t.Helper()
+	_, release, err := l.acquire(context.Background(), write, op)
+	if err != nil {
+		t.Fatalf("%s: %v", op, err)
+	}
+	return release
+}
+
+func TestRepoLockFIFO(t *testing.T) {
+	l := newRepoLock(5 * time.Second)
+	releaseFirst := mustAcquire(t, l, true, "first")
+
+	// Each operation reports when it gets the lock and holds it until told
+	// to release it.
+	type op struct {
+		name    string
+		write   bool
+		release chan struct{}
+	}
+	ops := []*op{{"read 1", false, nil}, {"write", true, nil}, {"read 2", false, nil}}
+	granted := make(chan string)
+	var wg sync.WaitGroup
+	for i, o := range ops {
+		o.release = make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, release, err := l.acquire(context.Background(), o.write, o.name)
+			if err != nil {
+				t.Error(err)
+				granted <- ""
+				return
+			}
+			granted <- o.name
+			<-o.release
+			release()
+		}()
+		waitQueued(t, l, i+1)
+	}
+	expectGranted := func(want string) {
+		t.Helper()
+		select {
+		case got := <-granted:
+			if got != want {
+				t.Fatalf("%q got the lock, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not get the lock", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-granted:
+			t.Fatalf("%q got the lock out of turn", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	releaseFirst()
+	expectGranted("read 1")
+	// The second reader could share the lock with the first, but it queued
+	// behind the writer.
+	expectNone()
+	close(ops[0].release)
+	expectGranted("write")
+	expectNone()
+	close(ops[1].release)
+	expectGranted("read 2")
+	close(ops[2].release)
+	wg.Wait()
+
+	// Readers share the lock when nobody is waiting.
+	releaseA := mustAcquire(t, l, false, "a")
+	releaseB := mustAcquire(t, l, false, "b")
+	if n := len(l.status().Holders); n != 2 {
+		t.Errorf("%d holders, want 2", n)
+	}
+	releaseA()
+	releaseB()
+}
+
+func TestRepoLockBusy(t *testing.T) {
+	l := newRepoLock(20 * time.Millisecond)
+	ctx := context.WithValue(context.Background(), userContextKey, &User{Name: "alice"})
+	_, release, err := l.acquire(ctx, true, "git pull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	for _, write := range []bool{true, false} {
+		_, _, err := l.acquire(context.Background(), write, "git status")
+		var busy *BusyError
+		if !errors.As(err, &busy) {
+			t.Fatalf("write=%v: got %v, want a BusyError", write, err)
+		}
+		if busy.Holder.Op != "git pull" || busy.Holder.User != "alice" || busy.Waited < 20*time.Millisecond {
+			t.Errorf("write=%v: got %+v", write, busy)
+		}
+		if !strings.Contains(err.Error(), "running git pull for user alice") {
+			t.Errorf("write=%v: message %q", write, err)
+		}
+	}
+	if st := l.status(); len(st.Queued) != 0 || len(st.Holders) != 1 {
+		t.Errorf("status after timeouts: %+v", st)
+	}
+}
+
+func TestRepoLockCancel(t *testing.T) {
+	l := newRepoLock(5 * time.Second)
+	releaseReader := mustAcquire(t, l, false, "reader")
+
+	// A writer waits for the reader, and another reader queues behind it.
+	ctx, cancel := context.WithCancel(context.Background())
+	writerErr := make(chan error)
+	go func() {
+		_, _, err := l.acquire(ctx, true, "writer")
+		writerErr <- err
+	}()
+	waitQueued(t, l, 1)
+	readerDone := make(chan func())
+	go func() {
+		_, release, err := l.acquire(context.Background(), false, "queued reader")
+		if err != nil {
+			t.Error(err)
+		}
+		readerDone <- release
+	}()
+	waitQueued(t, l, 2)
+
+	// When the writer gives up, the reader behind it can share the lock
+	// with the first reader straight away.
+	cancel()
+	if err := <-writerErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("writer: got %v, want context.Canceled", err)
+	}
+	select {
+	case release := <-readerDone:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the queued reader was not granted the lock")
+	}
+	releaseReader()
+	if st := l.status(); len(st.Queued)+len(st.Holders) != 0 {
+		t.Errorf("status after release: %+v", st)
+	}
+}
+
+func TestRepoLockGrantedWhileGivingUp(t *testing.T) {
+	l := newRepoLock(5 * time.Second)
+	_, releaseFirst, err := l.acquire(context.Background(), true, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writerErr := make(chan error)
+	go func() {
+		_, _, err := l.acquire(ctx, true, "writer")
+		writerErr <- err
+	}()
+	waitQueued(t, l, 1)
+	readerDone := make(chan func())
+	go func() {
+		_, release, err := l.acquire(context.Background(), false, "reader")
+		if err != nil {
+			t.Error(err)
+		}
+		readerDone <- release
+	}()
+	waitQueued(t, l, 2)
+
+	// Cancel the writer while holding the lock's mutex, so it gives up but
+	// can't leave the queue, then grant it the lock before it gets there.
+	l.mu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	l.releaseLocked(mustHolder(t, l, "first"))
+	l.mu.Unlock()
+	releaseFirst() // Releasing twice is harmless.
+
+	if err := <-writerErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("writer: got %v, want context.Canceled", err)
+	}
+	// The writer handed the lock on to the reader.
+	select {
+	case release := <-readerDone:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the reader was not granted the lock")
+	}
+	if st := l.status(); len(st.Queued)+len(st.Holders) != 0 {
+		t.Errorf("status after release: %+v", st)
+	}
+}
+
+// mustHolder returns the holder of l running op. l.mu must be held.
+func mustHolder(t *testing.T, l *repoLock, op string) *LockHolder {
+	t.Helper()
+	if l.writer != nil && l.writer.Op == op {
+		return l.writer
+	}
+	for r := range l.readers {
+		if r.Op == op {
+			return r
+		}
+	}
+	t.Fatalf("%s does not hold the lock", op)
+	return nil
+}
+
+func TestRepoLockNested(t *testing.T) {
+	l := newRepoLock(20 * time.Millisecond)
+	ctx, release, err := l.acquire(context.Background(), true, "workflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Commands run under the workflow's context don't wait on it.
+	for _, write := range []bool{true, false} {
+		nestedCtx, nestedRelease, err := l.acquire(ctx, write, "step")
+		if err != nil || nestedCtx != ctx {
+			t.Fatalf("write=%v: got %v", write, err)
+		}
+		nestedRelease()
+	}
+	if st := l.status(); len(st.Holders) != 1 || st.Holders[0].Op != "workflow" {
+		t.Errorf("nested release dropped the lock: %+v", st)
+	}
+	// Other locks are unaffected.
+	other := newRepoLock(time.Second)
+	if _, otherRelease, err := other.acquire(ctx, true, "other"); err != nil {
+		t.Error(err)
+	} else {
+		otherRelease()
+	}
+	release()
+
+	// A shared lock can't be upgraded.
+	ctx, release, err = l.acquire(context.Background(), false, "health check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, _, err := l.acquire(ctx, false, "git log"); err != nil {
+		t.Errorf("read under read: %v", err)
+	}
+	_, _, err = l.acquire(ctx, true, "git read-tree")
+	if err == nil || err.Error() != "git read-tree needs exclusive access but health check holds a shared lock" {
+		t.Errorf("write under read: got %v", err)
+	}
+}
@@ -1,80 +1,35 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 )
 
-// Get Git repository path from ENV variable, fallback if not set
-var GitRepoPath = getRepoPath()
-var HBLReportsDir = filepath.Join(GitRepoPath, "hbl-swipe-statements/reports")
-
-func getRepoURL() string {
-	if path, exists := os.LookupEnv("GIT_REPO_URL"); exists {
-		return path
-	}
-	return "https://github.com/sumanchapai/superview-accounting"
-}
-
-func getRepoPath() string {
-	if path, exists := os.LookupEnv("GIT_REPO_PATH"); exists {
-		return path
-	}
-	return "/Users/suman/Desktop/projects/superview/superview-accounting"
-}
-
 // GitCommand represents a request to run a git command.
 type GitCommand struct {
 	Command []string `json:"command"`
 }
 
-// runGit executes a git command inside the Git repo directory.
-func runGit(command ...string) (string, error) {
-	cmd := exec.Command("git", command...)
-	cmd.Dir = GitRepoPath // Enforce the working directory
-
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return stderr.String(), err
-	}
-	return out.String(), nil
-}
-
-// Allowed Git commands (ensures security)
-var allowedCommands = map[string]bool{
-	"show":     true,
-	"status":   true,
-	"log":      true,
-	"diff":     true,
-	"pull":     true,
-	"push":     true,
-	"add":      true,
-	"commit":   true,
-	"checkout": true,
-	"branch":   true,
-	"reset":    true,
-	"merge":    true,
-}
+// policy decides which git commands /git/run accepts. It is replaced in main
+// once the config file has been loaded.
+var policy *Policy
 
 // rootHandler: Serve the main page with Git status and a command input form
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	html := fmt.Sprintf(`<!DOCTYPE html>
+func rootHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	user := currentUser(r.Context())
+	page := fmt.Sprintf(`<!DOCTYPE html>
 <html>
 <head>
     <title>Git Server</title>
@@ -106,6 +61,26 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
       .diff-deletion { color: #b31d28; background-color: #ffeef0; }
       .diff-hunk     { color: #6a737d; font-weight: bold; }
 
+      .diff-file { border: 1px solid #ccc; margin: 0.5rem 0; }
+      .diff-file summary { background: #f6f8fa; padding: 4px; cursor: pointer; font-family: monospace; }
+      .diff-table { border-collapse: collapse; width: 100%%; font-family: monospace; font-size: 12px; }
+      .diff-table td { padding: 0 4px; white-space: pre-wrap; word-break: break-all; vertical-align: top; }
+      .diff-table td.diff-num { color: #6a737d; text-align: right; user-select: none; width: 1%%; white-space: nowrap; }
+      .ledger-balances td { padding: 0 8px; font-family: monospace; }
+      .query-table { overflow-x: auto; }
+      .query-table table { border-collapse: collapse; font-size: 13px; }
+      .query-table th { cursor: pointer; background: #f6f8fa; text-align: left; white-space: nowrap; }
+      .query-table th, .query-table td { border: 1px solid #ddd; padding: 2px 6px; }
+      .query-table td.num { text-align: right; font-family: monospace; white-space: nowrap; }
+      .diff-table tr.check-error td { outline: 1px solid #d73a49; }
+      .diff-table tr.check-focus td { background-color: #fff5b1; }
+      .ledger-balances td.amount { text-align: right; }
+      .word-add { background-color: #acf2bd; }
+      .word-del { background-color: #fdb8c0; }
+
+      .conflict-hunk { border: 1px solid #d73a49; margin: 0.5rem 0; padding: 0.5rem; }
+      .conflict-hunk pre { margin: 0.25rem 0; background: #f6f8fa; overflow-x: auto; }
+
       .responsive-grid {
         display: grid;
         grid-template-columns: 1fr; /* default: single column on small screens */
@@ -121,15 +96,47 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 </head>
 <body>
   <a href="/">&larr; Back to Beancount</a>
+  <form method="POST" action="/logout" style="float: right;">
+    Signed in as %s (%s)
+    <button type="submit">Logout</button>
+  </form>
   </br>
   </br>
-  <a href="%s">%s</a>
+  <label>Repository: <select id="repoSelect" onchange="location.href = '/repos/' + this.value + '/'">%s</select></label>
+  <a href="%s">%s</a>%s
+  | <a href="/audit">Audit log</a>
   <div class="responsive-grid">
     <div>
       <div style="border: 1px solid black; margin-top: 2rem;">
       <h2>Create PR with Edits</h2>
+      <label>Topic (optional): <input id="prTopic" placeholder="e.g. March receipts"></label>
       <button onclick="createPR()">Create PR</button>
+      <button onclick="checkLedger()">Check ledger</button>
       <pre id="prOutput"></pre>
+      <div id="checkProblems"></div>
+      <h3>Changes to commit</h3>
+      <div id="changes"></div>
+      <h3>Edit branches</h3>
+      <p id="editBranchesInfo"></p>
+      <table id="editBranches"></table>
+      </div>
+
+      <div style="border: 1px solid green; margin-top: 2rem;">
+      <h2>Pull Requests</h2>
+      <button onclick="refreshPRs()">Refresh</button>
+      <div id="prList"></div>
+      <div id="prDetail"></div>
+      <pre id="prDiff" class="diff-output" style="display: none;"></pre>
+      <div id="prLedgerDiff"></div>
+      </div>
+
+      <div id="conflictsPanel" style="border: 1px solid red; margin-top: 2rem; display: none;">
+      <h2>Merge Conflicts</h2>
+      <p id="conflictsSummary"></p>
+      <div id="conflictFiles"></div>
+      <button onclick="completeMerge()">Complete merge</button>
+      <button onclick="abortMerge()">Abort merge</button>
+      <pre id="conflictsOutput"></pre>
       </div>
 
       <div style="border: 1px solid orange; margin-top: 2rem;">
@@ -138,28 +145,73 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
         <input type="text" id="command" placeholder="Enter git command (e.g., log --oneline)" style="width: 80%%;">
         <button type="submit">Run</button>
       </form>
+      <div>
+        <input id="commandHistorySearch" placeholder="Search history" oninput="refreshHistory('command')">
+        <select id="commandHistory" onchange="pickHistory('command')" style="max-width: 60%%;"></select>
+        <button onclick="rerunHistory('command')">Run again</button>
+      </div>
       <h3>Output:</h3>
       <pre id="output"></pre>
       </div>
 
       <div style="border: 1px solid purple; margin-top: 2rem;">
       <h2>Beancount Query</h2>
-      <p>To ignore positive income that is intented, mention "intended positive" in narration.</p>
-      <button onclick="positiveIncome()">Positive Incomes</button>
-      <button onclick="negativeExpenses()">Negative Expenses</button>
-      <button onclick="bankCharge()">Missing bank charges for HBL Income</button>
+      <div id="savedQueries">Loading saved queries...</div>
+      <div id="queryParams"></div>
+      <datalist id="accountList"></datalist>
       <form id="beanQueryForm" style="margin-top: 1rem">
         <input type="text" id="bean-query-command" placeholder="Enter beancount query" style="width: 80%%;">
+        <select id="queryFormat">
+          <option value="json">Table</option>
+          <option value="text">Text</option>
+        </select>
         <button type="submit">Run</button>
       </form>
+      <div>
+        <input id="queryHistorySearch" placeholder="Search history" oninput="refreshHistory('query')">
+        <select id="queryHistory" onchange="pickHistory('query')" style="max-width: 60%%;"></select>
+        <button onclick="rerunHistory('query')">Run again</button>
+      </div>
 
       <h3>Output:</h3>
       <pre id="beancount-output"></pre>
+      <div id="queryControls" style="display: none;">
+        <input id="queryFilter" placeholder="Filter rows" oninput="renderQueryTable()">
+        <span id="queryCount"></span>
+        <button onclick="downloadQueryCSV()">Download CSV</button>
+      </div>
+      <div id="queryTable" class="query-table"></div>
+      <details id="queryEditor" style="display: none; margin-top: 1rem;">
+        <summary>Manage saved queries</summary>
+        <table id="savedQueryTable"></table>
+        <h4 id="queryEditorTitle">New query</h4>
+        <input id="sqName" placeholder="Name">
+        <input id="sqDescription" placeholder="Description" style="width: 60%%;">
+        <textarea id="sqQuery" placeholder="BQL query; write {{name}} where a parameter goes"></textarea>
+        <div id="sqParams"></div>
+        <button onclick="addQueryParamRow({})">Add parameter</button>
+        <button onclick="useCurrentQuery()">Use current query</button>
+        <button onclick="saveQuery()">Save</button>
+        <button onclick="editQuery(null)">Clear</button>
+        <pre id="sqOutput"></pre>
+      </details>
+      </div>
+
+      <div style="border: 1px solid teal; margin-top: 2rem;">
+      <h2>Health Checks</h2>
+      <p id="healthInfo">Loading health checks...</p>
+      <button onclick="refreshHealth()">Refresh</button>
+      <button id="healthRun" onclick="runHealthChecks()" style="display: none;">Run now</button>
+      <table id="healthChecks"></table>
+      <div id="healthDetail" class="query-table"></div>
+      <h3>History</h3>
+      <table id="healthRuns"></table>
+      <pre id="healthOutput"></pre>
       </div>
 
       <div style="border: 1px solid orange; margin-top: 2rem;">
       <h2>HBL Swipe Statements</h2>
-      <a href="/git/hbl">View Reports</a>
+      <a href="%s/git/hbl/">View Reports</a>
       <div style="margin-top: 1rem">
         <form id="hblReportQueryForm"/>
         <input id="hbl-report-date" type="date" required />
@@ -169,40 +221,42 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
       <pre id="hblfetchresult"></pre>
       </div>
 
+      <div style="border: 1px solid gray; margin-top: 2rem;">
+      <h2>Jobs</h2>
+      <p>Long operations run in the background and keep going if this page is closed.</p>
+      <button onclick="refreshJobs()">Refresh</button>
+      <table id="jobsTable"></table>
+      <pre id="jobOutput"></pre>
+      </div>
+
     </div>
 
 
     <div style="border: 1px solid blue; margin-top: 2rem">
+    <h2>Status</h2>
+    <div id="statusOutput">Loading git status...</div>
     <h2 >Git Diff</h2>
-    <h3>Output:</h3>
-    <pre id="diffOutput" class="diff-output">Loading git diff...</pre>
+    <div>
+      <label><input type="checkbox" id="diffCached" onchange="refreshDiff()"> Staged</label>
+      <input id="diffRange" placeholder="Commit range, e.g. main..HEAD">
+      <input id="diffPath" placeholder="Path">
+      <select id="diffView" onchange="changeDiffView()">
+        <option value="unified">Unified</option>
+        <option value="split">Side by side</option>
+        <option value="ledger">Transactions</option>
+      </select>
+      <button onclick="refreshDiff()">Refresh</button>
+    </div>
+    <div id="diffOutput">Loading git diff...</div>
 
     </div>
   </div>
 
     <script>
-
-    function positiveIncome() {
-      const input = document.getElementById("bean-query-command")
-      input.value = 'select date, lineno, account, narration, position where account ~ "Income" and narration !~ "refund" and narration !~ "intended positive" and number > 0'
-      // Submit the bean-query form
-      document.getElementById("beanQueryForm").requestSubmit()
-    }
-
-    function negativeExpenses() {
-      const input = document.getElementById("bean-query-command")
-      input.value = 'select date, lineno, account, narration, position where account ~ "Expenses" and narration !~ "intended negative" and number < 0'
-      // Submit the bean-query form
-      document.getElementById("beanQueryForm").requestSubmit()
-    }
-
-    function bankCharge() {
-      const input = document.getElementById("bean-query-command")
-      input.value = 'select date, lineno, account, position, narration where has_account("Assets:Bank:HBL") and has_account("Income") and account = "Assets:Bank:HBL" and not has_account("Expenses:BankCharge") and flag = "*"'
-
-      // Submit the bean-query form
-      document.getElementById("beanQueryForm").requestSubmit()
-    }
+    const base = %s;
+    const repoID = %s;
+    const canMaintain = %t;
+    const canEdit = %t;
 
     document.getElementById("beanQueryForm").onsubmit = function(event) {
       event.preventDefault()
@@ -212,16 +266,401 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
           alert("Please enter a command.");
           return;
       }
+      document.getElementById("queryParams").innerHTML = "";
+      runQuery(base + "/git/bean-query", "text/plain", commandStr);
+    }
 
-      fetch("/git/bean-query", {
+    // runQuery runs a query job and shows its output as a table or text.
+    function runQuery(url, contentType, body) {
+      const format = document.getElementById("queryFormat").value;
+      const output = document.getElementById("beancount-output");
+      queryResult = null;
+      renderQueryTable();
+      runJob(url + "?format=" + format, {
          method: "POST",
-         headers: { "Content-Type": "text/plain" },
-         body: commandStr
-      }).then(x => x.text()).then(x => {
-        document.getElementById("beancount-output").innerText = x;
+         headers: { "Content-Type": contentType },
+         body: body
+      }, output).then(done => {
+        if (format === "json" && done.status === 200) {
+          output.innerText = "";
+          queryResult = JSON.parse(done.body);
+          querySort = { column: -1, desc: false };
+          renderQueryTable();
+          return;
+        }
+        showResult(output, done);
       }).catch(err => {
-          document.getElementById("beancount-output").innerText = "Error: " + err;
+          output.innerText = "Error: " + err;
+      }).finally(() => refreshHistory("query"));
+    }
+
+    // The input and form of each kind of history entry.
+    const historyInputs = { query: "bean-query-command", command: "command" };
+    const historyForms = { query: "beanQueryForm", command: "gitForm" };
+    const historyEntries = { query: [], command: [] };
+
+    function historyText(e) {
+      return e.kind === "command" ? e.command.join(" ") : e.query;
+    }
+
+    // refreshHistory lists the user's past queries or commands matching the
+    // search, newest first, in the history dropdown.
+    async function refreshHistory(kind) {
+      const search = document.getElementById(kind + "HistorySearch").value.trim();
+      const resp = await fetch(base + "/api/history?kind=" + kind + "&q=" + encodeURIComponent(search));
+      if (!resp.ok) return;
+      const entries = await resp.json();
+      historyEntries[kind] = entries;
+      const select = document.getElementById(kind + "History");
+      select.innerHTML = "";
+      const first = document.createElement("option");
+      first.value = "";
+      first.innerText = entries.length ? "History (" + entries.length + ")" : (search ? "No matches" : "No history yet");
+      select.appendChild(first);
+      entries.forEach((e, i) => {
+        let outcome = "failed";
+        if (!e.error) outcome = e.rows === undefined ? "done" : e.rows + (e.kind === "command" ? " lines" : " rows");
+        const text = (e.saved_query ? e.saved_query + ": " : "") + historyText(e);
+        const option = document.createElement("option");
+        option.value = i;
+        option.title = text;
+        option.innerText = new Date(e.time).toLocaleString() + " \u2014 " + (text.length > 100 ? text.slice(0, 100) + "\u2026" : text) + " (" + outcome + ")";
+        select.appendChild(option);
+      });
+    }
+
+    // pickHistory puts the chosen entry into the input, ready to edit or run.
+    function pickHistory(kind) {
+      const e = historyEntries[kind][document.getElementById(kind + "History").value];
+      if (e) document.getElementById(historyInputs[kind]).value = historyText(e);
+      return e;
+    }
+
+    // rerunHistory runs the chosen entry again on the current ledger.
+    function rerunHistory(kind) {
+      if (!pickHistory(kind)) {
+        alert("Choose an entry from the history.");
+        return;
+      }
+      document.getElementById(historyForms[kind]).requestSubmit();
+    }
+
+    let savedQueries = [];
+    let editingQuery = null;
+
+    async function refreshSavedQueries() {
+      const el = document.getElementById("savedQueries");
+      const resp = await fetch(base + "/api/queries");
+      if (!resp.ok) {
+        el.innerText = await resp.text();
+        return;
+      }
+      savedQueries = await resp.json();
+      el.innerHTML = "";
+      for (const q of savedQueries) {
+        const button = document.createElement("button");
+        button.innerText = q.name;
+        button.title = q.description || "";
+        button.onclick = () => selectSavedQuery(q);
+        el.appendChild(button);
+      }
+      if (canEdit) {
+        document.getElementById("queryEditor").style.display = "";
+        renderSavedQueryTable();
+      }
+    }
+
+    // selectSavedQuery shows a saved query and runs it, asking for its
+    // parameters first if it has any.
+    function selectSavedQuery(q) {
+      document.getElementById("bean-query-command").value = q.query;
+      const el = document.getElementById("queryParams");
+      el.innerHTML = "";
+      if (q.description) {
+        const description = document.createElement("p");
+        description.innerText = q.description;
+        el.appendChild(description);
+      }
+      const url = base + "/api/queries/" + encodeURIComponent(q.id) + "/run";
+      const params = q.params || [];
+      if (params.length === 0) {
+        runQuery(url, "application/json", "{}");
+        return;
+      }
+      const widgets = [];
+      for (const p of params) {
+        const label = document.createElement("label");
+        label.innerText = p.name + " ";
+        label.title = p.description || "";
+        const widget = queryParamWidget(p);
+        label.appendChild(widget.el);
+        el.appendChild(label);
+        el.appendChild(document.createTextNode(" "));
+        widgets.push([p.name, widget]);
+      }
+      const run = document.createElement("button");
+      run.innerText = "Run " + q.name;
+      run.onclick = () => {
+        const values = {};
+        for (const [name, widget] of widgets) {
+          const problem = widget.check();
+          if (problem) {
+            alert(name + ": " + problem);
+            return;
+          }
+          values[name] = widget.value();
+        }
+        runQuery(url, "application/json", JSON.stringify({ params: values }));
+      };
+      el.appendChild(run);
+    }
+
+    let accountsLoaded = false;
+
+    async function loadAccounts() {
+      if (accountsLoaded) return;
+      accountsLoaded = true;
+      const resp = await fetch(base + "/api/accounts");
+      if (!resp.ok) return;
+      const list = document.getElementById("accountList");
+      for (const account of await resp.json()) {
+        const option = document.createElement("option");
+        option.value = account;
+        list.appendChild(option);
+      }
+    }
+
+    // queryParamWidget returns the input for a parameter of its type, with
+    // value() giving what is sent to the server and check() a problem with
+    // it, if any. The server checks the values again.
+    function queryParamWidget(p) {
+      const input = (type, value) => {
+        const el = document.createElement("input");
+        el.type = type;
+        el.value = value || "";
+        el.placeholder = p.description || "";
+        return el;
+      };
+      if (p.type === "daterange") {
+        const [from, to] = (p.default || "..").split("..");
+        const el = document.createElement("span");
+        const start = input("date", from), end = input("date", to);
+        el.appendChild(start);
+        el.appendChild(document.createTextNode(" to "));
+        el.appendChild(end);
+        return {
+          el: el,
+          value: () => (start.value || end.value) ? start.value + ".." + end.value : "",
+          check: () => (start.value && end.value && start.value > end.value) ? "the range ends before it starts" : "",
+        };
+      }
+      const types = { date: "date", amount: "number" };
+      const el = input(types[p.type] || "text", p.default);
+      if (p.type === "amount") el.step = "any";
+      if (p.type === "account") {
+        el.setAttribute("list", "accountList");
+        loadAccounts();
+      }
+      return {
+        el: el,
+        value: () => el.value.trim(),
+        check: () => {
+          const v = el.value.trim();
+          if (!v) return p.default ? "" : "a value is required";
+          if (p.type === "account" && !/^[A-Z][A-Za-z0-9-]*(:[A-Z0-9][A-Za-z0-9-]*)*$/.test(v)) return "not an account name";
+          if (p.type === "regex") {
+            try { new RegExp(v); } catch (err) { return "invalid regex"; }
+          }
+          return "";
+        },
+      };
+    }
+
+    function renderSavedQueryTable() {
+      const table = document.getElementById("savedQueryTable");
+      table.innerHTML = "";
+      for (const q of savedQueries) {
+        const row = table.insertRow();
+        row.insertCell().innerText = q.name;
+        row.insertCell().innerText = q.id;
+        const actions = row.insertCell();
+        const edit = document.createElement("button");
+        edit.innerText = "Edit";
+        edit.onclick = () => editQuery(q);
+        actions.appendChild(edit);
+        const remove = document.createElement("button");
+        remove.innerText = "Delete";
+        remove.onclick = () => deleteQuery(q);
+        actions.appendChild(remove);
+      }
+    }
+
+    // editQuery loads a saved query into the editor, or clears it for a new
+    // one if q is null.
+    function editQuery(q) {
+      editingQuery = q ? q.id : null;
+      document.getElementById("queryEditorTitle").innerText = q ? "Edit " + q.name : "New query";
+      document.getElementById("sqName").value = q ? q.name : "";
+      document.getElementById("sqDescription").value = q ? q.description || "" : "";
+      document.getElementById("sqQuery").value = q ? q.query : "";
+      document.getElementById("sqParams").innerHTML = "";
+      for (const p of (q && q.params) || []) addQueryParamRow(p);
+      document.getElementById("sqOutput").innerText = "";
+    }
+
+    function addQueryParamRow(p) {
+      const row = document.createElement("div");
+      row.className = "sq-param";
+      for (const [field, placeholder] of [["name", "Parameter name"], ["type"], ["description", "Description"], ["default", "Default value"]]) {
+        let input;
+        if (field === "type") {
+          input = document.createElement("select");
+          for (const type of ["string", "account", "date", "daterange", "amount", "regex"]) {
+            const option = document.createElement("option");
+            option.value = type;
+            option.innerText = type;
+            input.appendChild(option);
+          }
+          input.title = "daterange defaults are written FROM..TO, e.g. 2025-01-01..2025-03-31";
+        } else {
+          input = document.createElement("input");
+          input.placeholder = placeholder;
+        }
+        input.dataset.field = field;
+        input.value = p[field] || (field === "type" ? "string" : "");
+        row.appendChild(input);
+      }
+      const remove = document.createElement("button");
+      remove.innerText = "Remove";
+      remove.onclick = () => row.remove();
+      row.appendChild(remove);
+      document.getElementById("sqParams").appendChild(row);
+    }
+
+    function useCurrentQuery() {
+      document.getElementById("sqQuery").value = document.getElementById("bean-query-command").value.trim();
+    }
+
+    async function saveQuery() {
+      const params = [];
+      for (const row of document.querySelectorAll("#sqParams .sq-param")) {
+        const p = {};
+        for (const input of row.querySelectorAll("input, select")) p[input.dataset.field] = input.value.trim();
+        params.push(p);
+      }
+      const q = {
+        name: document.getElementById("sqName").value.trim(),
+        description: document.getElementById("sqDescription").value.trim(),
+        query: document.getElementById("sqQuery").value.trim(),
+        params: params,
+      };
+      const url = base + "/api/queries" + (editingQuery ? "/" + encodeURIComponent(editingQuery) : "");
+      const resp = await fetch(url, {
+        method: editingQuery ? "PUT" : "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(q),
       });
+      const output = document.getElementById("sqOutput");
+      if (!resp.ok) {
+        output.innerText = await resp.text();
+        return;
+      }
+      editQuery(null);
+      output.innerText = "Saved. Create a PR to share the change.";
+      refreshSavedQueries();
+      refreshDiff();
+    }
+
+    async function deleteQuery(q) {
+      if (!confirm("Delete the saved query " + q.name + "?")) return;
+      const resp = await fetch(base + "/api/queries/" + encodeURIComponent(q.id), { method: "DELETE" });
+      document.getElementById("sqOutput").innerText = resp.ok ? "Deleted. Create a PR to share the change." : await resp.text();
+      refreshSavedQueries();
+      refreshDiff();
+    }
+
+    let queryResult = null;
+    let querySort = { column: -1, desc: false };
+
+    function queryCellText(value) {
+      if (value === null || value === undefined) return "";
+      if (typeof value === "object") return value.number + " " + value.currency;
+      return String(value);
+    }
+
+    // queryCompare orders two values of a column by its type, empty values
+    // first.
+    function queryCompare(type, a, b) {
+      if (a === null || b === null) return (a === null ? 0 : 1) - (b === null ? 0 : 1);
+      if (type === "number") return parseFloat(a) - parseFloat(b);
+      if (type === "amount" && a.currency === b.currency) return parseFloat(a.number) - parseFloat(b.number);
+      const x = type === "amount" ? a.currency : String(a), y = type === "amount" ? b.currency : String(b);
+      return x < y ? -1 : (x > y ? 1 : 0);
+    }
+
+    // queryRows returns the rows of queryResult matching the filter, sorted
+    // by the selected column.
+    function queryRows() {
+      const filter = document.getElementById("queryFilter").value.trim().toLowerCase();
+      let rows = queryResult.rows;
+      if (filter) {
+        rows = rows.filter(row => row.some(value => queryCellText(value).toLowerCase().includes(filter)));
+      }
+      const c = querySort.column;
+      if (c >= 0) {
+        const type = queryResult.columns[c].type;
+        rows = rows.slice().sort((a, b) => (querySort.desc ? -1 : 1) * queryCompare(type, a[c], b[c]));
+      }
+      return rows;
+    }
+
+    function renderQueryTable() {
+      const controls = document.getElementById("queryControls");
+      const el = document.getElementById("queryTable");
+      el.innerHTML = "";
+      if (!queryResult) {
+        controls.style.display = "none";
+        return;
+      }
+      controls.style.display = "";
+      const rows = queryRows();
+      document.getElementById("queryCount").innerText = rows.length + " of " + queryResult.rows.length + " rows";
+      const table = document.createElement("table");
+      const head = table.createTHead().insertRow();
+      queryResult.columns.forEach((col, i) => {
+        const th = document.createElement("th");
+        th.innerText = col.name + (querySort.column === i ? (querySort.desc ? " \u25bc" : " \u25b2") : "");
+        th.title = col.type;
+        th.onclick = () => {
+          querySort = { column: i, desc: querySort.column === i && !querySort.desc };
+          renderQueryTable();
+        };
+        head.appendChild(th);
+      });
+      const body = table.createTBody();
+      for (const row of rows) {
+        const tr = body.insertRow();
+        queryResult.columns.forEach((col, i) => {
+          const td = tr.insertCell();
+          td.innerText = queryCellText(row[i]);
+          if (col.type === "number" || col.type === "amount") td.className = "num";
+        });
+      }
+      el.appendChild(table);
+    }
+
+    // downloadQueryCSV saves the rows shown, filtered and sorted, as CSV.
+    function downloadQueryCSV() {
+      const quote = text => /[",\r\n]/.test(text) ? '"' + text.replace(/"/g, '""') + '"' : text;
+      const lines = [queryResult.columns.map(col => quote(col.name)).join(",")];
+      for (const row of queryRows()) {
+        lines.push(row.map(value => quote(queryCellText(value))).join(","));
+      }
+      const link = document.createElement("a");
+      link.href = URL.createObjectURL(new Blob([lines.join("\r\n") + "\r\n"], { type: "text/csv" }));
+      link.download = "query.csv";
+      link.click();
+      URL.revokeObjectURL(link.href);
     }
 
     function createPR() {
@@ -233,11 +672,34 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
         const prOutput = document.getElementById("prOutput");
         prOutput.innerText = "Waiting for server response...";
+        showCheckProblems([]);
+
+        const options = { method: "POST" };
+        // Without a loaded list of changes the server commits everything.
+        if (document.querySelector("#changes .stage-file")) {
+            const sel = selectedChanges();
+            if (sel.paths.length === 0 && sel.hunks.length === 0) {
+                alert("Select the changes to commit.");
+                return;
+            }
+            options.headers = { "Content-Type": "application/json" };
+            options.body = JSON.stringify(sel);
+        }
 
-        fetch("/git/create-pr-with-edits?commit_msg=" + encodeURIComponent(message), { method: "POST" })
-            .then(resp => resp.text())
-            .then(text => {
-                text = text.trim();
+        const topic = document.getElementById("prTopic").value.trim();
+        runJob(base + "/git/create-pr-with-edits?on_conflict=resolve&commit_msg=" + encodeURIComponent(message) + "&topic=" + encodeURIComponent(topic), options, prOutput)
+            .then(done => {
+                if (done.status === 422 && done.body.startsWith("{")) {
+                    const failed = JSON.parse(done.body);
+                    prOutput.innerText = failed.error;
+                    showCheckProblems(failed.problems);
+                    return;
+                }
+                if (done.status >= 400) {
+                    showResult(prOutput, done);
+                    return;
+                }
+                let text = done.body.trim();
                 const words = text.split(/\s+/);
 
                 if (words.length === 1 && (text.startsWith("http://") || text.startsWith("https://"))) {
@@ -250,7 +712,504 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
             })
             .catch(err => {
                 prOutput.innerText = "Error: " + err;
-            }).finally(refreshDiff);
+            }).finally(() => { refreshDiff(); refreshConflicts(); refreshPRs(); refreshEditBranches(); });
+    }
+
+    let checkProblems = [];
+
+    async function checkLedger() {
+      const el = document.getElementById("checkProblems");
+      el.innerText = "Checking the ledger...";
+      const resp = await fetch(base + "/api/check");
+      if (!resp.ok) {
+        el.innerText = await resp.text();
+        return;
+      }
+      const result = await resp.json();
+      showCheckProblems(result.problems);
+      if (result.ok) el.innerText = "The ledger passed its checks.";
+    }
+
+    // showCheckProblems lists the problems of failed ledger checks, each
+    // linked to its line in the Git Diff panel, and marks those lines.
+    function showCheckProblems(problems) {
+      checkProblems = problems;
+      const el = document.getElementById("checkProblems");
+      el.innerHTML = "";
+      if (problems.length > 0) {
+        const list = document.createElement("ul");
+        for (const p of problems) {
+          const item = document.createElement("li");
+          if (p.file) {
+            const link = document.createElement("a");
+            link.href = "#";
+            link.innerText = p.file + ":" + p.line;
+            link.onclick = event => { event.preventDefault(); showDiffLine(p.file, p.line); };
+            item.appendChild(link);
+            item.appendChild(document.createTextNode(": " + p.message));
+          } else {
+            item.innerText = p.check + ": " + p.message;
+          }
+          if (p.detail) {
+            const detail = document.createElement("pre");
+            detail.innerText = p.detail;
+            item.appendChild(detail);
+          }
+          list.appendChild(item);
+        }
+        el.appendChild(list);
+      }
+      markCheckProblems();
+    }
+
+    function markCheckProblems() {
+      for (const row of document.querySelectorAll("#diffOutput tr.check-error")) {
+        row.classList.remove("check-error");
+        row.title = "";
+      }
+      for (const p of checkProblems) {
+        const row = diffRow(p.file, p.line);
+        if (row) {
+          row.classList.add("check-error");
+          row.title = p.message;
+        }
+      }
+    }
+
+    function diffRow(path, line) {
+      for (const details of document.querySelectorAll("#diffOutput .diff-file")) {
+        if (details.dataset.path === path) {
+          return details.querySelector('tr[data-new-line="' + line + '"]') || details;
+        }
+      }
+      return null;
+    }
+
+    // showDiffLine scrolls the Git Diff panel to a line of the working tree,
+    // or to its file if the line is unchanged.
+    async function showDiffLine(path, line) {
+      const view = document.getElementById("diffView");
+      if (view.value === "ledger" || document.getElementById("diffCached").checked || document.getElementById("diffRange").value.trim()) {
+        if (view.value === "ledger") view.value = "unified";
+        document.getElementById("diffCached").checked = false;
+        document.getElementById("diffRange").value = "";
+        await refreshDiff();
+      }
+      const target = diffRow(path, line);
+      if (!target) {
+        alert(path + " has no changes in the diff.");
+        return;
+      }
+      if (target.tagName === "DETAILS") {
+        target.open = true;
+        target.scrollIntoView({ block: "start" });
+        alert("Line " + line + " of " + path + " is not part of the diff.");
+        return;
+      }
+      target.closest("details").open = true;
+      target.scrollIntoView({ block: "center" });
+      for (const row of document.querySelectorAll("#diffOutput tr.check-focus")) row.classList.remove("check-focus");
+      target.classList.add("check-focus");
+    }
+
+    async function refreshChanges() {
+      const el = document.getElementById("changes");
+      const resp = await fetch(base + "/git/changes");
+      if (!resp.ok) {
+        el.innerText = await resp.text();
+        return;
+      }
+      const files = await resp.json();
+      el.innerHTML = "";
+      if (files.length === 0) {
+        el.innerText = "No changes.";
+        return;
+      }
+      for (const file of files) {
+        const box = document.createElement("div");
+        const check = document.createElement("input");
+        check.type = "checkbox";
+        check.className = "stage-file";
+        check.dataset.path = file.path;
+        check.checked = !file.denied;
+        check.disabled = file.denied;
+        const label = document.createElement("label");
+        label.appendChild(check);
+        label.appendChild(document.createTextNode(" " + file.path + " (" + file.status +
+          (file.binary ? ", binary" : "") + (file.denied ? ", matches the stage deny list" : "") + ")"));
+        box.appendChild(label);
+        if (file.hunks.length > 0) {
+          const details = document.createElement("details");
+          const summary = document.createElement("summary");
+          summary.innerText = file.hunks.length + (file.hunks.length === 1 ? " hunk" : " hunks");
+          details.appendChild(summary);
+          const hunkChecks = [];
+          for (const hunk of file.hunks) {
+            const hunkCheck = document.createElement("input");
+            hunkCheck.type = "checkbox";
+            hunkCheck.className = "stage-hunk";
+            hunkCheck.dataset.id = hunk.id;
+            hunkCheck.checked = true;
+            hunkCheck.onchange = () => {
+              const n = hunkChecks.filter(c => c.checked).length;
+              check.checked = n === hunkChecks.length;
+              check.indeterminate = n > 0 && n < hunkChecks.length;
+            };
+            hunkChecks.push(hunkCheck);
+            const pre = document.createElement("pre");
+            pre.className = "diff-output";
+            pre.innerHTML = formatGitDiff(hunk.header + "\n" + hunk.lines.join("\n"));
+            details.appendChild(hunkCheck);
+            details.appendChild(pre);
+          }
+          check.onchange = () => {
+            for (const c of hunkChecks) c.checked = check.checked;
+          };
+          box.appendChild(details);
+        }
+        el.appendChild(box);
+      }
+    }
+
+    // selectedChanges returns the files checked as a whole and the checked
+    // hunks of the others.
+    function selectedChanges() {
+      const sel = { paths: [], hunks: [] };
+      for (const box of document.querySelectorAll("#changes > div")) {
+        const check = box.querySelector(".stage-file");
+        if (check.checked && !check.indeterminate) {
+          sel.paths.push(check.dataset.path);
+          continue;
+        }
+        for (const hunk of box.querySelectorAll(".stage-hunk")) {
+          if (hunk.checked) sel.hunks.push(hunk.dataset.id);
+        }
+      }
+      return sel;
+    }
+
+    async function refreshEditBranches() {
+      const info = document.getElementById("editBranchesInfo");
+      const table = document.getElementById("editBranches");
+      const resp = await fetch(base + "/api/edit-branches");
+      if (!resp.ok) {
+        info.innerText = await resp.text();
+        return;
+      }
+      const data = await resp.json();
+      info.innerText = "Without a topic your edits go to " + data.mine + "." + (data.pr_error ? " PRs unavailable: " + data.pr_error : "");
+      table.innerHTML = "";
+      for (const b of data.branches) {
+        const row = table.insertRow();
+        const name = row.insertCell();
+        name.innerText = b.name;
+        if (b.mine) name.style.fontWeight = "bold";
+        row.insertCell().innerText = b.user || "shared";
+        row.insertCell().innerText = b.ahead + " ahead, " + b.behind + " behind " + data.base + (b.remote ? "" : " (not pushed)");
+        row.insertCell().innerText = b.subject;
+        const pr = row.insertCell();
+        if (b.pr) {
+          const link = document.createElement("a");
+          link.href = "#";
+          link.innerText = "#" + b.pr.number;
+          link.onclick = event => { event.preventDefault(); showPR(b.pr.number); };
+          pr.appendChild(link);
+        } else {
+          pr.innerText = "no PR";
+        }
+        if (b.mine && b.topic) {
+          const use = document.createElement("button");
+          use.innerText = "Use topic";
+          use.onclick = () => { document.getElementById("prTopic").value = b.topic; };
+          row.insertCell().appendChild(use);
+        }
+      }
+    }
+
+    async function refreshPRs() {
+      const list = document.getElementById("prList");
+      const resp = await fetch(base + "/api/prs");
+      if (!resp.ok) {
+        list.innerText = await resp.text();
+        return;
+      }
+      const data = await resp.json();
+      list.innerHTML = "";
+      if (data.prs.length === 0) {
+        list.innerText = "No open PRs on " + data.provider + ".";
+        return;
+      }
+      for (const pr of data.prs) {
+        const row = document.createElement("div");
+        const link = document.createElement("a");
+        link.href = "#";
+        link.innerText = "#" + pr.number + " " + pr.title;
+        link.onclick = event => { event.preventDefault(); showPR(pr.number); };
+        row.appendChild(link);
+        row.appendChild(document.createTextNode(
+          " (" + pr.head + " \u2192 " + pr.base + ", by " + pr.author + ")" + (pr.edit ? " [edit]" : "")));
+        list.appendChild(row);
+      }
+    }
+
+    async function showPR(number) {
+      const detail = document.getElementById("prDetail");
+      const diff = document.getElementById("prDiff");
+      const ledgerDiff = document.getElementById("prLedgerDiff");
+      detail.innerText = "Loading PR #" + number + "...";
+      diff.style.display = "none";
+      ledgerDiff.innerHTML = "";
+      const resp = await fetch(base + "/api/prs/" + number);
+      if (!resp.ok) {
+        detail.innerText = await resp.text();
+        return;
+      }
+      const pr = await resp.json();
+      detail.innerHTML = "";
+      const title = document.createElement("h3");
+      const link = document.createElement("a");
+      link.href = pr.url;
+      link.target = "_blank";
+      link.innerText = "#" + pr.number + " " + pr.title;
+      title.appendChild(link);
+      detail.appendChild(title);
+
+      const mergeable = pr.mergeable === null ? "unknown (still being computed)" : (pr.mergeable ? "yes" : "no");
+      const lines = [
+        "State: " + pr.state + (pr.draft ? " (draft)" : ""),
+        "Mergeable: " + mergeable + (pr.merge_state ? " \u2013 " + pr.merge_state : ""),
+        "Reviews: " + (pr.reviews.length === 0 ? "none" : pr.reviews.map(r => r.user + ": " + r.state.replace("_", " ")).join(", ")),
+        "Checks: " + (pr.checks.length === 0 ? "none" : ""),
+      ];
+      const info = document.createElement("pre");
+      info.innerText = lines.join("\n");
+      detail.appendChild(info);
+      if (pr.checks.length > 0) {
+        const checks = document.createElement("ul");
+        for (const check of pr.checks) {
+          const item = document.createElement("li");
+          const name = document.createElement(check.url ? "a" : "span");
+          if (check.url) {
+            name.href = check.url;
+            name.target = "_blank";
+          }
+          name.innerText = check.name;
+          item.appendChild(name);
+          item.appendChild(document.createTextNode(": " + check.status));
+          checks.appendChild(item);
+        }
+        detail.appendChild(checks);
+      }
+
+      const diffButton = document.createElement("button");
+      diffButton.innerText = "Show diff against " + pr.base;
+      diffButton.onclick = async () => {
+        diff.style.display = "";
+        diff.innerText = "Loading diff...";
+        const resp = await fetch(base + "/api/prs/" + number + "/diff");
+        const text = await resp.text();
+        diff.innerHTML = resp.ok ? formatGitDiff(text) : escapeHtml(text);
+      };
+      detail.appendChild(diffButton);
+
+      const ledgerButton = document.createElement("button");
+      ledgerButton.innerText = "Show transaction changes";
+      ledgerButton.onclick = async () => {
+        ledgerDiff.innerText = "Loading transaction changes...";
+        const resp = await fetch(base + "/api/prs/" + number + "/ledger-diff");
+        if (!resp.ok) {
+          ledgerDiff.innerText = await resp.text();
+          return;
+        }
+        renderLedgerDiff(ledgerDiff, await resp.json());
+      };
+      detail.appendChild(ledgerButton);
+
+      if (canMaintain && pr.edit && pr.state === "open") {
+        const approve = document.createElement("button");
+        approve.innerText = "Approve";
+        approve.onclick = () => prAction(number, "approve", "");
+        detail.appendChild(approve);
+
+        const method = document.createElement("select");
+        for (const m of ["merge", "squash", "rebase"]) {
+          const option = document.createElement("option");
+          option.value = m;
+          option.innerText = m;
+          method.appendChild(option);
+        }
+        const merge = document.createElement("button");
+        merge.innerText = "Merge";
+        merge.onclick = () => {
+          if (confirm("Merge PR #" + number + " with " + method.value + "?")) {
+            prAction(number, "merge", "?method=" + method.value);
+          }
+        };
+        detail.appendChild(method);
+        detail.appendChild(merge);
+
+        const close = document.createElement("button");
+        close.innerText = "Close";
+        close.onclick = () => {
+          if (confirm("Close PR #" + number + " without merging?")) {
+            prAction(number, "close", "");
+          }
+        };
+        detail.appendChild(close);
+      }
+      const result = document.createElement("pre");
+      result.id = "prActionResult";
+      detail.appendChild(result);
+    }
+
+    async function prAction(number, action, query) {
+      const resp = await fetch(base + "/api/prs/" + number + "/" + action + query, { method: "POST" });
+      const text = await resp.text();
+      await showPR(number);
+      document.getElementById("prActionResult").innerText = text;
+      refreshPRs();
+    }
+
+    async function refreshConflicts() {
+      const panel = document.getElementById("conflictsPanel");
+      const resp = await fetch(base + "/git/conflicts");
+      if (!resp.ok) {
+        // Viewers can't resolve conflicts; keep the panel hidden.
+        panel.style.display = "none";
+        return;
+      }
+      const state = await resp.json();
+      if (!state.merging) {
+        panel.style.display = "none";
+        return;
+      }
+      panel.style.display = "";
+      document.getElementById("conflictsSummary").innerText = state.files.length === 0
+        ? "All conflicts are resolved. Complete the merge to commit it."
+        : (state.message.split("\n")[0] || "Merge in progress") + ": " + state.files.length + " conflicted file(s).";
+
+      const container = document.getElementById("conflictFiles");
+      container.innerHTML = "";
+      for (const file of state.files) {
+        container.appendChild(renderConflictFile(file));
+      }
+    }
+
+    function renderConflictFile(file) {
+      const div = document.createElement("div");
+      const title = document.createElement("h3");
+      title.innerText = file.path;
+      div.appendChild(title);
+
+      if (file.kind !== "text") {
+        const note = document.createElement("p");
+        note.innerText = file.kind !== "delete" ? "Binary file."
+          : (!file.has_ours && !file.has_theirs ? "Deleted on both sides."
+          : "Deleted on " + (file.has_ours ? "their" : "our") + " side and modified on the other.");
+        div.appendChild(note);
+        if (!file.has_ours && !file.has_theirs) {
+          const button = document.createElement("button");
+          button.innerText = "Delete";
+          button.onclick = () => resolveConflict({ path: file.path, side: "ours" });
+          div.appendChild(button);
+          return div;
+        }
+        for (const side of ["ours", "theirs"]) {
+          const button = document.createElement("button");
+          const present = side === "ours" ? file.has_ours : file.has_theirs;
+          button.innerText = (present ? "Keep " : "Delete (") + side + (present ? "" : ")");
+          button.onclick = () => resolveConflict({ path: file.path, side: side });
+          div.appendChild(button);
+        }
+        return div;
+      }
+
+      let hunk = 0;
+      for (const seg of file.segments) {
+        if (!seg.conflict) {
+          const details = document.createElement("details");
+          const summary = document.createElement("summary");
+          summary.innerText = seg.text.split("\n").length - 1 + " unchanged line(s)";
+          details.appendChild(summary);
+          const pre = document.createElement("pre");
+          pre.innerText = seg.text;
+          details.appendChild(pre);
+          div.appendChild(details);
+          continue;
+        }
+        const box = document.createElement("div");
+        box.className = "conflict-hunk";
+        const name = "conflict-" + file.path + "-" + hunk;
+        for (const [choice, label, text] of [
+          ["ours", "Ours", seg.conflict.ours],
+          ["base", "Base", seg.conflict.base],
+          ["theirs", "Theirs", seg.conflict.theirs],
+          ["both", "Both (ours first)", null],
+          ["both-theirs-first", "Both (theirs first)", null],
+        ]) {
+          const radio = document.createElement("input");
+          radio.type = "radio";
+          radio.name = name;
+          radio.value = choice;
+          radio.dataset.file = file.path;
+          radio.checked = choice === "ours";
+          const labelEl = document.createElement("label");
+          labelEl.appendChild(radio);
+          labelEl.appendChild(document.createTextNode(" " + label));
+          box.appendChild(labelEl);
+          if (text !== null) {
+            const pre = document.createElement("pre");
+            pre.innerText = text;
+            box.appendChild(pre);
+          } else {
+            box.appendChild(document.createElement("br"));
+          }
+        }
+        div.appendChild(box);
+        hunk++;
+      }
+
+      const button = document.createElement("button");
+      button.innerText = "Resolve " + file.path;
+      button.onclick = () => {
+        const choices = [];
+        for (let i = 0; i < hunk; i++) {
+          const checked = div.querySelector('input[name="' + CSS.escape("conflict-" + file.path + "-" + i) + '"]:checked');
+          choices.push(checked.value);
+        }
+        resolveConflict({ path: file.path, choices: choices });
+      };
+      div.appendChild(button);
+      return div;
+    }
+
+    async function resolveConflict(resolution) {
+      const output = document.getElementById("conflictsOutput");
+      const resp = await fetch(base + "/git/conflicts/resolve", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(resolution)
+      });
+      output.innerText = resp.ok ? "Resolved " + resolution.path : await resp.text();
+      refreshConflicts();
+      refreshDiff();
+    }
+
+    async function completeMerge() {
+      const output = document.getElementById("conflictsOutput");
+      const resp = await fetch(base + "/git/conflicts/commit", { method: "POST" });
+      output.innerText = await resp.text();
+      refreshConflicts();
+      refreshDiff();
+    }
+
+    async function abortMerge() {
+      if (!confirm("Abort the merge and discard the resolutions made so far?")) return;
+      const output = document.getElementById("conflictsOutput");
+      const resp = await fetch(base + "/git/conflicts/abort", { method: "POST" });
+      output.innerText = await resp.text();
+      refreshConflicts();
+      refreshDiff();
     }
 
     document.getElementById("gitForm").onsubmit = function(event) {
@@ -264,15 +1223,15 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
             let commandParts = commandStr.split(" ");
             document.getElementById("output").innerText = "Waiting for server response...";
-            fetch("/git/run", {
+            runJob(base + "/git/run", {
                 method: "POST",
                 headers: { "Content-Type": "application/json" },
                 body: JSON.stringify({ command: commandParts })
-            }).then(x => x.text()).then(x => {
-              document.getElementById("output").innerText = x;
+            }, document.getElementById("output")).then(done => {
+              showResult(document.getElementById("output"), done);
             }).catch(err => {
                 document.getElementById("output").innerText = "Error: " + err;
-            }).finally(refreshDiff);
+            }).finally(() => { refreshDiff(); refreshHistory("command"); });
         };
 
 
@@ -299,17 +1258,549 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
             .replace(/>/g, "&gt;");
     }
 
+    // runJob starts a request as a background job and follows it, showing
+    // its steps and command output in logEl as they arrive. It resolves to
+    // the final {status, body} of the operation. The job keeps running if
+    // the page is closed and can be found again in the Jobs panel.
+    async function runJob(url, options, logEl) {
+      url += (url.includes("?") ? "&" : "?") + "async=1";
+      const resp = await fetch(url, options);
+      if (resp.status !== 202) {
+        return { status: resp.status, body: await resp.text() };
+      }
+      const job = await resp.json();
+      refreshJobs();
+      const done = await followJob(job.id, logEl);
+      refreshJobs();
+      return done;
+    }
+
+    // followJob replays the log of a job into logEl and follows it until it
+    // finishes, reconnecting if the connection drops.
+    async function followJob(id, logEl) {
+      while (true) {
+        try {
+          const resp = await fetch("/jobs/" + id + "/events");
+          if (!resp.ok) {
+            return { status: resp.status, body: await resp.text() };
+          }
+          const done = await readEvents(resp, logEl);
+          if (done) return done;
+        } catch (err) {
+          // Retry below.
+        }
+        await new Promise(resolve => setTimeout(resolve, 2000));
+      }
+    }
+
+    // readEvents shows the events of an event stream response in logEl and
+    // returns the final "done" event, or null if the stream ended early.
+    async function readEvents(resp, logEl) {
+      logEl.innerText = "";
+      const append = line => {
+        logEl.innerText += line + "\n";
+        logEl.scrollTop = logEl.scrollHeight;
+      };
+      const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      while (true) {
+        const { value, done } = await reader.read();
+        if (done) return null;
+        buffer += value;
+        let end;
+        while ((end = buffer.indexOf("\n\n")) >= 0) {
+          const frame = buffer.slice(0, end);
+          buffer = buffer.slice(end + 2);
+          let event = "message", data = "";
+          for (const line of frame.split("\n")) {
+            if (line.startsWith("event: ")) event = line.slice(7);
+            else if (line.startsWith("data: ")) data += line.slice(6);
+          }
+          if (!data) continue;
+          const payload = JSON.parse(data);
+          if (event === "step") append("==> " + payload.step);
+          else if (event === "command") append("$ " + payload.argv.join(" "));
+          else if (event === "output") append(payload.line);
+          else if (event === "done") return payload;
+        }
+      }
+    }
+
+    async function refreshHealth() {
+      const resp = await fetch(base + "/api/health?limit=20");
+      if (!resp.ok) return;
+      const status = await resp.json();
+      const info = document.getElementById("healthInfo");
+      if (!status.enabled) {
+        info.innerText = "Health checks are not configured.";
+        return;
+      }
+      document.getElementById("healthRun").style.display = canEdit ? "" : "none";
+      info.innerText = status.schedule
+        ? "Scheduled " + status.schedule + (status.next ? ", next run " + new Date(status.next).toLocaleString() : "") + ", and after every pull."
+        : "Run after every pull.";
+      const table = document.getElementById("healthRuns");
+      table.innerHTML = "";
+      for (const run of status.runs) {
+        const row = table.insertRow();
+        row.insertCell().innerText = new Date(run.started).toLocaleString();
+        row.insertCell().innerText = run.trigger + (run.user ? " by " + run.user : "");
+        row.insertCell().innerText = run.commit ? run.commit.slice(0, 7) : "";
+        const failing = run.checks.filter(c => c.status === "failing").length;
+        const errors = run.checks.filter(c => c.status === "error").length;
+        row.insertCell().innerText = (failing ? failing + " failing" : "all passed") + (errors ? ", " + errors + " errors" : "");
+        row.insertCell().innerText = run.alerted ? "alerted: " + run.alerted.join(", ") : "";
+        const show = document.createElement("button");
+        show.innerText = "Show";
+        show.onclick = () => showHealthRun(run);
+        row.insertCell().appendChild(show);
+      }
+      showHealthRun(status.runs[0]);
+    }
+
+    // showHealthRun lists the checks of a run with the rows or problems of
+    // those that failed.
+    function showHealthRun(run) {
+      const table = document.getElementById("healthChecks");
+      table.innerHTML = "";
+      document.getElementById("healthDetail").innerHTML = "";
+      if (!run) return;
+      const caption = table.createCaption();
+      caption.innerText = "Run of " + new Date(run.started).toLocaleString();
+      for (const c of run.checks) {
+        const row = table.insertRow();
+        row.insertCell().innerText = c.name;
+        const status = row.insertCell();
+        status.innerText = c.status;
+        status.style.color = c.status === "ok" ? "green" : "red";
+        row.insertCell().innerText = c.status === "error" ? c.error : (c.kind === "ledger" ? c.rows + " problems" : c.rows + " rows");
+        if (c.result || c.problems) {
+          const show = document.createElement("button");
+          show.innerText = "Details";
+          show.onclick = () => showHealthCheck(c);
+          row.insertCell().appendChild(show);
+        }
+      }
+    }
+
+    function showHealthCheck(c) {
+      const el = document.getElementById("healthDetail");
+      el.innerHTML = "";
+      const title = document.createElement("h4");
+      title.innerText = c.name + (c.result && c.result.rows.length < c.rows ? " (first " + c.result.rows.length + " of " + c.rows + " rows)" : "");
+      el.appendChild(title);
+      if (c.problems) {
+        const list = document.createElement("ul");
+        for (const p of c.problems) {
+          const item = document.createElement("li");
+          item.innerText = (p.file ? p.file + ":" + p.line + ": " : p.check + ": ") + p.message + (p.detail ? "\n" + p.detail : "");
+          item.style.whiteSpace = "pre-wrap";
+          list.appendChild(item);
+        }
+        el.appendChild(list);
+        return;
+      }
+      const table = document.createElement("table");
+      const head = table.createTHead().insertRow();
+      for (const col of c.result.columns) {
+        const th = document.createElement("th");
+        th.innerText = col.name;
+        head.appendChild(th);
+      }
+      const body = table.createTBody();
+      for (const values of c.result.rows) {
+        const tr = body.insertRow();
+        c.result.columns.forEach((col, i) => {
+          const td = tr.insertCell();
+          td.innerText = queryCellText(values[i]);
+          if (col.type === "number" || col.type === "amount") td.className = "num";
+        });
+      }
+      el.appendChild(table);
+    }
+
+    async function runHealthChecks() {
+      const output = document.getElementById("healthOutput");
+      output.innerText = "Waiting for server response...";
+      const done = await runJob(base + "/api/health/run", { method: "POST" }, output);
+      if (done.status >= 400 || done.status === 0) {
+        showResult(output, done);
+        return;
+      }
+      output.innerText = "";
+      refreshHealth();
+    }
+
+    async function refreshJobs() {
+      const resp = await fetch("/jobs?limit=10&repo=" + encodeURIComponent(repoID));
+      if (!resp.ok) return;
+      const list = await resp.json();
+      const table = document.getElementById("jobsTable");
+      table.innerHTML = "";
+      for (const job of list) {
+        const row = table.insertRow();
+        row.insertCell().innerText = new Date(job.created).toLocaleString();
+        row.insertCell().innerText = job.endpoint.replace(/^\S+ (\/repos\/[^/]+)?/, "");
+        row.insertCell().innerText = job.user;
+        row.insertCell().innerText = job.status;
+        const actions = row.insertCell();
+        const show = document.createElement("button");
+        show.innerText = "Show";
+        show.onclick = async () => {
+          const output = document.getElementById("jobOutput");
+          showResult(output, await followJob(job.id, output));
+          refreshJobs();
+        };
+        actions.appendChild(show);
+        if (job.status === "queued" || job.status === "running") {
+          const cancel = document.createElement("button");
+          cancel.innerText = "Cancel";
+          cancel.onclick = async () => {
+            await fetch("/jobs/" + job.id + "/cancel", { method: "POST" });
+            refreshJobs();
+          };
+          actions.appendChild(cancel);
+        }
+      }
+    }
+
+    // showResult replaces the progress log with the result of a successful
+    // operation, and keeps it above the error of a failed one.
+    function showResult(el, done) {
+      if ((done.status === 0 || done.status >= 400) && el.innerText.trim() !== "" && el.innerText !== "Waiting for server response...") {
+        el.innerText += "\n" + done.body;
+      } else {
+        el.innerText = done.body;
+      }
+    }
+
+    let diffFiles = [];
+    let diffIsLedger = false;
+
     async function refreshDiff() {
-      const resp = await fetch("/git/diff");
-      const rawDiff = await resp.text();
-      document.getElementById("diffOutput").innerHTML = formatGitDiff(rawDiff);
+      refreshStatus();
+      refreshChanges();
+      const params = new URLSearchParams();
+      if (document.getElementById("diffCached").checked) params.set("cached", "1");
+      const range = document.getElementById("diffRange").value.trim();
+      if (range) params.set("range", range);
+      const out = document.getElementById("diffOutput");
+      diffIsLedger = document.getElementById("diffView").value === "ledger";
+      if (diffIsLedger) {
+        const resp = await fetch(base + "/api/ledger-diff?" + params);
+        if (!resp.ok) {
+          out.innerText = await resp.text();
+          return;
+        }
+        renderLedgerDiff(out, await resp.json());
+        return;
+      }
+      const path = document.getElementById("diffPath").value.trim();
+      if (path) params.set("path", path);
+      const resp = await fetch(base + "/api/diff?" + params);
+      if (!resp.ok) {
+        out.innerText = await resp.text();
+        return;
+      }
+      diffFiles = await resp.json();
+      renderDiff();
+    }
+
+    // changeDiffView re-renders the line diff, or fetches the other kind of
+    // diff when switching between lines and transactions.
+    function changeDiffView() {
+      if (diffIsLedger || document.getElementById("diffView").value === "ledger") {
+        refreshDiff();
+      } else {
+        renderDiff();
+      }
+    }
+
+    function formatTransaction(txn) {
+      let head = txn.date + " " + txn.flag;
+      if (txn.payee) head += " " + JSON.stringify(txn.payee);
+      head += " " + JSON.stringify(txn.narration);
+      for (const tag of txn.tags || []) head += " #" + tag;
+      for (const link of txn.links || []) head += " ^" + link;
+      const lines = [head];
+      for (const meta of txn.meta || []) lines.push("  " + meta);
+      for (const p of txn.postings) {
+        let line = "  " + (p.flag ? p.flag + " " : "") + p.account;
+        if (p.units) line += "  " + p.units;
+        if (p.cost) line += " " + p.cost;
+        if (p.price) line += " " + p.price;
+        lines.push(line);
+      }
+      return lines.join("\n");
+    }
+
+    // renderLedgerDiff shows the balance changes and the added, removed and
+    // modified transactions of a /api/ledger-diff response.
+    function renderLedgerDiff(el, d) {
+      el.innerHTML = "";
+      const summary = document.createElement("p");
+      summary.innerText = d.from + " \u2192 " + d.to + ": " + d.added.length + " added, " +
+        d.removed.length + " removed, " + d.modified.length + " modified transactions";
+      el.appendChild(summary);
+      if (d.errors && d.errors.length > 0) {
+        const errors = document.createElement("pre");
+        errors.className = "diff-deletion";
+        errors.innerText = "Could not parse everything:\n" + d.errors.join("\n");
+        el.appendChild(errors);
+      }
+      if (d.balances.length > 0) {
+        const heading = document.createElement("h4");
+        heading.innerText = "Balance changes";
+        el.appendChild(heading);
+        const table = document.createElement("table");
+        table.className = "ledger-balances";
+        for (const b of d.balances) {
+          const row = table.insertRow();
+          row.insertCell().innerText = b.account;
+          const amount = row.insertCell();
+          amount.innerText = (b.delta.startsWith("-") ? "" : "+") + b.delta + " " + b.currency;
+          amount.className = "amount " + (b.delta.startsWith("-") ? "diff-deletion" : "diff-addition");
+        }
+        el.appendChild(table);
+      }
+      const section = (title, items, render) => {
+        if (items.length === 0) return;
+        const details = document.createElement("details");
+        details.className = "diff-file";
+        details.open = true;
+        const heading = document.createElement("summary");
+        heading.innerText = title + " (" + items.length + ")";
+        details.appendChild(heading);
+        const table = document.createElement("table");
+        table.className = "diff-table";
+        for (const item of items) render(table.insertRow(), item);
+        details.appendChild(table);
+        el.appendChild(details);
+      };
+      const place = txn => escapeHtml(txn.file + ":" + txn.line);
+      section("Added", d.added, (row, txn) => {
+        diffCell(row, place(txn), "diff-num");
+        diffCell(row, escapeHtml(formatTransaction(txn)), "diff-addition");
+      });
+      section("Removed", d.removed, (row, txn) => {
+        diffCell(row, place(txn), "diff-num");
+        diffCell(row, escapeHtml(formatTransaction(txn)), "diff-deletion");
+      });
+      section("Modified", d.modified, (row, change) => {
+        const [before, after] = wordDiff(formatTransaction(change.old), formatTransaction(change.new));
+        diffCell(row, place(change.old), "diff-num");
+        diffCell(row, before, "diff-deletion");
+        diffCell(row, place(change.new), "diff-num");
+        diffCell(row, after, "diff-addition");
+      });
+      if (d.added.length + d.removed.length + d.modified.length === 0) {
+        el.appendChild(document.createTextNode("No transactions changed."));
+      }
+    }
+
+    // renderDiff shows diffFiles as collapsible files in the unified or
+    // side-by-side view.
+    function renderDiff() {
+      const out = document.getElementById("diffOutput");
+      out.innerHTML = "";
+      if (diffFiles.length === 0) {
+        out.innerText = "No changes.";
+        return;
+      }
+      const split = document.getElementById("diffView").value === "split";
+      for (const file of diffFiles) {
+        const details = document.createElement("details");
+        details.className = "diff-file";
+        details.dataset.path = file.status === "deleted" ? file.old_path : file.new_path;
+        details.open = true;
+        const summary = document.createElement("summary");
+        let name = file.status === "deleted" ? file.old_path : file.new_path;
+        if (file.status === "renamed" || file.status === "copied") {
+          name = file.old_path + " \u2192 " + file.new_path;
+        }
+        summary.innerText = name + " (" + file.status + ", +" + file.additions + " \u2212" + file.deletions + ")";
+        details.appendChild(summary);
+        if (file.status === "conflicted") {
+          summary.innerText = name + " (conflicted)";
+          const note = document.createElement("p");
+          note.appendChild(document.createTextNode("This file has merge conflicts. Resolve them in the "));
+          const link = document.createElement("a");
+          link.href = "#conflictsPanel";
+          link.innerText = "Merge Conflicts panel";
+          note.appendChild(link);
+          note.appendChild(document.createTextNode("."));
+          details.appendChild(note);
+          out.appendChild(details);
+          continue;
+        }
+        if (file.binary) {
+          details.appendChild(document.createTextNode("Binary file"));
+        }
+        const table = document.createElement("table");
+        table.className = "diff-table";
+        for (const hunk of file.hunks) {
+          const header = table.insertRow().insertCell();
+          header.className = "diff-hunk";
+          header.colSpan = split ? 4 : 3;
+          header.innerText = hunk.header;
+          for (const block of diffBlocks(hunk.lines)) {
+            if (split) {
+              renderSplitBlock(table, block);
+            } else {
+              renderUnifiedBlock(table, block);
+            }
+          }
+        }
+        details.appendChild(table);
+        out.appendChild(details);
+      }
+      markCheckProblems();
+    }
+
+    // diffBlocks groups hunk lines into context lines and changes, each a
+    // run of deleted lines followed by the lines added in their place. Each
+    // line gets an html field with the words that changed highlighted.
+    function diffBlocks(lines) {
+      const blocks = [];
+      let i = 0;
+      while (i < lines.length) {
+        const line = lines[i];
+        if (line.type !== "delete" && line.type !== "add") {
+          blocks.push({ type: line.type, line: Object.assign({ html: escapeHtml(line.text) }, line) });
+          i++;
+          continue;
+        }
+        const dels = [], adds = [];
+        while (i < lines.length && lines[i].type === "delete") dels.push(Object.assign({}, lines[i++]));
+        while (i < lines.length && lines[i].type === "add") adds.push(Object.assign({}, lines[i++]));
+        for (let j = 0; j < Math.max(dels.length, adds.length); j++) {
+          if (j < dels.length && j < adds.length) {
+            [dels[j].html, adds[j].html] = wordDiff(dels[j].text, adds[j].text);
+          } else if (j < dels.length) {
+            dels[j].html = escapeHtml(dels[j].text);
+          } else {
+            adds[j].html = escapeHtml(adds[j].text);
+          }
+        }
+        blocks.push({ type: "change", dels: dels, adds: adds });
+      }
+      return blocks;
+    }
+
+    // wordDiff highlights the words that differ between a deleted and an
+    // added line, using the longest common subsequence of their tokens.
+    function wordDiff(a, b) {
+      const ta = a.match(/\w+|\s+|[^\w\s]/g) || [];
+      const tb = b.match(/\w+|\s+|[^\w\s]/g) || [];
+      if (ta.length * tb.length > 40000) {
+        return [escapeHtml(a), escapeHtml(b)];
+      }
+      const lcs = [];
+      for (let i = 0; i <= ta.length; i++) lcs.push(new Array(tb.length + 1).fill(0));
+      for (let i = ta.length - 1; i >= 0; i--) {
+        for (let j = tb.length - 1; j >= 0; j--) {
+          lcs[i][j] = ta[i] === tb[j] ? lcs[i + 1][j + 1] + 1 : Math.max(lcs[i + 1][j], lcs[i][j + 1]);
+        }
+      }
+      let i = 0, j = 0, outA = "", outB = "";
+      const mark = (cls, token) => '<span class="' + cls + '">' + escapeHtml(token) + '</span>';
+      while (i < ta.length || j < tb.length) {
+        if (i < ta.length && j < tb.length && ta[i] === tb[j]) {
+          outA += escapeHtml(ta[i++]);
+          outB += escapeHtml(tb[j++]);
+        } else if (j >= tb.length || (i < ta.length && lcs[i + 1][j] >= lcs[i][j + 1])) {
+          outA += mark("word-del", ta[i++]);
+        } else {
+          outB += mark("word-add", tb[j++]);
+        }
+      }
+      return [outA, outB];
+    }
+
+    function diffCell(row, html, className) {
+      const cell = row.insertCell();
+      cell.innerHTML = html;
+      if (className) cell.className = className;
+      return cell;
+    }
+
+    function renderUnifiedBlock(table, block) {
+      const rows = block.type === "change"
+        ? block.dels.map(l => ["-", l, "diff-deletion"]).concat(block.adds.map(l => ["+", l, "diff-addition"]))
+        : [[block.type === "note" ? "\\" : " ", block.line, block.type === "note" ? "diff-hunk" : ""]];
+      for (const [sign, line, className] of rows) {
+        const row = table.insertRow();
+        if (line.new) row.dataset.newLine = line.new;
+        diffCell(row, line.old || "", "diff-num");
+        diffCell(row, line.new || "", "diff-num");
+        diffCell(row, escapeHtml(sign) + line.html, className);
+      }
+    }
+
+    function renderSplitBlock(table, block) {
+      if (block.type !== "change") {
+        const row = table.insertRow();
+        if (block.line.new) row.dataset.newLine = block.line.new;
+        const className = block.type === "note" ? "diff-hunk" : "";
+        diffCell(row, block.line.old || "", "diff-num");
+        diffCell(row, block.line.html, className);
+        diffCell(row, block.line.new || "", "diff-num");
+        diffCell(row, block.line.html, className);
+        return;
+      }
+      for (let j = 0; j < Math.max(block.dels.length, block.adds.length); j++) {
+        const row = table.insertRow();
+        const del = block.dels[j], add = block.adds[j];
+        if (add) row.dataset.newLine = add.new;
+        diffCell(row, del ? del.old : "", "diff-num");
+        diffCell(row, del ? del.html : "", del ? "diff-deletion" : "");
+        diffCell(row, add ? add.new : "", "diff-num");
+        diffCell(row, add ? add.html : "", add ? "diff-addition" : "");
+      }
+    }
+
+    async function refreshStatus() {
+      const container = document.getElementById("statusOutput");
+      const resp = await fetch(base + "/api/status");
+      if (!resp.ok) {
+        container.innerText = await resp.text();
+        return;
+      }
+      const status = await resp.json();
+      const b = status.branch;
+      let summary = b.detached ? "Detached HEAD at " + b.commit.slice(0, 7) : "On branch " + b.head;
+      if (b.upstream) {
+        summary += " tracking " + b.upstream + " (ahead " + b.ahead + ", behind " + b.behind + ")";
+      }
+      container.innerHTML = "";
+      const p = document.createElement("p");
+      p.innerText = summary;
+      container.appendChild(p);
+
+      const groups = [
+        ["Staged", status.staged.map(f => f.status + ": " + f.path)],
+        ["Unstaged", status.unstaged.map(f => f.status + ": " + f.path)],
+        ["Untracked", status.untracked],
+        ["Conflicted", status.conflicted.map(f => f.path)],
+      ];
+      for (const [title, files] of groups) {
+        if (files.length === 0) continue;
+        const details = document.createElement("details");
+        const summaryEl = document.createElement("summary");
+        summaryEl.innerText = title + " (" + files.length + ")";
+        details.appendChild(summaryEl);
+        const list = document.createElement("pre");
+        list.innerText = files.join("\n");
+        details.appendChild(list);
+        container.appendChild(details);
+      }
     }
 
     function fetchLatestSwipeStatements() {
         document.getElementById("hblfetchresult").innerText = "Loading...";
-        fetch("/git/fetch-latest-hbl")
-          .then(x => x.text()).then(x => {
-          document.getElementById("hblfetchresult").innerText = x;
+        runJob(base + "/git/fetch-latest-hbl/", {}, document.getElementById("hblfetchresult"))
+          .then(done => {
+          showResult(document.getElementById("hblfetchresult"), done);
           }).catch(err => {
               document.getElementById("hblfetchresult").innerText = "Error: " + err;
           });
@@ -319,28 +1810,55 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
       event.preventDefault()
       const date = document.getElementById("hbl-report-date").value
       document.getElementById("hblfetchresult").innerText = "Loading...";
-      fetch("/git/fetch-hbl-report/?date=" + date)
-        .then(x => x.text()).then(x => {
-        document.getElementById("hblfetchresult").innerText = x;
+      runJob(base + "/git/fetch-hbl-report/?date=" + date, {}, document.getElementById("hblfetchresult"))
+        .then(done => {
+        showResult(document.getElementById("hblfetchresult"), done);
         }).catch(err => {
             document.getElementById("hblfetchresult").innerText = "Error: " + err;
         });
     }
 
-    window.onload = refreshDiff;
+    window.onload = () => { refreshDiff(); refreshConflicts(); refreshJobs(); refreshPRs(); refreshEditBranches(); refreshSavedQueries(); refreshHealth(); refreshHistory("query"); refreshHistory("command"); };
 
     </script>
 </body>
-</html>`, getRepoURL(), getRepoURL())
+</html>`, html.EscapeString(user.Name), user.Role, repoOptions(repo), html.EscapeString(repo.URL), html.EscapeString(repo.URL), worktreeNote(repo), repo.BasePath(), jsString(repo.BasePath()), jsString(repo.ID), user.Role >= RoleMaintainer, user.Role >= RoleEditor)
 
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	w.Write([]byte(page))
+}
+
+// repoOptions renders the <option> elements of the repository switcher.
+func repoOptions(current *Repo) string {
+	var b strings.Builder
+	for _, repo := range repos.List() {
+		selected := ""
+		if repo.ID == current.ID {
+			selected = " selected"
+		}
+		fmt.Fprintf(&b, `<option value="%s"%s>%s</option>`, html.EscapeString(repo.ID), selected, html.EscapeString(repo.Name))
+	}
+	return b.String()
+}
+
+// worktreeNote tells users working in their own worktree where it is.
+func worktreeNote(repo *Repo) string {
+	if !repo.Worktree {
+		return ""
+	}
+	return ` | Your worktree: <code>` + html.EscapeString(repo.Path) + `</code>`
 }
 
-func diffHandler(w http.ResponseWriter, r *http.Request) {
-	gitDiff, err := runGit("diff")
+// jsString encodes s as a JavaScript string literal.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	gitDiff, err := repo.runGit(r.Context(), "diff")
 	if err != nil {
-		http.Error(w, "Failed to get git diff: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to get git diff: "+err.Error(), errorStatus(err))
 		return
 	}
 
@@ -350,7 +1868,7 @@ func diffHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // gitCommandHandler: Executes Git commands via POST request
-func gitCommandHandler(w http.ResponseWriter, r *http.Request) {
+func gitCommandHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
 	var cmd GitCommand
 	err := json.NewDecoder(r.Body).Decode(&cmd)
 	if err != nil || len(cmd.Command) == 0 {
@@ -362,9 +1880,10 @@ func gitCommandHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract base command
 	baseCmd := cmd.Command[0]
 
-	// Check if command is allowed
-	if !allowedCommands[baseCmd] {
-		http.Error(w, "Forbidden command", http.StatusForbidden)
+	// Check the command against the policy
+	isCommit := func(rev string) bool { return repo.namesCommit(r.Context(), rev) }
+	if err := policy.Check(cmd.Command, isCommit); err != nil {
+		http.Error(w, "Forbidden command: "+err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -376,9 +1895,12 @@ func gitCommandHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		// Rejoin commit message
 		msg := strings.Join(cmd.Command[2:], " ")
-		output, err := runGit("commit", "-m", msg)
+		args := append([]string{"commit", "-m", msg}, authorArgs(currentUser(r.Context()))...)
+		start := time.Now()
+		output, err := repo.runGit(r.Context(), args...)
+		recordCommand(r.Context(), repo, cmd.Command, start, output, err)
 		if err != nil {
-			http.Error(w, output, http.StatusInternalServerError)
+			http.Error(w, output, errorStatus(err))
 			log.Println(err)
 			return
 		}
@@ -387,190 +1909,106 @@ func gitCommandHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Run generic allowed commands
-	output, err := runGit(cmd.Command...)
+	start := time.Now()
+	output, err := repo.runGit(r.Context(), cmd.Command...)
+	recordCommand(r.Context(), repo, cmd.Command, start, output, err)
 	if err != nil {
-		http.Error(w, output, http.StatusInternalServerError)
+		http.Error(w, output, errorStatus(err))
 		log.Println(err)
 		return
 	}
+	if baseCmd == "pull" && health != nil {
+		// In a worktree the pull moved the user's branch rather than the
+		// shared clone, so check the commit it brought in.
+		req := healthRequest{trigger: "pull"}
+		if repo.Worktree {
+			if out, err := repo.runGit(r.Context(), "rev-parse", "HEAD"); err == nil {
+				req.commit = strings.TrimSpace(out)
+			}
+		}
+		health.trigger(repo.ID, req)
+	}
 
 	w.Write([]byte(output))
 }
 
-// createPRHandler: Creates a PR after committing main.bean to edit branch
-func createPrHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Step 1: Get current branch
-	currentBranch, err := runGit("rev-parse", "--abbrev-ref", "HEAD")
-	if err != nil {
-		http.Error(w, "Failed to get current branch: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	currentBranch = strings.TrimSpace(currentBranch)
-
-	// Step 2: Switch to "edit" branch if not already on it
-	// Merge origin/edit if it exists
-	if currentBranch != "edit" {
-		_, err := runGit("checkout", "-B", "edit")
-		if err != nil {
-			http.Error(w, "Failed to switch to edit branch: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Fetch from origin
-	_, err = runGit("fetch", "origin")
+// beanQueryHandler: POST /git/bean-query?format= runs the query in the body
+// on the main file. format is "text" (the default) for bean-query's table,
+// "csv", or "json" for a QueryResult with typed columns.
+func beanQueryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	// Get the query string
+	queryString, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to fetch origin: "+err.Error(), http.StatusInternalServerError)
+		errMsg := fmt.Sprintf("Error reading query string %v", err.Error())
+		http.Error(w, errMsg, http.StatusInternalServerError)
 		return
 	}
+	runBeanQuery(w, r, repo, string(queryString), &HistoryEntry{})
+}
 
-	// Check if origin/edit exists
-	_, err = runGit("ls-remote", "--exit-code", "--heads", "origin", "edit")
-	if err == nil {
-		// origin/edit exists, merge it too
-		_, err = runGit("merge", "origin/edit")
-		if err != nil {
-			http.Error(w, "Failed to merge origin/edit: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Merge origin/main if exists
-	_, err = runGit("ls-remote", "--exit-code", "--heads", "origin", "main")
-	if err == nil {
-		// origin/main exists, merge it too
-		_, err = runGit("merge", "origin/main")
-		if err != nil {
-			http.Error(w, "Failed to merge origin/main: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Step 3: Add all staged files
-	_, err = runGit("add", ".")
-	if err != nil {
-		http.Error(w, "Failed to add file: "+err.Error(), http.StatusInternalServerError)
+// runBeanQuery runs query on the main file and writes the result in the
+// format asked for by the request. entry, which may name the saved query
+// that ran, is completed and added to the user's history.
+func runBeanQuery(w http.ResponseWriter, r *http.Request, repo *Repo, query string, entry *HistoryEntry) {
+	format := r.URL.Query().Get("format")
+	args := []string{repo.MainFile, query}
+	switch format {
+	case "", "text":
+	case "csv", "json":
+		args = append([]string{"-f", "csv"}, args...)
+	default:
+		http.Error(w, "Unknown format "+format, http.StatusBadRequest)
 		return
 	}
-
-	// Step 4: Check for staged changes
-	diffCmd := exec.Command("git", "diff", "--cached", "--quiet")
-	diffCmd.Dir = GitRepoPath
-	err = diffCmd.Run()
+	// Execute the command
+	ctx, release, err := repo.lock.acquire(r.Context(), false, "bean-query")
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			// There are staged changes
-			commitMsg := r.URL.Query().Get("commit_msg")
-			if commitMsg == "" {
-				commitMsg = "Add data"
-			}
-			if len(commitMsg) > 300 {
-				commitMsg = commitMsg[:300] + "…"
-			}
-			authorEmail := r.Header.Get("Cf-Access-Authenticated-User-Email")
-			if authorEmail != "" {
-				_, err = runGit("commit", "-m", commitMsg, "--author", fmt.Sprintf("X <%s>", authorEmail))
-			} else {
-				_, err = runGit("commit", "-m", commitMsg)
-			}
-			if err != nil {
-				http.Error(w, "Commit failed: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else {
-			http.Error(w, "Error checking staged changes: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		fmt.Fprintf(w, "No changes to commit")
+		http.Error(w, "Failed to run bean-query: "+err.Error(), errorStatus(err))
 		return
 	}
-
-	// Step 5: Push the branch to origin
-	_, err = runGit("push", "-u", "origin", "edit")
+	defer release()
+	entry.Time, entry.Repo, entry.Kind, entry.Query = time.Now().UTC(), repo.ID, "query", query
+	out, stderr, err := runCommand(ctx, repo.Path, "bean-query", args...)
+	entry.DurationMs = time.Since(entry.Time).Milliseconds()
 	if err != nil {
-		http.Error(w, "Failed to push branch: "+err.Error(), http.StatusInternalServerError)
+		entry.Error = strings.TrimSpace(stderr + "\n" + err.Error())
+		history.Record(ctx, entry)
+		http.Error(w, "Failed to run bean-query: "+stderr+"\n"+err.Error(), errorStatus(err))
 		return
 	}
-
-	// Step 6: Check if an open PR already exists for 'edit' branch
-	checkPRCmd := exec.Command("gh", "pr", "list", "--head", "edit", "--state", "open")
-	checkPRCmd.Dir = GitRepoPath
-	var out bytes.Buffer
-	checkPRCmd.Stdout = &out
-	checkPRCmd.Stderr = &out
-
-	if err := checkPRCmd.Run(); err != nil {
-		w.Write([]byte("Error checking for existing PR:\n" + err.Error() + out.String()))
-		return
+	// The text format has no reliable row count.
+	var result *QueryResult
+	var parseErr error
+	if format == "csv" || format == "json" {
+		if result, parseErr = parseQueryCSV(out); parseErr == nil {
+			rows := len(result.Rows)
+			entry.Rows = &rows
+		}
 	}
-
-	if strings.TrimSpace(out.String()) != "" {
-		// An open PR already exists for 'edit'
-		checkPRCmd = exec.Command("gh", "pr", "view", "edit", "--json", "url", "-t", "{{.url}}\n")
-		checkPRCmd.Dir = GitRepoPath
-		out = bytes.Buffer{}
-		checkPRCmd.Stdout = &out
-		checkPRCmd.Stderr = &out
-		if err := checkPRCmd.Run(); err != nil {
-			w.Write([]byte("Error listing existing PR:\n" + err.Error() + out.String()))
+	history.Record(ctx, entry)
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="query.csv"`)
+	case "json":
+		if parseErr != nil {
+			http.Error(w, parseErr.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Write([]byte(out.String()))
+		writeJSON(w, result)
 		return
 	}
-
-	// Step 7: Create PR since none exists
-	cmd := exec.Command("gh", "pr", "create", "--fill")
-	cmd.Dir = GitRepoPath
-
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
-	if err != nil {
-		http.Error(w, "Failed to create PR: "+stderr.String()+"\n"+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Step 8: Return PR output
-	w.Write([]byte(out.String()))
+	w.Write([]byte(out))
 }
 
-func beanQueryHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the query string
-	queryString, err := io.ReadAll(r.Body)
-	if err != nil {
-		errMsg := fmt.Sprintf("Error reading query string %v", err.Error())
-		http.Error(w, errMsg, http.StatusInternalServerError)
-	}
-	// Execute the command
-	cmd := exec.Command("bean-query", "main.bean", string(queryString))
-	cmd.Dir = GitRepoPath
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
-	if err != nil {
-		http.Error(w, "Failed to create PR: "+stderr.String()+"\n"+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Step 8: Return PR output
-	w.Write([]byte(out.String()))
-}
-
-// Get the date for which there exists HBL swipe statement in the HBLReportsDir
+// Get the date for which there exists HBL swipe statement in reportsDir
 // If no date exists, get some arbitrary default date
-func lastReportDate() (string, error) {
+func lastReportDate(reportsDir string) (string, error) {
 	re := regexp.MustCompile(`^report-(\d{4}-\d{2}-\d{2})\.(?:pdf|no-data)$`)
 	latest := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	err := filepath.WalkDir(HBLReportsDir, func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(reportsDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return err
 		}
@@ -598,33 +2036,33 @@ func lastReportDate() (string, error) {
 	return latest.Format("2006-01-02"), nil
 }
 
-func fetchLatestHBLSwipesHandler(w http.ResponseWriter, r *http.Request) {
+func fetchLatestHBLSwipesHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
 	dateFormat := "2006-01-02"
-	fromDate, err := lastReportDate()
+	fromDate, err := lastReportDate(repo.ReportsDir)
 	if err != nil {
 		http.Error(w, "Failed to get last report date: "+"\n"+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	todayDate := time.Now().Format(dateFormat)
 	// Execute the command
-	cmd := exec.Command("go", "run", "download.go", fromDate, todayDate)
-	cmd.Dir = filepath.Join(HBLReportsDir, "..")
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
+	// The download writes into the working tree.
+	ctx, release, err := repo.lock.acquire(r.Context(), true, "HBL download")
 	if err != nil {
-		http.Error(w, "Failed to download HBL reports: "+stderr.String()+"\n"+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to download HBL reports: "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+	reportStep(ctx, fmt.Sprintf("Downloading reports from %s to %s", fromDate, todayDate))
+	out, stderr, err := runCommand(ctx, filepath.Join(repo.ReportsDir, ".."), "go", "run", "download.go", fromDate, todayDate)
+	if err != nil {
+		http.Error(w, "Failed to download HBL reports: "+stderr+"\n"+err.Error(), errorStatus(err))
 		return
 	}
 
-	// Step 8: Return PR output
-	w.Write([]byte(out.String()))
+	w.Write([]byte(out))
 }
 
-func fetchHBLReportHandler(w http.ResponseWriter, r *http.Request) {
+func fetchHBLReportHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
 	dateFormat := "2006-01-02"
 	fromDate := r.URL.Query().Get("date")
 	_, err := time.Parse(dateFormat, fromDate)
@@ -633,53 +2071,174 @@ func fetchHBLReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Execute the command
-	cmd := exec.Command("go", "run", "download.go", fromDate, fromDate)
-	cmd.Dir = filepath.Join(HBLReportsDir, "..")
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
+	// The download writes into the working tree.
+	ctx, release, err := repo.lock.acquire(r.Context(), true, "HBL download")
 	if err != nil {
-		http.Error(w, "Failed to download HBL reports: "+stderr.String()+"\n"+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to download HBL reports: "+err.Error(), errorStatus(err))
 		return
 	}
+	defer release()
+	reportStep(ctx, "Downloading the report for "+fromDate)
+	out, stderr, err := runCommand(ctx, filepath.Join(repo.ReportsDir, ".."), "go", "run", "download.go", fromDate, fromDate)
+	if err != nil {
+		http.Error(w, "Failed to download HBL reports: "+stderr+"\n"+err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Write([]byte(out))
+}
 
-	// Step 8: Return PR output
-	w.Write([]byte(out.String()))
+// hblReportsHandler serves the files in the repository's reports directory.
+func hblReportsHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	prefix := strings.TrimSuffix(r.URL.Path, r.PathValue("file"))
+	http.StripPrefix(prefix, http.FileServer(http.Dir(repo.ReportsDir))).ServeHTTP(w, r)
 }
 
 // main starts the server
 func main() {
 	// Parse optional port argument
 	port := flag.String("port", "7001", "Port to run the server on")
+	configPath := flag.String("config", getConfigPath(), "Path to the JSON config file")
+	hashPasswordFlag := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the config file and exit")
+	newTokenFlag := flag.Bool("new-token", false, "Print a new API token and its hash for the config file and exit")
 	flag.Parse()
 
-	// Ensure the Git repo directory exists
-	absPath, err := filepath.Abs(GitRepoPath)
+	if *hashPasswordFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		fmt.Println(hashPassword(strings.TrimRight(password, "\r\n")))
+		return
+	}
+	if *newTokenFlag {
+		token, hashed := newToken()
+		fmt.Println("token:", token)
+		fmt.Println("config:", hashed)
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policyConfig := cfg.Policy
+	if policyConfig == nil {
+		policyConfig = defaultPolicyConfig()
+	}
+	policy, err = newPolicy(policyConfig)
+	if err != nil {
+		log.Fatalf("Invalid policy: %v", err)
+	}
+
+	lockTimeout, err := cfg.lockTimeout()
+	if err != nil {
+		log.Fatal(err)
+	}
+	commandTimeouts, err = parseCommandTimeouts(cfg.CommandTimeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repos, err = newRepoRegistry(cfg.Repos, lockTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authenticator, err = newAuthenticator(cfg.Auth)
 	if err != nil {
-		log.Fatalf("Invalid repo path: %v", err)
+		log.Fatal(err)
 	}
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		log.Fatalf("Git repo directory does not exist: %s", absPath)
+
+	auditLog, err = openAuditLog(cfg.auditPath())
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	history, err = openHistory(cfg.historyDir())
+	if err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+
+	jobs, err = newJobManager(cfg.jobsDir(), cfg.Jobs)
+	if err != nil {
+		log.Fatalf("Failed to start jobs: %v", err)
+	}
+
+	if cfg.Worktrees != nil {
+		worktrees, err = newWorktreeManager(cfg.worktreesDir(), cfg.Worktrees)
+		if err != nil {
+			log.Fatalf("Failed to set up worktrees: %v", err)
+		}
+		go worktrees.cleanupLoop()
+	}
+
+	if cfg.Health != nil {
+		health, err = newHealthMonitor(cfg.healthDir(), cfg.Health)
+		if err != nil {
+			log.Fatalf("Invalid health checks: %v", err)
+		}
+		if health.schedule != nil {
+			go health.scheduleLoop()
+		}
 	}
 
 	addr := "127.0.0.1:" + *port
-	log.Println("Git server running on", addr, "in directory:", absPath)
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/git/run", gitCommandHandler)
-	http.HandleFunc("/git/create-pr-with-edits", createPrHandler)
-	http.HandleFunc("/git/diff", diffHandler)
-	http.HandleFunc("/git/bean-query", beanQueryHandler)
-
-	fs := http.FileServer(http.Dir(HBLReportsDir))
-	http.Handle("/git/hbl/", http.StripPrefix("/git/hbl/", fs))
+	for _, repo := range repos.List() {
+		log.Printf("Serving repo %s from directory: %s", repo.ID, repo.Path)
+	}
+	log.Println("Git server running on", addr)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("POST /logout", logoutHandler)
+	handleRepo("/", RoleViewer, rootHandler)
+	handleRepo("/git/run", RoleAdmin, longRunning(gitCommandHandler))
+	handleRepo("/git/create-pr-with-edits", RoleEditor, longRunning(createPrHandler))
+	handleRepo("/git/diff", RoleViewer, diffHandler)
+	handleRepo("GET /git/changes", RoleViewer, changesHandler)
+	handleRepo("GET /api/diff", RoleViewer, apiDiffHandler)
+	handleRepo("GET /api/ledger-diff", RoleViewer, apiLedgerDiffHandler)
+	handleRepo("GET /api/check", RoleViewer, apiCheckHandler)
+	handleRepo("GET /git/conflicts", RoleEditor, conflictsHandler)
+	handleRepo("POST /git/conflicts/resolve", RoleEditor, resolveConflictHandler)
+	handleRepo("POST /git/conflicts/commit", RoleEditor, completeMergeHandler)
+	handleRepo("POST /git/conflicts/abort", RoleEditor, abortMergeHandler)
+	handleRepo("/git/bean-query", RoleViewer, longRunning(beanQueryHandler))
+	handleRepo("GET /api/queries", RoleViewer, apiQueriesHandler)
+	handleRepo("GET /api/accounts", RoleViewer, apiAccountsHandler)
+	handleRepo("POST /api/queries", RoleEditor, createQueryHandler)
+	handleRepo("PUT /api/queries/{query}", RoleEditor, updateQueryHandler)
+	handleRepo("DELETE /api/queries/{query}", RoleEditor, deleteQueryHandler)
+	handleRepo("POST /api/queries/{query}/run", RoleViewer, longRunning(runQueryHandler))
+	handleRepo("GET /api/history", RoleViewer, apiHistoryHandler)
+	handleRepo("GET /api/health", RoleViewer, apiHealthHandler)
+	handleRepo("POST /api/health/run", RoleEditor, longRunning(runHealthHandler))
+	handleRepo("GET /api/status", RoleViewer, apiStatusHandler)
+	handleRepo("GET /api/log", RoleViewer, apiLogHandler)
+	handleRepo("GET /api/branches", RoleViewer, apiBranchesHandler)
+	handleRepo("GET /api/lock", RoleViewer, apiLockHandler)
+	handleRepo("GET /api/edit-branches", RoleViewer, apiEditBranchesHandler)
+	handleRepo("GET /api/prs", RoleViewer, apiPRsHandler)
+	handleRepo("GET /api/prs/{number}", RoleViewer, apiPRHandler)
+	handleRepo("GET /api/prs/{number}/diff", RoleViewer, apiPRDiffHandler)
+	handleRepo("GET /api/prs/{number}/ledger-diff", RoleViewer, apiPRLedgerDiffHandler)
+	handleRepo("POST /api/prs/{number}/approve", RoleMaintainer, approvePRHandler)
+	handleRepo("POST /api/prs/{number}/merge", RoleMaintainer, mergePRHandler)
+	handleRepo("POST /api/prs/{number}/close", RoleMaintainer, closePRHandler)
+
+	handleRepo("/git/hbl/{file...}", RoleViewer, hblReportsHandler)
 	// TODO:
 	// Global rate limit this API to prevent overwhelming HBL server.
 	// 10 requests per day max
-	http.HandleFunc("/git/fetch-latest-hbl/", fetchLatestHBLSwipesHandler)
-	http.HandleFunc("/git/fetch-hbl-report/", fetchHBLReportHandler)
+	handleRepo("/git/fetch-latest-hbl/", RoleEditor, longRunning(fetchLatestHBLSwipesHandler))
+	handleRepo("/git/fetch-hbl-report/", RoleEditor, longRunning(fetchHBLReportHandler))
+
+	http.HandleFunc("GET /jobs", requireRole(RoleViewer, jobsHandler))
+	http.HandleFunc("GET /jobs/{id}", requireRole(RoleViewer, jobHandler))
+	http.HandleFunc("GET /jobs/{id}/events", requireRole(RoleViewer, jobEventsHandler))
+	http.HandleFunc("POST /jobs/{id}/cancel", requireRole(RoleViewer, cancelJobHandler))
+
+	http.HandleFunc("GET /audit", requireRole(RoleAdmin, auditPageHandler))
+	http.HandleFunc("GET /audit/entries", requireRole(RoleAdmin, auditEntriesHandler))
+	http.HandleFunc("GET /audit/export", requireRole(RoleAdmin, auditExportHandler))
 
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
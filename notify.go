@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifierConfig is one entry of "notifiers" in the health section: where
+// alerts about failing health checks are sent.
+type NotifierConfig struct {
+	// Type is "webhook", "smtp" or "file".
+	Type string `json:"type"`
+	// URL receives a POST of the alert as JSON (webhook).
+	URL string `json:"url"`
+	// Addr is the "host:port" of the mail server (smtp).
+	Addr string `json:"addr"`
+	From string `json:"from"`
+	// To lists the recipients (smtp).
+	To []string `json:"to"`
+	// Username and Password authenticate with the mail server if set.
+	// PasswordEnv names an environment variable to read the password from
+	// instead.
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordEnv string `json:"password_env"`
+	// Path is the JSON lines file alerts are appended to (file). Defaults
+	// to health/alerts.jsonl in the data directory.
+	Path string `json:"path"`
+}
+
+// HealthAlert is sent when checks of a repository start failing.
+type HealthAlert struct {
+	Repo    string    `json:"repo"`
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Commit  string    `json:"commit,omitempty"`
+	// Checks are the checks that failed in this run after passing before.
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// Subject is a one line summary of the alert.
+func (a *HealthAlert) Subject() string {
+	names := make([]string, len(a.Checks))
+	for i, c := range a.Checks {
+		names[i] = c.Name
+	}
+	return fmt.Sprintf("%s: health checks started failing: %s", a.Repo, strings.Join(names, ", "))
+}
+
+// Text describes the failing checks for a plain text message.
+func (a *HealthAlert) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Health checks of %s started failing (%s run at %s", a.Repo, a.Trigger, a.Time.Format(time.RFC3339))
+	if a.Commit != "" {
+		fmt.Fprintf(&b, ", commit %s", shortHash(a.Commit))
+	}
+	b.WriteString(").\n")
+	for _, c := range a.Checks {
+		fmt.Fprintf(&b, "\n%s: %s\n", c.Name, c.Summary())
+		for _, p := range c.Problems {
+			fmt.Fprintf(&b, "  %s\n", p)
+		}
+		if c.Result != nil {
+			for _, row := range c.Result.Rows {
+				cells := make([]string, len(row))
+				for i, v := range row {
+					switch v := v.(type) {
+					case nil:
+					case QueryAmount:
+						cells[i] = string(v.Number) + " " + v.Currency
+					default:
+						cells[i] = fmt.Sprint(v)
+					}
+				}
+				fmt.Fprintf(&b, "  %s\n", strings.Join(cells, " | "))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Notifier delivers health alerts.
+type Notifier interface {
+	Notify(ctx context.Context, alert *HealthAlert) error
+}
+
+// newNotifier returns the notifier cfg describes. defaultPath is where the
+// file notifier writes unless it has a path.
+func newNotifier(cfg NotifierConfig, defaultPath string) (Notifier, error) {
+	switch cfg.Type {
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook notifier: url is required")
+		}
+		return &webhookNotifier{url: cfg.URL, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "smtp":
+		if cfg.Addr == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("smtp notifier: addr, from and to are required")
+		}
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("smtp notifier: %w", err)
+		}
+		n := &smtpNotifier{addr: cfg.Addr, from: cfg.From, to: cfg.To}
+		if cfg.Username != "" {
+			password := cfg.Password
+			if cfg.PasswordEnv != "" {
+				password = os.Getenv(cfg.PasswordEnv)
+			}
+			n.auth = smtp.PlainAuth("", cfg.Username, password, host)
+		}
+		return n, nil
+	case "file":
+		path := cfg.Path
+		if path == "" {
+			path = defaultPath
+		}
+		return &fileNotifier{path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", cfg.Type)
+	}
+}
+
+// webhookNotifier posts alerts as JSON.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert *HealthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails alerts.
+type smtpNotifier struct {
+	addr, from string
+	to         []string
+	auth       smtp.Auth
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, alert *HealthAlert) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alert.Subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(alert.Text(), "\n", "\r\n"))
+	// SendMail can't be canceled; the notifier's deadline is best effort.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.addr, n.auth, n.from, n.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fileNotifier appends alerts to a JSON lines file.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (n *fileNotifier) Notify(ctx context.Context, alert *HealthAlert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(n.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// PolicyConfig describes which git subcommands may be run through /git/run
+// and which arguments they accept. Subcommands that are not listed are
+// rejected.
+//
+// Example:
+//
+//	"policy": {
+//	  "commands": {
+//	    "log":   {},
+//	    "reset": {"require": ["^--soft$"]},
+//	    "push":  {"deny": ["^--force", "^-f$", "^\\+"]}
+//	  }
+//	}
+type PolicyConfig struct {
+	Commands map[string]PolicyRuleConfig `json:"commands"`
+}
+
+// PolicyRuleConfig holds the argument patterns for a single subcommand. All
+// patterns are Go regular expressions matched against each argument.
+type PolicyRuleConfig struct {
+	// Deny rejects the command if any argument matches one of the patterns.
+	Deny []string `json:"deny"`
+	// Require rejects the command unless, for every pattern, at least one
+	// argument matches it.
+	Require []string `json:"require"`
+	// AllowFlags, when non-empty, rejects any flag (an argument starting
+	// with "-") that matches none of the patterns.
+	AllowFlags []string `json:"allow_flags"`
+	// DenyPaths rejects arguments that name paths, which checkout takes to
+	// mean "discard the changes to these files": everything after "--",
+	// ".", positional arguments after the first, and a first positional
+	// argument that is neither a commit nor a remote branch. The values of
+	// -b, -B and --orphan are not positional.
+	DenyPaths bool `json:"deny_paths"`
+}
+
+// defaultPolicyConfig keeps the subcommands that used to be allowed by the
+// server but blocks their destructive forms.
+func defaultPolicyConfig() *PolicyConfig {
+	return &PolicyConfig{Commands: map[string]PolicyRuleConfig{
+		"show":     {Deny: noOutputFile},
+		"status":   {},
+		"log":      {Deny: noOutputFile},
+		"diff":     {Deny: noOutputFile},
+		"pull":     {},
+		"push":     {Deny: []string{`^--force`, `^-[A-Za-z]*f`, `^--mirror$`, `^--delete$`, `^-d$`, `^\+`, `^:`}},
+		"add":      {},
+		"commit":   {Deny: []string{`^--amend$`}},
+		"checkout": {Deny: []string{`^-f$`, `^--force$`, `^--discard-changes$`, `^--pathspec-from-file`}, DenyPaths: true},
+		"branch":   {Deny: []string{`^-[A-Za-z]*D`, `^--delete$`, `^-d$`, `^--force$`, `^-f$`}},
+		"reset":    {Deny: []string{`^--hard$`, `^--merge$`, `^--keep$`}},
+		"merge":    {},
+	}}
+}
+
+// noOutputFile denies the diff option that writes to a file on the server
+// instead of the response.
+var noOutputFile = []string{`^--output`}
+
+// policyPattern is a compiled pattern together with the name of the rule it
+// came from, e.g. push.deny[0].
+type policyPattern struct {
+	rule string
+	re   *regexp.Regexp
+}
+
+type policyRule struct {
+	deny           []policyPattern
+	require        []policyPattern
+	allowFlags     []policyPattern
+	allowFlagsRule string
+	denyPaths      bool
+}
+
+// Policy is the compiled form of PolicyConfig.
+type Policy struct {
+	commands map[string]*policyRule
+}
+
+// PolicyError reports which rule rejected a command.
+type PolicyError struct {
+	Command string
+	Rule    string
+	Pattern string
+	Arg     string
+	Reason  string
+}
+
+func (e *PolicyError) Error() string {
+	msg := fmt.Sprintf("git %s: %s", e.Command, e.Reason)
+	if e.Rule != "" {
+		msg += fmt.Sprintf(" (rule %s", e.Rule)
+		if e.Pattern != "" {
+			msg += fmt.Sprintf(" %q", e.Pattern)
+		}
+		msg += ")"
+	}
+	return msg
+}
+
+func (e *PolicyError) HTTPStatus() int { return http.StatusForbidden }
+
+// newPolicy compiles cfg, failing on the first invalid pattern.
+func newPolicy(cfg *PolicyConfig) (*Policy, error) {
+	p := &Policy{commands: make(map[string]*policyRule)}
+	for name, rc := range cfg.Commands {
+		rule := &policyRule{allowFlagsRule: name + ".allow_flags", denyPaths: rc.DenyPaths}
+		var err error
+		if rule.deny, err = compilePolicyPatterns(name+".deny", rc.Deny); err != nil {
+			return nil, err
+		}
+		if rule.require, err = compilePolicyPatterns(name+".require", rc.Require); err != nil {
+			return nil, err
+		}
+		if rule.allowFlags, err = compilePolicyPatterns(name+".allow_flags", rc.AllowFlags); err != nil {
+			return nil, err
+		}
+		p.commands[name] = rule
+	}
+	return p, nil
+}
+
+func compilePolicyPatterns(prefix string, patterns []string) ([]policyPattern, error) {
+	var compiled []policyPattern
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %s[%d]: %w", prefix, i, err)
+		}
+		compiled = append(compiled, policyPattern{rule: fmt.Sprintf("%s[%d]", prefix, i), re: re})
+	}
+	return compiled, nil
+}
+
+// Check returns a *PolicyError if the git command (subcommand followed by
+// its arguments) is not permitted. isCommit tells whether an argument names
+// a commit in the repository the command will run in; it is only called for
+// rules with DenyPaths, and a nil isCommit treats every such argument as a
+// path.
+func (p *Policy) Check(command []string, isCommit func(rev string) bool) error {
+	if len(command) == 0 {
+		return &PolicyError{Reason: "empty command"}
+	}
+	name, args := command[0], command[1:]
+	rule, ok := p.commands[name]
+	if !ok {
+		return &PolicyError{Command: name, Reason: "command not allowed", Rule: "commands"}
+	}
+
+	for _, arg := range args {
+		for _, pat := range rule.deny {
+			if pat.re.MatchString(arg) {
+				return &PolicyError{
+					Command: name, Arg: arg, Rule: pat.rule, Pattern: pat.re.String(),
+					Reason: fmt.Sprintf("argument %q is denied", arg),
+				}
+			}
+		}
+		if len(rule.allowFlags) > 0 && strings.HasPrefix(arg, "-") && !matchesAny(rule.allowFlags, arg) {
+			return &PolicyError{
+				Command: name, Arg: arg, Rule: rule.allowFlagsRule,
+				Reason: fmt.Sprintf("flag %q is not allowed", arg),
+			}
+		}
+	}
+
+	if rule.denyPaths {
+		path, rev := pathArgument(args)
+		if path != "" {
+			return &PolicyError{
+				Command: name, Arg: path, Rule: name + ".deny_paths",
+				Reason: fmt.Sprintf("argument %q names a path, whose changes would be discarded", path),
+			}
+		}
+		if rev != "" && (isCommit == nil || !isCommit(rev)) {
+			return &PolicyError{
+				Command: name, Arg: rev, Rule: name + ".deny_paths",
+				Reason: fmt.Sprintf("argument %q is not a branch or commit, so it would be taken as a path whose changes are discarded", rev),
+			}
+		}
+	}
+
+	for _, pat := range rule.require {
+		found := false
+		for _, arg := range args {
+			if pat.re.MatchString(arg) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &PolicyError{
+				Command: name, Rule: pat.rule, Pattern: pat.re.String(),
+				Reason: "missing a required argument",
+			}
+		}
+	}
+	return nil
+}
+
+// pathArgument returns the first argument of a checkout-style command that
+// certainly names a path, or "" if there is none. Otherwise rev is the
+// single positional argument, which git takes as a path unless it names a
+// commit, or "" if there is none.
+func pathArgument(args []string) (path, rev string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if i+1 < len(args) {
+				return args[i+1], ""
+			}
+			return "", rev
+		case arg == "-b" || arg == "-B" || arg == "--orphan":
+			// The next argument is the new branch's name.
+			i++
+		case strings.HasPrefix(arg, "-"):
+		case arg == ".":
+			return arg, ""
+		case rev != "":
+			return arg, ""
+		default:
+			rev = arg
+		}
+	}
+	return "", rev
+}
+
+// namesCommit reports whether checkout would take rev as a commit rather
+// than a path: either it resolves to one, or it is the name of a remote
+// branch that checkout creates a local branch for.
+func (repo *Repo) namesCommit(ctx context.Context, rev string) bool {
+	if _, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", rev+"^{commit}"); err == nil {
+		return true
+	}
+	// for-each-ref patterns are globs, and a glob is a pathspec to checkout.
+	if strings.ContainsAny(rev, "*?[\\") {
+		return false
+	}
+	out, err := repo.runGit(ctx, "for-each-ref", "--format=%(refname)", "refs/remotes/*/"+rev)
+	return err == nil && strings.TrimSpace(out) != ""
+}
+
+func matchesAny(patterns []policyPattern, s string) bool {
+	for _, pat := range patterns {
+		if pat.re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRepo creates a git repository with one commit of main.bean on
+// main.
+func newTestRepo(t *testing.T) *Repo {
+	t.Helper()
+	repo := &Repo{ID: "test", Path: t.TempDir(), MainFile: "main.bean", lock: newRepoLock(time.Second)}
+	git(t, repo, "init", "-q", "-b", "main")
+	git(t, repo, "config", "user.name", "Test")
+	git(t, repo, "config", "user.email", "test@example.com")
+	writeFile(t, repo, "main.bean", "2025-01-01 open Assets:Cash\n")
+	git(t, repo, "add", "main.bean")
+	git(t, repo, "commit", "-q", "-m", "initial")
+	return repo
+}
+
+// git runs a git command in repo, failing the test if it fails.
+func git(t *testing.T, repo *Repo, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repo.Path
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// writeFile writes a file in repo's working tree.
+func writeFile(t *testing.T, repo *Repo, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(repo.Path, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	p, err := newPolicy(defaultPolicyConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := map[string]bool{"main": true, "topic": true, "HEAD": true, "origin/main": true, "origin/topic": true}
+	isCommit := func(rev string) bool { return commits[rev] }
+	tests := []struct {
+		command string
+		rule    string // empty if allowed
+	}{
+		{"status", ""},
+		{"log --oneline -5", ""},
+		{"diff --stat HEAD~1", ""},
+		{"log --output=/etc/passwd", "log.deny[0]"},
+		{"diff --output /tmp/x", "diff.deny[0]"},
+		{"show --output=x HEAD", "show.deny[0]"},
+		{"push origin main", ""},
+		{"push --force origin main", "push.deny[0]"},
+		{"push -uf origin main", "push.deny[1]"},
+		{"push origin +main", "push.deny[5]"},
+		{"push origin :main", "push.deny[6]"},
+		{"commit -m msg", ""},
+		{"commit --amend", "commit.deny[0]"},
+		{"checkout main", ""},
+		{"checkout -b topic origin/main", ""},
+		{"checkout --orphan new", ""},
+		{"checkout --track origin/topic", ""},
+		{"checkout .", "checkout.deny_paths"},
+		{"checkout -- main.bean", "checkout.deny_paths"},
+		{"checkout HEAD -- main.bean", "checkout.deny_paths"},
+		{"checkout main main.bean", "checkout.deny_paths"},
+		{"checkout topic", ""},
+		{"checkout main.bean", "checkout.deny_paths"},
+		{"checkout --ours main.bean", "checkout.deny_paths"},
+		{"checkout --theirs -- main.bean", "checkout.deny_paths"},
+		{"checkout -b topic main main.bean", "checkout.deny_paths"},
+		{"checkout -f main", "checkout.deny[0]"},
+		{"checkout --pathspec-from-file=list", "checkout.deny[3]"},
+		{"branch -D topic", "branch.deny[0]"},
+		{"reset --hard", "reset.deny[0]"},
+		{"reset HEAD~1", ""},
+		{"rebase main", "commands"},
+		{"config user.name x", "commands"},
+	}
+	for _, tt := range tests {
+		err := p.Check(strings.Fields(tt.command), isCommit)
+		if tt.rule == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.command, err)
+			}
+			continue
+		}
+		var pe *PolicyError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: got %v, want rejection by %s", tt.command, err, tt.rule)
+		} else if pe.Rule != tt.rule {
+			t.Errorf("%s: rejected by %s, want %s", tt.command, pe.Rule, tt.rule)
+		}
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := newPolicy(&PolicyConfig{Commands: map[string]PolicyRuleConfig{
+		"reset": {Require: []string{`^--soft$`}},
+		"log":   {AllowFlags: []string{`^--oneline$`, `^-\d+$`}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command string
+		ok      bool
+	}{
+		{"reset --soft HEAD~1", true},
+		{"reset HEAD~1", false},
+		{"log --oneline -3", true},
+		{"log --stat", false},
+		{"log main", true},
+		{"log main.bean", true},
+	}
+	for _, tt := range tests {
+		if err := p.Check(strings.Fields(tt.command), nil); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.command, err, tt.ok)
+		}
+	}
+	if err := p.Check(nil, nil); err == nil {
+		t.Error("empty command was allowed")
+	}
+}
+
+func TestNewPolicyInvalidPattern(t *testing.T) {
+	_, err := newPolicy(&PolicyConfig{Commands: map[string]PolicyRuleConfig{"log": {Deny: []string{"("}}}})
+	if err == nil || !strings.Contains(err.Error(), "log.deny[0]") {
+		t.Errorf("got %v, want an error naming log.deny[0]", err)
+	}
+}
+
+func TestNamesCommit(t *testing.T) {
+	repo := newTestRepo(t)
+	git(t, repo, "branch", "topic")
+	git(t, repo, "update-ref", "refs/remotes/origin/remote-only", "HEAD")
+	git(t, repo, "update-ref", "refs/remotes/origin/x.bean", "HEAD")
+	tests := []struct {
+		rev  string
+		want bool
+	}{
+		{"main", true},
+		{"topic", true},
+		{"HEAD~0", true},
+		{"origin/remote-only", true},
+		{"remote-only", true},
+		{"main.bean", false},
+		{"missing", false},
+		{"*.bean", false},
+	}
+	for _, tt := range tests {
+		if got := repo.namesCommit(context.Background(), tt.rev); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.rev, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// snapshotRefPrefix, followed by the user slug, names the ref that keeps a
+// user's latest pre-PR snapshot reachable so it survives garbage collection
+// if a rollback ever needs manual recovery. Worktrees share refs, so each
+// user needs their own.
+const snapshotRefPrefix = "refs/git-commands/pr-snapshot/"
+
+func snapshotRef(user *User) string {
+	return snapshotRefPrefix + userSlug(user)
+}
+
+// createPrHandler: Creates a PR after committing the edits, or the selection
+// in the request body, to the user's edit branch or to the branch of the
+// optional topic parameter
+func createPrHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	branch, err := repo.editBranch(currentUser(r.Context()), strings.TrimSpace(r.URL.Query().Get("topic")))
+	if err != nil {
+		http.Error(w, "Invalid topic: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// An optional JSON body selects the changes to commit; without one
+	// everything is committed.
+	var sel *StageSelection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil && err != io.EOF {
+		http.Error(w, "Invalid selection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hold the repository for the whole workflow so no other command runs
+	// between its steps.
+	ctx, release, err := repo.lock.acquire(r.Context(), true, "create PR")
+	if err != nil {
+		http.Error(w, "Failed to create PR: "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+
+	commitMsg := r.URL.Query().Get("commit_msg")
+	if commitMsg == "" {
+		commitMsg = "Add data"
+	}
+	if len(commitMsg) > 300 {
+		commitMsg = commitMsg[:300] + "…"
+	}
+
+	// on_conflict=resolve leaves a conflicted merge in place so it can be
+	// resolved in the UI instead of rolling everything back.
+	keepConflicts := r.URL.Query().Get("on_conflict") == "resolve"
+
+	out, err := createPR(ctx, repo, branch, commitMsg, sel, keepConflicts)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		// The problems are returned as JSON so the UI can point at them.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err))
+		json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "problems": checkErr.Problems})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Write([]byte(out))
+}
+
+// createPR commits the working changes to branch, pushes it and opens a PR.
+// Only the changes in sel are committed, or all of them if sel is nil. If
+// anything fails before the push, the repository is restored to the state it
+// was in before the call, unless keepConflicts is set and a merge stopped on
+// conflicts; then the merge is left in progress and a *ConflictError is
+// returned.
+func createPR(ctx context.Context, repo *Repo, branch, commitMsg string, sel *StageSelection, keepConflicts bool) (string, error) {
+	reportStep(ctx, "Recording the repository state")
+	snap, err := takeSnapshot(ctx, repo, branch)
+	if err != nil {
+		return "", fmt.Errorf("Failed to snapshot repository state: %w", err)
+	}
+	fail := func(step, out string, err error) (string, error) {
+		return "", snap.rollback(ctx, gitStepError(step, out, err))
+	}
+
+	// Fetch from origin
+	reportStep(ctx, "Fetching origin")
+	if out, err := repo.runGit(ctx, "fetch", "origin"); err != nil {
+		return fail("Failed to fetch origin", out, err)
+	}
+
+	// Step 1: Switch to the edit branch if not already on it. A new branch
+	// starts from the current commit, unless that is another edit branch
+	// whose commits don't belong in this one; then the working changes are
+	// carried over to the base branch with a three-way merge.
+	if snap.branch != branch {
+		reportStep(ctx, "Switching to "+branch)
+		args := []string{"checkout", branch}
+		if snap.workBranchRef == "" {
+			args = []string{"checkout", "-b", branch}
+			if repo.isEditBranch(snap.branch) {
+				args = []string{"checkout", "--merge", "-b", branch, "origin/" + repo.BaseBranch}
+			}
+		}
+		if out, err := repo.runGit(ctx, args...); err != nil {
+			return fail("Failed to switch to "+branch, out, err)
+		}
+		// checkout --merge succeeds even if the changes conflict.
+		if paths, _ := conflictedPaths(ctx, repo); len(paths) > 0 {
+			return fail("Failed to switch to "+branch, "", fmt.Errorf("your changes conflict with %s in %s", repo.BaseBranch, strings.Join(paths, ", ")))
+		}
+	}
+
+	// Merge the remote edit branch and the base branch if they exist
+	for _, merge := range []string{branch, repo.BaseBranch} {
+		if _, err := repo.runGit(ctx, "ls-remote", "--exit-code", "--heads", "origin", merge); err != nil {
+			continue
+		}
+		reportStep(ctx, "Merging origin/"+merge)
+		if out, err := repo.runGit(ctx, "merge", "origin/"+merge); err != nil {
+			if keepConflicts {
+				if paths, _ := conflictedPaths(ctx, repo); len(paths) > 0 {
+					return "", &ConflictError{Ref: "origin/" + merge, Files: paths}
+				}
+			}
+			return fail("Failed to merge origin/"+merge, out, err)
+		}
+	}
+
+	// Step 2: Stage the selected changes
+	reportStep(ctx, "Committing the changes")
+	if err := stageSelection(ctx, repo, sel); err != nil {
+		return "", snap.rollback(ctx, err)
+	}
+
+	// Step 3: Check for staged changes
+	_, _, err = runCommand(ctx, repo.Path, "git", "diff", "--cached", "--quiet")
+	if err == nil {
+		return "No changes to commit", nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return fail("Error checking staged changes", "", err)
+	}
+
+	// Step 4: Check the ledger as it would be committed. Without a selection
+	// the working tree is what gets committed, so no export is needed.
+	if len(repo.Checks) > 0 {
+		reportStep(ctx, "Checking the ledger")
+		var problems []CheckProblem
+		if sel == nil {
+			problems, err = runChecks(ctx, repo, repo.Path)
+		} else {
+			problems, err = checkIndex(ctx, repo)
+		}
+		if err != nil {
+			return "", snap.rollback(ctx, fmt.Errorf("Failed to check the ledger: %w", err))
+		}
+		if len(problems) > 0 {
+			return "", snap.rollback(ctx, &CheckError{Problems: problems})
+		}
+	}
+	args := append([]string{"commit", "-m", commitMsg}, authorArgs(currentUser(ctx))...)
+	if out, err := repo.runGit(ctx, args...); err != nil {
+		return fail("Commit failed", out, err)
+	}
+
+	// Step 5: Push the branch to origin
+	reportStep(ctx, "Pushing "+branch)
+	if out, err := repo.runGit(ctx, "push", "-u", "origin", branch); err != nil {
+		return fail("Failed to push branch", out, err)
+	}
+
+	// The commit is published now, so later failures leave it in place.
+
+	// Step 6: Check if an open PR already exists for the branch
+	provider := repo.provider
+	reportStep(ctx, "Looking for an open PR on "+provider.Name())
+	pr, err := provider.FindOpen(ctx, branch, repo.BaseBranch)
+	if err != nil {
+		return "Error checking for existing PR:\n" + err.Error(), nil
+	}
+	if pr != nil {
+		// An open PR already exists for the branch
+		return pr.URL + "\n", nil
+	}
+
+	// Step 7: Create PR since none exists
+	reportStep(ctx, "Creating the PR")
+	body, err := repo.runGit(ctx, "log", "--reverse", "--no-merges", "--format=- %s", "origin/"+repo.BaseBranch+".."+branch)
+	if err != nil {
+		body = ""
+	}
+	pr, err = provider.Create(ctx, NewPullRequest{
+		Head:  branch,
+		Base:  repo.BaseBranch,
+		Title: strings.SplitN(commitMsg, "\n", 2)[0],
+		Body:  body,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create PR: %w", err)
+	}
+	if pr.URL == "" {
+		return "Pushed " + branch + "; the " + provider.Name() + " provider doesn't open PRs.\n", nil
+	}
+	return pr.URL + "\n", nil
+}
+
+// gitStepError describes a failed workflow step with the command's output.
+func gitStepError(step, out string, err error) error {
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%s: %w\n%s", step, err, out)
+	}
+	return fmt.Errorf("%s: %w", step, err)
+}
+
+// repoSnapshot is the repository state before a workflow started.
+type repoSnapshot struct {
+	repo *Repo
+	// branch is the checked out branch, empty if HEAD was detached.
+	branch string
+	head   string
+	// workBranch is the branch the workflow moves and workBranchRef its
+	// previous commit, empty if it did not exist.
+	workBranch    string
+	workBranchRef string
+	// ref is the ref the snapshot is saved in.
+	ref string
+	// indexTree and worktreeTree record the index and every non-ignored
+	// file of the working tree, including untracked ones.
+	indexTree    string
+	worktreeTree string
+}
+
+// takeSnapshot records the current branch, HEAD, index and working tree.
+// workBranch is the branch the workflow is about to reset or commit to.
+func takeSnapshot(ctx context.Context, repo *Repo, workBranch string) (*repoSnapshot, error) {
+	s := &repoSnapshot{repo: repo, workBranch: workBranch, ref: snapshotRef(currentUser(ctx))}
+	// The plumbing below is of no interest to someone following progress.
+	ctx = withProgress(ctx, nil)
+
+	out, err := repo.runGit(ctx, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, gitStepError("reading HEAD", out, err)
+	}
+	s.head = strings.TrimSpace(out)
+	if out, err := repo.runGit(ctx, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		s.branch = strings.TrimSpace(out)
+	}
+	if out, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+workBranch); err == nil {
+		s.workBranchRef = strings.TrimSpace(out)
+	}
+
+	out, err = repo.runGit(ctx, "write-tree")
+	if err != nil {
+		return nil, gitStepError("recording the index (resolve any conflicts first)", out, err)
+	}
+	s.indexTree = strings.TrimSpace(out)
+
+	// Stage everything into a throwaway index to capture the working tree
+	// without touching the real index.
+	tmp, err := os.MkdirTemp("", "git-commands-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+	for _, args := range [][]string{{"read-tree", s.head}, {"add", "--all"}} {
+		if out, err := repo.runGitEnv(ctx, env, args...); err != nil {
+			return nil, gitStepError("recording the working tree", out, err)
+		}
+	}
+	out, err = repo.runGitEnv(ctx, env, "write-tree")
+	if err != nil {
+		return nil, gitStepError("recording the working tree", out, err)
+	}
+	s.worktreeTree = strings.TrimSpace(out)
+
+	out, err = repo.runGit(ctx, "commit-tree", s.worktreeTree, "-p", s.head, "-m", "git-commands: working tree before create PR")
+	if err != nil {
+		return nil, gitStepError("saving the snapshot", out, err)
+	}
+	commit := strings.TrimSpace(out)
+	if out, err := repo.runGit(ctx, "update-ref", s.ref, commit); err != nil {
+		return nil, gitStepError("saving the snapshot", out, err)
+	}
+	return s, nil
+}
+
+// RollbackError is a workflow failure together with what was undone.
+type RollbackError struct {
+	Cause error
+	// RolledBack lists the restore steps that succeeded.
+	RolledBack []string
+	// Err is set if the rollback itself failed.
+	Err error
+	// Snapshot is the ref the changes were saved in.
+	Snapshot string
+}
+
+func (e *RollbackError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Cause.Error())
+	if len(e.RolledBack) > 0 {
+		b.WriteString("\n\nRolled back:\n")
+		for _, step := range e.RolledBack {
+			b.WriteString("- " + step + "\n")
+		}
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, "\nRollback failed: %v\nYour changes are saved in %s; restore them with `git read-tree -u --reset %s^{tree}`.\n",
+			e.Err, e.Snapshot, e.Snapshot)
+	}
+	return b.String()
+}
+
+func (e *RollbackError) Unwrap() error { return e.Cause }
+
+// rollback restores the snapshot after cause made the workflow fail and
+// returns a *RollbackError describing both.
+func (s *repoSnapshot) rollback(ctx context.Context, cause error) error {
+	rb := &RollbackError{Cause: cause, Snapshot: s.ref}
+	// Restore the repository even if the workflow was canceled.
+	ctx = context.WithoutCancel(ctx)
+	reportStep(ctx, "Rolling back")
+	git := func(args ...string) error {
+		out, err := s.repo.runGit(ctx, args...)
+		if err != nil {
+			return gitStepError("git "+strings.Join(args, " "), out, err)
+		}
+		return nil
+	}
+
+	if _, err := s.repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "MERGE_HEAD"); err == nil {
+		if err := git("merge", "--abort"); err != nil {
+			rb.Err = err
+			return rb
+		}
+		rb.RolledBack = append(rb.RolledBack, "aborted the unfinished merge")
+	}
+
+	// Force the checkout; the working tree is restored from the snapshot
+	// below.
+	if s.branch != "" {
+		rb.Err = git("checkout", "--force", s.branch)
+	} else {
+		rb.Err = git("checkout", "--force", "--detach", s.head)
+	}
+	if rb.Err != nil {
+		return rb
+	}
+	if rb.Err = git("reset", "--hard", s.head); rb.Err != nil {
+		return rb
+	}
+	if s.branch != "" {
+		rb.RolledBack = append(rb.RolledBack, fmt.Sprintf("checked out %s at %s", s.branch, shortHash(s.head)))
+	} else {
+		rb.RolledBack = append(rb.RolledBack, fmt.Sprintf("checked out detached HEAD at %s", shortHash(s.head)))
+	}
+
+	if s.branch != s.workBranch {
+		if s.workBranchRef != "" {
+			rb.Err = git("update-ref", "refs/heads/"+s.workBranch, s.workBranchRef)
+			if rb.Err == nil {
+				rb.RolledBack = append(rb.RolledBack, fmt.Sprintf("reset branch %s to %s", s.workBranch, shortHash(s.workBranchRef)))
+			}
+		} else if _, err := s.repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+s.workBranch); err == nil {
+			rb.Err = git("branch", "-D", s.workBranch)
+			if rb.Err == nil {
+				rb.RolledBack = append(rb.RolledBack, "deleted the newly created branch "+s.workBranch)
+			}
+		}
+		if rb.Err != nil {
+			return rb
+		}
+	}
+
+	// Bring back the working tree, including untracked files, then the index.
+	if rb.Err = git("read-tree", "-u", "--reset", s.worktreeTree); rb.Err != nil {
+		return rb
+	}
+	if rb.Err = git("read-tree", s.indexTree); rb.Err != nil {
+		return rb
+	}
+	rb.RolledBack = append(rb.RolledBack, "restored the working tree and index")
+	return rb
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRollbackErrorMessage(t *testing.T) {
+	ref := snapshotRef(&User{Name: "Bob B"})
+	if !strings.HasPrefix(ref, "refs/git-commands/pr-snapshot/bob-b-") {
+		t.Errorf("snapshot ref %q", ref)
+	}
+	if snapshotRef(&User{Name: "alice"}) == snapshotRef(&User{Name: "Alice"}) {
+		t.Error("alice and Alice share a snapshot ref")
+	}
+
+	err := &RollbackError{Cause: errors.New("merge failed"), RolledBack: []string{"aborted the unfinished merge"}, Snapshot: ref}
+	if got, want := err.Error(), "merge failed\n\nRolled back:\n- aborted the unfinished merge\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	err.Err = errors.New("checkout failed")
+	if got := err.Error(); !strings.Contains(got, "saved in "+ref+";") || !strings.Contains(got, "git read-tree -u --reset "+ref+"^{tree}") {
+		t.Errorf("message doesn't name %s: %q", ref, got)
+	}
+}
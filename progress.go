@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressHeartbeat is how often an idle stream sends a comment so proxies
+// don't close it during long silent steps.
+const progressHeartbeat = 15 * time.Second
+
+// progressSink receives the steps and command output of an operation: an
+// event stream to the client, or the log of a background job.
+type progressSink interface {
+	send(event string, data any)
+}
+
+type progressContextKey struct{}
+
+// withProgress directs the progress of operations run with ctx to p. A nil
+// p silences it.
+func withProgress(ctx context.Context, p progressSink) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, p)
+}
+
+// progressFrom returns where to report progress, or nil if nobody is
+// following it.
+func progressFrom(ctx context.Context) progressSink {
+	p, _ := ctx.Value(progressContextKey{}).(progressSink)
+	return p
+}
+
+// sseStream sends progress to the client as Server-Sent Events.
+type sseStream struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// newSSEStream starts an event stream response on w.
+func newSSEStream(w http.ResponseWriter) *sseStream {
+	rc := http.NewResponseController(w)
+	// Handlers still read the request body after the stream has started.
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx and similar proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	return &sseStream{w: w, rc: rc}
+}
+
+// send writes one event. Write errors mean the client went away, which the
+// operation finds out about through its context.
+func (p *sseStream) send(event string, data any) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, "event: %s\ndata: %s\n\n", event, b)
+	p.rc.Flush()
+}
+
+func (p *sseStream) ping() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.w, ": ping\n\n")
+	p.rc.Flush()
+}
+
+// reportStep tells a streaming client that a workflow moved on to a new
+// step. It does nothing for ordinary requests.
+func reportStep(ctx context.Context, step string) {
+	if p := progressFrom(ctx); p != nil {
+		p.send("step", map[string]string{"step": step})
+	}
+}
+
+// reportCommand announces a command about to run.
+func reportCommand(ctx context.Context, argv []string) {
+	if p := progressFrom(ctx); p != nil {
+		p.send("command", map[string][]string{"argv": argv})
+	}
+}
+
+// progressLineWriter forwards complete lines written to it as output events.
+// Carriage returns end a line too, so progress meters show up as they
+// update.
+type progressLineWriter struct {
+	p      progressSink
+	stream string
+	buf    []byte
+}
+
+func (lw *progressLineWriter) Write(b []byte) (int, error) {
+	lw.buf = append(lw.buf, b...)
+	for {
+		i := bytes.IndexAny(lw.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		lw.emit(string(lw.buf[:i]))
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush sends a trailing partial line.
+func (lw *progressLineWriter) Flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(string(lw.buf))
+		lw.buf = nil
+	}
+}
+
+func (lw *progressLineWriter) emit(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	lw.p.send("output", map[string]string{"stream": lw.stream, "line": line})
+}
+
+// keepAlive pings the client while the stream is idle until the returned
+// function is called.
+func (p *sseStream) keepAlive() (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.ping()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// wantsStream reports whether the client asked for a Server-Sent Events
+// response, with ?stream=1 or an Accept header.
+func wantsStream(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "1" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// bufferedResponse captures what a handler would have sent so it can be
+// delivered as the final event of a stream.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// streamable lets the client follow a long-running handler. For streaming
+// requests, steps and command output are sent as "step", "command" and
+// "output" events while h runs, and its response as a final "done" event
+// with the HTTP status it would have used and the body. Other requests are
+// passed to h unchanged.
+func streamable(h repoHandlerFunc) repoHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, repo *Repo) {
+		if !wantsStream(r) {
+			h(w, r, repo)
+			return
+		}
+		p := newSSEStream(w)
+		defer p.keepAlive()()
+
+		res := &bufferedResponse{header: make(http.Header)}
+		h(res, r.WithContext(withProgress(r.Context(), p)), repo)
+		if res.status == 0 {
+			res.status = http.StatusOK
+		}
+		p.send("done", map[string]any{"status": res.status, "body": res.body.String()})
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ProviderConfig selects the hosting service PRs are opened on. It is set
+// per repository as "provider" in the config file.
+type ProviderConfig struct {
+	// Type is "github", "gitlab", "gitea" or "local". The local provider
+	// only pushes the branch.
+	Type string `json:"type"`
+	// BaseURL is the API root, e.g. https://gitlab.example.com/api/v4.
+	// Defaults to the public service, or to the API of the host in the
+	// repository URL.
+	BaseURL string `json:"base_url"`
+	// Project is "owner/name" (a group path on GitLab). Defaults to the path
+	// of the repository URL.
+	Project string `json:"project"`
+	// Token authenticates API requests. TokenEnv names an environment
+	// variable to read it from instead; without either the provider's usual
+	// variable (GITHUB_TOKEN or GH_TOKEN, GITLAB_TOKEN, GITEA_TOKEN) is used.
+	Token    string `json:"token"`
+	TokenEnv string `json:"token_env"`
+	// BaseBranch is the branch PRs target. Defaults to main.
+	BaseBranch string `json:"base_branch"`
+}
+
+// PullRequest is a pull request (merge request on GitLab) as reported by a
+// provider.
+type PullRequest struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Head   string `json:"head"`
+	Base   string `json:"base"`
+	State  string `json:"state"`
+	Author string `json:"author"`
+}
+
+// PRCheck is a CI check or commit status of a PR's head commit.
+type PRCheck struct {
+	Name string `json:"name"`
+	// Status is "pending", "success", "failure" or "neutral".
+	Status string `json:"status"`
+	URL    string `json:"url,omitempty"`
+}
+
+// PRReview is the latest review of one reviewer.
+type PRReview struct {
+	User string `json:"user"`
+	// State is "approved", "changes_requested" or "commented".
+	State string `json:"state"`
+}
+
+// PullRequestDetail adds review and merge information to a PR.
+type PullRequestDetail struct {
+	PullRequest
+	Body    string `json:"body"`
+	HeadSHA string `json:"head_sha"`
+	Draft   bool   `json:"draft"`
+	// Mergeable is nil while the provider is still working it out.
+	Mergeable *bool `json:"mergeable"`
+	// MergeState is the provider's own description, e.g. "blocked".
+	MergeState string     `json:"merge_state,omitempty"`
+	Checks     []PRCheck  `json:"checks"`
+	Reviews    []PRReview `json:"reviews"`
+}
+
+// MergeMethod is how a PR is merged.
+type MergeMethod string
+
+const (
+	MergeCommit MergeMethod = "merge"
+	MergeSquash MergeMethod = "squash"
+	MergeRebase MergeMethod = "rebase"
+)
+
+// errNotSupported is returned for operations a provider can't do.
+var errNotSupported = errors.New("not supported by this provider")
+
+// NewPullRequest describes a PR to open.
+type NewPullRequest struct {
+	Head  string
+	Base  string
+	Title string
+	Body  string
+}
+
+// PRProvider opens and finds PRs on a hosting service.
+type PRProvider interface {
+	// Name identifies the provider in messages.
+	Name() string
+	// FindOpen returns the open PR from head into base, or nil if there is
+	// none.
+	FindOpen(ctx context.Context, head, base string) (*PullRequest, error)
+	// Create opens a PR.
+	Create(ctx context.Context, pr NewPullRequest) (*PullRequest, error)
+	// List returns the open PRs.
+	List(ctx context.Context) ([]PullRequest, error)
+	// Get returns a PR with its checks, reviews and mergeability.
+	Get(ctx context.Context, number int) (*PullRequestDetail, error)
+	Approve(ctx context.Context, number int) error
+	Merge(ctx context.Context, number int, method MergeMethod) error
+	Close(ctx context.Context, number int) error
+}
+
+const defaultBaseBranch = "main"
+
+// newPRProvider builds the provider of a repository. Without a provider
+// config, GitHub is used if the repository URL points to github.com and a
+// token is found, and the local provider otherwise.
+func newPRProvider(cfg *ProviderConfig, repoURL string) (PRProvider, error) {
+	explicit := cfg != nil
+	if cfg == nil {
+		cfg = &ProviderConfig{Type: "github"}
+	}
+	host, project := parseRemoteURL(repoURL)
+	if !explicit && host != "github.com" {
+		// Other hosts may be GitHub Enterprise, GitLab or anything else;
+		// they need a provider config.
+		log.Printf("Repository URL %q is not on github.com and there is no provider config; PRs will not be opened", repoURL)
+		return localProvider{}, nil
+	}
+	if cfg.Project != "" {
+		project = strings.Trim(cfg.Project, "/")
+	}
+
+	typ := cmp.Or(cfg.Type, "github")
+	switch typ {
+	case "local":
+		return localProvider{}, nil
+	case "github", "gitlab", "gitea":
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", typ)
+	}
+	if project == "" {
+		if !explicit {
+			log.Printf("Cannot tell the GitHub repository from URL %q; PRs will not be opened", repoURL)
+			return localProvider{}, nil
+		}
+		return nil, fmt.Errorf("%s provider: project is required", typ)
+	}
+
+	token := cfg.Token
+	envNames := map[string][]string{
+		"github": {"GITHUB_TOKEN", "GH_TOKEN"},
+		"gitlab": {"GITLAB_TOKEN"},
+		"gitea":  {"GITEA_TOKEN"},
+	}[typ]
+	if cfg.TokenEnv != "" {
+		envNames = []string{cfg.TokenEnv}
+	}
+	for _, name := range envNames {
+		if token != "" {
+			break
+		}
+		token = os.Getenv(name)
+	}
+	if token == "" && typ == "github" && cfg.TokenEnv == "" {
+		token = ghAuthToken(cmp.Or(host, "github.com"))
+	}
+	if token == "" {
+		hint := "set " + strings.Join(envNames, " or ") + ", or \"token\" or \"token_env\" in the provider config"
+		if typ == "github" {
+			hint += `, or run "gh auth login"`
+		}
+		if !explicit {
+			log.Printf("No GitHub token for %s; PRs will not be opened. To open them, %s", project, hint)
+			return localProvider{}, nil
+		}
+		return nil, fmt.Errorf("%s provider for %s: no API token; %s", typ, project, hint)
+	}
+
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	switch typ {
+	case "github":
+		if baseURL == "" {
+			baseURL = "https://api.github.com"
+			if host != "" && host != "github.com" {
+				// GitHub Enterprise Server
+				baseURL = "https://" + host + "/api/v3"
+			}
+		}
+		return newGitHubProvider(baseURL, project, token), nil
+	case "gitlab":
+		if baseURL == "" {
+			baseURL = "https://" + cmp.Or(host, "gitlab.com") + "/api/v4"
+		}
+		return newGitLabProvider(baseURL, project, token), nil
+	default:
+		if baseURL == "" {
+			if host == "" {
+				return nil, fmt.Errorf("gitea provider: base_url is required")
+			}
+			baseURL = "https://" + host + "/api/v1"
+		}
+		return newGiteaProvider(baseURL, project, token), nil
+	}
+}
+
+// ghAuthToken returns the token the gh CLI is logged in to host with, or
+// "" if gh isn't installed or logged in, so that setups which used to open
+// PRs with gh keep working.
+func ghAuthToken(host string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, _, err := runCommand(ctx, "", "gh", "auth", "token", "--hostname", host)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+var scpLikeURL = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// parseRemoteURL splits a git remote or web URL such as
+// https://github.com/owner/repo, git@github.com:owner/repo.git or
+// ssh://git@host/group/sub/repo into its host and project path.
+func parseRemoteURL(raw string) (host, project string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ""
+	}
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		host, project = u.Hostname(), u.Path
+	} else if m := scpLikeURL.FindStringSubmatch(raw); m != nil {
+		host, project = m[1], m[2]
+	} else {
+		return "", ""
+	}
+	project = strings.TrimSuffix(strings.Trim(project, "/"), ".git")
+	if !strings.Contains(project, "/") {
+		return host, ""
+	}
+	return host, project
+}
+
+// providerHTTPClient is used for all provider API calls.
+var providerHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// apiClient makes JSON requests to a provider's REST API.
+type apiClient struct {
+	provider string
+	baseURL  string
+	header   http.Header
+}
+
+// ProviderError is an unsuccessful response from a provider's API.
+type ProviderError struct {
+	Provider string
+	Status   int
+	Message  string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s API returned %d: %s", e.Provider, e.Status, e.Message)
+}
+
+func (e *ProviderError) HTTPStatus() int { return http.StatusBadGateway }
+
+// do sends in as the JSON body, if not nil, and decodes the response into
+// out, if not nil.
+func (c *apiClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s API: %w", c.provider, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return fmt.Errorf("%s API: %w", c.provider, err)
+	}
+	if resp.StatusCode >= 300 {
+		return &ProviderError{Provider: c.provider, Status: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s API: decoding response: %w", c.provider, err)
+	}
+	return nil
+}
+
+// apiErrorMessage extracts the message from an error response body. GitHub
+// and Gitea use "message", GitLab "message" or "error".
+func apiErrorMessage(data []byte) string {
+	var body struct {
+		Message any    `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		if body.Message != nil {
+			if s, ok := body.Message.(string); ok {
+				return s
+			}
+			b, _ := json.Marshal(body.Message)
+			return string(b)
+		}
+		if body.Error != "" {
+			return body.Error
+		}
+	}
+	msg := strings.TrimSpace(string(data))
+	if len(msg) > 500 {
+		msg = msg[:500] + "…"
+	}
+	return msg
+}
+
+// localProvider pushes branches without opening PRs.
+type localProvider struct{}
+
+func (localProvider) Name() string { return "local" }
+
+func (localProvider) FindOpen(ctx context.Context, head, base string) (*PullRequest, error) {
+	return nil, nil
+}
+
+func (localProvider) Create(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	return &PullRequest{Title: pr.Title, Head: pr.Head, Base: pr.Base, State: "pushed"}, nil
+}
+
+func (localProvider) List(ctx context.Context) ([]PullRequest, error) {
+	return []PullRequest{}, nil
+}
+
+func (localProvider) Get(ctx context.Context, number int) (*PullRequestDetail, error) {
+	return nil, errNotSupported
+}
+
+func (localProvider) Approve(ctx context.Context, number int) error { return errNotSupported }
+
+func (localProvider) Merge(ctx context.Context, number int, method MergeMethod) error {
+	return errNotSupported
+}
+
+func (localProvider) Close(ctx context.Context, number int) error { return errNotSupported }
+
+// checkStatus maps the many ways providers spell a check result onto
+// PRCheck.Status.
+func checkStatus(s string) string {
+	switch strings.ToLower(s) {
+	case "success", "passed", "skipped", "manual":
+		return "success"
+	case "failure", "failed", "error", "timed_out", "cancelled", "canceled", "action_required", "startup_failure":
+		return "failure"
+	case "neutral", "stale":
+		return "neutral"
+	default:
+		return "pending"
+	}
+}
+
+// reviewState maps a provider's review state onto PRReview.State. Empty
+// means the review doesn't count, e.g. a pending or dismissed one.
+func reviewState(s string) string {
+	switch strings.ToUpper(s) {
+	case "APPROVED":
+		return "approved"
+	case "CHANGES_REQUESTED", "REQUEST_CHANGES":
+		return "changes_requested"
+	case "COMMENTED", "COMMENT":
+		return "commented"
+	default:
+		return ""
+	}
+}
+
+// latestReviews keeps the last counting review of each user, in the order
+// reviewers first appeared.
+func latestReviews(reviews []PRReview) []PRReview {
+	latest := []PRReview{}
+	index := make(map[string]int)
+	for _, r := range reviews {
+		if r.State == "" {
+			continue
+		}
+		// A comment doesn't undo an earlier approval or change request.
+		if i, ok := index[r.User]; ok {
+			if r.State != "commented" {
+				latest[i] = r
+			}
+			continue
+		}
+		index[r.User] = len(latest)
+		latest = append(latest, r)
+	}
+	return latest
+}
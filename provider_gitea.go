@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// giteaProvider talks to the Gitea (and Forgejo) REST API.
+type giteaProvider struct {
+	api   *apiClient
+	owner string
+	repo  string
+}
+
+func newGiteaProvider(baseURL, project, token string) *giteaProvider {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "token "+token)
+	}
+	owner, repo, _ := strings.Cut(project, "/")
+	return &giteaProvider{
+		api:   &apiClient{provider: "Gitea", baseURL: baseURL, header: header},
+		owner: owner,
+		repo:  repo,
+	}
+}
+
+func (p *giteaProvider) Name() string { return "gitea" }
+
+// Gitea's pull request objects have the same shape as GitHub's for the
+// fields used here.
+type giteaPull = githubPull
+
+func (p *giteaProvider) repoPath() string {
+	return "/repos/" + url.PathEscape(p.owner) + "/" + url.PathEscape(p.repo)
+}
+
+// giteaPageLimit is the page size used when listing pull requests.
+const giteaPageLimit = 50
+
+func (p *giteaProvider) FindOpen(ctx context.Context, head, base string) (*PullRequest, error) {
+	// The list endpoint can't filter by branch, so page through open PRs.
+	for page := 1; ; page++ {
+		query := url.Values{
+			"state": {"open"},
+			"page":  {strconv.Itoa(page)},
+			"limit": {strconv.Itoa(giteaPageLimit)},
+		}
+		var pulls []giteaPull
+		if err := p.api.do(ctx, http.MethodGet, p.repoPath()+"/pulls?"+query.Encode(), nil, &pulls); err != nil {
+			return nil, err
+		}
+		for _, pull := range pulls {
+			if pull.Head.Ref == head && pull.Base.Ref == base {
+				return pull.pullRequest(), nil
+			}
+		}
+		if len(pulls) < giteaPageLimit {
+			return nil, nil
+		}
+	}
+}
+
+func (p *giteaProvider) Create(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	in := map[string]string{"title": pr.Title, "head": pr.Head, "base": pr.Base, "body": pr.Body}
+	var created giteaPull
+	if err := p.api.do(ctx, http.MethodPost, p.repoPath()+"/pulls", in, &created); err != nil {
+		return nil, fmt.Errorf("creating pull request: %w", err)
+	}
+	return created.pullRequest(), nil
+}
+
+func (p *giteaProvider) List(ctx context.Context) ([]PullRequest, error) {
+	list := []PullRequest{}
+	for page := 1; ; page++ {
+		query := url.Values{
+			"state": {"open"},
+			"page":  {strconv.Itoa(page)},
+			"limit": {strconv.Itoa(giteaPageLimit)},
+		}
+		var pulls []giteaPull
+		if err := p.api.do(ctx, http.MethodGet, p.repoPath()+"/pulls?"+query.Encode(), nil, &pulls); err != nil {
+			return nil, err
+		}
+		for i := range pulls {
+			list = append(list, *pulls[i].pullRequest())
+		}
+		if len(pulls) < giteaPageLimit {
+			return list, nil
+		}
+	}
+}
+
+func (p *giteaProvider) pullPath(number int) string {
+	return p.repoPath() + "/pulls/" + strconv.Itoa(number)
+}
+
+func (p *giteaProvider) Get(ctx context.Context, number int) (*PullRequestDetail, error) {
+	var pull giteaPull
+	if err := p.api.do(ctx, http.MethodGet, p.pullPath(number), nil, &pull); err != nil {
+		return nil, err
+	}
+	d := &PullRequestDetail{
+		PullRequest: *pull.pullRequest(),
+		Body:        pull.Body,
+		HeadSHA:     pull.Head.SHA,
+		Draft:       pull.Draft,
+		Mergeable:   pull.Mergeable,
+		Checks:      []PRCheck{},
+	}
+
+	var combined struct {
+		Statuses []struct {
+			Context   string `json:"context"`
+			Status    string `json:"status"`
+			TargetURL string `json:"target_url"`
+		} `json:"statuses"`
+	}
+	if err := p.api.do(ctx, http.MethodGet, p.repoPath()+"/commits/"+url.PathEscape(pull.Head.SHA)+"/status", nil, &combined); err != nil {
+		return nil, err
+	}
+	for _, st := range combined.Statuses {
+		d.Checks = append(d.Checks, PRCheck{Name: st.Context, Status: checkStatus(st.Status), URL: st.TargetURL})
+	}
+
+	var reviews []struct {
+		State     string `json:"state"`
+		Dismissed bool   `json:"dismissed"`
+		User      struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := p.api.do(ctx, http.MethodGet, p.pullPath(number)+"/reviews", nil, &reviews); err != nil {
+		return nil, err
+	}
+	all := []PRReview{}
+	for _, r := range reviews {
+		if !r.Dismissed {
+			all = append(all, PRReview{User: r.User.Login, State: reviewState(r.State)})
+		}
+	}
+	d.Reviews = latestReviews(all)
+	return d, nil
+}
+
+func (p *giteaProvider) Approve(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPost, p.pullPath(number)+"/reviews", map[string]string{"event": "APPROVED"}, nil)
+}
+
+func (p *giteaProvider) Merge(ctx context.Context, number int, method MergeMethod) error {
+	return p.api.do(ctx, http.MethodPost, p.pullPath(number)+"/merge", map[string]string{"Do": string(method)}, nil)
+}
+
+func (p *giteaProvider) Close(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPatch, p.pullPath(number), map[string]string{"state": "closed"}, nil)
+}
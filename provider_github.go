@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// githubProvider talks to the GitHub REST API, on github.com or a GitHub
+// Enterprise Server.
+type githubProvider struct {
+	api   *apiClient
+	owner string
+	repo  string
+}
+
+func newGitHubProvider(baseURL, project, token string) *githubProvider {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	owner, repo, _ := strings.Cut(project, "/")
+	return &githubProvider{
+		api:   &apiClient{provider: "GitHub", baseURL: baseURL, header: header},
+		owner: owner,
+		repo:  repo,
+	}
+}
+
+func (p *githubProvider) Name() string { return "github" }
+
+type githubPull struct {
+	Number         int    `json:"number"`
+	Title          string `json:"title"`
+	Body           string `json:"body"`
+	HTMLURL        string `json:"html_url"`
+	State          string `json:"state"`
+	Draft          bool   `json:"draft"`
+	Mergeable      *bool  `json:"mergeable"`
+	MergeableState string `json:"mergeable_state"`
+	Head           struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+func (g *githubPull) pullRequest() *PullRequest {
+	return &PullRequest{
+		Number: g.Number,
+		Title:  g.Title,
+		URL:    g.HTMLURL,
+		Head:   g.Head.Ref,
+		Base:   g.Base.Ref,
+		State:  g.State,
+		Author: g.User.Login,
+	}
+}
+
+func (p *githubProvider) repoPath() string {
+	return "/repos/" + url.PathEscape(p.owner) + "/" + url.PathEscape(p.repo)
+}
+
+func (p *githubProvider) FindOpen(ctx context.Context, head, base string) (*PullRequest, error) {
+	query := url.Values{
+		"state": {"open"},
+		"head":  {p.owner + ":" + head},
+		"base":  {base},
+	}
+	var pulls []githubPull
+	if err := p.api.do(ctx, http.MethodGet, p.repoPath()+"/pulls?"+query.Encode(), nil, &pulls); err != nil {
+		return nil, err
+	}
+	if len(pulls) == 0 {
+		return nil, nil
+	}
+	return pulls[0].pullRequest(), nil
+}
+
+func (p *githubProvider) Create(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	in := map[string]string{"title": pr.Title, "head": pr.Head, "base": pr.Base, "body": pr.Body}
+	var created githubPull
+	if err := p.api.do(ctx, http.MethodPost, p.repoPath()+"/pulls", in, &created); err != nil {
+		return nil, fmt.Errorf("creating pull request: %w", err)
+	}
+	return created.pullRequest(), nil
+}
+
+func (p *githubProvider) List(ctx context.Context) ([]PullRequest, error) {
+	var pulls []githubPull
+	if err := p.api.do(ctx, http.MethodGet, p.repoPath()+"/pulls?state=open&per_page=100", nil, &pulls); err != nil {
+		return nil, err
+	}
+	list := make([]PullRequest, len(pulls))
+	for i := range pulls {
+		list[i] = *pulls[i].pullRequest()
+	}
+	return list, nil
+}
+
+func (p *githubProvider) pullPath(number int) string {
+	return p.repoPath() + "/pulls/" + strconv.Itoa(number)
+}
+
+func (p *githubProvider) Get(ctx context.Context, number int) (*PullRequestDetail, error) {
+	var pull githubPull
+	if err := p.api.do(ctx, http.MethodGet, p.pullPath(number), nil, &pull); err != nil {
+		return nil, err
+	}
+	d := &PullRequestDetail{
+		PullRequest: *pull.pullRequest(),
+		Body:        pull.Body,
+		HeadSHA:     pull.Head.SHA,
+		Draft:       pull.Draft,
+		Mergeable:   pull.Mergeable,
+		MergeState:  pull.MergeableState,
+		Checks:      []PRCheck{},
+	}
+
+	// Checks come both as check runs (GitHub Actions and apps) and as
+	// commit statuses (older integrations).
+	var runs struct {
+		CheckRuns []struct {
+			Name       string `json:"name"`
+			Status     string `json:"status"`
+			Conclusion string `json:"conclusion"`
+			HTMLURL    string `json:"html_url"`
+		} `json:"check_runs"`
+	}
+	commitPath := p.repoPath() + "/commits/" + url.PathEscape(pull.Head.SHA)
+	if err := p.api.do(ctx, http.MethodGet, commitPath+"/check-runs?per_page=100", nil, &runs); err != nil {
+		return nil, err
+	}
+	for _, run := range runs.CheckRuns {
+		status := "pending"
+		if run.Status == "completed" {
+			status = checkStatus(run.Conclusion)
+		}
+		d.Checks = append(d.Checks, PRCheck{Name: run.Name, Status: status, URL: run.HTMLURL})
+	}
+	var combined struct {
+		Statuses []struct {
+			Context   string `json:"context"`
+			State     string `json:"state"`
+			TargetURL string `json:"target_url"`
+		} `json:"statuses"`
+	}
+	if err := p.api.do(ctx, http.MethodGet, commitPath+"/status", nil, &combined); err != nil {
+		return nil, err
+	}
+	for _, st := range combined.Statuses {
+		d.Checks = append(d.Checks, PRCheck{Name: st.Context, Status: checkStatus(st.State), URL: st.TargetURL})
+	}
+
+	var reviews []struct {
+		State string `json:"state"`
+		User  struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := p.api.do(ctx, http.MethodGet, p.pullPath(number)+"/reviews?per_page=100", nil, &reviews); err != nil {
+		return nil, err
+	}
+	all := make([]PRReview, len(reviews))
+	for i, r := range reviews {
+		all[i] = PRReview{User: r.User.Login, State: reviewState(r.State)}
+	}
+	d.Reviews = latestReviews(all)
+	return d, nil
+}
+
+func (p *githubProvider) Approve(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPost, p.pullPath(number)+"/reviews", map[string]string{"event": "APPROVE"}, nil)
+}
+
+func (p *githubProvider) Merge(ctx context.Context, number int, method MergeMethod) error {
+	return p.api.do(ctx, http.MethodPut, p.pullPath(number)+"/merge", map[string]string{"merge_method": string(method)}, nil)
+}
+
+func (p *githubProvider) Close(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPatch, p.pullPath(number), map[string]string{"state": "closed"}, nil)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// gitlabProvider talks to the GitLab REST API. PRs are merge requests there.
+type gitlabProvider struct {
+	api     *apiClient
+	project string
+}
+
+func newGitLabProvider(baseURL, project, token string) *gitlabProvider {
+	header := http.Header{}
+	if token != "" {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+	return &gitlabProvider{
+		api:     &apiClient{provider: "GitLab", baseURL: baseURL, header: header},
+		project: project,
+	}
+}
+
+func (p *gitlabProvider) Name() string { return "gitlab" }
+
+type gitlabMergeRequest struct {
+	IID                 int    `json:"iid"`
+	Title               string `json:"title"`
+	Description         string `json:"description"`
+	WebURL              string `json:"web_url"`
+	State               string `json:"state"`
+	Draft               bool   `json:"draft"`
+	SHA                 string `json:"sha"`
+	DetailedMergeStatus string `json:"detailed_merge_status"`
+	HeadPipeline        *struct {
+		Status string `json:"status"`
+		WebURL string `json:"web_url"`
+	} `json:"head_pipeline"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	Author       struct {
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+func (m *gitlabMergeRequest) pullRequest() *PullRequest {
+	state := m.State
+	if state == "opened" {
+		state = "open"
+	}
+	return &PullRequest{
+		Number: m.IID,
+		Title:  m.Title,
+		URL:    m.WebURL,
+		Head:   m.SourceBranch,
+		Base:   m.TargetBranch,
+		State:  state,
+		Author: m.Author.Username,
+	}
+}
+
+// projectPath is the API path of the project; GitLab takes the URL-encoded
+// full path in place of the numeric id.
+func (p *gitlabProvider) projectPath() string {
+	return "/projects/" + url.PathEscape(p.project)
+}
+
+func (p *gitlabProvider) FindOpen(ctx context.Context, head, base string) (*PullRequest, error) {
+	query := url.Values{
+		"state":         {"opened"},
+		"source_branch": {head},
+		"target_branch": {base},
+	}
+	var mrs []gitlabMergeRequest
+	if err := p.api.do(ctx, http.MethodGet, p.projectPath()+"/merge_requests?"+query.Encode(), nil, &mrs); err != nil {
+		return nil, err
+	}
+	if len(mrs) == 0 {
+		return nil, nil
+	}
+	return mrs[0].pullRequest(), nil
+}
+
+func (p *gitlabProvider) Create(ctx context.Context, pr NewPullRequest) (*PullRequest, error) {
+	in := map[string]string{
+		"source_branch": pr.Head,
+		"target_branch": pr.Base,
+		"title":         pr.Title,
+		"description":   pr.Body,
+	}
+	var created gitlabMergeRequest
+	if err := p.api.do(ctx, http.MethodPost, p.projectPath()+"/merge_requests", in, &created); err != nil {
+		return nil, fmt.Errorf("creating merge request: %w", err)
+	}
+	return created.pullRequest(), nil
+}
+
+func (p *gitlabProvider) List(ctx context.Context) ([]PullRequest, error) {
+	var mrs []gitlabMergeRequest
+	if err := p.api.do(ctx, http.MethodGet, p.projectPath()+"/merge_requests?state=opened&per_page=100", nil, &mrs); err != nil {
+		return nil, err
+	}
+	list := make([]PullRequest, len(mrs))
+	for i := range mrs {
+		list[i] = *mrs[i].pullRequest()
+	}
+	return list, nil
+}
+
+func (p *gitlabProvider) mrPath(number int) string {
+	return p.projectPath() + "/merge_requests/" + strconv.Itoa(number)
+}
+
+func (p *gitlabProvider) Get(ctx context.Context, number int) (*PullRequestDetail, error) {
+	var mr gitlabMergeRequest
+	if err := p.api.do(ctx, http.MethodGet, p.mrPath(number), nil, &mr); err != nil {
+		return nil, err
+	}
+	d := &PullRequestDetail{
+		PullRequest: *mr.pullRequest(),
+		Body:        mr.Description,
+		HeadSHA:     mr.SHA,
+		Draft:       mr.Draft,
+		MergeState:  mr.DetailedMergeStatus,
+		Checks:      []PRCheck{},
+		Reviews:     []PRReview{},
+	}
+	switch mr.DetailedMergeStatus {
+	case "mergeable":
+		d.Mergeable = boolPtr(true)
+	case "checking", "unchecked", "preparing", "":
+	default:
+		d.Mergeable = boolPtr(false)
+	}
+	if mr.HeadPipeline != nil {
+		d.Checks = append(d.Checks, PRCheck{Name: "pipeline", Status: checkStatus(mr.HeadPipeline.Status), URL: mr.HeadPipeline.WebURL})
+	}
+
+	var approvals struct {
+		ApprovedBy []struct {
+			User struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		} `json:"approved_by"`
+	}
+	if err := p.api.do(ctx, http.MethodGet, p.mrPath(number)+"/approvals", nil, &approvals); err != nil {
+		return nil, err
+	}
+	for _, a := range approvals.ApprovedBy {
+		d.Reviews = append(d.Reviews, PRReview{User: a.User.Username, State: "approved"})
+	}
+	return d, nil
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func (p *gitlabProvider) Approve(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPost, p.mrPath(number)+"/approve", nil, nil)
+}
+
+// Merge merges or squashes the merge request. How GitLab merges is a project
+// setting, so a rebase merge can't be requested per merge request.
+func (p *gitlabProvider) Merge(ctx context.Context, number int, method MergeMethod) error {
+	if method == MergeRebase {
+		return fmt.Errorf("rebase merges: %w; set the merge method in the GitLab project instead", errNotSupported)
+	}
+	return p.api.do(ctx, http.MethodPut, p.mrPath(number)+"/merge", map[string]bool{"squash": method == MergeSquash}, nil)
+}
+
+func (p *gitlabProvider) Close(ctx context.Context, number int) error {
+	return p.api.do(ctx, http.MethodPut, p.mrPath(number), map[string]string{"state_event": "close"}, nil)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeAPI is a hosting service that answers requests from canned JSON
+// responses, keyed by "METHOD /request/uri", and records what it was sent.
+type fakeAPI struct {
+	t         *testing.T
+	responses map[string]string
+	requests  []*http.Request
+	bodies    map[string]string
+}
+
+func newFakeAPI(t *testing.T, responses map[string]string) (*fakeAPI, *httptest.Server) {
+	f := &fakeAPI{t: t, responses: responses, bodies: make(map[string]string)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.RequestURI()
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies[key] = string(body)
+	resp, ok := f.responses[key]
+	if !ok {
+		f.t.Logf("unexpected request %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		resp = `{"message": "Not Found"}`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, resp)
+}
+
+// body returns the decoded JSON body of a request.
+func (f *fakeAPI) body(key string) map[string]any {
+	f.t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(f.bodies[key]), &m); err != nil {
+		f.t.Fatalf("%s: body %q: %v", key, f.bodies[key], err)
+	}
+	return m
+}
+
+func TestGitHubProvider(t *testing.T) {
+	pull := `{"number": 7, "title": "Edits", "body": "desc", "html_url": "https://github.com/o/r/pull/7", "state": "open",
+		"mergeable": true, "mergeable_state": "clean", "head": {"ref": "edit/alice", "sha": "abc"}, "base": {"ref": "main"}, "user": {"login": "alice"}}`
+	f, srv := newFakeAPI(t, map[string]string{
+		"GET /repos/o/r/pulls?base=main&head=o%3Aedit%2Falice&state=open": "[" + pull + "]",
+		"GET /repos/o/r/pulls?base=main&head=o%3Aother&state=open":        "[]",
+		"POST /repos/o/r/pulls":                        pull,
+		"GET /repos/o/r/pulls?state=open&per_page=100": "[" + pull + "]",
+		"GET /repos/o/r/pulls/7":                       pull,
+		"GET /repos/o/r/commits/abc/check-runs?per_page=100": `{"check_runs": [
+			{"name": "build", "status": "completed", "conclusion": "success", "html_url": "u1"},
+			{"name": "lint", "status": "in_progress"}]}`,
+		"GET /repos/o/r/commits/abc/status": `{"statuses": [{"context": "ci/legacy", "state": "failure", "target_url": "u2"}]}`,
+		"GET /repos/o/r/pulls/7/reviews?per_page=100": `[
+			{"state": "CHANGES_REQUESTED", "user": {"login": "bob"}},
+			{"state": "COMMENTED", "user": {"login": "carol"}},
+			{"state": "APPROVED", "user": {"login": "bob"}},
+			{"state": "COMMENTED", "user": {"login": "bob"}},
+			{"state": "PENDING", "user": {"login": "dave"}}]`,
+		"PUT /repos/o/r/pulls/7/merge":    `{"merged": true}`,
+		"POST /repos/o/r/pulls/7/reviews": `{}`,
+		"PATCH /repos/o/r/pulls/7":        pull,
+	})
+	p := newGitHubProvider(srv.URL, "o/r", "tok")
+	ctx := context.Background()
+	want := &PullRequest{Number: 7, Title: "Edits", URL: "https://github.com/o/r/pull/7", Head: "edit/alice", Base: "main", State: "open", Author: "alice"}
+
+	pr, err := p.FindOpen(ctx, "edit/alice", "main")
+	if err != nil || !reflect.DeepEqual(pr, want) {
+		t.Errorf("FindOpen: got %+v, %v", pr, err)
+	}
+	if r := f.requests[0]; r.Header.Get("Accept") != "application/vnd.github+json" || r.Header.Get("Authorization") != "Bearer tok" {
+		t.Errorf("request headers %v", r.Header)
+	}
+	if pr, err := p.FindOpen(ctx, "other", "main"); pr != nil || err != nil {
+		t.Errorf("FindOpen without a PR: got %+v, %v", pr, err)
+	}
+
+	if _, err := p.Create(ctx, NewPullRequest{Head: "edit/alice", Base: "main", Title: "Edits", Body: "desc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("POST /repos/o/r/pulls"); got["head"] != "edit/alice" || got["base"] != "main" || got["title"] != "Edits" {
+		t.Errorf("create body %v", got)
+	}
+
+	if list, err := p.List(ctx); err != nil || len(list) != 1 || list[0] != *want {
+		t.Errorf("List: got %+v, %v", list, err)
+	}
+
+	d, err := p.Get(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChecks := []PRCheck{{Name: "build", Status: "success", URL: "u1"}, {Name: "lint", Status: "pending"}, {Name: "ci/legacy", Status: "failure", URL: "u2"}}
+	if !reflect.DeepEqual(d.Checks, wantChecks) {
+		t.Errorf("checks %+v", d.Checks)
+	}
+	wantReviews := []PRReview{{User: "bob", State: "approved"}, {User: "carol", State: "commented"}}
+	if !reflect.DeepEqual(d.Reviews, wantReviews) {
+		t.Errorf("reviews %+v", d.Reviews)
+	}
+	if d.HeadSHA != "abc" || d.Body != "desc" || d.Mergeable == nil || !*d.Mergeable || d.MergeState != "clean" {
+		t.Errorf("detail %+v", d)
+	}
+
+	if err := p.Merge(ctx, 7, MergeSquash); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("PUT /repos/o/r/pulls/7/merge"); got["merge_method"] != "squash" {
+		t.Errorf("merge body %v", got)
+	}
+	if err := p.Approve(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("POST /repos/o/r/pulls/7/reviews"); got["event"] != "APPROVE" {
+		t.Errorf("approve body %v", got)
+	}
+	if err := p.Close(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("PATCH /repos/o/r/pulls/7"); got["state"] != "closed" {
+		t.Errorf("close body %v", got)
+	}
+
+	var pe *ProviderError
+	if _, err := p.Get(ctx, 8); !errors.As(err, &pe) || pe.Status != http.StatusNotFound || pe.Message != "Not Found" {
+		t.Errorf("Get of a missing PR: got %v", err)
+	}
+}
+
+func TestGitLabProvider(t *testing.T) {
+	mr := `{"iid": 3, "title": "Edits", "description": "desc", "web_url": "w", "state": "opened", "sha": "abc",
+		"detailed_merge_status": "mergeable", "head_pipeline": {"status": "running", "web_url": "p"},
+		"source_branch": "edit/alice", "target_branch": "main", "author": {"username": "alice"}}`
+	project := "/projects/group%2Fsub%2Frepo"
+	f, srv := newFakeAPI(t, map[string]string{
+		"GET " + project + "/merge_requests?source_branch=edit%2Falice&state=opened&target_branch=main": "[" + mr + "]",
+		"POST " + project + "/merge_requests":                          mr,
+		"GET " + project + "/merge_requests/3":                         mr,
+		"GET " + project + "/merge_requests/3/approvals":               `{"approved_by": [{"user": {"username": "bob"}}]}`,
+		"PUT " + project + "/merge_requests/3/merge":                   `{}`,
+		"PUT " + project + "/merge_requests/3":                         mr,
+		"GET " + project + "/merge_requests?state=opened&per_page=100": "[" + mr + "]",
+	})
+	p := newGitLabProvider(srv.URL, "group/sub/repo", "tok")
+	ctx := context.Background()
+
+	pr, err := p.FindOpen(ctx, "edit/alice", "main")
+	want := &PullRequest{Number: 3, Title: "Edits", URL: "w", Head: "edit/alice", Base: "main", State: "open", Author: "alice"}
+	if err != nil || !reflect.DeepEqual(pr, want) {
+		t.Errorf("FindOpen: got %+v, %v", pr, err)
+	}
+	if r := f.requests[0]; r.Header.Get("PRIVATE-TOKEN") != "tok" || r.Header.Get("Accept") != "application/json" {
+		t.Errorf("request headers %v", r.Header)
+	}
+
+	if _, err := p.Create(ctx, NewPullRequest{Head: "edit/alice", Base: "main", Title: "Edits", Body: "desc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("POST " + project + "/merge_requests"); got["source_branch"] != "edit/alice" || got["description"] != "desc" {
+		t.Errorf("create body %v", got)
+	}
+	if list, err := p.List(ctx); err != nil || len(list) != 1 {
+		t.Errorf("List: got %+v, %v", list, err)
+	}
+
+	d, err := p.Get(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mergeable == nil || !*d.Mergeable || d.HeadSHA != "abc" {
+		t.Errorf("detail %+v", d)
+	}
+	if want := []PRCheck{{Name: "pipeline", Status: "pending", URL: "p"}}; !reflect.DeepEqual(d.Checks, want) {
+		t.Errorf("checks %+v", d.Checks)
+	}
+	if want := []PRReview{{User: "bob", State: "approved"}}; !reflect.DeepEqual(d.Reviews, want) {
+		t.Errorf("reviews %+v", d.Reviews)
+	}
+
+	if err := p.Merge(ctx, 3, MergeSquash); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("PUT " + project + "/merge_requests/3/merge"); got["squash"] != true {
+		t.Errorf("merge body %v", got)
+	}
+	if err := p.Merge(ctx, 3, MergeRebase); !errors.Is(err, errNotSupported) {
+		t.Errorf("rebase merge: got %v", err)
+	}
+	if err := p.Close(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("PUT " + project + "/merge_requests/3"); got["state_event"] != "close" {
+		t.Errorf("close body %v", got)
+	}
+}
+
+func TestGiteaProvider(t *testing.T) {
+	pull := func(number int, head string) string {
+		return fmt.Sprintf(`{"number": %d, "title": "PR", "state": "open", "head": {"ref": %q, "sha": "abc"}, "base": {"ref": "main"}, "user": {"login": "alice"}}`, number, head)
+	}
+	var page1 []string
+	for i := 1; i <= giteaPageLimit; i++ {
+		page1 = append(page1, pull(i, "topic"))
+	}
+	f, srv := newFakeAPI(t, map[string]string{
+		"GET /repos/o/r/pulls?limit=50&page=1&state=open": "[" + strings.Join(page1, ",") + "]",
+		"GET /repos/o/r/pulls?limit=50&page=2&state=open": "[" + pull(51, "edit/alice") + "]",
+		"GET /repos/o/r/pulls/51":                         pull(51, "edit/alice"),
+		"GET /repos/o/r/commits/abc/status":               `{"statuses": [{"context": "ci", "status": "success", "target_url": "u"}]}`,
+		"GET /repos/o/r/pulls/51/reviews": `[
+			{"state": "APPROVED", "user": {"login": "bob"}},
+			{"state": "REQUEST_CHANGES", "dismissed": true, "user": {"login": "bob"}},
+			{"state": "REQUEST_CHANGES", "user": {"login": "carol"}}]`,
+		"POST /repos/o/r/pulls/51/merge":   ``,
+		"POST /repos/o/r/pulls/51/reviews": `{}`,
+	})
+	p := newGiteaProvider(srv.URL, "o/r", "tok")
+	ctx := context.Background()
+
+	pr, err := p.FindOpen(ctx, "edit/alice", "main")
+	if err != nil || pr == nil || pr.Number != 51 {
+		t.Fatalf("FindOpen: got %+v, %v", pr, err)
+	}
+	if got := f.requests[0].Header.Get("Authorization"); got != "token tok" {
+		t.Errorf("Authorization %q", got)
+	}
+	if list, err := p.List(ctx); err != nil || len(list) != giteaPageLimit+1 {
+		t.Errorf("List: got %d PRs, %v", len(list), err)
+	}
+
+	d, err := p.Get(ctx, 51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PRCheck{{Name: "ci", Status: "success", URL: "u"}}; !reflect.DeepEqual(d.Checks, want) {
+		t.Errorf("checks %+v", d.Checks)
+	}
+	if want := []PRReview{{User: "bob", State: "approved"}, {User: "carol", State: "changes_requested"}}; !reflect.DeepEqual(d.Reviews, want) {
+		t.Errorf("reviews %+v", d.Reviews)
+	}
+
+	if err := p.Merge(ctx, 51, MergeRebase); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("POST /repos/o/r/pulls/51/merge"); got["Do"] != "rebase" {
+		t.Errorf("merge body %v", got)
+	}
+	if err := p.Approve(ctx, 51); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.body("POST /repos/o/r/pulls/51/reviews"); got["event"] != "APPROVED" {
+		t.Errorf("approve body %v", got)
+	}
+}
+
+func TestNewPRProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *ProviderConfig
+		url     string
+		typ     string
+		baseURL string
+		err     string
+		// githubToken is the GITHUB_TOKEN environment variable.
+		githubToken string
+	}{
+		{"github", &ProviderConfig{Token: "t"}, "git@github.com:o/r.git", "github", "https://api.github.com", "", ""},
+		{"github enterprise", &ProviderConfig{Token: "t"}, "https://ghe.example.com/o/r", "github", "https://ghe.example.com/api/v3", "", ""},
+		{"gitlab", &ProviderConfig{Type: "gitlab", Token: "t"}, "https://gitlab.example.com/g/sub/r.git", "gitlab", "https://gitlab.example.com/api/v4", "", ""},
+		{"gitea", &ProviderConfig{Type: "gitea", Token: "t", BaseURL: "http://localhost:3000/api/v1/"}, "ssh://git@host/o/r", "gitea", "http://localhost:3000/api/v1", "", ""},
+		{"local", &ProviderConfig{Type: "local"}, "", "local", "", "", ""},
+		{"unknown type", &ProviderConfig{Type: "svn"}, "https://github.com/o/r", "", "", "unknown provider type", ""},
+		{"no project", &ProviderConfig{Type: "gitlab", Token: "t"}, "/srv/ledger", "", "", "project is required", ""},
+		{"gitea without a host", &ProviderConfig{Type: "gitea", Token: "t", Project: "o/r"}, "", "", "", "base_url is required", ""},
+		{"no token", &ProviderConfig{Type: "gitlab", TokenEnv: "GIT_COMMANDS_TEST_UNSET"}, "https://gitlab.com/g/r", "", "", "no API token", ""},
+		{"no github token", &ProviderConfig{}, "https://github.com/o/r", "", "", "no API token", ""},
+		{"github token from the environment", &ProviderConfig{}, "https://github.com/o/r", "github", "https://api.github.com", "", "t"},
+		// Without a config only github.com with a token opens PRs.
+		{"implicit github", nil, "git@github.com:o/r.git", "github", "https://api.github.com", "", "t"},
+		{"implicit github without a token", nil, "git@github.com:o/r.git", "local", "", "", ""},
+		{"implicit gitlab", nil, "git@gitlab.com:team/ledger.git", "local", "", "", "t"},
+		{"implicit github enterprise", nil, "https://ghe.example.com/o/r", "local", "", "", "t"},
+		{"implicit local path", nil, "/srv/ledger", "local", "", "", "t"},
+		{"implicit no project", nil, "https://github.com/o", "local", "", "", "t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_TOKEN", tt.githubToken)
+			t.Setenv("GH_TOKEN", "")
+			// Keep a logged in gh from providing a token.
+			t.Setenv("PATH", t.TempDir())
+			p, err := newPRProvider(tt.cfg, tt.url)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Name() != tt.typ {
+				t.Errorf("got provider %s, want %s", p.Name(), tt.typ)
+			}
+			var baseURL string
+			switch p := p.(type) {
+			case *githubProvider:
+				baseURL = p.api.baseURL
+			case *gitlabProvider:
+				baseURL = p.api.baseURL
+			case *giteaProvider:
+				baseURL = p.api.baseURL
+			}
+			if baseURL != tt.baseURL {
+				t.Errorf("base URL %q, want %q", baseURL, tt.baseURL)
+			}
+		})
+	}
+}
+
+func TestParseRemoteURL(t *testing.T) {
+	tests := []struct {
+		url, host, project string
+	}{
+		{"https://github.com/owner/repo", "github.com", "owner/repo"},
+		{"https://github.com/owner/repo.git/", "github.com", "owner/repo"},
+		{"git@github.com:owner/repo.git", "github.com", "owner/repo"},
+		{"ssh://git@gitlab.example.com:2222/group/sub/repo.git", "gitlab.example.com", "group/sub/repo"},
+		{"github.com:owner/repo", "github.com", "owner/repo"},
+		{"https://example.com/repo", "example.com", ""},
+		{"/srv/ledger", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		host, project := parseRemoteURL(tt.url)
+		if host != tt.host || project != tt.project {
+			t.Errorf("%q: got %q, %q, want %q, %q", tt.url, host, project, tt.host, tt.project)
+		}
+	}
+}
+
+func TestAPIErrorMessage(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"message": "Validation Failed"}`, "Validation Failed"},
+		{`{"message": {"base": ["is invalid"]}}`, `{"base":["is invalid"]}`},
+		{`{"error": "insufficient_scope"}`, "insufficient_scope"},
+		{"Bad Gateway\n", "Bad Gateway"},
+	}
+	for _, tt := range tests {
+		if got := apiErrorMessage([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isEditBranch reports whether branch is one the create PR workflow pushes.
+// Only PRs from such branches can be approved, merged or closed here.
+func (repo *Repo) isEditBranch(branch string) bool {
+	_, _, ok := repo.parseEditBranch(branch)
+	return ok || branch == legacyEditBranch
+}
+
+// PRListEntry is a PR in the /api/prs listing.
+type PRListEntry struct {
+	PullRequest
+	// Edit is set for PRs opened by the create PR workflow.
+	Edit bool `json:"edit"`
+}
+
+// apiPRsHandler: GET /api/prs lists the open PRs of the repository.
+func apiPRsHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	prs, err := repo.provider.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list PRs: "+err.Error(), errorStatus(err))
+		return
+	}
+	entries := make([]PRListEntry, len(prs))
+	for i, pr := range prs {
+		entries[i] = PRListEntry{PullRequest: pr, Edit: repo.isEditBranch(pr.Head)}
+	}
+	writeJSON(w, map[string]any{"provider": repo.provider.Name(), "base": repo.BaseBranch, "prs": entries})
+}
+
+// prFromRequest fetches the {number} PR, writing the error response if that
+// fails.
+func prFromRequest(w http.ResponseWriter, r *http.Request, repo *Repo) *PullRequestDetail {
+	number, err := strconv.Atoi(r.PathValue("number"))
+	if err != nil || number <= 0 {
+		http.Error(w, "Invalid PR number", http.StatusBadRequest)
+		return nil
+	}
+	pr, err := repo.provider.Get(r.Context(), number)
+	if err != nil {
+		http.Error(w, "Failed to get PR: "+err.Error(), errorStatus(err))
+		return nil
+	}
+	return pr
+}
+
+// apiPRHandler: GET /api/prs/{number} shows a PR with its checks, reviews and
+// mergeability.
+func apiPRHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	pr := prFromRequest(w, r, repo)
+	if pr == nil {
+		return
+	}
+	writeJSON(w, struct {
+		*PullRequestDetail
+		Edit bool `json:"edit"`
+	}{pr, repo.isEditBranch(pr.Head)})
+}
+
+// apiPRDiffHandler: GET /api/prs/{number}/diff returns the changes the PR
+// would bring into its base branch, computed with the local clone.
+func apiPRDiffHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	pr := prFromRequest(w, r, repo)
+	if pr == nil {
+		return
+	}
+	ctx := r.Context()
+	if err := fetchPR(ctx, repo, pr); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	out, err := repo.runGit(ctx, "diff", "--no-color", "origin/"+pr.Base+"..."+pr.HeadSHA)
+	if err != nil {
+		http.Error(w, gitStepError("Failed to diff the PR", out, err).Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(out))
+}
+
+// fetchPR fetches the head and base branches of pr unless the clone already
+// has its head commit and base branch.
+func fetchPR(ctx context.Context, repo *Repo, pr *PullRequestDetail) error {
+	_, headErr := repo.runGit(ctx, "cat-file", "-e", pr.HeadSHA+"^{commit}")
+	_, baseErr := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "origin/"+pr.Base)
+	if headErr == nil && baseErr == nil {
+		return nil
+	}
+	if out, err := repo.runGit(ctx, "fetch", "origin", pr.Base, pr.Head); err != nil {
+		return gitStepError("Failed to fetch the PR", out, err)
+	}
+	return nil
+}
+
+// prAction runs a maintainer action on an edit PR and records it in the
+// audit log.
+func prAction(w http.ResponseWriter, r *http.Request, repo *Repo, action string, args []string, run func(pr *PullRequestDetail) error) {
+	pr := prFromRequest(w, r, repo)
+	if pr == nil {
+		return
+	}
+	if !repo.isEditBranch(pr.Head) {
+		http.Error(w, "Only PRs opened from edit branches can be managed here", http.StatusForbidden)
+		return
+	}
+	if pr.State != "open" {
+		http.Error(w, "PR is "+pr.State, http.StatusConflict)
+		return
+	}
+	start := time.Now()
+	err := run(pr)
+	recordAudit(r.Context(), auditCommand{
+		dir:      repo.Path,
+		argv:     append([]string{repo.provider.Name(), action, strconv.Itoa(pr.Number)}, args...),
+		start:    start,
+		exitCode: exitCode(err),
+		err:      err,
+	})
+	if err != nil {
+		http.Error(w, "Failed to "+action+" PR: "+err.Error(), errorStatus(err))
+		return
+	}
+	w.Write([]byte("PR #" + strconv.Itoa(pr.Number) + " " + strings.TrimSuffix(action, "e") + "ed"))
+}
+
+// approvePRHandler: POST /api/prs/{number}/approve
+func approvePRHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	prAction(w, r, repo, "approve", nil, func(pr *PullRequestDetail) error {
+		return repo.provider.Approve(r.Context(), pr.Number)
+	})
+}
+
+// mergePRHandler: POST /api/prs/{number}/merge?method=merge|squash|rebase
+func mergePRHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	method := MergeMethod(r.URL.Query().Get("method"))
+	switch method {
+	case "":
+		method = MergeCommit
+	case MergeCommit, MergeSquash, MergeRebase:
+	default:
+		http.Error(w, "Invalid merge method", http.StatusBadRequest)
+		return
+	}
+	prAction(w, r, repo, "merge", []string{string(method)}, func(pr *PullRequestDetail) error {
+		return repo.provider.Merge(r.Context(), pr.Number, method)
+	})
+}
+
+// closePRHandler: POST /api/prs/{number}/close
+func closePRHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	prAction(w, r, repo, "close", nil, func(pr *PullRequestDetail) error {
+		return repo.provider.Close(r.Context(), pr.Number)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// QueryColumn is a column of a bean-query result. Type is "date", "number",
+// "amount", "boolean" or "string", inferred from the values, which all have
+// that type or are empty.
+type QueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// QueryAmount is a value of an "amount" column.
+type QueryAmount struct {
+	Number   json.Number `json:"number"`
+	Currency string      `json:"currency"`
+}
+
+// QueryResult is a bean-query result with typed values: strings for dates
+// and strings, JSON numbers that keep their decimals, QueryAmount, booleans,
+// and null for empty cells.
+type QueryResult struct {
+	Columns []QueryColumn `json:"columns"`
+	Rows    [][]any       `json:"rows"`
+}
+
+var (
+	queryDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	queryNumber   = regexp.MustCompile(`^-?\d+(?:\.\d+)?$`)
+	queryAmount   = regexp.MustCompile(`^(-?\d+(?:\.\d+)?) +([A-Z][A-Z0-9'._-]*)$`)
+	queryBooleans = map[string]bool{"TRUE": true, "True": true, "true": true, "FALSE": false, "False": false, "false": false}
+)
+
+// parseQueryCSV parses the output of `bean-query -f csv`, whose first record
+// names the columns.
+func parseQueryCSV(out string) (*QueryResult, error) {
+	r := csv.NewReader(strings.NewReader(out))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV from bean-query: %w", err)
+	}
+	result := &QueryResult{Columns: []QueryColumn{}, Rows: [][]any{}}
+	if len(records) == 0 {
+		return result, nil
+	}
+	for _, name := range records[0] {
+		result.Columns = append(result.Columns, QueryColumn{Name: strings.TrimSpace(name)})
+	}
+	records = records[1:]
+	for i := range result.Columns {
+		result.Columns[i].Type = queryColumnType(records, i)
+	}
+	for _, record := range records {
+		row := make([]any, len(result.Columns))
+		for i, col := range result.Columns {
+			if i < len(record) {
+				row[i] = queryValue(col.Type, strings.TrimSpace(record[i]))
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, nil
+}
+
+// queryColumnType returns the most specific type all non-empty values of
+// column i have.
+func queryColumnType(records [][]string, i int) string {
+	for _, typ := range []string{"date", "number", "amount", "boolean"} {
+		matches, values := true, 0
+		for _, record := range records {
+			if i >= len(record) {
+				continue
+			}
+			v := strings.TrimSpace(record[i])
+			if v == "" {
+				continue
+			}
+			values++
+			switch typ {
+			case "date":
+				matches = queryDate.MatchString(v)
+			case "number":
+				matches = queryNumber.MatchString(v)
+			case "amount":
+				matches = queryAmount.MatchString(v)
+			case "boolean":
+				_, matches = queryBooleans[v]
+			}
+			if !matches {
+				break
+			}
+		}
+		if matches && values > 0 {
+			return typ
+		}
+	}
+	return "string"
+}
+
+func queryValue(typ, v string) any {
+	if v == "" {
+		return nil
+	}
+	switch typ {
+	case "number":
+		return json.Number(v)
+	case "amount":
+		m := queryAmount.FindStringSubmatch(v)
+		return QueryAmount{Number: json.Number(m[1]), Currency: m[2]}
+	case "boolean":
+		return queryBooleans[v]
+	}
+	return v
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryCSV(t *testing.T) {
+	out := "date ,account,balance,amount,flag,note\n" +
+		"2025-01-02,Assets:Cash,-3.50,-3.50 USD,TRUE,\"a, b\"\n" +
+		"2025-01-03,Expenses:Food,12,100 VTI,false,\n" +
+		",Assets:Bank,,,,x\n" +
+		"2025-01-04,short\n"
+	result, err := parseQueryCSV(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantColumns := []QueryColumn{
+		{"date", "date"}, {"account", "string"}, {"balance", "number"},
+		{"amount", "amount"}, {"flag", "boolean"}, {"note", "string"},
+	}
+	if !reflect.DeepEqual(result.Columns, wantColumns) {
+		t.Errorf("columns %+v", result.Columns)
+	}
+	wantRows := [][]any{
+		{"2025-01-02", "Assets:Cash", json.Number("-3.50"), QueryAmount{"-3.50", "USD"}, true, "a, b"},
+		{"2025-01-03", "Expenses:Food", json.Number("12"), QueryAmount{"100", "VTI"}, false, nil},
+		{nil, "Assets:Bank", nil, nil, nil, "x"},
+		{"2025-01-04", "short", nil, nil, nil, nil},
+	}
+	if !reflect.DeepEqual(result.Rows, wantRows) {
+		t.Errorf("rows %v\nwant %v", result.Rows, wantRows)
+	}
+
+	// Numbers keep their decimals in JSON.
+	data, _ := json.Marshal(result.Rows[0][2:4])
+	if got := string(data); got != `[-3.50,{"number":-3.50,"currency":"USD"}]` {
+		t.Errorf("JSON %s", got)
+	}
+
+	if result, err := parseQueryCSV(""); err != nil || len(result.Columns) != 0 || len(result.Rows) != 0 {
+		t.Errorf("empty output: got %+v, %v", result, err)
+	}
+	if _, err := parseQueryCSV("a,b\n\"unterminated\n"); err == nil {
+		t.Error("expected an error for invalid CSV")
+	}
+}
+
+func TestQueryColumnType(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"2025-01-01", "", "2025-12-31"}, "date"},
+		{[]string{"2025-01-01", "soon"}, "string"},
+		{[]string{"1", "-2.5", " 3 "}, "number"},
+		{[]string{"1e5"}, "string"},
+		{[]string{"1,000"}, "string"},
+		{[]string{"10 USD", "-2.5 EUR", "1 VTI.X"}, "amount"},
+		{[]string{"10 USD", "10"}, "string"},
+		{[]string{"10 usd"}, "string"},
+		{[]string{"True", "false", "FALSE"}, "boolean"},
+		{[]string{"yes"}, "string"},
+		{[]string{"", ""}, "string"},
+		{nil, "string"},
+	}
+	for _, tt := range tests {
+		records := make([][]string, len(tt.values))
+		for i, v := range tt.values {
+			records[i] = []string{"x", v}
+		}
+		if got := queryColumnType(records, 1); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.values, got, tt.want)
+		}
+	}
+
+	// Short records don't count.
+	if got := queryColumnType([][]string{{"2025-01-01", "1"}, {"2025-01-02"}}, 1); got != "number" {
+		t.Errorf("short records: got %s", got)
+	}
+}
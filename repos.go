@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RepoConfig describes one ledger repository in the config file.
+type RepoConfig struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Path is the local clone the server operates on.
+	Path string `json:"path"`
+	// URL is the remote shown in the UI.
+	URL string `json:"url"`
+	// MainFile is the beancount file passed to bean-query, relative to Path.
+	// Defaults to main.bean.
+	MainFile string `json:"main_file"`
+	// ReportsDir holds the HBL swipe statements. Relative paths are resolved
+	// against Path. Defaults to hbl-swipe-statements/reports.
+	ReportsDir string `json:"reports_dir"`
+	// Provider is the hosting service PRs are opened on. Defaults to GitHub,
+	// with the repository taken from URL.
+	Provider *ProviderConfig `json:"provider"`
+	// BranchPrefix is prepended to the user name to form each user's edit
+	// branch. Defaults to "edits/". It can't be "edit/" while a branch named
+	// edit exists, as git can't have both.
+	BranchPrefix string `json:"branch_prefix"`
+	// StageDeny lists glob patterns of untracked files create PR refuses to
+	// commit. Patterns without a slash match the file name anywhere.
+	// Defaults to defaultStageDeny.
+	StageDeny []string `json:"stage_deny"`
+	// Checks are the commands that must succeed before create PR commits,
+	// each a program and its arguments, run in a checkout of the files to be
+	// committed. "{main_file}" is replaced with MainFile. Defaults to
+	// bean-check on the main file; an empty list disables the checks.
+	Checks [][]string `json:"checks"`
+	// QueriesFile holds the saved queries, relative to Path. Defaults to
+	// queries.json.
+	QueriesFile string `json:"queries_file"`
+}
+
+// Repo is a ledger repository managed by the server.
+type Repo struct {
+	ID         string
+	Name       string
+	Path       string
+	URL        string
+	MainFile   string
+	ReportsDir string
+	// BaseBranch is the branch edits are merged from and PRs target.
+	BaseBranch string
+	// BranchPrefix starts the name of every edit branch.
+	BranchPrefix string
+	StageDeny    []string
+	Checks       [][]string
+	QueriesFile  string
+	// Worktree is set when Path is a user's worktree rather than the clone.
+	Worktree bool
+
+	lock     *repoLock
+	provider PRProvider
+}
+
+// RepoRegistry holds the configured repositories in config order. The first
+// one is the default repository used by the unscoped routes.
+type RepoRegistry struct {
+	repos []*Repo
+	byID  map[string]*Repo
+}
+
+var validRepoID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// repos is the registry of managed repositories, set in main.
+var repos *RepoRegistry
+
+const (
+	defaultMainFile   = "main.bean"
+	defaultReportsDir = "hbl-swipe-statements/reports"
+)
+
+func getRepoURL() string {
+	if path, exists := os.LookupEnv("GIT_REPO_URL"); exists {
+		return path
+	}
+	return "https://github.com/sumanchapai/superview-accounting"
+}
+
+// Get Git repository path from ENV variable, fallback if not set
+func getRepoPath() string {
+	if path, exists := os.LookupEnv("GIT_REPO_PATH"); exists {
+		return path
+	}
+	return "/Users/suman/Desktop/projects/superview/superview-accounting"
+}
+
+// newRepoRegistry builds the registry from the config. Without any
+// configured repositories a single "default" repository is created from the
+// GIT_REPO_PATH and GIT_REPO_URL env variables.
+func newRepoRegistry(configs []RepoConfig, lockTimeout time.Duration) (*RepoRegistry, error) {
+	if len(configs) == 0 {
+		configs = []RepoConfig{{ID: "default", Path: getRepoPath(), URL: getRepoURL()}}
+	}
+	reg := &RepoRegistry{byID: make(map[string]*Repo)}
+	for _, rc := range configs {
+		if !validRepoID.MatchString(rc.ID) {
+			return nil, fmt.Errorf("invalid repo id %q", rc.ID)
+		}
+		if _, dup := reg.byID[rc.ID]; dup {
+			return nil, fmt.Errorf("duplicate repo id %q", rc.ID)
+		}
+		if rc.Path == "" {
+			return nil, fmt.Errorf("repo %s: path is required", rc.ID)
+		}
+		path, err := filepath.Abs(rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("repo %s: invalid path: %w", rc.ID, err)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, fmt.Errorf("repo %s: directory does not exist: %s", rc.ID, path)
+		}
+		repo := &Repo{
+			ID:         rc.ID,
+			Name:       rc.Name,
+			Path:       path,
+			URL:        rc.URL,
+			MainFile:   rc.MainFile,
+			ReportsDir: rc.ReportsDir,
+			lock:       newRepoLock(lockTimeout),
+		}
+		if repo.Name == "" {
+			repo.Name = repo.ID
+		}
+		if repo.MainFile == "" {
+			repo.MainFile = defaultMainFile
+		}
+		if repo.ReportsDir == "" {
+			repo.ReportsDir = defaultReportsDir
+		}
+		if !filepath.IsAbs(repo.ReportsDir) {
+			repo.ReportsDir = filepath.Join(repo.Path, repo.ReportsDir)
+		}
+		repo.BranchPrefix = defaultBranchPrefix
+		if rc.BranchPrefix != "" {
+			if !validBranchPrefix.MatchString(rc.BranchPrefix) {
+				return nil, fmt.Errorf("repo %s: invalid branch_prefix %q", rc.ID, rc.BranchPrefix)
+			}
+			repo.BranchPrefix = rc.BranchPrefix
+		}
+		repo.StageDeny = defaultStageDeny
+		if rc.StageDeny != nil {
+			repo.StageDeny = rc.StageDeny
+		}
+		for _, pattern := range repo.StageDeny {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("repo %s: invalid stage_deny pattern %q", rc.ID, pattern)
+			}
+		}
+		repo.Checks = defaultChecks
+		if rc.Checks != nil {
+			repo.Checks = rc.Checks
+		}
+		for _, argv := range repo.Checks {
+			if len(argv) == 0 || argv[0] == "" {
+				return nil, fmt.Errorf("repo %s: empty check command", rc.ID)
+			}
+		}
+		repo.QueriesFile = defaultQueriesFile
+		if rc.QueriesFile != "" {
+			if !filepath.IsLocal(rc.QueriesFile) {
+				return nil, fmt.Errorf("repo %s: queries_file must be inside the repository", rc.ID)
+			}
+			repo.QueriesFile = rc.QueriesFile
+		}
+		repo.BaseBranch = defaultBaseBranch
+		if rc.Provider != nil && rc.Provider.BaseBranch != "" {
+			repo.BaseBranch = rc.Provider.BaseBranch
+		}
+		if repo.provider, err = newPRProvider(rc.Provider, rc.URL); err != nil {
+			return nil, fmt.Errorf("repo %s: %w", rc.ID, err)
+		}
+		reg.repos = append(reg.repos, repo)
+		reg.byID[repo.ID] = repo
+	}
+	return reg, nil
+}
+
+// Get returns the repository with the given id, or nil.
+func (reg *RepoRegistry) Get(id string) *Repo {
+	return reg.byID[id]
+}
+
+// Default returns the first configured repository.
+func (reg *RepoRegistry) Default() *Repo {
+	return reg.repos[0]
+}
+
+// List returns all repositories in config order.
+func (reg *RepoRegistry) List() []*Repo {
+	return reg.repos
+}
+
+// BasePath is the URL prefix of the repository's routes.
+func (repo *Repo) BasePath() string {
+	return "/repos/" + repo.ID
+}
+
+// repoHandlerFunc is an HTTP handler operating on a single repository.
+type repoHandlerFunc func(w http.ResponseWriter, r *http.Request, repo *Repo)
+
+// withRepo resolves the {id} path value to a repository, falling back to the
+// default repository on the unscoped routes, and switches to the user's
+// worktree if there is one.
+func withRepo(h repoHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repo := repos.Default()
+		if id := r.PathValue("id"); id != "" {
+			repo = repos.Get(id)
+			if repo == nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		requestInfoFrom(r.Context()).Repo = repo.ID
+		// Editors work in their own worktree when worktrees are enabled.
+		if user := currentUser(r.Context()); worktrees != nil && user != nil && user.Role >= RoleEditor {
+			wt, err := worktrees.forUser(r.Context(), repo, user)
+			if err != nil {
+				http.Error(w, "Failed to prepare your worktree: "+err.Error(), errorStatus(err))
+				return
+			}
+			repo = wt
+		}
+		h(w, r, repo)
+	}
+}
+
+// handleRepo registers h both under /repos/{id} and, for compatibility with
+// existing clients, on the unscoped pattern where it serves the default
+// repository. The pattern may start with an HTTP method, e.g. "GET /api/log".
+// Users below role are rejected.
+func handleRepo(pattern string, role Role, h repoHandlerFunc) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	} else {
+		method += " "
+	}
+	http.HandleFunc(pattern, requireRole(role, withRepo(h)))
+	http.HandleFunc(method+"/repos/{id}"+path, requireRole(role, withRepo(h)))
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultQueriesFile holds the saved queries of a repository, relative to its
+// path, unless it configures queries_file.
+const defaultQueriesFile = "queries.json"
+
+// QueryParam is a parameter of a saved query, referenced in its BQL as
+// {{name}}.
+type QueryParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Type decides how values are checked and written into the query; see
+	// literal. Defaults to "string".
+	Type string `json:"type,omitempty"`
+	// Default is used when a run gives no value.
+	Default string `json:"default,omitempty"`
+}
+
+// SavedQuery is a named BQL query kept in the repository's queries file.
+type SavedQuery struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Query       string       `json:"query"`
+	Params      []QueryParam `json:"params,omitempty"`
+}
+
+// defaultSavedQueries are the queries of a repository without a queries file.
+// Saving any change writes them to the file along with it.
+var defaultSavedQueries = []SavedQuery{
+	{
+		ID:          "positive-income",
+		Name:        "Positive Incomes",
+		Description: `Income postings with a positive amount. To ignore positive income that is intended, mention "intended positive" in the narration.`,
+		Query:       `select date, lineno, account, narration, position where {{period}} and account ~ {{account}} and narration !~ {{ignore}} and number > {{threshold}}`,
+		Params: []QueryParam{
+			{Name: "period", Type: "daterange", Description: "Dates to look at, all if empty"},
+			{Name: "account", Type: "account", Description: "Income accounts", Default: "Income"},
+			{Name: "ignore", Type: "regex", Description: "Narrations to skip", Default: "refund|intended positive"},
+			{Name: "threshold", Type: "amount", Description: "Report amounts above", Default: "0"},
+		},
+	},
+	{
+		ID:          "negative-expenses",
+		Name:        "Negative Expenses",
+		Description: `Expense postings with a negative amount. To ignore one that is intended, mention "intended negative" in the narration.`,
+		Query:       `select date, lineno, account, narration, position where {{period}} and account ~ {{account}} and narration !~ {{ignore}} and number < {{threshold}}`,
+		Params: []QueryParam{
+			{Name: "period", Type: "daterange", Description: "Dates to look at, all if empty"},
+			{Name: "account", Type: "account", Description: "Expense accounts", Default: "Expenses"},
+			{Name: "ignore", Type: "regex", Description: "Narrations to skip", Default: "intended negative"},
+			{Name: "threshold", Type: "amount", Description: "Report amounts below", Default: "0"},
+		},
+	},
+	{
+		ID:          "bank-charge",
+		Name:        "Missing bank charges for HBL Income",
+		Description: "Income received in the bank account without a bank charge posting.",
+		Query:       `select date, lineno, account, position, narration where {{period}} and has_account({{bank}}) and has_account("Income") and account = {{bank}} and not has_account({{charges}}) and flag = "*"`,
+		Params: []QueryParam{
+			{Name: "period", Type: "daterange", Description: "Dates to look at, all if empty"},
+			{Name: "bank", Type: "account", Description: "Bank account", Default: "Assets:Bank:HBL"},
+			{Name: "charges", Type: "account", Description: "Bank charge account", Default: "Expenses:BankCharge"},
+		},
+	},
+}
+
+var (
+	validQueryID     = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+	validAccountName = regexp.MustCompile(`^[A-Z][A-Za-z0-9-]*(?::[A-Z0-9][A-Za-z0-9-]*)*$`)
+	validQueryAmount = regexp.MustCompile(`^-?\d+(?:\.\d+)?$`)
+	validParamName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	queryPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// queryParamTypes are the types a parameter can have.
+var queryParamTypes = map[string]bool{"string": true, "account": true, "date": true, "daterange": true, "amount": true, "regex": true}
+
+// literal checks the value v of p and returns it as BQL:
+//
+//   - string: a quoted string
+//   - account: an account name, or the start of one, as a quoted string
+//   - regex: a regular expression, as a quoted string
+//   - date: a YYYY-MM-DD date literal
+//   - daterange: "FROM..TO" with either end optional, as the condition
+//     (date >= FROM AND date <= TO); an empty range is TRUE
+//   - amount: a decimal number
+func (p *QueryParam) literal(v string) (string, error) {
+	switch p.Type {
+	case "", "string":
+		return bqlString(v), nil
+	case "account":
+		if !validAccountName.MatchString(v) {
+			return "", fmt.Errorf("invalid account %q", v)
+		}
+		return bqlString(v), nil
+	case "regex":
+		if _, err := regexp.Compile(v); err != nil {
+			return "", fmt.Errorf("invalid regex %q", v)
+		}
+		return bqlString(v), nil
+	case "date":
+		if _, err := time.Parse(time.DateOnly, v); err != nil {
+			return "", fmt.Errorf("invalid date %q, expected YYYY-MM-DD", v)
+		}
+		return v, nil
+	case "daterange":
+		from, to, found := strings.Cut(v, "..")
+		if v != "" && !found {
+			return "", fmt.Errorf("invalid date range %q, expected FROM..TO", v)
+		}
+		var conds []string
+		for _, end := range []struct{ date, op string }{{from, ">="}, {to, "<="}} {
+			if end.date == "" {
+				continue
+			}
+			if _, err := time.Parse(time.DateOnly, end.date); err != nil {
+				return "", fmt.Errorf("invalid date %q in range, expected YYYY-MM-DD", end.date)
+			}
+			conds = append(conds, "date "+end.op+" "+end.date)
+		}
+		if len(conds) == 0 {
+			return "TRUE", nil
+		}
+		return "(" + strings.Join(conds, " AND ") + ")", nil
+	case "amount":
+		if !validQueryAmount.MatchString(v) {
+			return "", fmt.Errorf("invalid amount %q", v)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown parameter type %q", p.Type)
+}
+
+// validate checks a query before it is saved.
+func (q *SavedQuery) validate() error {
+	if !validQueryID.MatchString(q.ID) {
+		return fmt.Errorf("invalid id %q: use lowercase letters, digits and dashes", q.ID)
+	}
+	if strings.TrimSpace(q.Name) == "" {
+		return errors.New("name is required")
+	}
+	if strings.TrimSpace(q.Query) == "" {
+		return errors.New("query is required")
+	}
+	declared := make(map[string]bool)
+	for _, p := range q.Params {
+		if !validParamName.MatchString(p.Name) {
+			return fmt.Errorf("invalid parameter name %q", p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("duplicate parameter %q", p.Name)
+		}
+		if p.Type != "" && !queryParamTypes[p.Type] {
+			return fmt.Errorf("parameter %s has unknown type %q", p.Name, p.Type)
+		}
+		if p.Default != "" {
+			if _, err := p.literal(p.Default); err != nil {
+				return fmt.Errorf("default of %s: %w", p.Name, err)
+			}
+		}
+		declared[p.Name] = true
+	}
+	for _, m := range queryPlaceholder.FindAllStringSubmatch(q.Query, -1) {
+		if !declared[m[1]] {
+			return fmt.Errorf("{{%s}} is not a declared parameter", m[1])
+		}
+	}
+	return nil
+}
+
+// render replaces the placeholders of the query with the checked values, or
+// the defaults, written as BQL literals of the parameter types. Only a date
+// range may be left empty.
+func (q *SavedQuery) render(values map[string]string) (string, error) {
+	params := make(map[string]QueryParam)
+	for _, p := range q.Params {
+		params[p.Name] = p
+	}
+	var problems []string
+	query := queryPlaceholder.ReplaceAllStringFunc(q.Query, func(s string) string {
+		p := params[queryPlaceholder.FindStringSubmatch(s)[1]]
+		v := strings.TrimSpace(values[p.Name])
+		if v == "" {
+			v = p.Default
+		}
+		if v == "" && p.Type != "daterange" {
+			problems = append(problems, p.Name+": a value is required")
+			return s
+		}
+		lit, err := p.literal(v)
+		if err != nil {
+			problems = append(problems, p.Name+": "+err.Error())
+			return s
+		}
+		return lit
+	})
+	if len(problems) > 0 {
+		return "", errors.New(strings.Join(problems, "; "))
+	}
+	return query, nil
+}
+
+// bqlString quotes s as a BQL string literal.
+func bqlString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// queriesPath is the queries file of repo.
+func (repo *Repo) queriesPath() string {
+	return filepath.Join(repo.Path, repo.QueriesFile)
+}
+
+// loadSavedQueries reads the queries file, falling back to the defaults if
+// the repository has none.
+func loadSavedQueries(repo *Repo) ([]SavedQuery, error) {
+	data, err := os.ReadFile(repo.queriesPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return append([]SavedQuery(nil), defaultSavedQueries...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queries []SavedQuery
+	if err := json.Unmarshal(data, &queries); err != nil {
+		return nil, fmt.Errorf("%s: %w", repo.QueriesFile, err)
+	}
+	return queries, nil
+}
+
+// saveSavedQueries writes the queries file, indented so changes to it diff
+// well. It is committed like any other edit.
+func saveSavedQueries(repo *Repo, queries []SavedQuery) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// Keep comparisons such as "number > 0" readable in the file.
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(queries); err != nil {
+		return err
+	}
+	path := repo.queriesPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// apiQueriesHandler: GET /api/queries lists the saved queries.
+func apiQueriesHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	_, release, err := repo.lock.acquire(r.Context(), false, "list queries")
+	if err != nil {
+		http.Error(w, "Failed to list queries: "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+	queries, err := loadSavedQueries(repo)
+	if err != nil {
+		http.Error(w, "Failed to list queries: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, queries)
+}
+
+// editSavedQueries applies edit to the saved queries under the repository
+// lock and writes the result. edit returns the HTTP status of its error.
+func editSavedQueries(w http.ResponseWriter, r *http.Request, repo *Repo, op string, edit func([]SavedQuery) ([]SavedQuery, int, error)) {
+	_, release, err := repo.lock.acquire(r.Context(), true, op)
+	if err != nil {
+		http.Error(w, "Failed to "+op+": "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+	queries, err := loadSavedQueries(repo)
+	if err != nil {
+		http.Error(w, "Failed to "+op+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	queries, status, err := edit(queries)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := saveSavedQueries(repo, queries); err != nil {
+		http.Error(w, "Failed to "+op+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, queries)
+}
+
+// decodeSavedQuery reads and validates the query in the request body. The id
+// defaults to the slug of the name.
+func decodeSavedQuery(w http.ResponseWriter, r *http.Request, id string) *SavedQuery {
+	var q SavedQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if id != "" {
+		q.ID = id
+	}
+	if q.ID == "" {
+		q.ID = slugify(q.Name)
+	}
+	if err := q.validate(); err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return &q
+}
+
+func findSavedQuery(queries []SavedQuery, id string) int {
+	for i := range queries {
+		if queries[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// createQueryHandler: POST /api/queries adds the saved query in the body and
+// returns the updated list.
+func createQueryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	q := decodeSavedQuery(w, r, "")
+	if q == nil {
+		return
+	}
+	editSavedQueries(w, r, repo, "save query", func(queries []SavedQuery) ([]SavedQuery, int, error) {
+		if findSavedQuery(queries, q.ID) >= 0 {
+			return nil, http.StatusConflict, fmt.Errorf("A query with id %s already exists", q.ID)
+		}
+		return append(queries, *q), 0, nil
+	})
+}
+
+// updateQueryHandler: PUT /api/queries/{query} replaces a saved query.
+func updateQueryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	q := decodeSavedQuery(w, r, r.PathValue("query"))
+	if q == nil {
+		return
+	}
+	editSavedQueries(w, r, repo, "save query", func(queries []SavedQuery) ([]SavedQuery, int, error) {
+		i := findSavedQuery(queries, q.ID)
+		if i < 0 {
+			return nil, http.StatusNotFound, fmt.Errorf("No query with id %s", q.ID)
+		}
+		queries[i] = *q
+		return queries, 0, nil
+	})
+}
+
+// deleteQueryHandler: DELETE /api/queries/{query} removes a saved query.
+func deleteQueryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	id := r.PathValue("query")
+	editSavedQueries(w, r, repo, "delete query", func(queries []SavedQuery) ([]SavedQuery, int, error) {
+		i := findSavedQuery(queries, id)
+		if i < 0 {
+			return nil, http.StatusNotFound, fmt.Errorf("No query with id %s", id)
+		}
+		return append(queries[:i], queries[i+1:]...), 0, nil
+	})
+}
+
+// runQueryHandler: POST /api/queries/{query}/run?format= runs a saved query with
+// the parameter values in the optional body, {"params": {"name": "value"}}.
+// The output is that of /git/bean-query.
+func runQueryHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	var body struct {
+		Params map[string]string `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "Invalid parameters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, release, err := repo.lock.acquire(r.Context(), false, "load query")
+	if err != nil {
+		http.Error(w, "Failed to load query: "+err.Error(), errorStatus(err))
+		return
+	}
+	queries, err := loadSavedQueries(repo)
+	release()
+	if err != nil {
+		http.Error(w, "Failed to load query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	i := findSavedQuery(queries, r.PathValue("query"))
+	if i < 0 {
+		http.Error(w, "No query with id "+r.PathValue("query"), http.StatusNotFound)
+		return
+	}
+	query, err := queries[i].render(body.Params)
+	if err != nil {
+		http.Error(w, "Invalid parameters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	runBeanQuery(w, r, repo, query, &HistoryEntry{SavedQuery: queries[i].ID, Params: body.Params})
+}
+
+// apiAccountsHandler: GET /api/accounts lists the accounts posted to in the
+// working tree's ledger, for the account inputs of query parameters.
+func apiAccountsHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	ctx, release, err := repo.lock.acquire(r.Context(), false, "list accounts")
+	if err != nil {
+		http.Error(w, "Failed to list accounts: "+err.Error(), errorStatus(err))
+		return
+	}
+	defer release()
+	txns, _, err := loadLedger(ctx, &ledgerSource{repo: repo}, repo.MainFile)
+	if err != nil {
+		http.Error(w, "Failed to list accounts: "+err.Error(), errorStatus(err))
+		return
+	}
+	seen := make(map[string]bool)
+	accounts := []string{}
+	for _, t := range txns {
+		for _, p := range t.Postings {
+			if !seen[p.Account] {
+				seen[p.Account] = true
+				accounts = append(accounts, p.Account)
+			}
+		}
+	}
+	sort.Strings(accounts)
+	writeJSON(w, accounts)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryParamLiteral(t *testing.T) {
+	tests := []struct {
+		typ, value, want, err string
+	}{
+		{"", `say "hi"`, `"say \"hi\""`, ""},
+		{"string", "", `""`, ""},
+		{"account", "Income", `"Income"`, ""},
+		{"account", "Assets:Bank:HBL", `"Assets:Bank:HBL"`, ""},
+		{"account", "Assets:2025", `"Assets:2025"`, ""},
+		{"account", `Income" or "1`, "", "invalid account"},
+		{"account", "income", "", "invalid account"},
+		{"account", "Assets:", "", "invalid account"},
+		{"regex", `refund|intended\s+positive`, `"refund|intended\\s+positive"`, ""},
+		{"regex", "(", "", "invalid regex"},
+		{"date", "2025-02-28", "2025-02-28", ""},
+		{"date", "2025-02-30", "", "invalid date"},
+		{"date", "2025-02-28 or TRUE", "", "invalid date"},
+		{"daterange", "2025-01-01..2025-03-31", "(date >= 2025-01-01 AND date <= 2025-03-31)", ""},
+		{"daterange", "2025-01-01..", "(date >= 2025-01-01)", ""},
+		{"daterange", "..2025-03-31", "(date <= 2025-03-31)", ""},
+		{"daterange", "", "TRUE", ""},
+		{"daterange", "..", "TRUE", ""},
+		{"daterange", "2025-01-01", "", "expected FROM..TO"},
+		{"daterange", "2025-01-01..soon", "", `invalid date "soon" in range`},
+		{"amount", "-12.50", "-12.50", ""},
+		{"amount", "0", "0", ""},
+		{"amount", "1e3", "", "invalid amount"},
+		{"amount", "0 or 1=1", "", "invalid amount"},
+		{"number", "1", "", "unknown parameter type"},
+	}
+	for _, tt := range tests {
+		p := &QueryParam{Name: "p", Type: tt.typ}
+		got, err := p.literal(tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s %q: got %q, %v, want an error containing %q", tt.typ, tt.value, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: got %q, %v, want %q", tt.typ, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestBQLString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", `"plain"`},
+		{"", `""`},
+		{`a "quote"`, `"a \"quote\""`},
+		{`back\slash`, `"back\\slash"`},
+		{`\"`, `"\\\""`},
+		{"multi\nline", "\"multi\nline\""},
+	}
+	for _, tt := range tests {
+		if got := bqlString(tt.in); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSavedQueryRender(t *testing.T) {
+	q := &SavedQuery{
+		ID:    "q",
+		Name:  "Q",
+		Query: `select * where {{period}} and account ~ {{ account }} and number > {{threshold}}`,
+		Params: []QueryParam{
+			{Name: "period", Type: "daterange"},
+			{Name: "account", Type: "account", Default: "Income"},
+			{Name: "threshold", Type: "amount"},
+		},
+	}
+	if err := q.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.render(map[string]string{"threshold": " 5 ", "period": "2025-01-01.."})
+	if want := `select * where (date >= 2025-01-01) and account ~ "Income" and number > 5`; err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+	_, err = q.render(map[string]string{"account": "bad account"})
+	if err == nil || err.Error() != `account: invalid account "bad account"; threshold: a value is required` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSavedQueryValidate(t *testing.T) {
+	valid := func() *SavedQuery {
+		return &SavedQuery{ID: "my-query", Name: "Mine", Query: "select {{x}}", Params: []QueryParam{{Name: "x"}}}
+	}
+	tests := []struct {
+		edit func(*SavedQuery)
+		err  string
+	}{
+		{func(q *SavedQuery) {}, ""},
+		{func(q *SavedQuery) { q.ID = "My Query" }, "invalid id"},
+		{func(q *SavedQuery) { q.Name = " " }, "name is required"},
+		{func(q *SavedQuery) { q.Query = "" }, "query is required"},
+		{func(q *SavedQuery) { q.Params[0].Name = "1x" }, "invalid parameter name"},
+		{func(q *SavedQuery) { q.Params = append(q.Params, QueryParam{Name: "x"}) }, "duplicate parameter"},
+		{func(q *SavedQuery) { q.Params[0].Type = "money" }, "unknown type"},
+		{func(q *SavedQuery) { q.Params[0].Type, q.Params[0].Default = "date", "today" }, "default of x"},
+		{func(q *SavedQuery) { q.Query = "select {{y}}" }, "{{y}} is not a declared parameter"},
+	}
+	for _, tt := range tests {
+		q := valid()
+		tt.edit(q)
+		err := q.validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%+v: %v", q, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: got %v, want an error containing %q", q, err, tt.err)
+		}
+	}
+	for _, q := range defaultSavedQueries {
+		if err := q.validate(); err != nil {
+			t.Errorf("default query %s: %v", q.ID, err)
+		}
+	}
+}
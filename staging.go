@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultStageDeny keeps common junk and secrets out of commits unless a
+// repository configures its own stage_deny list.
+var defaultStageDeny = []string{".DS_Store", "*.swp", "*~", ".env", "*.pem", "*.key"}
+
+// DiffHunk is one hunk of a file's changes. Its ID is derived from the path
+// and content, so it stays valid while line numbers shift.
+type DiffHunk struct {
+	ID string `json:"id"`
+	// Header is the "@@ -a,b +c,d @@" line.
+	Header string   `json:"header"`
+	Lines  []string `json:"lines"`
+}
+
+// ChangedFile is a file whose changes can be selected for a commit.
+type ChangedFile struct {
+	Path string `json:"path"`
+	// Status is "untracked" or a FileDiff status.
+	Status string `json:"status"`
+	Binary bool   `json:"binary"`
+	// Denied is set for untracked files matching the stage deny list; they
+	// can't be committed from here.
+	Denied bool        `json:"denied"`
+	Hunks  []*DiffHunk `json:"hunks"`
+
+	// header is the FileDiff header, needed to turn selected hunks back into
+	// a patch.
+	header []string
+}
+
+// StageSelection picks what create PR commits: whole files by path and
+// single hunks by ID.
+type StageSelection struct {
+	Paths []string `json:"paths"`
+	Hunks []string `json:"hunks"`
+}
+
+// StageError rejects a selection, listing the paths or hunks at fault.
+type StageError struct {
+	Reason string
+	Items  []string
+}
+
+func (e *StageError) Error() string {
+	if len(e.Items) == 0 {
+		return e.Reason
+	}
+	return e.Reason + ": " + strings.Join(e.Items, ", ")
+}
+
+func (e *StageError) HTTPStatus() int { return http.StatusUnprocessableEntity }
+
+// stageDenied reports whether the untracked file p matches the deny list.
+// Patterns without a slash match the file name in any directory.
+func (repo *Repo) stageDenied(p string) bool {
+	for _, pattern := range repo.StageDeny {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listChanges returns the changes of the working tree against HEAD followed
+// by the untracked files.
+func listChanges(ctx context.Context, repo *Repo) ([]*ChangedFile, error) {
+	args := append([]string{"diff", "HEAD", "--no-renames"}, diffPatchArgs...)
+	out, err := repo.runGit(ctx, args...)
+	if err != nil {
+		return nil, gitStepError("Failed to diff changes", out, err)
+	}
+	diffs, err := parseDiff(out)
+	if err != nil {
+		return nil, err
+	}
+	files := []*ChangedFile{}
+	for _, d := range diffs {
+		f := &ChangedFile{Path: d.Path(), Status: d.Status, Binary: d.Binary, Hunks: []*DiffHunk{}, header: d.header}
+		// Identical hunks in a file are told apart by their occurrence.
+		seen := make(map[string]int)
+		for _, h := range d.Hunks {
+			lines := h.rawLines()
+			key := f.Path + "\x00" + strings.Join(lines, "\n")
+			sum := sha256.Sum256([]byte(key + "\x00" + strconv.Itoa(seen[key])))
+			seen[key]++
+			f.Hunks = append(f.Hunks, &DiffHunk{ID: hex.EncodeToString(sum[:6]), Header: h.Header, Lines: lines})
+		}
+		files = append(files, f)
+	}
+
+	out, err = repo.runGit(ctx, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, gitStepError("Failed to list untracked files", out, err)
+	}
+	for _, p := range strings.Split(out, "\x00") {
+		if p != "" {
+			files = append(files, &ChangedFile{Path: p, Status: "untracked", Denied: repo.stageDenied(p), Hunks: []*DiffHunk{}})
+		}
+	}
+	return files, nil
+}
+
+// stageSelection replaces the index with the selected changes. A nil
+// selection stages everything, like `git add .`, unless an untracked file
+// is denied.
+func stageSelection(ctx context.Context, repo *Repo, sel *StageSelection) error {
+	changes, err := listChanges(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if sel == nil {
+		var denied []string
+		for _, f := range changes {
+			if f.Denied {
+				denied = append(denied, f.Path)
+			}
+		}
+		if len(denied) > 0 {
+			return &StageError{Reason: "untracked files match the stage deny list; select the files to commit or remove them", Items: denied}
+		}
+		if out, err := repo.runGit(ctx, "add", "."); err != nil {
+			return gitStepError("Failed to add file", out, err)
+		}
+		return nil
+	}
+
+	byPath := make(map[string]*ChangedFile)
+	byHunk := make(map[string]*ChangedFile)
+	for _, f := range changes {
+		byPath[f.Path] = f
+		for _, h := range f.Hunks {
+			byHunk[h.ID] = f
+		}
+	}
+	var missing, denied []string
+	whole := make(map[string]bool)
+	for _, p := range sel.Paths {
+		f := byPath[p]
+		switch {
+		case f == nil:
+			missing = append(missing, p)
+		case f.Denied:
+			denied = append(denied, p)
+		default:
+			whole[p] = true
+		}
+	}
+	selected := make(map[string]bool)
+	for _, id := range sel.Hunks {
+		if byHunk[id] == nil {
+			missing = append(missing, "hunk "+id)
+		}
+		selected[id] = true
+	}
+	if len(denied) > 0 {
+		return &StageError{Reason: "files match the stage deny list", Items: denied}
+	}
+	if len(missing) > 0 {
+		return &StageError{Reason: "the selection is out of date; reload the changes", Items: missing}
+	}
+	if len(whole) == 0 && len(selected) == 0 {
+		return &StageError{Reason: "nothing selected"}
+	}
+
+	// Start from an index matching HEAD, then add the selection.
+	if out, err := repo.runGit(ctx, "reset", "--quiet"); err != nil {
+		return gitStepError("Failed to reset the index", out, err)
+	}
+	if len(whole) > 0 {
+		args := []string{"add", "--all", "--"}
+		for _, f := range changes {
+			if whole[f.Path] {
+				args = append(args, f.Path)
+			}
+		}
+		if out, err := repo.runGitEnv(ctx, []string{"GIT_LITERAL_PATHSPECS=1"}, args...); err != nil {
+			return gitStepError("Failed to add files", out, err)
+		}
+	}
+
+	var patch strings.Builder
+	for _, f := range changes {
+		if whole[f.Path] {
+			continue
+		}
+		var hunks []*DiffHunk
+		for _, h := range f.Hunks {
+			if selected[h.ID] {
+				hunks = append(hunks, h)
+			}
+		}
+		if len(hunks) == 0 {
+			continue
+		}
+		for _, line := range f.header {
+			patch.WriteString(line + "\n")
+		}
+		for _, h := range hunks {
+			patch.WriteString(h.Header + "\n")
+			for _, line := range h.Lines {
+				patch.WriteString(line + "\n")
+			}
+		}
+	}
+	if patch.Len() == 0 {
+		return nil
+	}
+	tmp, err := os.MkdirTemp("", "git-commands-stage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	patchFile := filepath.Join(tmp, "selection.patch")
+	if err := os.WriteFile(patchFile, []byte(patch.String()), 0o600); err != nil {
+		return err
+	}
+	if out, err := repo.runGit(ctx, "apply", "--cached", "--whitespace=nowarn", patchFile); err != nil {
+		return gitStepError("Failed to stage the selected hunks", out, err)
+	}
+	return nil
+}
+
+// changesHandler: GET /git/changes lists the changed files and their hunks
+// for selecting what create PR commits.
+func changesHandler(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	files, err := listChanges(r.Context(), repo)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, files)
+}
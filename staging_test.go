@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ledgerLines returns n numbered lines.
+func ledgerLines(n int, edit map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		line := fmt.Sprintf("; line %d", i)
+		if s, ok := edit[i]; ok {
+			line = s
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// newStagingRepo returns a repository with two edits to main.bean far
+// enough apart to be separate hunks, a deleted file, a new file and a file
+// on the stage deny list.
+func newStagingRepo(t *testing.T) *Repo {
+	t.Helper()
+	repo := newTestRepo(t)
+	repo.StageDeny = defaultStageDeny
+	writeFile(t, repo, "main.bean", ledgerLines(20, nil))
+	writeFile(t, repo, "old.bean", "; old\n")
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "-q", "-m", "lines")
+
+	writeFile(t, repo, "main.bean", ledgerLines(20, map[int]string{2: "; first edit", 18: "; second edit"}))
+	os.Remove(filepath.Join(repo.Path, "old.bean"))
+	writeFile(t, repo, "new.bean", "; new\n")
+	writeFile(t, repo, ".env", "SECRET=1\n")
+	return repo
+}
+
+// hunkIDs returns the IDs of path's hunks, in order.
+func hunkIDs(t *testing.T, repo *Repo, path string) []string {
+	t.Helper()
+	changes, err := listChanges(context.Background(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, f := range changes {
+		if f.Path == path {
+			for _, h := range f.Hunks {
+				ids = append(ids, h.ID)
+			}
+		}
+	}
+	return ids
+}
+
+func TestListChanges(t *testing.T) {
+	repo := newStagingRepo(t)
+	changes, err := listChanges(context.Background(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range changes {
+		got = append(got, fmt.Sprintf("%s %s %d %v", f.Status, f.Path, len(f.Hunks), f.Denied))
+	}
+	want := []string{
+		"modified main.bean 2 false",
+		"deleted old.bean 1 false",
+		"untracked .env 0 true",
+		"untracked new.bean 0 false",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	// A line added between the hunks moves the second one down, but the
+	// IDs only depend on the content.
+	ids := []string{changes[0].Hunks[0].ID, changes[0].Hunks[1].ID}
+	writeFile(t, repo, "main.bean", ledgerLines(20, map[int]string{2: "; first edit", 10: "; line 10\n; inserted", 18: "; second edit"}))
+	if got := hunkIDs(t, repo, "main.bean"); len(got) != 3 || got[0] != ids[0] || got[2] != ids[1] {
+		t.Errorf("IDs %q after inserting a line, were %q", got, ids)
+	}
+}
+
+func TestStageSelection(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		sel  func(hunks []string) *StageSelection
+		// cached is the expected `git diff --cached --name-status`, and
+		// staged the lines the index adds to main.bean.
+		cached, staged string
+	}{
+		{
+			"first hunk",
+			func(hunks []string) *StageSelection { return &StageSelection{Hunks: hunks[:1]} },
+			"M\tmain.bean\n", "+; first edit\n",
+		},
+		{
+			"second hunk and whole files",
+			func(hunks []string) *StageSelection {
+				return &StageSelection{Paths: []string{"new.bean", "old.bean"}, Hunks: hunks[1:]}
+			},
+			"M\tmain.bean\nA\tnew.bean\nD\told.bean\n", "+; second edit\n",
+		},
+		{
+			"whole file wins over its hunks",
+			func(hunks []string) *StageSelection {
+				return &StageSelection{Paths: []string{"main.bean"}, Hunks: hunks[:1]}
+			},
+			"M\tmain.bean\n", "+; first edit\n+; second edit\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newStagingRepo(t)
+			// Something staged earlier is not part of the selection.
+			git(t, repo, "add", "old.bean")
+
+			if err := stageSelection(ctx, repo, tt.sel(hunkIDs(t, repo, "main.bean"))); err != nil {
+				t.Fatal(err)
+			}
+			if got := git(t, repo, "diff", "--cached", "--name-status"); got != tt.cached {
+				t.Errorf("staged files %q, want %q", got, tt.cached)
+			}
+			var added strings.Builder
+			for _, line := range strings.Split(git(t, repo, "diff", "--cached", "-U0", "--", "main.bean"), "\n") {
+				if strings.HasPrefix(line, "+;") {
+					added.WriteString(line + "\n")
+				}
+			}
+			if added.String() != tt.staged {
+				t.Errorf("staged lines %q, want %q", added.String(), tt.staged)
+			}
+			// The working tree keeps every edit.
+			if data, _ := os.ReadFile(filepath.Join(repo.Path, "main.bean")); !strings.Contains(string(data), "; second edit") {
+				t.Error("the working tree lost an edit")
+			}
+		})
+	}
+}
+
+func TestStageSelectionErrors(t *testing.T) {
+	ctx := context.Background()
+	repo := newStagingRepo(t)
+	tests := []struct {
+		name string
+		sel  *StageSelection
+		err  string
+	}{
+		{"everything with a denied file", nil, "untracked files match the stage deny list; select the files to commit or remove them: .env"},
+		{"denied file", &StageSelection{Paths: []string{".env", "new.bean"}}, "files match the stage deny list: .env"},
+		{"unknown path and hunk", &StageSelection{Paths: []string{"gone.bean"}, Hunks: []string{"abc"}},
+			"the selection is out of date; reload the changes: gone.bean, hunk abc"},
+		{"nothing", &StageSelection{}, "nothing selected"},
+	}
+	for _, tt := range tests {
+		err := stageSelection(ctx, repo, tt.sel)
+		var stageErr *StageError
+		if !errors.As(err, &stageErr) || err.Error() != tt.err {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if got := git(t, repo, "diff", "--cached", "--name-only"); got != "" {
+		t.Errorf("a rejected selection staged %q", got)
+	}
+
+	// Without denied files everything is staged.
+	os.Remove(filepath.Join(repo.Path, ".env"))
+	if err := stageSelection(ctx, repo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git(t, repo, "diff", "--cached", "--name-status"), "M\tmain.bean\nA\tnew.bean\nD\told.bean\n"; got != want {
+		t.Errorf("staged %q, want %q", got, want)
+	}
+}
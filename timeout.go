@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultCommandTimeouts apply unless the config overrides them. Keys are a
+// command name, optionally followed by a subcommand; "default" covers
+// everything else.
+var defaultCommandTimeouts = map[string]time.Duration{
+	"default":   2 * time.Minute,
+	"git fetch": 5 * time.Minute,
+	"git pull":  5 * time.Minute,
+	"git push":  5 * time.Minute,
+	// HBL downloads fetch one report per day since the last one.
+	"go run": time.Hour,
+}
+
+// commandTimeouts is set in main.
+var commandTimeouts = defaultCommandTimeouts
+
+// parseCommandTimeouts merges the "command_timeouts" config section, e.g.
+// {"git push": "1m", "bean-query": "30s"}, into the defaults. "0" disables
+// the timeout of a command.
+func parseCommandTimeouts(cfg map[string]string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(defaultCommandTimeouts)+len(cfg))
+	for k, v := range defaultCommandTimeouts {
+		timeouts[k] = v
+	}
+	for k, v := range cfg {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("command_timeouts[%q]: invalid duration %q", k, v)
+		}
+		timeouts[strings.Join(strings.Fields(k), " ")] = d
+	}
+	return timeouts, nil
+}
+
+// commandTimeout returns the timeout for argv, looking up the command with
+// its subcommand first, then the command alone, then the default. Zero means
+// no timeout.
+func commandTimeout(argv []string) time.Duration {
+	if len(argv) > 1 {
+		if d, ok := commandTimeouts[argv[0]+" "+argv[1]]; ok {
+			return d
+		}
+	}
+	if len(argv) > 0 {
+		if d, ok := commandTimeouts[argv[0]]; ok {
+			return d
+		}
+	}
+	return commandTimeouts["default"]
+}
+
+// TimeoutError is returned when a command is killed for running longer than
+// its timeout.
+type TimeoutError struct {
+	Argv    []string
+	Timeout time.Duration
+	// Err is the error the killed command exited with.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	name := e.Argv[0]
+	if len(e.Argv) > 1 && !strings.HasPrefix(e.Argv[1], "-") {
+		name += " " + e.Argv[1]
+	}
+	return fmt.Sprintf("%s timed out after %s", name, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+func (e *TimeoutError) HTTPStatus() int { return http.StatusGatewayTimeout }
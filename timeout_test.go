@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandTimeouts(t *testing.T) {
+	defer func(prev map[string]time.Duration) { commandTimeouts = prev }(commandTimeouts)
+	var err error
+	commandTimeouts, err = parseCommandTimeouts(map[string]string{"git  push": "1m", "bean-query": "30s", "go run": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		argv []string
+		want time.Duration
+	}{
+		{[]string{"git", "push", "origin"}, time.Minute},
+		{[]string{"git", "pull"}, 5 * time.Minute},
+		{[]string{"git", "status"}, 2 * time.Minute},
+		{[]string{"bean-query", "-f", "csv"}, 30 * time.Second},
+		{[]string{"go", "run", "."}, 0},
+		{[]string{"sh"}, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := commandTimeout(tt.argv); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.argv, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"soon", "-1s"} {
+		if _, err := parseCommandTimeouts(map[string]string{"git": bad}); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WorktreesConfig is the "worktrees" section of the config file. When it is
+// present, every editor works in a git worktree of their own instead of the
+// shared clone, so their uncommitted edits stay apart.
+type WorktreesConfig struct {
+	// Dir holds the worktrees, one directory per repository and user. It
+	// must be outside the repositories. Defaults to <data_dir>/worktrees.
+	Dir string `json:"dir"`
+	// StaleAfter is how long a worktree may go unused before it is removed,
+	// e.g. "72h". Defaults to a week.
+	StaleAfter string `json:"stale_after"`
+}
+
+const (
+	defaultWorktreeStaleAfter = 7 * 24 * time.Hour
+	worktreeCleanupInterval   = time.Hour
+	// worktreeTouchInterval limits how often the last use of a worktree is
+	// written to disk.
+	worktreeTouchInterval = time.Minute
+)
+
+// worktrees manages the per-user worktrees. It is nil when they are
+// disabled.
+var worktrees *WorktreeManager
+
+// WorktreeManager creates the worktrees of users on first use and removes
+// those that have not been used for a while.
+type WorktreeManager struct {
+	dir        string
+	staleAfter time.Duration
+
+	// create serializes worktree creation so concurrent requests of one
+	// user don't both add it.
+	create sync.Mutex
+
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func newWorktreeManager(dir string, cfg *WorktreesConfig) (*WorktreeManager, error) {
+	if cfg.Dir != "" {
+		dir = cfg.Dir
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &WorktreeManager{dir: dir, staleAfter: defaultWorktreeStaleAfter, lastUsed: make(map[string]time.Time)}
+	if cfg.StaleAfter != "" {
+		if m.staleAfter, err = time.ParseDuration(cfg.StaleAfter); err != nil {
+			return nil, fmt.Errorf("worktrees.stale_after: %w", err)
+		}
+	}
+	for _, repo := range repos.List() {
+		if rel, err := filepath.Rel(repo.Path, dir); err == nil && filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("worktrees.dir %s is inside repo %s", dir, repo.ID)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// path is the worktree directory of user in repo.
+func (m *WorktreeManager) path(repo *Repo, user *User) string {
+	return filepath.Join(m.dir, repo.ID, userSlug(user))
+}
+
+// forUser returns repo as seen from the worktree of user, creating the
+// worktree on its user's edit branch if needed.
+func (m *WorktreeManager) forUser(ctx context.Context, repo *Repo, user *User) (*Repo, error) {
+	path := m.path(repo, user)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := m.add(ctx, repo, user, path); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	m.touch(path)
+	return repo.inWorktree(path), nil
+}
+
+// add creates the worktree at path. The user's edit branch is checked out,
+// starting from the base branch if it doesn't exist yet.
+func (m *WorktreeManager) add(ctx context.Context, repo *Repo, user *User, path string) error {
+	m.create.Lock()
+	defer m.create.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	ctx, release, err := repo.lock.acquire(ctx, true, "create worktree")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	branch, err := repo.editBranch(user, "")
+	if err != nil {
+		return err
+	}
+	// Forget worktrees whose directories were deleted by hand, which would
+	// otherwise keep their branch checked out.
+	if out, err := repo.runGit(ctx, "worktree", "prune"); err != nil {
+		return gitStepError("Failed to prune worktrees", out, err)
+	}
+	args := []string{"worktree", "add", path, branch}
+	if _, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err != nil {
+		start := "origin/" + repo.BaseBranch
+		if _, err := repo.runGit(ctx, "rev-parse", "--verify", "--quiet", start); err != nil {
+			start = "HEAD"
+		}
+		args = []string{"worktree", "add", "--no-track", "-b", branch, path, start}
+	}
+	if out, err := repo.runGit(ctx, args...); err != nil {
+		return gitStepError("Failed to create worktree", out, err)
+	}
+	log.Printf("Created worktree %s on %s", path, branch)
+	return nil
+}
+
+// touch records that the worktree at path is in use. The time is kept in the
+// directory's modification time so it survives restarts.
+func (m *WorktreeManager) touch(path string) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastUsed[path]) < worktreeTouchInterval {
+		return
+	}
+	m.lastUsed[path] = now
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Println("Failed to record worktree use:", err)
+	}
+}
+
+// cleanupLoop removes stale worktrees now and then every
+// worktreeCleanupInterval.
+func (m *WorktreeManager) cleanupLoop() {
+	for {
+		for _, repo := range repos.List() {
+			m.cleanup(context.Background(), repo)
+		}
+		time.Sleep(worktreeCleanupInterval)
+	}
+}
+
+// cleanup removes the worktrees of repo that have not been used for
+// staleAfter. Worktrees with uncommitted changes are kept, as removing them
+// would lose work; their branches always survive.
+func (m *WorktreeManager) cleanup(ctx context.Context, repo *Repo) {
+	entries, err := os.ReadDir(filepath.Join(m.dir, repo.ID))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to list worktrees:", err)
+		}
+		return
+	}
+	ctx, release, err := repo.lock.acquire(ctx, true, "clean up worktrees")
+	if err != nil {
+		log.Printf("Skipping worktree cleanup of %s: %v", repo.ID, err)
+		return
+	}
+	defer release()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(m.dir, repo.ID, entry.Name())
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < m.staleAfter {
+			continue
+		}
+		out, err := repo.inWorktree(path).runGit(ctx, "status", "--porcelain")
+		if err != nil {
+			log.Printf("Keeping stale worktree %s: %v", path, gitStepError("status failed", out, err))
+			continue
+		}
+		if strings.TrimSpace(out) != "" {
+			log.Printf("Keeping stale worktree %s: it has uncommitted changes", path)
+			continue
+		}
+		if out, err := repo.runGit(ctx, "worktree", "remove", path); err != nil {
+			log.Printf("Failed to remove stale worktree %s: %v", path, gitStepError("worktree remove failed", out, err))
+			continue
+		}
+		m.mu.Lock()
+		delete(m.lastUsed, path)
+		m.mu.Unlock()
+		log.Printf("Removed stale worktree %s", path)
+	}
+	if out, err := repo.runGit(ctx, "worktree", "prune"); err != nil {
+		log.Println(gitStepError("Failed to prune worktrees", out, err))
+	}
+}
+
+// inWorktree returns a copy of repo operating on the worktree at path. It
+// shares the lock and provider of repo, as worktrees share refs.
+func (repo *Repo) inWorktree(path string) *Repo {
+	wt := *repo
+	wt.Path = path
+	if rel, err := filepath.Rel(repo.Path, repo.ReportsDir); err == nil && filepath.IsLocal(rel) {
+		wt.ReportsDir = filepath.Join(path, rel)
+	}
+	wt.Worktree = true
+	return &wt
+}